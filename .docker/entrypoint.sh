@@ -61,22 +61,102 @@ addFlag "$MAX_TRAJECTORY_LENGTH" "maxTrajectoryLength"
 addFlag "$MIN_TRAJECTORY_LENGTH" "minTrajectoryLength"
 addFlag "$NAME" "name"
 addFlag "$ICD9_TO_ICD10_FILE" "ICD9ToICD10File"
+addFlag "$ICD10_TO_ICD11_FILE" "ICD10ToICD11File"
+addFlag "$SNOMED_TO_ICD10_FILE" "SNOMEDToICD10File"
 addFlag "$CLUSTER" "cluster"
 addFlag "$MCL_PATH" "mclPath"
 addFlag "$ITER" "iter"
+addFlag "$MATCHED_CONTROLS" "matchedControls"
+addFlag "$MATCH_COMORBIDITIES" "matchComorbidities"
+addFlag "$PAIR_TEST" "pairTest"
+addFlag "$MAX_P_VALUE" "maxPValue"
+addFlag "$RR_BOUND" "rrBound"
+addFlag "$CONTINUITY_CORRECTION" "continuityCorrection"
+addFlag "$MIN_COUNT" "minCount"
+addFlag "$CENSORING" "censoring"
+addFlag "$END_DATE" "endDate"
+addFlag "$MAX_DIRECTIONALITY_P" "maxDirectionalityP"
+addFlag "$METRIC" "metric"
+addFlag "$PAIRS_BY_SEX" "pairsBySex"
+addFlag "$PAIRS_BY_AGE" "pairsByAge"
 addFlag "$SAVE_RR" "saveRR"
+addFlag "$RR_FORMAT" "rrFormat"
 addFlag "$LOAD_RR" "loadRR"
 addFlag "$PFILTERS" "pfilters"
+addFlag "$COMPARE_PFILTERS" "comparePFilters"
+addFlag "$PERMUTATION_TEST" "permutationTest"
+addFlag "$PERMUTATIONS" "permutations"
 addFlag "$TUMOR_INFO" "tumorInfo"
+addFlag "$TUMOR_SITES" "tumorSites"
+addFlag "$STAGING_RULES" "stagingRules"
 addFlag "$TFILTERS" "tfilters"
+addFlag "$TOP_TRAJECTORIES" "topTrajectories"
+addFlag "$MIN_EDGE_RR" "minEdgeRR"
+addFlag "$BOOTSTRAP" "bootstrap"
+addFlag "$VALIDATE_TRAJECTORIES" "validateTrajectories"
+addFlag "$SWEEP" "sweep"
+addFlag "$MORTALITY" "mortality"
+addFlag "$RENDER" "render"
 addFlag "$TREATMENT_INFO" "treatmentInfo"
+addFlag "$TREATMENT_SCHEMA" "treatmentSchema"
+addFlag "$CUSTOM_EVENTS" "customEvents"
+addFlag "$PROCEDURE_INFO" "procedureInfo"
+addFlag "$PROCEDURE_GROUPS" "procedureGroups"
+addFlag "$LAB_INFO" "labInfo"
+addFlag "$LAB_RULES" "labRules"
+addFlag "$ENROLLMENT_INFO" "enrollmentInfo"
 addFlag "$CLUSTER_GRANULARITIES" "clusterGranularities"
 addFlag "$NUMBER_OF_THREADS" "nrOfThreads"
 addFlag "$RR" "RR"
+addFlag "$DP_EPSILON" "dpEpsilon"
+addFlag "$MIN_CELL_SIZE" "minCellSize"
+addFlag "$PSEUDONYMIZE" "pseudonymize"
+addFlag "$PSEUDONYM_SALT" "pseudonymSalt"
+addFlag "$PSEUDONYM_MAP_FILE" "pseudonymMapFile"
+addFlag "$NEO4J" "neo4j"
+addFlag "$PARQUET" "parquet"
+addFlag "$PATIENT_TRAJECTORIES" "patientTrajectories"
+addFlag "$TIMELINE_PATIENTS" "timelinePatients"
+addFlag "$XLSX" "xlsx"
+addFlag "$MAX_BAD_ROWS" "maxBadRows"
+addFlag "$REJECTS_FILE" "rejectsFile"
+addFlag "$DETERMINISTIC" "deterministic"
+addFlag "$SEED" "seed"
+addFlag "$DEDUP" "dedup"
+addFlag "$DUPLICATE_PATIENTS" "duplicatePatients"
+addFlag "$TEMPORAL_CHECKS" "temporalChecks"
+addFlag "$REFERENCE_DATE" "referenceDate"
+addFlag "$AUDIT_LOG" "auditLog"
+addFlag "$AUDIT_USER" "auditUser"
+addFlag "$RUN_ID" "runID"
+addFlag "$INDEX_DATE" "indexDate"
+addFlag "$STRATIFY" "stratify"
+addFlag "$SAME_VISIT" "sameVisit"
+addFlag "$VISIT_ORDER" "visitOrder"
+addFlag "$PRIMARY_DIAGNOSES" "primaryDiagnoses"
+addFlag "$SECONDARY_WEIGHT" "secondaryWeight"
+addFlag "$LOAD_STATE" "loadState"
+addFlag "$SAVE_STATE" "saveState"
+addFlag "$DID_MAP" "didMap"
+addFlag "$INPUT_FORMAT" "inputFormat"
+addFlag "$INPUT_SCHEMA" "inputSchema"
+addFlag "$DATABASE" "database"
+addFlag "$BIG_QUERY" "bigQuery"
+addFlag "$STREAMING" "streaming"
 
 # Trim the flags
 FLAGS=$(echo "$FLAGS" | sed 's/ *$//g')
 FLAGS=$(echo "$FLAGS" | sed 's/--cluster 1/--cluster/g') # "--cluster" is a flag without parameter: to enable it, set it to "1"
+FLAGS=$(echo "$FLAGS" | sed 's/--neo4j 1/--neo4j/g') # idem for "--neo4j"
+FLAGS=$(echo "$FLAGS" | sed 's/--parquet 1/--parquet/g') # idem for "--parquet"
+FLAGS=$(echo "$FLAGS" | sed 's/--patientTrajectories 1/--patientTrajectories/g') # idem for "--patientTrajectories"
+FLAGS=$(echo "$FLAGS" | sed 's/--xlsx 1/--xlsx/g') # idem for "--xlsx"
+FLAGS=$(echo "$FLAGS" | sed 's/--deterministic 1/--deterministic/g') # idem for "--deterministic"
+FLAGS=$(echo "$FLAGS" | sed 's/--streaming 1/--streaming/g') # idem for "--streaming"
+FLAGS=$(echo "$FLAGS" | sed 's/--matchComorbidities 1/--matchComorbidities/g') # idem for "--matchComorbidities"
+FLAGS=$(echo "$FLAGS" | sed 's/--pairsBySex 1/--pairsBySex/g') # idem for "--pairsBySex"
+FLAGS=$(echo "$FLAGS" | sed 's/--pairsByAge 1/--pairsByAge/g') # idem for "--pairsByAge"
+FLAGS=$(echo "$FLAGS" | sed 's/--censoring 1/--censoring/g') # idem for "--censoring"
 echo "*$FLAGS*"
 cd ..
 
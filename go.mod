@@ -4,5 +4,7 @@ go 1.23
 
 require (
 	github.com/exascience/pargo v1.1.0
+	github.com/klauspost/compress v1.18.0
+	github.com/lib/pq v1.10.9
 	github.com/valyala/fastrand v1.1.0
 )
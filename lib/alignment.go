@@ -0,0 +1,155 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Index dates. Post-diagnosis progression studies follow the patients from an index date, e.g. the diagnosis of the
+// event of interest. With an index date, each patient gets an index date, diagnoses before the index date are dropped,
+// and trajectories are built from the remaining diagnoses. Patients without an index date are excluded. The diagnoses
+// keep their calendar dates, so the time frames between diagnoses and the ages are computed as without an index date.
+// Only the time from the index date to each diagnosis of a trajectory is reported on the time axis of the index date.
+// The enrollment index date is the start of the observation periods of the enrollment file, cf. enrollment.go. Since
+// the diagnoses outside of the observation periods are already removed, it mainly sets the time axis of the index date.
+
+// Index dates from which the patient timelines start.
+const (
+	IndexNone       = "none"       // no index date, the timelines are not cut
+	IndexEOI        = "eoi"        // the first diagnosis of the event of interest
+	IndexTreatment  = "treatment"  // the first treatment from the treatment file
+	IndexEnrollment = "enrollment" // the start of the first observation period, requires an enrollment file
+)
+
+// indexDate returns the index date of a patient, or nil if the patient has none.
+func indexDate(p *Patient, index string) *DiagnosisDate {
+	switch index {
+	case IndexEOI:
+		return p.EOIDate
+	case IndexTreatment:
+		return p.TreatmentDate
+	case IndexEnrollment:
+		return p.EnrollmentDate
+	default:
+		panic(fmt.Sprint("Unknown index date: ", index))
+	}
+}
+
+// IndexDateAligner sets the index date of a patient and removes all diagnoses before that date. Patients without an
+// index date are removed.
+func IndexDateAligner(index string) PatientFilter {
+	return func(p *Patient) bool {
+		p.IndexDate = indexDate(p, index)
+		if p.IndexDate == nil {
+			return false
+		}
+		newD := []*Diagnosis{}
+		for _, d := range p.Diagnoses {
+			if !DiagnosisDateSmallerThan(d.Date, *p.IndexDate) {
+				newD = append(newD, d)
+			}
+		}
+		p.Diagnoses = newD
+		return len(newD) > 0
+	}
+}
+
+// AlignPatients starts the timelines of all patients at the given index date, cf. IndexDateAligner.
+func AlignPatients(patients *PatientMap, index string) *PatientMap {
+	switch index {
+	case "", IndexNone:
+		return patients
+	case IndexEOI, IndexTreatment, IndexEnrollment:
+	default:
+		panic(fmt.Sprint("Unknown index date: ", index))
+	}
+	fmt.Println("Starting the patient timelines at index date: ", index)
+	aligned := ApplyPatientFilters([]PatientFilter{IndexDateAligner(index)}, patients)
+	fmt.Println("Kept ", len(aligned.PIDMap), " patients, removed ", len(patients.PIDMap)-len(aligned.PIDMap),
+		" patients without index date or diagnoses after it.")
+	return aligned
+}
+
+// YearsSinceIndex returns the number of years from the index date of a patient to the given date.
+func YearsSinceIndex(p *Patient, d DiagnosisDate) float64 {
+	return float64(DaysBetween(*p.IndexDate, d)) / 365.25
+}
+
+// meanYearsSinceIndex computes for each diagnosis of a trajectory the mean number of years from the index date to that
+// diagnosis, over the patients that completed the trajectory. The diagnoses of a patient are matched within the given
+// time frame, as the trajectories are built, cf. matchPatientTrajectory.
+func meanYearsSinceIndex(t *Trajectory, minTime, maxTime float64) []float64 {
+	totals := make([]float64, len(t.Diagnoses))
+	ctrs := make([]int, len(t.Diagnoses))
+	for _, p := range t.Patients[len(t.Patients)-1] {
+		for i, d := range matchPatientTrajectory(p, t.Diagnoses, minTime, maxTime) {
+			totals[i] += YearsSinceIndex(p, d.Date)
+			ctrs[i]++
+		}
+	}
+	for i := range totals {
+		if ctrs[i] > 0 {
+			totals[i] = totals[i] / float64(ctrs[i])
+		}
+	}
+	return totals
+}
+
+// printIndexTimesToTabFile prints the trajectories relative to the index date to a tab file. Per trajectory, it prints
+// two lines. A first line is a list of medical terms for the diagnoses in the trajectory, as in the trajectories tab
+// file. The second line lists for each diagnosis the mean number of years since the index date: y1 tab y2 tab ... yn.
+func printIndexTimesToTabFile(trajectories []*Trajectory, icd10Map map[int]Icd10Entry, name string, minTime,
+	maxTime float64) {
+	file, err := os.Create(name)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	for _, trajectory := range trajectories {
+		for i, node := range trajectory.Diagnoses {
+			if i > 0 {
+				fmt.Fprint(file, "\t")
+			}
+			fmt.Fprint(file, icd10Map[node].Name)
+		}
+		fmt.Fprintln(file)
+		for i, years := range meanYearsSinceIndex(trajectory, minTime, maxTime) {
+			if i > 0 {
+				fmt.Fprint(file, "\t")
+			}
+			fmt.Fprintf(file, "%.2f", years)
+		}
+		fmt.Fprintln(file)
+	}
+}
+
+// WriteIndexTimes writes the trajectories relative to the index date of an experiment to a tab file, with the diagnoses
+// matched within the given time frame, cf. printIndexTimesToTabFile. It returns the file name.
+func WriteIndexTimes(exp *Experiment, path string, minTime, maxTime float64) string {
+	fileName := filepath.Join(path, fmt.Sprintf("%s-index-times.tab", exp.Name))
+	printIndexTimesToTabFile(exp.Trajectories, exp.Icd10Map, fileName, minTime, maxTime)
+	return fileName
+}
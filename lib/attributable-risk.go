@@ -0,0 +1,81 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"github.com/exascience/pargo/parallel"
+	"math"
+)
+
+// Attributable risk of the diagnosis pairs, for burden estimates. The population attributable fraction of d1 -> d2 is
+// the fraction of the d2 diagnoses in the population that would not occur without the excess risk of d1, from Levin's
+// formula with the prevalence of d1 in the experiment and the RR of the pair. The excess incidence is the nr of d2
+// diagnoses in the exposed group beyond the mean nr in the comparison groups, cf. RRStats, per 1000 patient-years at
+// risk of the exposed group. A patient with d1 is at risk within the time frame after the first d1 diagnosis, until the
+// death of the patient or the end of the data, cf. Experiment.EndDate. The comparison groups are assumed to be at risk
+// as long as the exposed group, as they are drawn from the same cohorts.
+
+// patientYearsAtRisk returns the years that a patient is at risk within the time frame after the first d1 diagnosis,
+// until the death of the patient or the given end of the data.
+func patientYearsAtRisk(p *Patient, d1 int, end DiagnosisDate, minTime, maxTime float64) float64 {
+	if p.DeathDate != nil && DiagnosisDateSmallerThan(*p.DeathDate, end) {
+		end = *p.DeathDate
+	}
+	years := float64(DaysBetween(firstDiagnosisDate(p, d1), end))/daysPerYear - minTime
+	return math.Max(0, math.Min(years, maxTime-minTime))
+}
+
+// InitPatientYears computes the patient-years at risk of the patients with each diagnosis within the given time frame,
+// cf. Experiment.DPatientYears. The data ends at the end date of the experiment with censoring, and at the last
+// diagnosis of the given patients otherwise. This requires the patients per diagnosis, cf. DPatients.
+func (exp *Experiment) InitPatientYears(patients *PatientMap, minTime, maxTime float64) {
+	end := exp.EndDate
+	if !exp.Censoring {
+		end = LastDiagnosisDate(patients.PIDMap)
+	}
+	exp.DPatientYears = make([]float64, len(exp.DPatients))
+	parallel.Range(0, len(exp.DPatients), 0, func(low, high int) {
+		for d1 := low; d1 < high; d1++ {
+			for _, p := range exp.DPatients[d1] {
+				exp.DPatientYears[d1] += patientYearsAtRisk(p, d1, end, minTime, maxTime)
+			}
+		}
+	})
+}
+
+// attributableFraction returns the population attributable fraction of d1 -> d2, or NaN if it is unknown, e.g. for RR
+// scores without statistics, cf. rrStats.
+func (exp *Experiment) attributableFraction(d1, d2 int) float64 {
+	stats := exp.rrStats(d1, d2)
+	if stats == nil || stats.Exposed == 0 {
+		return math.NaN()
+	}
+	excess := float64(stats.Exposed) / float64(exp.MCtr+exp.FCtr) * (exp.DxDRR[d1][d2] - 1)
+	return excess / (1 + excess)
+}
+
+// excessIncidence returns the excess incidence of d2 after d1 per 1000 patient-years, or NaN if it is unknown, e.g. for
+// RR scores without statistics, cf. rrStats, or if the patient-years are not computed, cf. InitPatientYears.
+func (exp *Experiment) excessIncidence(d1, d2 int) float64 {
+	stats := exp.rrStats(d1, d2)
+	if stats == nil || d1 >= len(exp.DPatientYears) || exp.DPatientYears[d1] == 0 {
+		return math.NaN()
+	}
+	return (stats.ExposedD2 - stats.ComparisonD2) / exp.DPatientYears[d1] * 1000
+}
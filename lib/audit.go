@@ -0,0 +1,128 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Data-access audit logging. Information governance requires a record of which patient data a tool read and which
+// patient-level outputs it produced, by whom. An AuditLog appends one json object per event to an audit file. The audit
+// file is opened for each event, so that events of concurrent runs sharing the same audit file are not lost.
+
+// Audit actions.
+const (
+	AuditStart  = "start"  // a run started
+	AuditRead   = "read"   // a file was read
+	AuditWrite  = "write"  // a file was written
+	AuditFinish = "finish" // a run finished successfully
+	AuditFail   = "fail"   // a run stopped with an error
+)
+
+// AuditEvent is a single entry in the audit log.
+type AuditEvent struct {
+	Time         string `json:"time"`                   // time of the event in RFC 3339 format
+	RunID        string `json:"runID"`                  // identifies the run
+	User         string `json:"user"`                   // the configured user that started the run
+	Action       string `json:"action"`                 // cf. the Audit constants
+	File         string `json:"file,omitempty"`         // absolute path of the file that was read or written
+	PatientLevel bool   `json:"patientLevel,omitempty"` // whether the file contains patient-level data
+	Detail       string `json:"detail,omitempty"`       // more information, e.g. an error message
+}
+
+// AuditLog writes audit events to a file. A nil AuditLog ignores all events.
+type AuditLog struct {
+	Path  string // audit file, events are appended
+	User  string // user recorded for each event
+	RunID string // run ID recorded for each event
+	lock  sync.Mutex
+}
+
+// NewAuditLog creates an audit log that appends to the given file. If no user is given, the user running the process is
+// recorded. If no run ID is given, a random run ID is generated. If no file is given, it returns nil.
+func NewAuditLog(path, userName, runID string) *AuditLog {
+	if path == "" {
+		return nil
+	}
+	if userName == "" {
+		if u, err := user.Current(); err == nil {
+			userName = u.Username
+		}
+	}
+	if runID == "" {
+		id := make([]byte, 8)
+		if _, err := rand.Read(id); err != nil {
+			panic(err)
+		}
+		runID = hex.EncodeToString(id)
+	}
+	return &AuditLog{Path: path, User: userName, RunID: runID}
+}
+
+// Record appends an event to the audit log. It panics if the event cannot be written, cf. record.
+func (log *AuditLog) Record(action, file string, patientLevel bool, detail string) {
+	if err := log.record(action, file, patientLevel, detail); err != nil {
+		panic(err)
+	}
+}
+
+// record appends an event to the audit log, and returns an error if the event cannot be written.
+func (log *AuditLog) record(action, file string, patientLevel bool, detail string) (err error) {
+	if log == nil {
+		return nil
+	}
+	if isRemoteInput(file) {
+		file = redactURL(file) // credentials or a presigned URL must not leak into the log
+	} else if file != "" {
+		if abs, err := filepath.Abs(file); err == nil {
+			file = abs
+		}
+	}
+	event := AuditEvent{Time: time.Now().UTC().Format(time.RFC3339), RunID: log.RunID, User: log.User,
+		Action: action, File: file, PatientLevel: patientLevel, Detail: detail}
+	log.lock.Lock()
+	defer log.lock.Unlock()
+	auditFile, err := os.OpenFile(log.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := auditFile.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+	return json.NewEncoder(auditFile).Encode(event)
+}
+
+// Read records that a file was read.
+func (log *AuditLog) Read(file string, patientLevel bool) {
+	log.Record(AuditRead, file, patientLevel, "")
+}
+
+// Wrote records that a file was written.
+func (log *AuditLog) Wrote(file string, patientLevel bool) {
+	log.Record(AuditWrite, file, patientLevel, "")
+}
@@ -0,0 +1,253 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Reading query results from BigQuery, where many TriNetX and OMOP mirrors live, so that tables need not be exported to
+// csv files first. Queries run with the jobs.query method of the BigQuery REST API, and their results are read page by
+// page, so that large tables are streamed rather than held in memory. Requests are authorized with an OAuth 2.0 access
+// token, e.g. from gcloud auth print-access-token, or else from the metadata server when running on Google Cloud. The
+// tokens of the metadata server are refreshed before they expire, so that long exports do not fail midway. A token
+// that is passed is used as is. The
+// tokens of the metadata server are refreshed before they expire, so that long exports do not fail midway. A token
+// that is passed is used as is.
+
+// bigQueryEndpoint is the endpoint of the BigQuery REST API.
+const bigQueryEndpoint = "https://bigquery.googleapis.com/bigquery/v2"
+
+// bigQueryMetadataToken is the url of the access token of the default service account on Google Cloud.
+const bigQueryMetadataToken = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+
+// bigQueryTokenMargin is the time before its expiry at which a token of the metadata server is refreshed.
+const bigQueryTokenMargin = time.Minute
+
+// BigQuerySource runs queries on BigQuery. It implements OMOPSource for OMOP tables in a dataset, and QueryRunner for
+// the queries of the sql input format.
+type BigQuerySource struct {
+	Project  string       // project that runs the query jobs
+	Dataset  string       // default dataset of the queries, e.g. the OMOP dataset, none if empty
+	Token    string       // OAuth 2.0 access token, from the metadata server if empty
+	PageSize int          // number of rows per page, 10000 if 0
+	Client   *http.Client // http.DefaultClient if nil
+	Endpoint string       // endpoint of the BigQuery REST API, bigQueryEndpoint if empty
+	TokenURL string       // url of the access token of the metadata server, bigQueryMetadataToken if empty
+
+	metadataToken  string    // access token of the metadata server, cf. token
+	metadataExpiry time.Time // expiry of the access token of the metadata server
+}
+
+// NewBigQuerySource creates a source for a project, or a project and a default dataset written as project.dataset. The
+// access token is read from the GOOGLE_OAUTH_ACCESS_TOKEN environment variable, if set.
+func NewBigQuerySource(projectDataset string) *BigQuerySource {
+	project, dataset, _ := strings.Cut(projectDataset, ".")
+	return &BigQuerySource{Project: project, Dataset: dataset, Token: os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN")}
+}
+
+// bigQueryResponse is a response of the jobs.query and jobs.getQueryResults methods.
+type bigQueryResponse struct {
+	JobReference struct {
+		JobID    string `json:"jobId"`
+		Location string `json:"location"`
+	} `json:"jobReference"`
+	JobComplete bool `json:"jobComplete"`
+	Schema      struct {
+		Fields []struct {
+			Type string `json:"type"`
+		} `json:"fields"`
+	} `json:"schema"`
+	Rows []struct {
+		F []struct {
+			V interface{} `json:"v"`
+		} `json:"f"`
+	} `json:"rows"`
+	PageToken string `json:"pageToken"`
+	Error     *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// token returns the access token, from the metadata server if the source has none. The token of the metadata server is
+// reused until shortly before it expires.
+func (source *BigQuerySource) token() (string, error) {
+	if source.Token != "" {
+		return source.Token, nil
+	}
+	if source.metadataToken != "" && time.Now().Add(bigQueryTokenMargin).Before(source.metadataExpiry) {
+		return source.metadataToken, nil
+	}
+	metadata := source.TokenURL
+	if metadata == "" {
+		metadata = bigQueryMetadataToken
+	}
+	request, err := http.NewRequest(http.MethodGet, metadata, nil)
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Metadata-Flavor", "Google")
+	response, err := source.client().Do(request)
+	if err != nil {
+		return "", fmt.Errorf("no BigQuery access token, set GOOGLE_OAUTH_ACCESS_TOKEN: %v", err)
+	}
+	defer response.Body.Close()
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"` // seconds
+	}
+	if err := json.NewDecoder(response.Body).Decode(&token); err != nil || token.AccessToken == "" {
+		return "", errors.New("no BigQuery access token from the metadata server, set GOOGLE_OAUTH_ACCESS_TOKEN")
+	}
+	source.metadataToken = token.AccessToken
+	source.metadataExpiry = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	return source.metadataToken, nil
+}
+
+// client returns the http client of the source.
+func (source *BigQuerySource) client() *http.Client {
+	if source.Client != nil {
+		return source.Client
+	}
+	return http.DefaultClient
+}
+
+// call calls a method of the BigQuery REST API, with a json body for POST requests, and decodes the response. A request
+// that is rejected with a token of the metadata server, e.g. because it was revoked, is retried once with a new token.
+func (source *BigQuerySource) call(method, path string, body interface{}) (*bigQueryResponse, error) {
+	result, status, err := source.request(method, path, body)
+	if status == http.StatusUnauthorized && source.Token == "" && source.metadataToken != "" {
+		source.metadataToken = ""
+		result, _, err = source.request(method, path, body)
+	}
+	return result, err
+}
+
+// request sends a request to the BigQuery REST API, and returns the decoded response and its status code.
+func (source *BigQuerySource) request(method, path string, body interface{}) (*bigQueryResponse, int, error) {
+	token, err := source.token()
+	if err != nil {
+		return nil, 0, err
+	}
+	endpoint := source.Endpoint
+	if endpoint == "" {
+		endpoint = bigQueryEndpoint
+	}
+	var content bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&content).Encode(body); err != nil {
+			return nil, 0, err
+		}
+	}
+	request, err := http.NewRequest(method, endpoint+path, &content)
+	if err != nil {
+		return nil, 0, err
+	}
+	request.Header.Set("Authorization", "Bearer "+token)
+	request.Header.Set("Content-Type", "application/json")
+	response, err := source.client().Do(request)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer response.Body.Close()
+	result := &bigQueryResponse{}
+	if err := json.NewDecoder(response.Body).Decode(result); err != nil {
+		return nil, response.StatusCode, fmt.Errorf("BigQuery: %s: %v", response.Status, err)
+	}
+	if result.Error != nil {
+		return nil, response.StatusCode, fmt.Errorf("BigQuery: %s", result.Error.Message)
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, response.StatusCode, fmt.Errorf("BigQuery: %s", response.Status)
+	}
+	return result, response.StatusCode, nil
+}
+
+// bigQueryValue converts a value of a BigQuery result into a string. Timestamps, which BigQuery returns as seconds
+// since the epoch, are converted into date times, e.g. 2010-05-01 12:00:00. NULL values are empty strings.
+func bigQueryValue(value interface{}, fieldType string) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		if fieldType == "TIMESTAMP" {
+			if seconds, err := strconv.ParseFloat(v, 64); err == nil {
+				return time.Unix(int64(seconds), 0).UTC().Format("2006-01-02 15:04:05")
+			}
+		}
+		return strings.TrimSpace(v)
+	default: // records and repeated fields
+		data, _ := json.Marshal(v)
+		return string(data)
+	}
+}
+
+// ReadQuery implements QueryRunner. It waits for the query job to complete, and reads its results page by page.
+func (source *BigQuerySource) ReadQuery(query string, f func(values []string)) error {
+	pageSize := source.PageSize
+	if pageSize == 0 {
+		pageSize = 10000
+	}
+	request := map[string]interface{}{"query": query, "useLegacySql": false, "maxResults": pageSize}
+	if source.Dataset != "" {
+		request["defaultDataset"] = map[string]string{"projectId": source.Project, "datasetId": source.Dataset}
+	}
+	project := url.PathEscape(source.Project)
+	response, err := source.call(http.MethodPost, "/projects/"+project+"/queries", request)
+	for err == nil {
+		if response.JobComplete {
+			for _, row := range response.Rows {
+				values := make([]string, len(response.Schema.Fields)) // f may keep the values
+				for i := range values {
+					if i < len(row.F) {
+						values[i] = bigQueryValue(row.F[i].V, response.Schema.Fields[i].Type)
+					}
+				}
+				f(values)
+			}
+			if response.PageToken == "" {
+				return nil
+			}
+		}
+		parameters := url.Values{"maxResults": {strconv.Itoa(pageSize)}, "timeoutMs": {"60000"}}
+		if response.JobReference.Location != "" {
+			parameters.Set("location", response.JobReference.Location)
+		}
+		if response.JobComplete {
+			parameters.Set("pageToken", response.PageToken)
+		}
+		response, err = source.call(http.MethodGet, "/projects/"+project+"/queries/"+
+			url.PathEscape(response.JobReference.JobID)+"?"+parameters.Encode(), nil)
+	}
+	return err
+}
+
+// ReadTable implements OMOPSource, for OMOP tables in the dataset of the source.
+func (source *BigQuerySource) ReadTable(table string, columns []string, f func(values []string)) error {
+	return source.ReadQuery(fmt.Sprintf("SELECT %s FROM %s", strings.Join(columns, ", "), table), f)
+}
@@ -0,0 +1,144 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Bootstrap stability of the trajectories. The patients of the experiment are resampled with replacement, and the RR
+// scores and trajectories are rebuilt from each resampled population with the parameters of the experiment. The
+// stability of a trajectory is the fraction of the bootstrap replicates in which a trajectory with the same hash, cf.
+// TrajectoryHash, reappears. Robust trajectories reappear in most replicates, whereas trajectories that are artifacts
+// of the sampled patients only reappear in few.
+
+// TrajectoryStability is the nr of bootstrap replicates in which a trajectory reappears.
+type TrajectoryStability struct {
+	Trajectory *Trajectory
+	Found      int // nr of replicates in which the trajectory reappears
+	Replicates int
+}
+
+// Stability returns the fraction of the bootstrap replicates in which the trajectory reappears.
+func (s *TrajectoryStability) Stability() float64 {
+	return float64(s.Found) / float64(s.Replicates)
+}
+
+// resamplePatients draws as many patients as the given patients with replacement, using the given generator. The drawn
+// patients are copies with the draw as PID, so that a patient drawn more than once counts as separate patients.
+func resamplePatients(patients *PatientMap, rng *rand.Rand) *PatientMap {
+	pids := patients.sortedPIDs()
+	resampled := &PatientMap{PIDStringMap: map[string]int{}, PIDMap: make(map[int]*Patient, len(pids)),
+		Ctr: len(pids), NofStrata: patients.NofStrata, Periods: patients.Periods}
+	for pid := range pids {
+		p := *patients.PIDMap[pids[randomIndex(rng, len(pids))]]
+		p.PID = pid
+		resampled.PIDMap[pid] = &p
+		if p.Sex == Male {
+			resampled.MaleCtr++
+		} else {
+			resampled.FemaleCtr++
+		}
+	}
+	return resampled
+}
+
+// bootstrapReplicate returns an experiment on the given resampled patients with the settings of the experiment, of
+// which the RR scores are not yet computed. The replicate samples its comparison groups with the given seed if the
+// experiment has a seed.
+func (exp *Experiment) bootstrapReplicate(resampled *PatientMap, seed uint64) *Experiment {
+	cohorts := InitCohorts(resampled, exp.NofAgeGroups, exp.NofRegions, exp.NofDiagnosisCodes)
+	result := *exp
+	result.DxDRR = MakeDxDRR(exp.NofDiagnosisCodes)
+	result.DxDPatients = MakeDxDPatients(exp.NofDiagnosisCodes)
+	result.DPatients = MergeCohorts(cohorts).DPatients
+	result.Cohorts = cohorts
+	result.DxDStats, result.DxDDirectionality, result.DxDSexRR, result.DxDAgeRR = nil, nil, nil, nil
+	result.Pairs, result.Trajectories = nil, nil
+	if exp.Seed != 0 { // the comparison groups of the replicates differ from those of the experiment
+		result.Seed = seed
+	}
+	return &result
+}
+
+// BootstrapStability rebuilds the trajectories from the given nr of bootstrap replicates of the patients, with the
+// parameters with which the trajectories of the experiment are built, cf. InitRR and BuildTrajectories. With
+// matchComorbidities, the controls are also matched on their nr of comorbidities, cf. InitComorbidityMatching. It
+// returns the stability of the trajectories of the experiment, in the order of exp.Trajectories.
+func (exp *Experiment) BootstrapStability(patients *PatientMap, replicates, iter, minPatients, maxLength, minLength int,
+	minTime, maxTime, minRR float64, filters []TrajectoryFilter, matchComorbidities bool) []*TrajectoryStability {
+	stability := make([]*TrajectoryStability, len(exp.Trajectories))
+	for i, t := range exp.Trajectories {
+		stability[i] = &TrajectoryStability{Trajectory: t, Replicates: replicates}
+	}
+	for r := 0; r < replicates; r++ {
+		fmt.Println("Building the trajectories of bootstrap replicate ", r+1, " of ", replicates, "...")
+		rng := exp.Rand(bootstrapStreams + uint64(r))
+		replicate := exp.bootstrapReplicate(resamplePatients(patients, rng), rng.Uint64())
+		if matchComorbidities {
+			replicate.InitComorbidityMatching()
+		}
+		replicate.InitRR(minTime, maxTime, iter)
+		if exp.MaxDirectionalityP > 0 {
+			replicate.InitDirectionality(minTime, maxTime)
+		}
+		hashes := map[string]bool{}
+		for _, t := range replicate.BuildTrajectories(minPatients, maxLength, minLength, minTime, maxTime, minRR,
+			filters) {
+			hashes[t.Hash] = true
+		}
+		for _, s := range stability {
+			if hashes[s.Trajectory.Hash] {
+				s.Found++
+			}
+		}
+	}
+	return stability
+}
+
+// WriteBootstrapStability writes the stability of the trajectories to a file name-bootstrap.tab, with a line per
+// trajectory: the trajectory ID and hash, the terms and codes of the diagnoses, the nr of bootstrap replicates in which
+// the trajectory reappears, the nr of replicates, and the stability:
+// TID tab hash tab terms tab codes tab found tab replicates tab stability. It returns the file name.
+func WriteBootstrapStability(exp *Experiment, stability []*TrajectoryStability, path string) string {
+	name := filepath.Join(path, fmt.Sprintf("%s-bootstrap.tab", exp.Name))
+	file, err := os.Create(name)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	for _, s := range stability {
+		t := s.Trajectory
+		terms, codes := make([]string, len(t.Diagnoses)), make([]string, len(t.Diagnoses))
+		for i, did := range t.Diagnoses {
+			terms[i], codes[i] = exp.Icd10Map[did].Name, exp.IdMap[did]
+		}
+		fmt.Fprintf(file, "%d\t%s\t%s\t%s\t%d\t%d\t%s\n", t.ID, t.Hash, strings.Join(terms, " -> "),
+			strings.Join(codes, " -> "), s.Found, s.Replicates, formatRRFloat(s.Stability()))
+	}
+	return name
+}
@@ -0,0 +1,94 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Detecting the layout of the CCSR csv file. The yearly CCSR releases of the HCUP differ in their columns: v2020 has a
+// single default category, v2021 and v2022 have a default category for inpatient and one for outpatient data, and from
+// v2023 on there is a column with the rationale for the default assignment. The quoting of the values differs as well:
+// the codes are between single quotes in some releases and not in others. The layout is therefore derived from the
+// names of the columns in the header, rather than from fixed positions.
+
+// The CCSR releases that are distinguished by their header.
+const (
+	CCSRv2020 = "v2020"
+	CCSRv2021 = "v2021-v2022"
+	CCSRv2023 = "v2023-v2024"
+)
+
+// ccsrLayout gives the positions of the columns of a CCSR csv file.
+type ccsrLayout struct {
+	version         string
+	code            int      // ICD-10-CM code
+	defaultCategory int      // default CCSR category, the inpatient one if there are two
+	defaultName     int      // description of the default category
+	categories      [][2]int // CCSR categories and their descriptions, up to 6
+}
+
+// ccsrValue removes the single quotes and spaces around a value of a CCSR file, and a byte order mark.
+func ccsrValue(value string) string {
+	return strings.Trim(strings.TrimPrefix(value, "\ufeff"), "' ")
+}
+
+// detectCCSRLayout derives the layout of a CCSR file from its header, and panics if it is not a known layout.
+func detectCCSRLayout(file string, header []string) *ccsrLayout {
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.ToUpper(ccsrValue(name))] = i
+	}
+	column := func(name string) int {
+		if i, ok := columns[name]; ok {
+			return i
+		}
+		return -1
+	}
+	layout := &ccsrLayout{code: column("ICD-10-CM CODE")}
+	if i := column("DEFAULT CCSR CATEGORY IP"); i != -1 {
+		layout.version = CCSRv2021
+		layout.defaultCategory, layout.defaultName = i, column("DEFAULT CCSR CATEGORY DESCRIPTION IP")
+		if column("RATIONALE FOR DEFAULT ASSIGNMENT") != -1 {
+			layout.version = CCSRv2023
+		}
+	} else {
+		layout.version = CCSRv2020
+		layout.defaultCategory, layout.defaultName = column("DEFAULT CCSR CATEGORY"), column("DEFAULT CCSR CATEGORY DESCRIPTION")
+	}
+	for n := 1; n <= 6; n++ {
+		category, name := column(fmt.Sprint("CCSR CATEGORY ", n)), column(fmt.Sprint("CCSR CATEGORY ", n, " DESCRIPTION"))
+		if category != -1 && name != -1 {
+			layout.categories = append(layout.categories, [2]int{category, name})
+		}
+	}
+	if layout.code == -1 || layout.defaultCategory == -1 || layout.defaultName == -1 || len(layout.categories) == 0 {
+		panic(fmt.Sprint("Invalid DiagnosisInfo file ", file, ": unknown CCSR layout with header ", header))
+	}
+	return layout
+}
+
+// value returns a value of a row of a CCSR file, without quotes, and empty if the row is too short.
+func (layout *ccsrLayout) value(record []string, i int) string {
+	if i < len(record) {
+		return ccsrValue(record[i])
+	}
+	return ""
+}
@@ -0,0 +1,64 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import "fmt"
+
+// Censoring of the exposed patients. The RR of d1 -> d2 counts the exposed patients diagnosed with d2 within the time
+// frame after d1. Patients that die shortly after d1, or that are diagnosed with d1 shortly before the end of the data,
+// are not followed for the whole time frame, and would be counted as never diagnosed with d2. This biases the RR scores
+// of fatal or recent diagnoses downward. With censoring, the exposed patients without d2 of which the follow-up ends
+// before the end of the time frame are left out of the exposed group, and the nr of d2 diagnoses is scaled to the size
+// of the whole exposed group, so that the comparison groups and the statistics of the RR keep their meaning.
+
+// observationEnd returns the end of the follow-up of a patient: the death of the patient, or the end of the data of the
+// experiment, cf. Experiment.EndDate, whichever comes first.
+func (exp *Experiment) observationEnd(p *Patient) DiagnosisDate {
+	end := exp.EndDate
+	if p.DeathDate != nil && DiagnosisDateSmallerThan(*p.DeathDate, end) {
+		end = *p.DeathDate
+	}
+	return end
+}
+
+// censored checks if the follow-up of a patient exposed to d1 ends before maxTime years after the first d1 diagnosis.
+func (exp *Experiment) censored(p *Patient, d1 int, maxTime float64) bool {
+	return yearsLater(firstDiagnosisDate(p, d1), maxTime).After(dateToTime(exp.observationEnd(p)))
+}
+
+// LastDiagnosisDate returns the date of the last diagnosis of the given patients, which is the default end of the data
+// for censoring.
+func LastDiagnosisDate(patients map[int]*Patient) DiagnosisDate {
+	var last DiagnosisDate
+	for _, p := range patients {
+		if n := len(p.Diagnoses); n > 0 && DiagnosisDateSmallerThan(last, p.Diagnoses[n-1].Date) {
+			last = p.Diagnoses[n-1].Date
+		}
+	}
+	return last
+}
+
+// ParseEndDate parses the end of the data for censoring, formatted as YYYY-MM-DD.
+func ParseEndDate(date string) (DiagnosisDate, error) {
+	end, err := parseTriNetXDate(date)
+	if err != nil || len(date) != 10 {
+		return DiagnosisDate{}, fmt.Errorf("invalid end date: %s", date)
+	}
+	return end, nil
+}
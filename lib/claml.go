@@ -0,0 +1,203 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"encoding/xml"
+	"fmt"
+	"github.com/imec-int/ptra/lib/utils"
+	"io"
+	"strings"
+)
+
+// Reading the WHO ICD-10 vocabulary. European datasets are coded in WHO ICD-10 rather than in ICD-10-CM. The WHO
+// publishes the ICD-10 tabular list in the Classification Markup Language (ClaML), an xml file with a Class element per
+// chapter, block, and category, which refers to its parent with a SuperClass element. The classes are mapped onto the
+// same hierarchy as the ICD-10-CM tabular list: the chapters are level 0, the blocks level 1, and each next character
+// of the categories is one level deeper, so that the codes are grouped on a level of the hierarchy in the same way.
+
+// clamlExcludedChapters are the chapters of WHO ICD-10 that are excluded from analysis, cf. the excluded chapters of
+// ICD-10-CM.
+var clamlExcludedChapters = map[string]bool{
+	"XV":    true, // Pregnancy, childbirth and the puerperium
+	"XVI":   true, // Certain conditions originating in the perinatal period
+	"XVIII": true, // Symptoms, signs and abnormal clinical and laboratory findings, not elsewhere classified
+	"XIX":   true, // Injury, poisoning and certain other consequences of external causes
+	"XX":    true, // External causes of morbidity and mortality
+	"XXI":   true, // Factors influencing health status and contact with health services
+}
+
+// clamlReference refers to the parent or a child of a class.
+type clamlReference struct {
+	Code string `xml:"code,attr"`
+}
+
+// clamlLabel is the text of a rubric, without the markup of its references.
+type clamlLabel struct {
+	Text string `xml:",chardata"`
+}
+
+// clamlRubric is a description of a class, the preferred rubric is its name.
+type clamlRubric struct {
+	Kind   string       `xml:"kind,attr"`
+	Labels []clamlLabel `xml:"Label"`
+}
+
+// clamlClass is a chapter, block, or category of the classification.
+type clamlClass struct {
+	Code       string           `xml:"code,attr"`
+	Kind       string           `xml:"kind,attr"`
+	SuperClass []clamlReference `xml:"SuperClass"`
+	Rubrics    []clamlRubric    `xml:"Rubric"`
+}
+
+// clamlClassification contains the full ClaML file.
+type clamlClassification struct {
+	XmlName xml.Name     `xml:"ClaML"`
+	Classes []clamlClass `xml:"Class"`
+}
+
+// name returns the preferred label of a class, with its white space normalized.
+func (class *clamlClass) name() string {
+	for _, rubric := range class.Rubrics {
+		if rubric.Kind == "preferred" && len(rubric.Labels) > 0 {
+			return strings.Join(strings.Fields(rubric.Labels[0].Text), " ")
+		}
+	}
+	return class.Code
+}
+
+// superClass returns the code of the parent of a class, empty for the chapters.
+func (class *clamlClass) superClass() string {
+	if len(class.SuperClass) == 0 {
+		return ""
+	}
+	return class.SuperClass[0].Code
+}
+
+// clamlCharsetReader decodes ClaML files in ISO-8859-1, as published by some national institutes, besides UTF-8.
+func clamlCharsetReader(charset string, input io.Reader) (io.Reader, error) {
+	switch strings.ToLower(charset) {
+	case "iso-8859-1", "latin1", "latin-1":
+		bytes, err := io.ReadAll(input)
+		if err != nil {
+			return nil, err
+		}
+		runes := make([]rune, len(bytes))
+		for i, b := range bytes {
+			runes[i] = rune(b)
+		}
+		return strings.NewReader(string(runes)), nil
+	}
+	return nil, fmt.Errorf("unsupported charset in ClaML file: %s", charset)
+}
+
+// newClaMLDecoder returns an xml decoder for a ClaML file.
+func newClaMLDecoder(input io.Reader) *xml.Decoder {
+	decoder := xml.NewDecoder(input)
+	decoder.CharsetReader = clamlCharsetReader
+	return decoder
+}
+
+// isClaML checks if an xml file is a ClaML file, by its root element.
+func isClaML(file string) bool {
+	f, err := openInput(file)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	decoder := newClaMLDecoder(f)
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return false
+		}
+		if element, ok := token.(xml.StartElement); ok {
+			return element.Name.Local == "ClaML"
+		}
+	}
+}
+
+// initializeClaMLNameMap reads the WHO ICD-10 tabular list from a ClaML file, and returns a map ICD-10 code -> entry
+// (name, names of the ancestors, level), and the set of codes of the excluded chapters. Only the innermost block of a
+// category is one of its ancestors, as the ICD-10-CM tabular list has no nested blocks. As for ICD-10-CM, at most 6
+// levels are distinguished.
+func initializeClaMLNameMap(file string) (map[string]Icd10Entry, map[string]bool) {
+	fmt.Println("Parsing WHO ICD10 code hierarchy from ClaML file: ", file)
+	f, err := openInput(file)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	classification := clamlClassification{}
+	if err := newClaMLDecoder(f).Decode(&classification); err != nil {
+		panic(fmt.Sprint(file, ": ", err))
+	}
+	classes := map[string]*clamlClass{}
+	for i := range classification.Classes {
+		class := &classification.Classes[i]
+		classes[class.Code] = class
+	}
+	icd10Map := map[string]Icd10Entry{}
+	excluded := map[string]bool{}
+	for i := range classification.Classes {
+		class := &classification.Classes[i]
+		if class.Kind != "category" {
+			continue
+		}
+		var chapter, block string
+		var categories []string // names of the parent categories, innermost first
+		for ancestor := classes[class.superClass()]; ancestor != nil; ancestor = classes[ancestor.superClass()] {
+			switch ancestor.Kind {
+			case "chapter":
+				chapter = ancestor.Code
+				categories = append(categories, ancestor.name())
+			case "block":
+				if block == "" {
+					block = ancestor.name()
+					categories = append(categories, block)
+				}
+			default:
+				categories = append(categories, ancestor.name())
+			}
+		}
+		if clamlExcludedChapters[chapter] {
+			excluded[class.Code] = true
+			continue
+		}
+		entry := Icd10Entry{Name: class.name(), Categories: [6]string{"NONE", "NONE", "NONE", "NONE", "NONE", "NONE"}}
+		for i := 0; i < len(categories) && i < len(entry.Categories); i++ {
+			entry.Categories[i] = categories[len(categories)-1-i]
+		}
+		entry.Level = utils.MinInt(len(categories), len(entry.Categories))
+		icd10Map[class.Code] = entry
+	}
+	fmt.Println("Parsed ", len(icd10Map), " WHO ICD10 codes.")
+	return icd10Map, excluded
+}
+
+// initializeClaMLAnalysisMaps returns a map ICD-10 code -> internal analysis DID and a map analysis DID -> medical Name
+// for the WHO ICD-10 tabular list passed as a ClaML file and a requested hierarchy Level, as for the ICD-10-CM tabular
+// list. The custom events are added after the codes, nil for the default bladder cancer events.
+func initializeClaMLAnalysisMaps(file string, level int, events []*CustomEvent) icd10AnalysisMapsFromXML {
+	icd10Map, excluded := initializeClaMLNameMap(file)
+	analysisIdMap, analysisMap, ctr, _ := initializeIcd10AnalysisMaps(icd10Map, level, events)
+	return icd10AnalysisMapsFromXML{DIDMap: analysisIdMap, Icd10Map: analysisMap, NofDiagnosisCodes: ctr,
+		Excluded: excluded}
+}
@@ -0,0 +1,161 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+)
+
+// Enrichment of the clusters of trajectories against the background population, i.e. the patients of the experiment
+// after filtering. The patients of a cluster are the patients that follow one of its trajectories. For each patient
+// feature, i.e. the sex, the age group, death, the cancer stages and histologies of the tumor file, and the terminal
+// diagnoses of the trajectories of the cluster, the fraction of the patients of the cluster with the feature is
+// compared with the fraction of the other patients of the population with a one-sided Fisher's exact test.
+
+// stageFeatures are the patient filters of the cancer stages and histologies that are tested for enrichment if the
+// experiment has a tumor file, cf. GetPatientFilter.
+var stageFeatures = []string{"Ta", "Tis", "T1", "T2", "T3", "T4", "N0", "N1", "N2", "N3", "M0", "M1", "NMIBC", "MIBC",
+	"mUC", HistologyUrothelial, HistologySquamous, HistologyAdenocarcinoma, HistologyNeuroendocrine}
+
+// clusterFeature is a patient feature of which the enrichment in the clusters is tested.
+type clusterFeature struct {
+	name string
+	has  func(p *Patient) bool
+}
+
+// ClusterBackground is the background population against which the enrichment of the clusters is tested.
+type ClusterBackground struct {
+	patients []*Patient
+	features []clusterFeature // the features that do not depend on the cluster
+}
+
+// NewClusterBackground returns the background population of the given patients, with the cancer stages and
+// histologies of the given tumor information, if any.
+func NewClusterBackground(exp *Experiment, patients *PatientMap, tinfo map[string][]*TumorInfo) *ClusterBackground {
+	background := &ClusterBackground{}
+	for _, p := range patients.PIDMap {
+		background.patients = append(background.patients, p)
+	}
+	sort.Slice(background.patients, func(i, j int) bool {
+		return background.patients[i].PID < background.patients[j].PID
+	})
+	background.features = []clusterFeature{
+		{"sex: male", func(p *Patient) bool { return p.Sex == Male }},
+		{"sex: female", func(p *Patient) bool { return p.Sex == Female }},
+	}
+	for ageGroup := 0; ageGroup < exp.NofAgeGroups && exp.NofAgeGroups > 1; ageGroup++ {
+		background.features = append(background.features, clusterFeature{fmt.Sprintf("age group: %d", ageGroup),
+			func(p *Patient) bool { return p.CohortAge == ageGroup }})
+	}
+	background.features = append(background.features,
+		clusterFeature{"deceased", func(p *Patient) bool { return p.DeathDate != nil }})
+	if len(tinfo) > 0 {
+		for _, stage := range stageFeatures {
+			filter := GetPatientFilter(stage, tinfo)
+			background.features = append(background.features, clusterFeature{"stage: " + stage,
+				func(p *Patient) bool {
+					q := *p // the stage filters drop diagnoses of the patient they test
+					return filter(&q)
+				}})
+		}
+	}
+	return background
+}
+
+// ClusterEnrichment is the enrichment of a patient feature in a cluster.
+type ClusterEnrichment struct {
+	Feature     string
+	Patients    int     // nr of patients of the cluster with the feature
+	ClusterSize int     // nr of patients of the cluster
+	Background  int     // nr of patients of the population with the feature
+	Population  int     // nr of patients of the population
+	PValue      float64 // one-sided p-value of the enrichment
+}
+
+// Fold returns the ratio of the fraction of the patients of the cluster with the feature to the fraction of the
+// patients of the population.
+func (e *ClusterEnrichment) Fold() float64 {
+	return (float64(e.Patients) / float64(e.ClusterSize)) / (float64(e.Background) / float64(e.Population))
+}
+
+// clusterPatients returns the patients that follow one of the given trajectories of a cluster.
+func clusterPatients(trajectories []*Trajectory) map[int]bool {
+	pids := map[int]bool{}
+	for _, t := range trajectories {
+		if len(t.Patients) > 0 {
+			for _, p := range t.Patients[len(t.Patients)-1] {
+				pids[p.PID] = true
+			}
+		}
+	}
+	return pids
+}
+
+// terminalDiagnosisFeatures returns the features of the terminal diagnoses of the given trajectories of a cluster,
+// i.e. whether a patient is diagnosed with the last diagnosis of one of the trajectories.
+func terminalDiagnosisFeatures(exp *Experiment, trajectories []*Trajectory) []clusterFeature {
+	var dids []int
+	for _, t := range trajectories {
+		if did := t.Diagnoses[len(t.Diagnoses)-1]; !slices.Contains(dids, did) {
+			dids = append(dids, did)
+		}
+	}
+	features := make([]clusterFeature, len(dids))
+	for i, did := range dids {
+		features[i] = clusterFeature{fmt.Sprintf("terminal diagnosis: %s %s", exp.IdMap[did], exp.Icd10Map[did].Name),
+			func(p *Patient) bool {
+				return slices.ContainsFunc(p.Diagnoses, func(d *Diagnosis) bool { return d.DID == did })
+			}}
+	}
+	return features
+}
+
+// Enrichment returns the enrichment of the features of the background population and the terminal diagnoses in the
+// cluster of the given trajectories. The patients of the cluster are compared with the other patients of the population.
+// Features that no patient of the cluster has are left out.
+func (background *ClusterBackground) Enrichment(exp *Experiment, trajectories []*Trajectory) []*ClusterEnrichment {
+	pids := clusterPatients(trajectories)
+	var result []*ClusterEnrichment
+	for _, feature := range append(slices.Clone(background.features), terminalDiagnosisFeatures(exp, trajectories)...) {
+		e := &ClusterEnrichment{Feature: feature.name, Population: len(background.patients)}
+		for _, p := range background.patients {
+			if !feature.has(p) {
+				if pids[p.PID] {
+					e.ClusterSize++
+				}
+				continue
+			}
+			e.Background++
+			if pids[p.PID] {
+				e.ClusterSize++
+				e.Patients++
+			}
+		}
+		if e.Patients == 0 {
+			continue
+		}
+		others := e.Population - e.ClusterSize
+		e.PValue = fisherExactGreater(e.Patients, e.ClusterSize-e.Patients, e.Background-e.Patients,
+			others-(e.Background-e.Patients))
+		result = append(result, e)
+	}
+	return result
+}
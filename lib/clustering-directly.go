@@ -95,8 +95,9 @@ func convertTrajectoriesToAbcFormat(exp *Experiment, name string) {
 
 // ClusterTrajectories performs clustering of the trajectories that have been calculated for a given experiment.
 // It does a pairwise comparison of all trajectories by calculating the jaccard similarity coefficients. Subsequently,
-// MCL clustering is used to group the trajectories by jaccard similarity into clusters.
-func ClusterTrajectories(exp *Experiment, granularities []int, path string) error {
+// MCL clustering is used to group the trajectories by jaccard similarity into clusters. The enrichment of the clusters is
+// tested against the given background population, if not nil, cf. PrintClusteredTrajectoriesToFile.
+func ClusterTrajectories(exp *Experiment, background *ClusterBackground, granularities []int, path string) error {
 	fmt.Println("Clustering trajectories directly with MCL")
 	// convert trajectories to abc format for the Mcl tool
 	dirName := fmt.Sprintf("%s-clusters-directly/", exp.Name)
@@ -144,9 +145,11 @@ func ClusterTrajectories(exp *Experiment, granularities []int, path string) erro
 	for _, gran := range granularities {
 		dumpFileName := fmt.Sprintf("%s.I%d", outFileName, gran)
 		convertToGml(exp, dumpFileName, fmt.Sprintf("%s.trajectories.gml", dumpFileName))
-		PrintClusteredTrajectoriesToFile(exp, fmt.Sprintf("%s.clustered.trajectories.tab", dumpFileName))
+		PrintClusteredTrajectoriesToFile(exp, background, fmt.Sprintf("%s.clustered.trajectories.tab", dumpFileName))
+		printClusterGraphs(exp, dumpFileName)
 		PrintClustersToCSVFiles(exp, fmt.Sprintf("%s.clustered.patients.csv", dumpFileName),
 			fmt.Sprintf("%s.clustered.clusters.csv", dumpFileName))
+		exp.Clusterings = append(exp.Clusterings, newResultsClustering(exp, gran))
 	}
 
 	return nil
@@ -224,7 +227,8 @@ func convertToGml(exp *Experiment, input, output string) {
 			for _, node := range t.Diagnoses {
 				if _, ok := nodePrinted[node]; !ok {
 					icd10 := exp.Icd10Map[node]
-					fmt.Fprintf(ofile, "\tnode [\n\t\tid %d\n\t\tlabel \"%s\"\n\t", node, icd10.Name)
+					fmt.Fprintf(ofile, "\tnode [\n\t\tid %d\n\t\tlabel \"%s\"\n\t\tcode \"%s\"\n\t", node, icd10.Name,
+						exp.IdMap[node])
 					fmt.Fprintf(ofile, "\tlevel %d\n", icd10.Level)
 					for idx, cat := range icd10.Categories {
 						if cat == "NONE" {
@@ -246,7 +250,7 @@ func convertToGml(exp *Experiment, input, output string) {
 				target := t.Diagnoses[idx+1]
 				n := t.PatientNumbers[idx]
 				RR := strconv.FormatFloat(exp.DxDRR[source][target], 'f', 2, 64)
-				fmt.Fprintf(ofile, fmt.Sprintf("\tedge [\n\t\ttid %d\n\t\ttlen %d\n\t\ttidx %d\n\t\tsource %d\n\t\ttarget %d\n\t\tpatients %d\n\t\tRR \"%s\"\n\t]\n", t.ID, tlen, idx, source, target, n, RR))
+				fmt.Fprintf(ofile, fmt.Sprintf("\tedge [\n\t\ttid %d\n\t\tthash \"%s\"\n\t\ttlen %d\n\t\ttidx %d\n\t\tsource %d\n\t\ttarget %d\n\t\tpatients %d\n\t\tRR \"%s\"\n\t]\n", t.ID, t.Hash, tlen, idx, source, target, n, RR))
 			}
 		}
 		fmt.Fprintf(ofile, "]\n")
@@ -255,6 +259,23 @@ func convertToGml(exp *Experiment, input, output string) {
 	fmt.Println("Collected ", nofClusters, " clusters")
 }
 
+// printClusterGraphs plots the clustered trajectories of an experiment to GML and GraphML files: a merged graph of all
+// trajectories of which the edges carry the clusters of the trajectories, name.clustered.merged-graph.gml, and a graph
+// per cluster in the name.clusters folder, cluster<CID>.gml.
+func printClusterGraphs(exp *Experiment, name string) {
+	printTrajectories(exp, exp.Trajectories, true, fmt.Sprintf("%s.clustered.merged-graph.gml", name))
+	printTrajectoriesGraphML(exp, exp.Trajectories, true, fmt.Sprintf("%s.clustered.merged-graph.graphml", name))
+	dirName := fmt.Sprintf("%s.clusters", name)
+	if err := os.MkdirAll(dirName, 0777); err != nil {
+		panic(err)
+	}
+	for cid, trajectories := range collectClusters(exp) {
+		fileName := filepath.Join(dirName, fmt.Sprintf("cluster%d", cid))
+		printTrajectories(exp, trajectories, true, fileName+".gml")
+		printTrajectoriesGraphML(exp, trajectories, true, fileName+".graphml")
+	}
+}
+
 // percentMalesFemales computes for a given list of patients the percentage of males and females wrt to the total number
 // of males and females in the experiment.
 func percentMalesFemales(exp *Experiment, ps []*Patient) (float64, float64) {
@@ -0,0 +1,125 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Detection of the code system of the diagnoses. Exports write the code system of a diagnosis in many ways, e.g.
+// ICD-10-CM, ICD10CM, ICD10, or 10. The code system of each row is detected from these aliases, so that each diagnosis
+// is routed through the right mapper onto the vocabulary: ICD-10 codes directly, ICD-9 codes via the ICD9 to ICD10
+// mapping, and SNOMED CT concepts via a SNOMED CT to ICD10 mapping, e.g. the extended map of the SNOMED CT release.
+
+// codeSystemAliases maps the names of the code systems, in upper case and without separators, onto the code systems.
+var codeSystemAliases = map[string]string{
+	"ICD10CM":    CodeSystemICD10,
+	"ICD10":      CodeSystemICD10,
+	"I10":        CodeSystemICD10,
+	"10":         CodeSystemICD10,
+	"ICD9CM":     CodeSystemICD9,
+	"ICD9":       CodeSystemICD9,
+	"I9":         CodeSystemICD9,
+	"9":          CodeSystemICD9,
+	"SNOMEDCT":   CodeSystemSNOMED,
+	"SNOMEDCTUS": CodeSystemSNOMED,
+	"SNOMED":     CodeSystemSNOMED,
+	"SCT":        CodeSystemSNOMED,
+	"ICD11MMS":   CodeSystemICD11,
+	"ICD11":      CodeSystemICD11,
+	"11":         CodeSystemICD11,
+	"CUSTOM":     CodeSystemCustom,
+}
+
+// detectCodeSystem returns the code system with the given name or alias, e.g. ICD10 or icd-10-cm for ICD-10-CM. Unknown
+// names are returned unchanged.
+func detectCodeSystem(name string) string {
+	key := strings.Map(func(r rune) rune {
+		if r == '-' || r == '_' || r == '.' || unicode.IsSpace(r) {
+			return -1
+		}
+		return unicode.ToUpper(r)
+	}, name)
+	if codeSystem, ok := codeSystemAliases[key]; ok {
+		return codeSystem
+	}
+	return name
+}
+
+// parseSNOMEDToIcd10Mapping reads a mapping from SNOMED CT concepts onto ICD-10 codes. This is either a json file that
+// maps concept IDs onto ICD-10 codes, or the extended map of a SNOMED CT release in RF2 format, with
+// referencedComponentId and mapTarget columns. Of the map rules of a concept, the active rule with the lowest map group
+// and priority is used, as it is the default map of the concept. The ICD-10 codes are normalized, cf. normalizeICDCode.
+// SNOMED CT concept IDs and normalized ICD-9 codes are distinct, so that the mapping can be merged with the ICD9 to
+// ICD10 mapping.
+func parseSNOMEDToIcd10Mapping(file string) map[string]string {
+	mapping := map[string]string{}
+	if inputExt(file) == ".json" {
+		fmt.Println("Parsing SNOMED CT to ICD10 mapping from a json file.")
+		jsonFile, err := openInput(file)
+		if err != nil {
+			panic(err)
+		}
+		defer jsonFile.Close()
+		concepts := map[string]string{}
+		if err := json.NewDecoder(jsonFile).Decode(&concepts); err != nil {
+			panic(fmt.Sprint(file, ": ", err))
+		}
+		for concept, icd10Code := range concepts {
+			mapping[strings.TrimSpace(concept)] = normalizeICDCode(CodeSystemICD10, icd10Code)
+		}
+		return mapping
+	}
+	fmt.Println("Parsing SNOMED CT to ICD10 mapping from an RF2 extended map.")
+	rank := map[string][2]int{} // map group and priority of the rule of each concept in the mapping
+	err := readCSVTable(file, []string{"referencedComponentId", "mapTarget", "mapGroup", "mapPriority", "active"},
+		func(values []string) {
+			concept, target := values[0], values[1]
+			if concept == "" || target == "" || values[4] == "0" {
+				return
+			}
+			group, _ := strconv.Atoi(values[2])
+			priority, _ := strconv.Atoi(values[3])
+			if r, ok := rank[concept]; ok && (r[0] < group || (r[0] == group && r[1] <= priority)) {
+				return
+			}
+			rank[concept] = [2]int{group, priority}
+			mapping[concept] = normalizeICDCode(CodeSystemICD10, target)
+		})
+	if err != nil {
+		panic(err)
+	}
+	return mapping
+}
+
+// mergeToIcd10Mappings adds the SNOMED CT to ICD10 mapping to the ICD9 to ICD10 mapping, cf. parseSNOMEDToIcd10Mapping.
+func mergeToIcd10Mappings(icd9ToIcd10Map, snomedToIcd10Map map[string]string) map[string]string {
+	merged := make(map[string]string, len(icd9ToIcd10Map)+len(snomedToIcd10Map))
+	for code, icd10Code := range icd9ToIcd10Map {
+		merged[code] = icd10Code
+	}
+	for concept, icd10Code := range snomedToIcd10Map {
+		merged[concept] = icd10Code
+	}
+	return merged
+}
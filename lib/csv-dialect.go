@@ -0,0 +1,139 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"io"
+	"unicode/utf8"
+)
+
+// Detecting the dialect of csv input files. Exports of European hospitals are often separated by semicolons, as the
+// comma is their decimal separator, and are written by spreadsheet tools with a UTF-8 byte order mark, or in the
+// Windows-1252 encoding rather than in UTF-8. The separator is detected from the first line of a file: the most frequent
+// of comma, semicolon, and tab outside of quoted fields. A byte order mark is skipped, and a file that is not valid UTF-8
+// is decoded as Windows-1252.
+
+// csvDetectionSize is the nr of bytes at the start of a file that are used to detect its dialect.
+const csvDetectionSize = 64 * 1024
+
+// csvSeparators are the separators that are detected, in order of preference if equally frequent.
+var csvSeparators = []rune{',', ';', '\t'}
+
+// windows1252 maps the bytes 0x80-0x9F of Windows-1252 onto unicode, the other bytes are the same as in ISO-8859-1.
+var windows1252 = [32]rune{
+	'€', utf8.RuneError, '‚', 'ƒ', '„', '…', '†', '‡', 'ˆ', '‰', 'Š', '‹', 'Œ', utf8.RuneError, 'Ž', utf8.RuneError,
+	utf8.RuneError, '‘', '’', '“', '”', '•', '–', '—', '˜', '™', 'š', '›', 'œ', utf8.RuneError, 'ž', 'Ÿ',
+}
+
+// windows1252Reader decodes a Windows-1252 encoded input into UTF-8.
+type windows1252Reader struct {
+	input   *bufio.Reader
+	pending []byte // UTF-8 encoding of a decoded character that did not fit in the previous read
+}
+
+func (reader *windows1252Reader) Read(p []byte) (int, error) {
+	n := copy(p, reader.pending)
+	reader.pending = reader.pending[n:]
+	for n < len(p) {
+		b, err := reader.input.ReadByte()
+		if err != nil {
+			return n, err
+		}
+		r := rune(b)
+		if b >= 0x80 && b < 0xA0 {
+			r = windows1252[b-0x80]
+		}
+		var buf [utf8.UTFMax]byte
+		size := utf8.EncodeRune(buf[:], r)
+		copied := copy(p[n:], buf[:size])
+		reader.pending = append(reader.pending, buf[copied:size]...)
+		n += copied
+	}
+	return n, nil
+}
+
+// detectCSVSeparator returns the most frequent separator outside of quoted fields in the first line of a file, a comma
+// if there is none.
+func detectCSVSeparator(start []byte) rune {
+	counts := map[rune]int{}
+	quoted := false
+	for _, r := range string(start) {
+		if r == '"' {
+			quoted = !quoted
+		} else if r == '\n' && !quoted {
+			break
+		} else if !quoted {
+			counts[r]++
+		}
+	}
+	separator := csvSeparators[0]
+	for _, r := range csvSeparators[1:] {
+		if counts[r] > counts[separator] {
+			separator = r
+		}
+	}
+	return separator
+}
+
+// validUTF8 checks if the start of a file is valid UTF-8. Unless the start is the complete file, only its complete lines
+// are checked, or else all but a character that is cut off at its end.
+func validUTF8(start []byte, complete bool) bool {
+	if !complete {
+		if i := bytes.LastIndexByte(start, '\n'); i != -1 {
+			start = start[:i]
+		} else {
+			for i := 1; i < utf8.UTFMax && i <= len(start); i++ {
+				if utf8.RuneStart(start[len(start)-i]) {
+					if !utf8.FullRune(start[len(start)-i:]) {
+						start = start[:len(start)-i]
+					}
+					break
+				}
+			}
+		}
+	}
+	return utf8.Valid(start)
+}
+
+// newCSVReader returns a csv reader for an input file, with the separator and encoding detected from the start of the
+// file, cf. the dialects above.
+func newCSVReader(input io.Reader) *csv.Reader {
+	buffered := bufio.NewReaderSize(input, csvDetectionSize)
+	start, err := buffered.Peek(csvDetectionSize)
+	complete := err != nil // the whole file fits in the detection buffer
+	bom := bytes.HasPrefix(start, []byte("\xEF\xBB\xBF"))
+	if bom {
+		start = start[3:]
+	}
+	separator := detectCSVSeparator(start)
+	utf8Input := validUTF8(start, complete)
+	if bom {
+		_, _ = buffered.Discard(3)
+	}
+	var decoded io.Reader = buffered
+	if !utf8Input {
+		decoded = &windows1252Reader{input: buffered}
+	}
+	reader := csv.NewReader(decoded)
+	reader.Comma = separator
+	return reader
+}
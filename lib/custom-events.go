@@ -0,0 +1,133 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Custom events are synthetic diagnosis codes for events that are not part of the vocabulary, e.g. treatments. They are
+// added to the analysis maps after the codes of the vocabulary, and patients get a diagnosis for a custom event on the
+// date found in the treatment file. By default, the custom events are the treatments of the bladder cancer study: "C98"
+// for radical cystectomy, "C99" for MVAC chemotherapy, and "C100" for intravesical therapy, with the columns of the
+// treatment schema. A custom events file, or the treatments of the treatment schema, replace these, so that other
+// studies can inject their own events. A code may be read from several columns, e.g. when a row holds the dates of
+// several cycles of the same therapy.
+
+// CustomEvent describes a synthetic diagnosis code and the column of the treatment file that holds its date. Columns are
+// counted from 0. The date format is a Go time layout, the date format of the treatment schema if empty.
+type CustomEvent struct {
+	Code        string `json:"code"`                 // synthetic diagnosis code, must not occur in the vocabulary
+	Description string `json:"description"`          // medical name of the event
+	Column      int    `json:"column"`               // column of the treatment file with the date of the event
+	DateFormat  string `json:"dateFormat,omitempty"` // layout of the dates in the column
+}
+
+// DefaultCustomEvents returns the custom events of the bladder cancer study, with the columns of the treatment schema,
+// nil for the default TriNetX layout.
+func DefaultCustomEvents(schema *TreatmentSchema) []*CustomEvent {
+	if schema == nil {
+		schema = DefaultTreatmentSchema()
+	}
+	return []*CustomEvent{
+		{Code: "C98", Description: "Radical cystectomy (bladder cancer)", Column: schema.RadicalCystectomy},
+		{Code: "C99", Description: "MVAC Chemotherapy (bladder cancer)", Column: schema.MVAC},
+		{Code: "C100", Description: "Intravesical therapy (bladder cancer)", Column: schema.IntravesicalTherapy},
+	}
+}
+
+// LoadCustomEvents loads custom events from a json file with a list of events. An empty list disables custom events. The
+// events are validated.
+func LoadCustomEvents(path string) ([]*CustomEvent, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	events := []*CustomEvent{}
+	if err := json.Unmarshal(data, &events); err != nil {
+		return nil, fmt.Errorf("custom events %s: %v", path, err)
+	}
+	if err := validateCustomEvents(events); err != nil {
+		return nil, fmt.Errorf("custom events %s: %v", path, err)
+	}
+	return events, nil
+}
+
+// withCustomEvents loads custom events from a json file into a treatment schema, nil for the default TriNetX layout. The
+// columns of the events are validated against the schema.
+func withCustomEvents(schema *TreatmentSchema, path string) (*TreatmentSchema, error) {
+	events, err := LoadCustomEvents(path)
+	if err != nil {
+		return nil, err
+	}
+	if schema == nil {
+		schema = DefaultTreatmentSchema()
+	}
+	schema.Events = events
+	if err := schema.Validate(); err != nil {
+		return nil, fmt.Errorf("custom events %s: %v", path, err)
+	}
+	return schema, nil
+}
+
+// validateCustomEvents checks that the custom events have a code and description, that a code that is read from
+// several columns always has the same description, and that the date formats describe a year, month and day. The
+// columns are checked by the treatment schema.
+func validateCustomEvents(events []*CustomEvent) error {
+	descriptions := map[string]string{}
+	for i, event := range events {
+		if event == nil || event.Code == "" {
+			return fmt.Errorf("custom event %d has no code", i)
+		}
+		if event.Description == "" {
+			return fmt.Errorf("custom event %s has no description", event.Code)
+		}
+		if description, ok := descriptions[event.Code]; ok && description != event.Description {
+			return fmt.Errorf("custom event code %s is used with different descriptions", event.Code)
+		}
+		descriptions[event.Code] = event.Description
+		if event.DateFormat != "" {
+			if err := checkDateFormat(event.DateFormat, true); err != nil {
+				return fmt.Errorf("custom event %s: %v", event.Code, err)
+			}
+		}
+	}
+	return nil
+}
+
+// addCustomEventCodes adds the codes of the custom events to analysis maps, starting from the given analysis ID. The add
+// function is called with the code, the medical name, and the analysis ID of each event. The events get their analysis
+// IDs in the order of their codes, cf. sortedKeys. The events are nil for the default bladder cancer events. It returns
+// the next free analysis ID.
+func addCustomEventCodes(events []*CustomEvent, ctr int, add func(code, name string, id int)) int {
+	if events == nil {
+		events = DefaultCustomEvents(nil)
+	}
+	names := map[string]string{}
+	for _, event := range events {
+		names[event.Code] = event.Description
+	}
+	for _, code := range sortedKeys(names) {
+		add(code, names[code], ctr)
+		ctr++
+	}
+	return ctr
+}
@@ -0,0 +1,293 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Custom vocabularies. Internal code systems of hospitals, or groupings of diagnosis codes into phenotypes such as
+// phecodes, can be used as the vocabulary of an analysis without writing Go code. A custom vocabulary is a json or csv
+// file that lists its codes with their parent, description, and optionally their level in the hierarchy, so that they
+// can be grouped on a level, as for ICD-10. Diagnoses are coded in the custom code system, or in ICD-10, in which case
+// they are mapped onto the custom codes by the ICD-10 codes listed with each custom code.
+
+// CustomCode is a code of a custom vocabulary.
+type CustomCode struct {
+	Code        string   `json:"code"`
+	Parent      string   `json:"parent,omitempty"` // code of the parent, empty for the roots of the hierarchy
+	Description string   `json:"description"`
+	Level       *int     `json:"level,omitempty"` // level in the hierarchy, nil for one deeper than the parent, 0 for roots
+	ICD10       []string `json:"icd10,omitempty"` // ICD-10 codes mapped onto this code, which include their subcodes
+}
+
+// CustomVocabulary is a hierarchy of custom codes.
+type CustomVocabulary struct {
+	Codes            []*CustomCode `json:"codes"`
+	EventsOfInterest []string      `json:"eventsOfInterest,omitempty"` // codes of the events of interest and their subcodes
+	Excluded         []string      `json:"excluded,omitempty"`         // codes excluded from analysis with their subcodes
+	levels           map[string]int
+}
+
+// customVocabularyColumns are the columns of a custom vocabulary in csv format.
+var customVocabularyColumns = []string{"code", "parent", "description", "level", "icd10"}
+
+// isCustomVocabulary checks if a file is a custom vocabulary: a json file, or a csv file with code, parent, and
+// description columns.
+func isCustomVocabulary(file string) bool {
+	if inputExt(file) == ".json" {
+		return true
+	}
+	f, err := openInput(file)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	header, err := newCSVReader(f).Read()
+	if err != nil {
+		return false
+	}
+	columns := map[string]bool{}
+	for _, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = true
+	}
+	return columns["code"] && columns["parent"] && columns["description"]
+}
+
+// LoadCustomVocabulary loads a custom vocabulary from a json file with a CustomVocabulary object, or from a csv file
+// with code, parent, description, and optionally level and icd10 columns. The ICD-10 codes in the icd10 column are
+// separated by spaces or |. It returns an error if the file cannot be read or the vocabulary is invalid.
+func LoadCustomVocabulary(file string) (*CustomVocabulary, error) {
+	vocabulary := &CustomVocabulary{}
+	if inputExt(file) == ".json" {
+		jsonFile, err := openInput(file)
+		if err != nil {
+			return nil, err
+		}
+		defer jsonFile.Close()
+		if err := json.NewDecoder(jsonFile).Decode(vocabulary); err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+	} else {
+		var rowErr error
+		err := readCSVTable(file, customVocabularyColumns, func(values []string) {
+			code := &CustomCode{Code: strings.TrimSpace(values[0]), Parent: strings.TrimSpace(values[1]),
+				Description: strings.TrimSpace(values[2])}
+			if level := strings.TrimSpace(values[3]); level != "" {
+				l, err := strconv.Atoi(level)
+				if err != nil && rowErr == nil {
+					rowErr = fmt.Errorf("code %s: invalid level %q", code.Code, level)
+				}
+				code.Level = &l
+			}
+			code.ICD10 = strings.FieldsFunc(values[4], func(r rune) bool { return r == ' ' || r == '|' })
+			vocabulary.Codes = append(vocabulary.Codes, code)
+		})
+		if err == nil {
+			err = rowErr
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := vocabulary.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	return vocabulary, nil
+}
+
+// Validate checks that the codes of a custom vocabulary are unique and have a description, that their parents are
+// codes of the vocabulary without cycles, and that their levels are deeper than those of their parents, up to 6 levels.
+// It computes the levels of the codes.
+func (vocabulary *CustomVocabulary) Validate() error {
+	if len(vocabulary.Codes) == 0 {
+		return errors.New("no codes in custom vocabulary")
+	}
+	codes := map[string]*CustomCode{}
+	for _, code := range vocabulary.Codes {
+		if code.Code == "" || code.Description == "" {
+			return fmt.Errorf("code %q without code or description", code.Code)
+		}
+		if _, ok := codes[code.Code]; ok {
+			return fmt.Errorf("code %s occurs more than once", code.Code)
+		}
+		codes[code.Code] = code
+	}
+	vocabulary.levels = map[string]int{}
+	var level func(code *CustomCode, depth int) (int, error)
+	level = func(code *CustomCode, depth int) (int, error) {
+		if l, ok := vocabulary.levels[code.Code]; ok {
+			return l, nil
+		}
+		if depth > len(codes) {
+			return 0, fmt.Errorf("code %s is its own ancestor", code.Code)
+		}
+		l := 0
+		if code.Parent != "" {
+			parent, ok := codes[code.Parent]
+			if !ok {
+				return 0, fmt.Errorf("code %s: unknown parent %s", code.Code, code.Parent)
+			}
+			parentLevel, err := level(parent, depth+1)
+			if err != nil {
+				return 0, err
+			}
+			l = parentLevel + 1
+			if code.Level != nil && *code.Level <= parentLevel {
+				return 0, fmt.Errorf("code %s: level %d is not deeper than the level of its parent", code.Code, *code.Level)
+			}
+		}
+		if code.Level != nil {
+			l = *code.Level
+		}
+		if l < 0 || l > 6 {
+			return 0, fmt.Errorf("code %s: level %d is not in [0-6]", code.Code, l)
+		}
+		vocabulary.levels[code.Code] = l
+		return l, nil
+	}
+	for _, code := range vocabulary.Codes {
+		if _, err := level(code, 0); err != nil {
+			return err
+		}
+	}
+	for _, code := range append(append([]string{}, vocabulary.EventsOfInterest...), vocabulary.Excluded...) {
+		if _, ok := codes[code]; !ok {
+			return fmt.Errorf("unknown code %s in events of interest or excluded codes", code)
+		}
+	}
+	return nil
+}
+
+// customAnalysisMaps maps custom codes onto analysis DIDs. Its Icd10Map describes custom codes rather than ICD-10
+// codes.
+type customAnalysisMaps struct {
+	icd10AnalysisMapsFromXML
+	ICD10Map         map[string]string // maps ICD-10 codes onto custom codes
+	EventsOfInterest map[string]bool   // custom codes of the events of interest
+}
+
+func (analysisMap customAnalysisMaps) codeSystem() string {
+	return CodeSystemCustom
+}
+
+// fromICD10 maps an ICD-10 code onto the custom code of its longest listed prefix, e.g. C67.9 onto the code for C67.
+func (analysisMap customAnalysisMaps) fromICD10(icd10Code string) (string, bool) {
+	for n := len(icd10Code); n > 0; n-- {
+		if code, ok := analysisMap.ICD10Map[icd10Code[:n]]; ok {
+			return code, true
+		}
+	}
+	return "", false
+}
+
+func (analysisMap customAnalysisMaps) isEventOfInterest(code string) bool {
+	return analysisMap.EventsOfInterest[code]
+}
+
+// initializeCustomNameMap returns a map custom code -> entry (description, descriptions of the ancestors, level) for a
+// validated custom vocabulary, and the set of excluded codes. The ancestors are listed by their level. Levels without
+// ancestor are described by the nearest ancestor above them, or by the root for the levels above the root, so that
+// codes are grouped on that ancestor.
+func initializeCustomNameMap(vocabulary *CustomVocabulary) (map[string]Icd10Entry, map[string]bool) {
+	codes := map[string]*CustomCode{}
+	for _, code := range vocabulary.Codes {
+		codes[code.Code] = code
+	}
+	excludedRoots := map[string]bool{}
+	for _, code := range vocabulary.Excluded {
+		excludedRoots[code] = true
+	}
+	customMap := map[string]Icd10Entry{}
+	excluded := map[string]bool{}
+	for _, code := range vocabulary.Codes {
+		level := vocabulary.levels[code.Code]
+		entry := Icd10Entry{Name: code.Description, Categories: [6]string{"NONE", "NONE", "NONE", "NONE", "NONE", "NONE"},
+			Level: level}
+		isExcluded := excludedRoots[code.Code]
+		root := code.Description
+		for ancestor := codes[code.Parent]; ancestor != nil; ancestor = codes[ancestor.Parent] {
+			isExcluded = isExcluded || excludedRoots[ancestor.Code]
+			root = ancestor.Description
+			for l := vocabulary.levels[ancestor.Code]; l < level && l < len(entry.Categories); l++ {
+				if entry.Categories[l] == "NONE" {
+					entry.Categories[l] = ancestor.Description
+				}
+			}
+		}
+		for l := 0; l < level && l < len(entry.Categories); l++ {
+			if entry.Categories[l] == "NONE" {
+				entry.Categories[l] = root // levels above the root of the hierarchy of the code
+			}
+		}
+		if isExcluded {
+			excluded[code.Code] = true
+			continue
+		}
+		customMap[code.Code] = entry
+	}
+	return customMap, excluded
+}
+
+// initializeCustomAnalysisMaps returns a map custom code -> internal analysis DID and a map analysis DID -> medical
+// Name for a custom vocabulary file and a requested hierarchy Level. The custom codes of the events of interest are the
+// listed ones and their subcodes, and the codes onto which ICD-10 codes of events of interest are mapped. The custom
+// events are added after the codes, nil for the default bladder cancer events.
+func initializeCustomAnalysisMaps(file string, level int, events []*CustomEvent) customAnalysisMaps {
+	vocabulary, err := LoadCustomVocabulary(file)
+	if err != nil {
+		panic(err)
+	}
+	customMap, excluded := initializeCustomNameMap(vocabulary)
+	analysisIdMap, analysisMap, ctr, _ := initializeIcd10AnalysisMaps(customMap, level, events)
+	icd10Map := map[string]string{}
+	eventsOfInterest := map[string]bool{}
+	for _, code := range vocabulary.EventsOfInterest {
+		eventsOfInterest[code] = true
+	}
+	for _, code := range vocabulary.Codes {
+		for _, icd10Code := range code.ICD10 {
+			icd10Code = normalizeICDCode(CodeSystemICD10, icd10Code)
+			icd10Map[icd10Code] = code.Code
+			if TriNetXEventOfInterest(icd10Code) {
+				eventsOfInterest[code.Code] = true
+			}
+		}
+	}
+	codes := map[string]*CustomCode{}
+	for _, code := range vocabulary.Codes {
+		codes[code.Code] = code
+	}
+	for _, code := range vocabulary.Codes {
+		for ancestor := codes[code.Parent]; ancestor != nil; ancestor = codes[ancestor.Parent] {
+			if eventsOfInterest[ancestor.Code] && !excluded[code.Code] {
+				eventsOfInterest[code.Code] = true
+			}
+		}
+	}
+	fmt.Println("Parsed ", len(customMap)+len(excluded), " custom codes, and ", len(icd10Map),
+		" ICD-10 codes mapped onto them.")
+	return customAnalysisMaps{icd10AnalysisMapsFromXML: icd10AnalysisMapsFromXML{DIDMap: analysisIdMap,
+		Icd10Map: analysisMap, NofDiagnosisCodes: ctr, Excluded: excluded}, ICD10Map: icd10Map,
+		EventsOfInterest: eventsOfInterest}
+}
@@ -0,0 +1,114 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/imec-int/ptra/lib/utils"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// Export of the merged trajectory network as Cytoscape.js elements, for interactive exploration in the browser,
+// e.g. with cytoscape({container: ..., elements: data.elements}). As in the merged GML graph, there is an edge per
+// transition of each trajectory. With clustering, the cluster membership is part of the data of the elements: for each
+// granularity g, an edge has the ID of the cluster of its trajectory in cluster<g>, and a node has the IDs of the
+// clusters of the trajectories through it in cluster<g>, cf. ResultsClustering.
+
+// CytoscapeElements are the elements of a Cytoscape.js graph.
+type CytoscapeElements struct {
+	Nodes []*CytoscapeElement `json:"nodes"`
+	Edges []*CytoscapeElement `json:"edges"`
+}
+
+// CytoscapeElement is a node or an edge of a Cytoscape.js graph.
+type CytoscapeElement struct {
+	Data map[string]interface{} `json:"data"`
+}
+
+// newCytoscapeElements returns the merged trajectory network of an experiment as Cytoscape.js elements.
+func newCytoscapeElements(exp *Experiment) *CytoscapeElements {
+	elements := &CytoscapeElements{Nodes: []*CytoscapeElement{}, Edges: []*CytoscapeElement{}}
+	clusters := map[string]map[int]int{} // maps cluster<g> onto a map trajectory ID -> cluster ID
+	for _, clustering := range exp.Clusterings {
+		key := fmt.Sprint("cluster", clustering.Granularity)
+		clusters[key] = map[int]int{}
+		for _, cluster := range clustering.Clusters {
+			for _, tid := range cluster.Trajectories {
+				clusters[key][tid] = cluster.ID
+			}
+		}
+	}
+	nodes := map[int]*CytoscapeElement{}
+	for _, t := range exp.Trajectories {
+		for idx, did := range t.Diagnoses {
+			node, ok := nodes[did]
+			if !ok {
+				entry := exp.Icd10Map[did]
+				node = &CytoscapeElement{Data: map[string]interface{}{"id": strconv.Itoa(did), "label": entry.Name,
+					"code": exp.IdMap[did], "level": entry.Level}}
+				for key := range clusters {
+					node.Data[key] = []int{}
+				}
+				nodes[did] = node
+				elements.Nodes = append(elements.Nodes, node)
+			}
+			for key, cluster := range clusters {
+				if ids := node.Data[key].([]int); !utils.MemberInt(cluster[t.ID], ids) {
+					node.Data[key] = append(ids, cluster[t.ID])
+				}
+			}
+			if idx == 0 {
+				continue
+			}
+			source := t.Diagnoses[idx-1]
+			edge := &CytoscapeElement{Data: map[string]interface{}{"id": fmt.Sprintf("t%d.e%d", t.ID, idx-1),
+				"source": strconv.Itoa(source), "target": strconv.Itoa(did), "tid": t.ID, "thash": t.Hash,
+				"tidx": idx - 1, "patients": t.PatientNumbers[idx-1], "rr": exp.DxDRR[source][did]}}
+			for key, cluster := range clusters {
+				edge.Data[key] = cluster[t.ID]
+			}
+			elements.Edges = append(elements.Edges, edge)
+		}
+	}
+	return elements
+}
+
+// WriteCytoscapeElements writes the merged trajectory network of an experiment as a Cytoscape.js json file with an
+// elements object to the given output path, and returns the file name.
+func WriteCytoscapeElements(exp *Experiment, path string) string {
+	fileName := filepath.Join(path, fmt.Sprintf("%s-trajectories-cytoscape.json", exp.Name))
+	file, err := os.Create(fileName)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(map[string]interface{}{"elements": newCytoscapeElements(exp)}); err != nil {
+		panic(err)
+	}
+	return fileName
+}
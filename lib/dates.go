@@ -0,0 +1,104 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"math"
+	"time"
+)
+
+// Date arithmetic. Ages and time windows between diagnoses are computed on calendar dates with day precision, rather
+// than on fractional years, so that events close to a year boundary are not misclassified. Patients only have a known
+// year of birth, so their birthday is taken to be the middle of that year.
+
+// birthMonth and birthDay give the assumed birthday of a patient of which only the year of birth is known. July 1 is
+// about the middle of the year, which halves the largest error of an age compared to January 1 or December 31: an age
+// at a date is off by at most a year, and is one year too high for the patients born after July 1 that are diagnosed
+// between July 1 and their actual birthday, and one year too low for the patients born before July 1 that are
+// diagnosed between their actual birthday and July 1. The age groups of the cohorts, the age at a diagnosis or
+// transition, and the checks of diagnoses before birth all use this birthday.
+const (
+	birthMonth = 7
+	birthDay   = 1
+)
+
+// BirthDate returns the assumed date of birth of a patient.
+func BirthDate(p *Patient) DiagnosisDate {
+	return DiagnosisDate{Year: p.YOB, Month: birthMonth, Day: birthDay}
+}
+
+// AgeAt returns the age of a patient in completed years at the given date.
+func AgeAt(p *Patient, d DiagnosisDate) int {
+	return yearsBetween(BirthDate(p), d)
+}
+
+// yearsBetween returns the number of completed years from date d1 to date d2.
+func yearsBetween(d1, d2 DiagnosisDate) int {
+	years := d2.Year - d1.Year
+	if d2.Month < d1.Month || (d2.Month == d1.Month && d2.Day < d1.Day) {
+		years--
+	}
+	return years
+}
+
+// DaysBetween returns the number of days from date d1 to date d2.
+func DaysBetween(d1, d2 DiagnosisDate) int {
+	return int(dateToTime(d2).Sub(dateToTime(d1)).Hours() / 24)
+}
+
+// yearsLater adds a possibly fractional number of years to a date. Whole years are added on the calendar, the fraction is
+// added as a number of days of the year that follows.
+func yearsLater(d DiagnosisDate, years float64) time.Time {
+	whole := math.Floor(years)
+	t := dateToTime(d).AddDate(int(whole), 0, 0)
+	if fraction := years - whole; fraction > 0 {
+		daysInYear := t.AddDate(1, 0, 0).Sub(t).Hours() / 24
+		t = t.AddDate(0, 0, int(math.Round(fraction*daysInYear)))
+	}
+	return t
+}
+
+// withinYears checks if date d2 falls between minYears and maxYears after date d1, bounds included. Use a dateWindow
+// to check several dates against the same date d1.
+func withinYears(d1, d2 DiagnosisDate, minYears, maxYears float64) bool {
+	return newDateWindow(d1, minYears, maxYears).contains(d2)
+}
+
+// dateWindow is the window of dates between minYears and maxYears after a date, bounds included. Computing the bounds
+// on the calendar is costly compared to comparing dates, so they are computed once per date rather than for each date
+// that is checked against it, e.g. when counting the diagnosis pairs of the patients.
+type dateWindow struct {
+	from, to DiagnosisDate
+}
+
+// newDateWindow returns the window of dates between minYears and maxYears after date d.
+func newDateWindow(d DiagnosisDate, minYears, maxYears float64) dateWindow {
+	return dateWindow{from: timeToDate(yearsLater(d, minYears)), to: timeToDate(yearsLater(d, maxYears))}
+}
+
+// contains checks if date d falls within the window.
+func (w dateWindow) contains(d DiagnosisDate) bool {
+	return !DiagnosisDateSmallerThan(d, w.from) && !DiagnosisDateSmallerThan(w.to, d)
+}
+
+// timeToDate converts a time value to a diagnosis date.
+func timeToDate(t time.Time) DiagnosisDate {
+	year, month, day := t.Date()
+	return DiagnosisDate{Year: year, Month: int(month), Day: day}
+}
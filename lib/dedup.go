@@ -0,0 +1,166 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Detection of duplicate records. Duplicated exports lead to patients that occur twice in the patient file (same
+// PIDString) and to diagnosis rows that occur twice (same patient, code and date). Such duplicates inflate the counts
+// used for calculating RR scores. Duplicates are always counted, and depending on the policy they are removed while
+// parsing. By default, they are only counted. For duplicate patients, the first row is kept. In the streaming mode,
+// duplicate diagnosis rows are not tracked, as remembering all rows does not fit in memory for the largest extracts.
+// Their diagnoses are then only removed by the compaction of the diagnoses of each patient, which keeps a single
+// diagnosis per code and date.
+//
+// Duplicate patients are handled by a strategy: keep the first occurrence, merge the occurrences into a single patient,
+// fail, or keep all occurrences as separate patients. Without an explicit strategy, the first occurrence is kept if
+// the policy removes duplicate patients, and all occurrences are kept otherwise. A strategy that contradicts an
+// explicit policy is rejected. Occurrences with a different sex, year of birth or date of death are counted as
+// conflicts.
+
+// Policies for removing duplicate records.
+const (
+	DedupAll       = "all"       // remove duplicate patients and duplicate diagnoses
+	DedupPatients  = "patients"  // only remove duplicate patients
+	DedupDiagnoses = "diagnoses" // only remove duplicate diagnoses
+	DedupNone      = "none"      // only count duplicates
+)
+
+// Strategies for handling duplicate patients.
+const (
+	DuplicateFirst = "first" // keep the first occurrence of a patient
+	DuplicateMerge = "merge" // merge all occurrences into the first one, so their diagnoses belong to the same patient
+	DuplicateFail  = "fail"  // stop on the first duplicate patient
+	DuplicateKeep  = "keep"  // keep all occurrences as separate patients, the diagnoses belong to the last one
+)
+
+// DuplicateReport counts the duplicate records found in the input. It is reported in the run manifest.
+type DuplicateReport struct {
+	Policy    string `json:"policy"`              // which duplicates are removed, cf. the Dedup constants
+	Patients  int    `json:"patients"`            // nr of patient rows with a PIDString that occurred before
+	Diagnoses int    `json:"diagnoses"`           // nr of diagnosis rows with a patient, code and date that occurred before
+	Streaming bool   `json:"streaming,omitempty"` // duplicate diagnosis rows are not tracked, cf. diagnosisLoader
+	// strategy for duplicate patients, cf. the Duplicate constants, derived from the policy if empty
+	PatientStrategy string `json:"patientStrategy,omitempty"`
+	Conflicts       int    `json:"conflicts,omitempty"` // nr of duplicate patient rows with conflicting demographics
+}
+
+// NewDuplicateReport creates an empty report for the given policy, which defaults to only counting duplicates.
+func NewDuplicateReport(policy string) *DuplicateReport {
+	switch policy {
+	case "":
+		policy = DedupNone
+	case DedupAll, DedupPatients, DedupDiagnoses, DedupNone:
+	default:
+		panic(fmt.Sprint("Unknown deduplication policy: ", policy))
+	}
+	return &DuplicateReport{Policy: policy}
+}
+
+// SetPatientStrategy sets the strategy for duplicate patients, none if empty.
+func (report *DuplicateReport) SetPatientStrategy(strategy string) {
+	switch strategy {
+	case "", DuplicateFirst, DuplicateMerge, DuplicateFail, DuplicateKeep:
+		report.PatientStrategy = strategy
+	default:
+		panic(fmt.Sprint("Unknown duplicate patient strategy: ", strategy))
+	}
+}
+
+// validateDuplicateOptions checks the policy and the strategy for duplicate patients. A strategy that removes
+// duplicate patients (first or merge) conflicts with a policy that keeps them (diagnoses or none), and keeping all
+// occurrences conflicts with a policy that removes them (all or patients). An empty policy or strategy never conflicts.
+func validateDuplicateOptions(policy, strategy string) error {
+	switch policy {
+	case "", DedupAll, DedupPatients, DedupDiagnoses, DedupNone:
+	default:
+		return fmt.Errorf("unknown deduplication policy: %s", policy)
+	}
+	switch strategy {
+	case "", DuplicateFail:
+	case DuplicateFirst, DuplicateMerge:
+		if policy == DedupDiagnoses || policy == DedupNone {
+			return fmt.Errorf("the duplicate patient strategy %s conflicts with the deduplication policy %s, "+
+				"which keeps duplicate patients", strategy, policy)
+		}
+	case DuplicateKeep:
+		if policy == DedupAll || policy == DedupPatients {
+			return fmt.Errorf("the duplicate patient strategy %s conflicts with the deduplication policy %s, "+
+				"which removes duplicate patients", strategy, policy)
+		}
+	default:
+		return fmt.Errorf("unknown duplicate patient strategy: %s", strategy)
+	}
+	return nil
+}
+
+// patientStrategy returns the strategy for duplicate patients.
+func (report *DuplicateReport) patientStrategy() string {
+	if report.PatientStrategy != "" {
+		return report.PatientStrategy
+	}
+	if report.dedupPatients() {
+		return DuplicateFirst
+	}
+	return DuplicateKeep
+}
+
+// dedupPatients returns true if duplicate patients should be removed.
+func (report *DuplicateReport) dedupPatients() bool {
+	return report.Policy == DedupAll || report.Policy == DedupPatients
+}
+
+// dedupDiagnoses returns true if duplicate diagnoses should be removed.
+func (report *DuplicateReport) dedupDiagnoses() bool {
+	return report.Policy == DedupAll || report.Policy == DedupDiagnoses
+}
+
+// diagnosisRowKey identifies a diagnosis row for detecting duplicates.
+type diagnosisRowKey struct {
+	pid              int
+	codeSystem, code string
+	date             DiagnosisDate
+}
+
+// newDiagnosisRowKey creates a key for a diagnosis row. The strings are cloned, so that the key does not keep the
+// complete row alive.
+func newDiagnosisRowKey(pid int, codeSystem, code string, date DiagnosisDate) diagnosisRowKey {
+	return diagnosisRowKey{pid: pid, codeSystem: strings.Clone(codeSystem), code: strings.Clone(code), date: date}
+}
+
+// Log prints the nr of duplicates to standard output.
+func (report *DuplicateReport) Log() {
+	removed := func(b bool) string {
+		if b {
+			return "removed"
+		}
+		return "kept"
+	}
+	patients := fmt.Sprint(report.Patients, " duplicate patients (", report.patientStrategy(), ", ", report.Conflicts,
+		" with conflicting demographics)")
+	if report.Streaming {
+		fmt.Println("Found ", patients, ", duplicate diagnoses are not tracked in streaming mode.")
+		return
+	}
+	fmt.Println("Found ", patients, " and ", report.Diagnoses, " duplicate diagnoses (",
+		removed(report.dedupDiagnoses()), ").")
+}
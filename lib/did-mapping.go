@@ -0,0 +1,140 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"github.com/imec-int/ptra/lib/utils"
+	"io/fs"
+	"os"
+	"strconv"
+)
+
+// Stable analysis DIDs. Analysis DIDs are handed out in the order of the codes of the vocabulary, so that they change
+// when a new release of the vocabulary adds or retires codes, or when other events are added. Saved RR matrices,
+// cluster files, and downstream scripts that refer to DIDs are then no longer comparable across runs. A DID mapping
+// file persists the DIDs of a run as a tab separated file with did, code, and name columns. A later run reuses the DID
+// of each name in the mapping, hands out new DIDs after the DIDs of the mapping, and keeps the DIDs of the names that
+// no longer occur, so that a DID never changes meaning. The mapping file is updated with the new DIDs at each run.
+
+// didMappingEntry is a row of a DID mapping file.
+type didMappingEntry struct {
+	did        int
+	code, name string
+}
+
+// readDIDMapping reads a DID mapping file. It returns no entries if the file does not exist.
+func readDIDMapping(file string) []didMappingEntry {
+	var entries []didMappingEntry
+	dids := map[int]bool{}
+	err := readCSVTable(file, []string{"did", "code", "name"}, func(values []string) {
+		did, err := strconv.Atoi(values[0])
+		if err != nil || did < 0 || dids[did] {
+			panic(fmt.Sprint(file, ": invalid or duplicate DID ", values[0]))
+		}
+		dids[did] = true
+		entries = append(entries, didMappingEntry{did: did, code: values[1], name: values[2]})
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		panic(err)
+	}
+	return entries
+}
+
+// applyDIDMapping renumbers the analysis DIDs of the given analysis maps onto the DIDs of a mapping file, by the names
+// of the analysis DIDs. Names that are not in the mapping get new DIDs after those of the mapping, and the DIDs of the
+// mapping whose names no longer occur are kept as diagnoses without codes. It returns the new number of diagnosis codes
+// and the new map analysis DID -> code.
+func applyDIDMapping(file string, analysisMaps AnalysisMaps, icd10Map map[int]Icd10Entry,
+	nofDiagnosisCodes int) (int, map[int]string) {
+	entries := readDIDMapping(file)
+	if entries == nil {
+		fmt.Println("Creating DID mapping file ", file)
+		return nofDiagnosisCodes, analysisMaps.getIdMap()
+	}
+	nameDIDs := map[string]int{}
+	next := 0
+	for _, entry := range entries {
+		if _, ok := nameDIDs[entry.name]; !ok {
+			nameDIDs[entry.name] = entry.did
+		}
+		next = utils.MaxInt(next, entry.did+1)
+	}
+	dids := make([]int, nofDiagnosisCodes)
+	used := map[int]bool{}
+	for did := range dids {
+		if mapped, ok := nameDIDs[icd10Map[did].Name]; ok && !used[mapped] {
+			dids[did] = mapped
+		} else {
+			dids[did] = next
+			next++
+		}
+		used[dids[did]] = true
+	}
+	analysisMaps.remapDIDs(dids)
+	idMap := analysisMaps.getIdMap()
+	unused := 0
+	for _, entry := range entries {
+		if !used[entry.did] {
+			icd10Map[entry.did] = Icd10Entry{Name: entry.name}
+			idMap[entry.did] = entry.code
+			unused++
+		}
+	}
+	for did := 0; did < next; did++ {
+		if _, ok := icd10Map[did]; !ok {
+			icd10Map[did] = Icd10Entry{} // gap in the DIDs of the mapping file
+		}
+	}
+	fmt.Println("Mapped ", nofDiagnosisCodes, " analysis IDs onto the DIDs of ", file, ": ",
+		nofDiagnosisCodes-(len(entries)-unused), " new DIDs and ", unused, " DIDs that no longer occur.")
+	return next, idMap
+}
+
+// saveDIDMapping writes the analysis DIDs of an experiment to a DID mapping file.
+func saveDIDMapping(file string, icd10Map map[int]Icd10Entry, idMap map[int]string, nofDiagnosisCodes int) {
+	f, err := os.Create(file)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	writer := csv.NewWriter(f)
+	writer.Comma = '\t'
+	if err := writer.Write([]string{"did", "code", "name"}); err != nil {
+		panic(err)
+	}
+	for did := 0; did < nofDiagnosisCodes; did++ {
+		if err := writer.Write([]string{strconv.Itoa(did), idMap[did], icd10Map[did].Name}); err != nil {
+			panic(err)
+		}
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,242 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"github.com/exascience/pargo/parallel"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"strings"
+)
+
+// Differential trajectory analysis of two cohorts, e.g. the patients with muscle-invasive versus non-muscle-invasive
+// bladder cancer. The experiment is run on both cohorts, each with its own patient filters, and the trajectories found
+// in either cohort are joined on their hash, cf. TrajectoryHash. For each trajectory, the patients of both cohorts
+// that match the trajectory are counted, cf. matchPatientTrajectory, and the fractions of matching patients of the two
+// cohorts are compared with a two-sided Fisher's exact test. The p-values are adjusted for multiple testing with the
+// Benjamini-Hochberg procedure.
+
+// differentialFDR is the false discovery rate below which a trajectory is enriched in one of the cohorts.
+const differentialFDR = 0.05
+
+// differentialCohort is the result of the experiment on one of the cohorts of a differential analysis.
+type differentialCohort struct {
+	exp      *Experiment
+	patients *PatientMap
+	dids     map[string]int // maps the codes of the diagnoses to the analysis DIDs of the cohort
+}
+
+// DifferentialTrajectory compares the patients of two cohorts that match a trajectory.
+type DifferentialTrajectory struct {
+	Hash     string
+	Codes    []string // codes of the diagnoses of the trajectory
+	Names    []string // medical terms of the diagnoses of the trajectory
+	Found    [2]bool  // whether the trajectory is found in the experiment on each cohort
+	Patients [2]int   // nr of patients of each cohort that match the trajectory
+	Totals   [2]int   // nr of patients of each cohort
+	PValue   float64  // p-value of the two-sided Fisher's exact test
+	QValue   float64  // Benjamini-Hochberg adjusted p-value
+}
+
+// Ratio returns the ratio of the fraction of patients of the first cohort that match the trajectory to the fraction of
+// patients of the second cohort.
+func (t *DifferentialTrajectory) Ratio() float64 {
+	return (float64(t.Patients[0]) / float64(t.Totals[0])) / (float64(t.Patients[1]) / float64(t.Totals[1]))
+}
+
+// Difference returns the difference between the fraction of patients of the first cohort that match the trajectory and
+// the fraction of patients of the second cohort.
+func (t *DifferentialTrajectory) Difference() float64 {
+	return float64(t.Patients[0])/float64(t.Totals[0]) - float64(t.Patients[1])/float64(t.Totals[1])
+}
+
+// Enriched returns the cohort, 1 or 2, in which the trajectory is enriched, or 0 if it is not enriched in either.
+func (t *DifferentialTrajectory) Enriched() int {
+	if t.QValue > differentialFDR {
+		return 0
+	}
+	if t.Difference() > 0 {
+		return 1
+	}
+	return 2
+}
+
+// fisherExactTwoSided returns the two-sided p-value of Fisher's exact test for the 2x2 table with a cases and b
+// non-cases in the first group, and c cases and d non-cases in the second group, as twice the smallest one-sided
+// p-value.
+func fisherExactTwoSided(a, b, c, d int) float64 {
+	return math.Min(2*math.Min(fisherExactGreater(a, b, c, d), fisherExactGreater(c, d, a, b)), 1.0)
+}
+
+// benjaminiHochberg sets the adjusted p-values of the given trajectories, and sorts them by p-value.
+func benjaminiHochberg(trajectories []*DifferentialTrajectory) {
+	sort.SliceStable(trajectories, func(i, j int) bool {
+		return trajectories[i].PValue < trajectories[j].PValue
+	})
+	q := 1.0
+	for i := len(trajectories) - 1; i >= 0; i-- {
+		q = math.Min(q, trajectories[i].PValue*float64(len(trajectories))/float64(i+1))
+		trajectories[i].QValue = q
+	}
+}
+
+// matchingPatients returns the nr of patients of a cohort that match a trajectory of the given diagnosis codes within
+// the given time frame, cf. matchPatientTrajectory.
+func (cohort *differentialCohort) matchingPatients(codes []string, minTime, maxTime float64) int {
+	dids := make([]int, len(codes))
+	for i, code := range codes {
+		did, ok := cohort.dids[code]
+		if !ok {
+			return 0 // none of the patients of the cohort has the diagnosis
+		}
+		dids[i] = did
+	}
+	ctr := 0
+	for _, p := range cohort.patients.PIDMap {
+		if matchPatientTrajectory(p, dids, minTime, maxTime) != nil {
+			ctr++
+		}
+	}
+	return ctr
+}
+
+// compareCohorts compares the trajectories of two cohorts, cf. DifferentialTrajectory, sorted by p-value.
+func compareCohorts(cohorts [2]*differentialCohort, minTime, maxTime float64) []*DifferentialTrajectory {
+	index := map[string]*DifferentialTrajectory{}
+	var trajectories []*DifferentialTrajectory
+	for i, cohort := range cohorts {
+		for _, t := range cohort.exp.Trajectories {
+			dt, ok := index[t.Hash]
+			if !ok {
+				dt = &DifferentialTrajectory{Hash: t.Hash}
+				for _, did := range t.Diagnoses {
+					dt.Codes = append(dt.Codes, cohort.exp.IdMap[did])
+					dt.Names = append(dt.Names, cohort.exp.Icd10Map[did].Name)
+				}
+				index[t.Hash] = dt
+				trajectories = append(trajectories, dt)
+			}
+			dt.Found[i] = true
+		}
+	}
+	parallel.Range(0, len(trajectories), 0, func(low, high int) {
+		for _, t := range trajectories[low:high] {
+			for i, cohort := range cohorts {
+				t.Patients[i] = cohort.matchingPatients(t.Codes, minTime, maxTime)
+				t.Totals[i] = len(cohort.patients.PIDMap)
+			}
+			t.PValue = fisherExactTwoSided(t.Patients[0], t.Totals[0]-t.Patients[0], t.Patients[1],
+				t.Totals[1]-t.Patients[1])
+		}
+	})
+	benjaminiHochberg(trajectories)
+	return trajectories
+}
+
+// WriteDifferentialTrajectories writes the trajectories of a differential analysis to a tab file, cf.
+// compareCohorts, and returns the name of the file. For each trajectory, it prints one line with the hash, the medical
+// terms and codes of the diagnoses, the cohorts in which the trajectory is found (1, 2, or 1,2), the nr of matching
+// patients and the nr of patients of both cohorts, the ratio and the difference of the fractions of matching patients
+// of the first and second cohort, the p-value and the adjusted p-value, and the cohort in which the trajectory is
+// enriched (1 or 2), or 0 if neither:
+// hash tab terms tab codes tab found tab patients1 tab total1 tab patients2 tab total2 tab ratio tab difference tab
+// p-value tab q-value tab enriched. The counts of patients that are small cells are binned, cf. exp.
+func WriteDifferentialTrajectories(exp *Experiment, trajectories []*DifferentialTrajectory, path string) string {
+	name := filepath.Join(path, fmt.Sprintf("%s-differential.tab", exp.Name))
+	file, err := os.Create(name)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	for _, t := range trajectories {
+		var found []string
+		for i, ok := range t.Found {
+			if ok {
+				found = append(found, fmt.Sprint(i+1))
+			}
+		}
+		fmt.Fprintf(file, "%s\t%s\t%s\t%s\t%v\t%d\t%v\t%d\t%s\t%s\t%s\t%s\t%d\n", t.Hash,
+			strings.Join(t.Names, " -> "), strings.Join(t.Codes, " -> "), strings.Join(found, ","),
+			exp.cellValue(float64(t.Patients[0]), t.Patients[0]), t.Totals[0],
+			exp.cellValue(float64(t.Patients[1]), t.Patients[1]), t.Totals[1], formatRRFloat(t.Ratio()),
+			formatRRFloat(t.Difference()), formatRRFloat(t.PValue), formatRRFloat(t.QValue), t.Enriched())
+	}
+	return name
+}
+
+// RunDifferential runs a TriNetX experiment with the given parameters on two cohorts: the patients selected by the
+// patient filters, and the patients selected by the compare filters, cf. ComparePFilters. The outputs of the
+// experiments on the cohorts are written as for separate runs named name-cohort1 and name-cohort2, and the
+// trajectories that are enriched in either cohort are written to name-differential.tab.
+func RunDifferential(args *ExperimentParams) (err error) {
+	defer func() {
+		// converts any panics into errors to avoid crashing the app
+		if r := recover(); r != nil {
+			fmt.Println("Recovered from panic during differential analysis: ", r)
+			err = errors.New(fmt.Sprintf("%v", r))
+			fmt.Println(string(debug.Stack()))
+		}
+	}()
+	if args.DPEpsilon > 0 {
+		return errors.New("a differential analysis cannot be combined with differential privacy")
+	}
+	if args.SaveRR != "" || args.LoadRR != "" {
+		return errors.New("a differential analysis cannot save or load an RR matrix, since the cohorts have their own")
+	}
+	var cohorts [2]*differentialCohort
+	for i, filters := range []string{args.PFilters, args.ComparePFilters} {
+		cohortArgs := *args
+		cohortArgs.Name = fmt.Sprintf("%s-cohort%d", args.Name, i+1)
+		cohortArgs.PFilters, cohortArgs.ComparePFilters = filters, ""
+		if err := runExperiment(&cohortArgs, func(exp *Experiment, patients *PatientMap) {
+			cohorts[i] = &differentialCohort{exp: exp, patients: patients, dids: map[string]int{}}
+			for did, code := range exp.IdMap {
+				cohorts[i].dids[code] = did
+			}
+		}); err != nil {
+			return err
+		}
+	}
+	fmt.Println("Comparing the trajectories of the cohorts...")
+	trajectories := compareCohorts(cohorts, args.MinYears, args.MaxYears)
+	outputDir := path.Join(args.OutputPath, args.Name)
+	if err := os.MkdirAll(outputDir, 0700); err != nil {
+		return err
+	}
+	exp := &Experiment{Name: args.Name, MinCellSize: args.MinCellSize}
+	WriteDifferentialTrajectories(exp, trajectories, outputDir)
+	enriched := 0
+	for _, t := range trajectories {
+		if t.Enriched() != 0 {
+			enriched++
+		}
+	}
+	fmt.Println("Found ", enriched, " of ", len(trajectories), " trajectories enriched in either cohort.")
+	return nil
+}
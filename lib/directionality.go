@@ -0,0 +1,92 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"fmt"
+	"github.com/exascience/pargo/parallel"
+	"github.com/imec-int/ptra/lib/utils"
+	"math"
+)
+
+// Directionality of the diagnosis pairs, as in Jensen et al. An RR score above 1 for d1 -> d2 shows that d2 is more
+// common after d1, but the pair may as well occur in the other order. The binomial test checks if among the patients
+// diagnosed with both diagnoses, d1 -> d2 occurs significantly more often than d2 -> d1, with the p-value of observing
+// at least as many d1 -> d2 patients if both orders were equally likely. The p-values are computed for the pairs with
+// an RR score, and can be used as an additional filter on the pairs that trajectories are built from.
+
+// directionalityPValue returns the one-sided p-value of the binomial test that the given nr of patients diagnosed
+// with d1 -> d2 is larger than the given nr of patients diagnosed with d2 -> d1, for equally likely orders.
+func directionalityPValue(forward, backward int) float64 {
+	if forward == 0 {
+		return 1.0
+	}
+	if backward == 0 { // utils.BinomialCdf needs fewer events than trials
+		return math.Pow(0.5, float64(forward))
+	}
+	return utils.BinomialCdf(0.5, forward+backward, forward)
+}
+
+// directionality returns the p-value of the binomial test that d1 -> d2 occurs more often than d2 -> d1, or 1 if it is
+// unknown, cf. InitDirectionality.
+func (exp *Experiment) directionality(d1, d2 int) float64 {
+	if exp.DxDDirectionality == nil || exp.DxDDirectionality[d1] == nil {
+		return 1.0
+	}
+	return exp.DxDDirectionality[d1][d2]
+}
+
+// directional checks if the diagnosis pair d1 -> d2 passes the directionality filter of the experiment, cf.
+// MaxDirectionalityP. All pairs pass if there is no filter or the p-values are unknown.
+func (exp *Experiment) directional(d1, d2 int) bool {
+	if exp.MaxDirectionalityP <= 0 || exp.DxDDirectionality == nil {
+		return true
+	}
+	return exp.directionality(d1, d2) <= exp.MaxDirectionalityP
+}
+
+// InitDirectionality computes the p-values of the binomial test of the directionality of the diagnosis pairs with an
+// RR score, cf. InitRR. The patients diagnosed with d1 -> d2 and d2 -> d1 are counted within the same time frame
+// (cf. minTime and maxTime) as the RR scores. This requires the patients per diagnosis, cf. DPatients.
+func (exp *Experiment) InitDirectionality(minTime, maxTime float64) {
+	fmt.Println("Testing the directionality of the diagnosis pairs...")
+	exp.DxDDirectionality = make([][]float64, exp.NofDiagnosisCodes)
+	parallel.Range(0, exp.NofDiagnosisCodes, 0, func(low, high int) {
+		for d1 := low; d1 < high; d1++ {
+			for d2, patients := range exp.DxDPatients[d1] {
+				if len(patients) == 0 {
+					continue
+				}
+				if exp.DxDDirectionality[d1] == nil {
+					exp.DxDDirectionality[d1] = make([]float64, exp.NofDiagnosisCodes)
+					for i := range exp.DxDDirectionality[d1] {
+						exp.DxDDirectionality[d1][i] = 1.0
+					}
+				}
+				backward := 0
+				for _, p := range exp.DPatients[d2] {
+					if ctr, _ := countPatientDiagnosisPair(p, d2, d1, minTime, maxTime); ctr > 0 {
+						backward++
+					}
+				}
+				exp.DxDDirectionality[d1][d2] = directionalityPValue(len(patients), backward)
+			}
+		}
+	})
+}
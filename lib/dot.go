@@ -0,0 +1,101 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"fmt"
+	"github.com/imec-int/ptra/lib/utils"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Plotting of trajectories in the DOT language of Graphviz, for rendering figures directly from a run, e.g. with:
+//
+//	dot -Tpdf exp1-trajectories-merged-graph.dot -o trajectories.pdf
+//
+// The DOT file holds the merged graph of the trajectories, cf. printTrajectories, with a single edge per diagnosis pair.
+// The edges are labelled with the nr of patients, and their width and color hint at the RR of the diagnosis pair.
+
+// dotMaxRR is the RR from which the edges have the maximum width and the darkest color.
+const dotMaxRR = 5.0
+
+// dotText quotes a string for use as an ID or attribute value in a DOT file.
+func dotText(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
+
+// dotEdgeStyle returns the width and color of an edge with the given RR. The color is taken from the reds9 color scheme
+// of Graphviz, from light red for an RR of 1 or less to dark red from dotMaxRR on.
+func dotEdgeStyle(rr float64) (float64, int) {
+	scaled := (rr - 1) / (dotMaxRR - 1)
+	if scaled < 0 {
+		scaled = 0
+	}
+	if scaled > 1 {
+		scaled = 1
+	}
+	return 1 + 3*scaled, 3 + int(6*scaled)
+}
+
+// printTrajectoriesDot plots the given trajectories of an experiment as a single graph to a DOT file. A transition
+// that occurs in several trajectories is labelled with its largest nr of patients.
+func printTrajectoriesDot(exp *Experiment, trajectories []*Trajectory, name string) {
+	file, err := os.Create(name)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	var nodes []int
+	var edges [][2]int
+	patients := map[[2]int]int{}
+	for _, t := range trajectories {
+		for idx, did := range t.Diagnoses {
+			if !utils.MemberInt(did, nodes) {
+				nodes = append(nodes, did)
+			}
+			if idx == 0 {
+				continue
+			}
+			edge := [2]int{t.Diagnoses[idx-1], did}
+			if _, ok := patients[edge]; !ok {
+				edges = append(edges, edge)
+			}
+			patients[edge] = utils.MaxInt(patients[edge], t.PatientNumbers[idx-1])
+		}
+	}
+	fmt.Fprintf(file, "digraph %s {\n", dotText(exp.Name))
+	fmt.Fprintf(file, "\tnode [shape=box, style=rounded];\n")
+	fmt.Fprintf(file, "\tedge [colorscheme=reds9];\n")
+	for _, did := range nodes {
+		fmt.Fprintf(file, "\t%d [label=%s, tooltip=%s];\n", did, dotText(exp.Icd10Map[did].Name),
+			dotText(exp.IdMap[did]))
+	}
+	for _, edge := range edges {
+		rr := exp.DxDRR[edge[0]][edge[1]]
+		width, color := dotEdgeStyle(rr)
+		fmt.Fprintf(file, "\t%d -> %d [label=\"%d\", tooltip=\"RR %s\", penwidth=%s, color=%d];\n", edge[0], edge[1],
+			patients[edge], strconv.FormatFloat(rr, 'f', 2, 64), strconv.FormatFloat(width, 'f', 2, 64), color)
+	}
+	fmt.Fprintf(file, "}\n")
+}
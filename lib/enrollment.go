@@ -0,0 +1,132 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Observation periods. Claims and registry data only cover the periods in which the patients are enrolled, e.g. in an
+// insurance plan. Outside of these periods, the absence of diagnoses does not mean that the patient had none. With an
+// enrollment file, only the diagnoses inside the observation periods of a patient are counted, and patients without
+// observation period are left out, so that coverage lapses do not show up as spurious gaps in their trajectories.
+
+// ObservationPeriod is a period in which the diagnoses of a patient are observed.
+type ObservationPeriod struct {
+	Start DiagnosisDate
+	End   *DiagnosisDate // nil if the period is ongoing
+}
+
+// contains checks if a date is inside an observation period, including its start and end date.
+func (period ObservationPeriod) contains(date DiagnosisDate) bool {
+	if DiagnosisDateSmallerThan(date, period.Start) {
+		return false
+	}
+	return period.End == nil || !DiagnosisDateSmallerThan(*period.End, date)
+}
+
+// observed checks if a date is inside any of the given observation periods.
+func observed(periods []ObservationPeriod, date DiagnosisDate) bool {
+	for _, period := range periods {
+		if period.contains(date) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseEnrollmentFile reads the observation periods of the patients from a csv file with patient_id, start_date, and
+// end_date columns. The dates are formatted as YYYY-MM-DD, and the end date is empty for ongoing periods. A patient may
+// have several periods. Rows with invalid dates are skipped.
+func parseEnrollmentFile(file string) map[string][]ObservationPeriod {
+	periods := map[string][]ObservationPeriod{}
+	ctr, skipped := 0, 0
+	err := readCSVTable(file, []string{"patient_id", "start_date", "end_date"}, func(values []string) {
+		ctr++
+		start, err := parseTriNetXDate(strings.TrimSpace(values[1]))
+		if err != nil || values[0] == "" {
+			skipped++
+			return
+		}
+		period := ObservationPeriod{Start: start}
+		if end := strings.TrimSpace(values[2]); end != "" {
+			date, err := parseTriNetXDate(end)
+			if err != nil || DiagnosisDateSmallerThan(date, start) {
+				skipped++
+				return
+			}
+			period.End = &date
+		}
+		periods[values[0]] = append(periods[values[0]], period)
+	})
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println("Parsed ", ctr-skipped, " observation periods of ", len(periods), " patients, skipped ", skipped,
+		" periods with invalid dates.")
+	return periods
+}
+
+// ApplyObservationPeriods removes the diagnoses outside of the observation periods of the patients, and the patients
+// without observation period. It sets the enrollment date of the remaining patients to the start of their first
+// observation period. If the event of interest of a patient is not observed, it becomes the first observed diagnosis
+// for which isEventOfInterest holds, if any. It returns the remaining patients.
+func ApplyObservationPeriods(patients *PatientMap, periods map[string][]ObservationPeriod,
+	isEventOfInterest func(did int) bool) *PatientMap {
+	dropped, droppedPatients := 0, 0
+	filter := func(p *Patient) bool {
+		patientPeriods, ok := periods[p.PIDString]
+		if !ok {
+			droppedPatients++
+			return false
+		}
+		start := patientPeriods[0].Start
+		for _, period := range patientPeriods[1:] {
+			if DiagnosisDateSmallerThan(period.Start, start) {
+				start = period.Start
+			}
+		}
+		p.EnrollmentDate = &start
+		diagnoses := p.Diagnoses[:0]
+		for _, d := range p.Diagnoses {
+			if observed(patientPeriods, d.Date) {
+				diagnoses = append(diagnoses, d)
+			} else {
+				dropped++
+			}
+		}
+		p.Diagnoses = diagnoses
+		if p.EOIDate != nil && !observed(patientPeriods, *p.EOIDate) {
+			p.EOIDate = nil
+			for _, d := range p.Diagnoses {
+				if isEventOfInterest(d.DID) {
+					date := d.Date
+					p.EOIDate = &date
+					break
+				}
+			}
+		}
+		return true
+	}
+	result := ApplyPatientFilters([]PatientFilter{filter}, patients)
+	fmt.Println("Observation periods: dropped ", dropped, " diagnoses outside of the periods, and ", droppedPatients,
+		" patients without period.")
+	return result
+}
@@ -19,6 +19,7 @@
 package lib
 
 import (
+	"database/sql"
 	"errors"
 	"fmt"
 	"github.com/imec-int/ptra/lib/utils"
@@ -28,6 +29,7 @@ import (
 	"runtime/debug"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type ExperimentParams struct {
@@ -47,21 +49,103 @@ type ExperimentParams struct {
 	MaxTrajectoryLength  int
 	MinTrajectoryLength  int
 	ICD9ToICD10File      string
+	ICD10ToICD11File     string
+	SNOMEDToICD10File    string
 	Cluster              bool
 	ClusterGranularities string
 	Iter                 int
+	MatchedControls      int     // nr of controls matched to each exposed patient, cf. matching.go, 0 for cohort sampling
+	MatchComorbidities   bool    // also match the controls on their nr of comorbidities
+	PairTest             string  // test of the significance of the diagnosis pairs, cf. the PairTest constants, sampling if empty
+	MaxPValue            float64 // maximum p-value of the RR scores of the pairs, DefaultMaxPValue if 0
+	RRBound              string  // bound of the RR scores compared with RR, cf. the RRBound constants, point if empty
+	ContinuityCorrection float64 // added to the cells of the 2x2 tables of the pairs with a zero cell, 0 for none
+	MinCount             int     // nr of d2 diagnoses in either group of a pair below which it is flagged as rare
+	Censoring            bool    // censor the exposed patients at their death or the end of the data, cf. censoring.go
+	EndDate              string  // end of the data for censoring, YYYY-MM-DD, the last diagnosis date if empty
+	Metric               string  // effect size of the pairs reported besides the RR, cf. the Metric constants, rr if empty
+	MaxDirectionalityP   float64 // maximum directionality p-value of the pairs, cf. directionality.go, 0 for no filter
+	PairsBySex           bool    // also compute the RR scores of the pairs within the male and female patients
+	PairsByAge           bool    // also compute the RR scores of the pairs within the patients of each age group
 	RR                   float64
 	SaveRR               string
+	RRFormat             string // format of the saved RR matrix, cf. the RRFormat constants, dense if empty
 	LoadRR               string
 	PFilters             string
+	ComparePFilters      string // patient filters of the second cohort of a differential analysis, cf. differential.go
+	Sweep                string // grid of parameter values of a sensitivity analysis, cf. sweep.go, none if empty
+	PermutationGroup     string // patient filter that defines the groups of the permutation test, none if empty
+	Permutations         int    // nr of permutations of the permutation test, DefaultPermutations if 0
 	TFilters             string
+	TopTrajectories      int     // the number of trajectories with the most patients to output, 0 for all
+	MinEdgeRR            float64 // the minimum RR score of the transitions of the trajectories to output
+	Bootstrap            int     // nr of bootstrap replicates of the stability of the trajectories, cf. bootstrap.go
+	ValidateTrajectories string  // json results of a previous run of which the trajectories are validated, none if empty
+	Mortality            string  // comma separated windows in years of the mortality of the trajectories, none if empty
+	Render               string  // image format of the rendered figures, cf. the Render constants, none if empty
 	TumorInfo            string
+	TumorSites           string // comma separated topography prefixes of the tumors to record, bladder (C67) if empty
+	StagingRules         string // json file with the TNM staging rules of other cancers than bladder cancer
 	TreatmentInfo        string
+	ProcedureInfo        string // TriNetX procedure file, none if empty
+	ProcedureGroups      string // csv file that groups the procedure codes into events
+	LabInfo              string // TriNetX lab result file, none if empty
+	LabRules             string // json file with the rules that turn lab results into events
+	EnrollmentInfo       string // csv file with the observation periods of the patients, none if empty
 	NrOfThreads          int
+	DPEpsilon            float64
+	MinCellSize          int // patient counts below this size are suppressed in the outputs, 0 for none
+	Pseudonymize         string
+	PseudonymSalt        string `json:"-"` // secret, left out of the run manifest
+	PseudonymMapFile     string
+	Neo4j                bool   // write the trajectories as csv files for the bulk importer of Neo4j
+	Parquet              bool   // write the pairs, trajectories, and patients of the trajectories as Parquet files
+	PatientTrajectories  bool   // write the trajectories of each patient, with the dates of the matched diagnoses
+	TimelinePatients     string // comma separated list or file of the patient ids of which to write the timelines
+	Xlsx                 bool   // write the trajectories, pairs, clusters, and summary as an Excel workbook
+	MaxBadRows           int
+	RejectsFile          string
+	Deterministic        bool   // fixed seed and timestamps, so that the same input always results in the same output
+	Seed                 uint64 // seed for random sampling, cf. Experiment.Rand, 0 for a random seed unless deterministic
+	Dedup                string
+	DuplicatePatients    string // strategy for duplicate patients, cf. the Duplicate constants, derived from Dedup if empty
+	TemporalChecks       string
+	ReferenceDate        string // date used as today by the temporal checks, YYYY-MM-DD, the current date if empty
+	AuditLog             string // file to which data-access audit events are appended, none if empty
+	AuditUser            string
+	RunID                string
+	TreatmentSchema      string          // json file describing the columns of the treatment file, default TriNetX layout if empty
+	CustomEvents         string          // json file with the custom events of the treatment file, bladder cancer treatments if empty
+	InputSchema          string          // json file describing the columns of the csv input format
+	IndexDate            string          // index date from which the patient timelines start, cf. alignment.go
+	InputFormat          string          // format of the patient and diagnosis files, cf. the Input constants, TriNetX if empty
+	OMOPSource           OMOPSource      `json:"-"` // source of the OMOP tables, e.g. a database, csv files if nil
+	Database             *sql.DB         `json:"-"` // database of the sql input format, whose queries are in the patient, diagnosis, and tumor files
+	BigQuery             *BigQuerySource `json:"-"` // runs the queries of the sql input format instead of the database if not nil
+	Streaming            bool            // load the diagnoses with bounded memory, without tracking duplicate diagnosis rows
+	Stratify             string          // race/ethnicity dimensions on which cohorts are stratified, cf. strata.go
+	SameVisit            string          // grouping of the diagnoses of the same visit, cf. visits.go
+	VisitOrder           string          // tie-breaking of the diagnoses of the same visit, cf. visits.go
+	PrimaryDiagnoses     bool            // only primary diagnoses are trajectory events, cf. principal-diagnoses.go
+	SecondaryWeight      float64         // weight of secondary diagnoses in the RR scores, between 0 and 1
+	LoadState            string          // state file of a previous run to which the input files are added, none if empty
+	SaveState            string          // state file to which the parsed diagnoses are saved, none if empty
+	DIDMap               string          // file that persists the analysis DIDs across runs, none if empty
+	Version              string          `json:"-"` // version of ptra, recorded in the run manifest
 }
 
+// DeterministicSeed is the seed used for random sampling in deterministic mode.
+const DeterministicSeed uint64 = 1
+
 // Run runs a TriNetX experiment with the given parameters.
-func Run(args *ExperimentParams) (err error) {
+func Run(args *ExperimentParams) error {
+	return runExperiment(args, nil)
+}
+
+// runExperiment runs a TriNetX experiment with the given parameters. If finish is not nil, it is called with the
+// experiment and its patients after all outputs are written, for further analysis, cf. RunDifferential.
+func runExperiment(args *ExperimentParams, finish func(exp *Experiment, patients *PatientMap)) (err error) {
+	audit := NewAuditLog(args.AuditLog, args.AuditUser, args.RunID)
 	defer func() {
 		// converts any panics into errors to avoid crashing the app
 		if r := recover(); r != nil {
@@ -69,7 +153,24 @@ func Run(args *ExperimentParams) (err error) {
 			err = errors.New(fmt.Sprintf("%v", r))
 			fmt.Println(string(debug.Stack()))
 		}
+		// a failing audit log must not panic again, so its error is returned instead
+		var auditErr error
+		if err != nil {
+			auditErr = audit.record(AuditFail, "", false, err.Error())
+		} else {
+			auditErr = audit.record(AuditFinish, "", false, "")
+		}
+		if auditErr != nil {
+			fmt.Println("Could not write the audit log: ", auditErr)
+			if err == nil {
+				err = auditErr
+			}
+		}
 	}()
+	audit.Record(AuditStart, "", false, args.Name)
+	telemetry := NewTelemetry()
+	start := time.Now()
+	inputs := inputChecksums(args) // before the run creates or changes any of the files, e.g. the DID mapping
 
 	outputDir := path.Join(args.OutputPath, args.Name)
 	err = os.MkdirAll(outputDir, 0700)
@@ -81,26 +182,380 @@ func Run(args *ExperimentParams) (err error) {
 		runtime.GOMAXPROCS(args.NrOfThreads)
 	}
 
+	if args.SecondaryWeight < 0 || args.SecondaryWeight > 1 {
+		return errors.New("the weight of secondary diagnoses must be between 0 and 1")
+	}
+
+	if args.PairTest != "" && args.PairTest != PairTestSampling && args.PairTest != PairTestFisher &&
+		args.PairTest != PairTestAuto {
+		return fmt.Errorf("unknown pair test: %s", args.PairTest)
+	}
+
+	if args.MaxPValue < 0 || args.MaxPValue > 1 {
+		return errors.New("the maximum p-value must be between 0 and 1")
+	}
+
+	if args.RRBound != "" && args.RRBound != RRBoundPoint && args.RRBound != RRBoundLow {
+		return fmt.Errorf("unknown RR bound: %s", args.RRBound)
+	}
+
+	if args.RRBound == RRBoundLow && args.DPEpsilon > 0 {
+		return errors.New("the pairs cannot be selected on the confidence intervals with differential privacy")
+	}
+
+	if args.ContinuityCorrection < 0 {
+		return errors.New("the continuity correction must not be negative")
+	}
+
+	if args.MinCount < 0 {
+		return errors.New("the minimum count must not be negative")
+	}
+
+	if args.EndDate != "" {
+		if !args.Censoring {
+			return errors.New("an end date requires censoring")
+		}
+		if _, err := ParseEndDate(args.EndDate); err != nil {
+			return err
+		}
+	}
+
+	referenceDate, err := ParseReferenceDate(args.ReferenceDate)
+	if err != nil {
+		return err
+	}
+
+	if args.MatchedControls < 0 {
+		return errors.New("the number of matched controls must not be negative")
+	}
+
+	if args.MatchComorbidities && args.MatchedControls == 0 {
+		return errors.New("matching on comorbidities requires matched controls")
+	}
+
+	if args.Metric != "" && args.Metric != MetricRR && args.Metric != MetricOR && args.Metric != MetricRD &&
+		args.Metric != MetricHR {
+		return fmt.Errorf("unknown metric: %s", args.Metric)
+	}
+
+	if args.MaxDirectionalityP < 0 || args.MaxDirectionalityP > 1 {
+		return errors.New("the maximum directionality p-value must be between 0 and 1")
+	}
+
+	if (args.PairsBySex || args.PairsByAge) && args.DPEpsilon > 0 {
+		return errors.New("the stratified RR scores cannot be computed with differential privacy")
+	}
+
+	if args.PermutationGroup != "" {
+		if !IsPermutationGroup(args.PermutationGroup) {
+			return fmt.Errorf("unknown group of the permutation test: %s", args.PermutationGroup)
+		}
+		if args.DPEpsilon > 0 {
+			return errors.New("the permutation test cannot be combined with differential privacy")
+		}
+	}
+
+	if args.Permutations < 0 {
+		return errors.New("the number of permutations must not be negative")
+	}
+
+	if args.Bootstrap < 0 {
+		return errors.New("the number of bootstrap replicates must not be negative")
+	}
+
+	if args.Bootstrap > 0 && (args.DPEpsilon > 0 || args.LoadRR != "") {
+		return errors.New("the bootstrap replicates cannot be combined with differential privacy or a loaded RR matrix")
+	}
+
+	if args.ValidateTrajectories != "" && args.DPEpsilon > 0 {
+		return errors.New("the validation of trajectories cannot be combined with differential privacy")
+	}
+
+	if err := validateDuplicateOptions(args.Dedup, args.DuplicatePatients); err != nil {
+		return err
+	}
+
+	var mortalityWindows []float64
+	if args.Mortality != "" {
+		if args.DPEpsilon > 0 {
+			return errors.New("the mortality of the trajectories cannot be computed with differential privacy")
+		}
+		var err error
+		if mortalityWindows, err = ParseMortalityWindows(args.Mortality); err != nil {
+			return err
+		}
+	}
+
+	if args.MinCellSize < 0 {
+		return errors.New("the minimum cell size must not be negative")
+	}
+
+	if args.IndexDate == IndexEnrollment && args.EnrollmentInfo == "" {
+		return errors.New("the enrollment index date requires an enrollment file")
+	}
+
+	if args.Pseudonymize == PseudonymizeHash && args.PseudonymSalt == "" {
+		return errors.New("hashed pseudonyms require a salt")
+	}
+
+	if (args.SaveRR != "" || args.SaveState != "") && args.Pseudonymize == PseudonymizeStudy {
+		return errors.New("the patients of a saved RR matrix or state can only be found by a later run with hashed " +
+			"pseudonyms")
+	}
+
+	if args.DPEpsilon > 0 && args.Deterministic {
+		return errors.New("the noise of differential privacy cannot be deterministic")
+	}
+
+	if args.RRFormat != "" && args.RRFormat != RRFormatDense && args.RRFormat != RRFormatSparse {
+		return fmt.Errorf("unknown RR matrix format: %s", args.RRFormat)
+	}
+
+	if args.Render != "" && args.Render != RenderSVG && args.Render != RenderPNG {
+		return fmt.Errorf("unknown image format: %s", args.Render)
+	}
+
 	// start execution
-	// 1. Parse input into experiment
+	telemetry.Begin(StageParse)
+	// 0. Validate the input files, report all malformed rows at once rather than failing on the first one
+	var treatmentSchema *TreatmentSchema
+	if args.TreatmentSchema != "" {
+		if treatmentSchema, err = LoadTreatmentSchema(args.TreatmentSchema); err != nil {
+			return err
+		}
+		audit.Read(args.TreatmentSchema, false)
+	}
+	if args.CustomEvents != "" {
+		if treatmentSchema, err = withCustomEvents(treatmentSchema, args.CustomEvents); err != nil {
+			return err
+		}
+		audit.Read(args.CustomEvents, false)
+	}
+	var validationResults *Results
+	if args.ValidateTrajectories != "" {
+		if validationResults, err = ReadResults(args.ValidateTrajectories); err != nil {
+			return err
+		}
+		if validationResults.Parameters != nil && validationResults.Parameters.Level != args.Lvl {
+			return fmt.Errorf("the trajectories to validate are built with level %d instead of %d",
+				validationResults.Parameters.Level, args.Lvl)
+		}
+		audit.Read(args.ValidateTrajectories, false)
+	}
+	var staging StagingRegistry
+	if args.StagingRules != "" {
+		if staging, err = LoadStagingRules(args.StagingRules); err != nil {
+			return err
+		}
+		audit.Read(args.StagingRules, false)
+	}
+	var inputSchema *InputSchema
+	if args.InputSchema != "" {
+		if args.InputFormat != InputCSV {
+			return errors.New("an input schema requires the csv input format")
+		}
+		if inputSchema, err = LoadInputSchema(args.InputSchema); err != nil {
+			return err
+		}
+		audit.Read(args.InputSchema, false)
+	} else if args.InputFormat == InputCSV {
+		return errors.New("the csv input format requires an input schema")
+	}
+	var database *SQLSource
+	if args.InputFormat == InputSQL {
+		if args.Database == nil && args.BigQuery == nil {
+			return errors.New("the sql input format requires a database")
+		}
+		if database, err = LoadSQLSource(args.Database, args.PatientInfo, args.PatientDiagnoses, args.TumorInfo); err != nil {
+			return err
+		}
+		if args.BigQuery != nil {
+			database.Runner = args.BigQuery
+		}
+		for _, file := range []string{args.PatientInfo, args.PatientDiagnoses, args.TumorInfo} {
+			if file != "" {
+				audit.Read(file, false)
+			}
+		}
+	}
+	if args.InputFormat != "" && args.InputFormat != InputTriNetX { // only the TriNetX and csv files are validated
+		if args.InputFormat == InputOMOP && args.OMOPSource != nil {
+			audit.Record(AuditRead, "", true, "OMOP database")
+		} else if args.InputFormat == InputSQL {
+			audit.Record(AuditRead, "", true, "database")
+		} else if args.InputFormat != InputCSV { // the csv files are audited with the validated files
+			audit.Read(args.PatientInfo, true)
+			if args.PatientDiagnoses != args.PatientInfo {
+				audit.Read(args.PatientDiagnoses, true)
+			}
+		}
+	}
+	var labRules []*LabRule
+	if args.LabInfo != "" {
+		if args.LabRules == "" {
+			return errors.New("a lab file requires lab rules")
+		}
+		if labRules, err = LoadLabRules(args.LabRules); err != nil {
+			return err
+		}
+		audit.Read(args.LabRules, false)
+	}
+
+	// 1. Parse input into experiment, the csv input files are validated while they are parsed
+	report := NewValidationReport()
+	seed := args.Seed
+	if args.Deterministic && seed == 0 {
+		seed = DeterministicSeed
+	}
+	pseudonymizer := NewPseudonymizer(args.Pseudonymize, args.PseudonymSalt, fmt.Sprintf("%s-", args.Name))
 	tinfo := map[string][]*TumorInfo{}
-	if args.TumorInfo != "" {
-		tinfo = ParsetTriNetXTumorData(args.TumorInfo) // need parsed patients to be able to parse tumor data file
+	if database != nil && database.TumorQuery != "" {
+		tinfo = parseSQLTumors(database, ParseTumorSites(args.TumorSites), staging)
+	} else if args.TumorInfo != "" {
+		// need parsed patients to be able to parse tumor data file
+		tinfo = ParsetTriNetXTumorData(args.TumorInfo, ParseTumorSites(args.TumorSites), staging, report)
 	}
 
-	exp, patients := ParseTriNetXData(args.Name, args.PatientInfo, args.PatientDiagnoses, args.DiagnosisInfo,
-		args.TreatmentInfo, args.NofAgeGroups, args.Lvl, args.MinYears, args.MaxYears, args.ICD9ToICD10File, GetPatientFilters(args.PFilters, tinfo))
+	filters := GetPatientFilters(args.PFilters, tinfo)
+	if args.PrimaryDiagnoses {
+		filters = append([]PatientFilter{PrimaryDiagnosisFilter}, filters...)
+	}
+	exp, patients := ParseTriNetXData(args, &ParseOptions{LabRules: labRules, Filters: filters,
+		ReferenceDate: referenceDate, Report: report, TreatmentSchema: treatmentSchema, InputSchema: inputSchema,
+		Database: database, Pseudonymizer: pseudonymizer, Telemetry: telemetry})
+	for _, file := range report.Files {
+		audit.Read(file, true)
+	}
+	report.Log(20)
+	if !report.OK() {
+		rejectsFile := args.RejectsFile
+		if rejectsFile == "" {
+			rejectsFile = path.Join(outputDir, fmt.Sprintf("%s-rejects.tab", args.Name))
+		}
+		report.Save(rejectsFile)
+		audit.Wrote(rejectsFile, true)
+		if report.NofBadRows() > args.MaxBadRows {
+			return report.Error()
+		}
+		fmt.Println("Skipped ", report.NofBadRows(), " malformed rows, see: ", rejectsFile)
+	}
+	exp.Audit = audit
+	exp.Seed = seed
+	exp.Pseudonymizer = pseudonymizer
+	exp.SecondaryWeight = args.SecondaryWeight
+	exp.MinCellSize = args.MinCellSize
+	exp.PairTest = args.PairTest
+	exp.MaxPValue = args.MaxPValue
+	exp.ContinuityCorrection = args.ContinuityCorrection
+	exp.MinCount = args.MinCount
+	exp.Censoring = args.Censoring
+	if args.Censoring {
+		if args.EndDate != "" {
+			exp.EndDate, _ = ParseEndDate(args.EndDate) // validated above
+		} else {
+			exp.EndDate = LastDiagnosisDate(patients.PIDMap)
+		}
+	}
+	exp.RRBound = args.RRBound
+	if exp.RRBound == "" {
+		exp.RRBound = RRBoundPoint
+	}
+	exp.MatchedControls = args.MatchedControls
+	exp.MaxDirectionalityP = args.MaxDirectionalityP
+	exp.Metric = args.Metric
+	if exp.Metric == "" {
+		exp.Metric = MetricRR
+	}
+	audit.Read(args.DiagnosisInfo, false)
+	if args.ICD9ToICD10File != "" {
+		audit.Read(args.ICD9ToICD10File, false)
+	}
+	if args.ICD10ToICD11File != "" {
+		audit.Read(args.ICD10ToICD11File, false)
+	}
+	if args.SNOMEDToICD10File != "" {
+		audit.Read(args.SNOMEDToICD10File, false)
+	}
+	if args.ProcedureGroups != "" {
+		audit.Read(args.ProcedureGroups, false)
+	}
+	if args.EnrollmentInfo != "" {
+		audit.Read(args.EnrollmentInfo, true)
+	}
+	if args.LoadState != "" {
+		audit.Read(args.LoadState, true)
+	}
+	if args.DIDMap != "" {
+		audit.Wrote(args.DIDMap, false)
+	}
+	if args.SaveState != "" {
+		audit.Wrote(args.SaveState, true)
+	}
+	exp.Duplicates.Log()
+	exp.UnmappedCodes.Log(20)
+	unmappedFile := path.Join(outputDir, fmt.Sprintf("%s-unmapped-codes.tab", args.Name))
+	exp.UnmappedCodes.Save(unmappedFile)
+	audit.Wrote(unmappedFile, false)
+	exp.Warnings.Log()
+	warningsFile := path.Join(outputDir, fmt.Sprintf("%s-warnings.jsonl", args.Name))
+	exp.Warnings.Save(warningsFile)
+	audit.Wrote(warningsFile, false)
 
 	// 2. Initialise relative risk ratios or load them from file from a previous run
+	telemetry.Begin(StageRR)
 	if args.LoadRR != "" {
 		exp.LoadRRMatrix(args.LoadRR)
 		exp.LoadDxDPatients(patients, fmt.Sprintf("%s.patients.csv", args.LoadRR))
+		audit.Read(args.LoadRR, false)
+		audit.Read(fmt.Sprintf("%s.patients.csv", args.LoadRR), true)
 	} else {
+		if args.MatchComorbidities {
+			exp.InitComorbidityMatching()
+		}
 		exp.InitRR(args.MinYears, args.MaxYears, args.Iter)
+		if exp.ComorbidityFallbacks > 0 {
+			fmt.Println("Matched controls drawn without comorbidity matching: ", exp.ComorbidityFallbacks)
+		}
+	}
+	exp.InitDirectionality(args.MinYears, args.MaxYears)
+	if exp.Metric == MetricHR {
+		exp.InitHazardRatios(args.MaxYears)
+	}
+	if args.PairsBySex {
+		exp.InitSexRR(args.MinYears, args.MaxYears, args.Iter)
+	}
+	if args.PairsByAge {
+		exp.InitAgeRR(args.MinYears, args.MaxYears, args.Iter)
+	}
+	manifest := &RunManifest{Name: args.Name, Created: runTimestamp(args.Deterministic), Deterministic: args.Deterministic,
+		Pseudonymization: exp.Pseudonymizer.Method, Duplicates: exp.Duplicates, IndexDate: exp.IndexDate,
+		Stratification: exp.Stratification, Version: args.Version, Revision: buildRevision(),
+		Parameters: manifestParameters(args), Inputs: inputs}
+	if exp.Warnings != nil {
+		manifest.Warnings = exp.Warnings.Reasons
+	}
+	if audit != nil {
+		manifest.RunID = audit.RunID
+	}
+	if args.DPEpsilon > 0 { // perturb RR scores before they are used or saved
+		manifest.Privacy = NewPrivacyBudget(args.DPEpsilon)
+		exp.ApplyRRNoise(manifest.Privacy)
 	}
 	if args.SaveRR != "" { // save RR matrix to file + DPatients
-		exp.SaveRRMatrix(args.SaveRR)
+		if args.RRFormat == RRFormatSparse {
+			exp.SaveSparseRRMatrix(args.SaveRR)
+		} else {
+			exp.SaveRRMatrix(args.SaveRR)
+		}
 		exp.SaveDxDPatients(fmt.Sprintf("%s.patients.csv", args.SaveRR))
+		audit.Wrote(args.SaveRR, false)
+		audit.Wrote(fmt.Sprintf("%s.patients.csv", args.SaveRR), true)
+	}
+
+	summary := NewSummaryReport(exp, manifest.Privacy != nil)
+
+	if exp.DxDStats != nil { // the excess incidence is unknown without statistics, e.g. with --dpEpsilon or --loadRR
+		exp.InitPatientYears(patients, args.MinYears, args.MaxYears)
 	}
 
 	// assist the gc and nil some exp data that is no longer needed after initializing RR
@@ -108,28 +563,148 @@ func Run(args *ExperimentParams) (err error) {
 	exp.DPatients = nil
 
 	// 3. Build the trajectories
+	telemetry.Begin(StageTrajectories)
 	exp.BuildTrajectories(args.MinPatients, args.MaxTrajectoryLength, args.MinTrajectoryLength, args.MinYears, args.MaxYears, args.RR,
 		GetTrajectoryFilters(args.TFilters, exp))
+	if manifest.Privacy != nil {
+		exp.ApplyCountNoise(manifest.Privacy)
+	}
+	exp.SelectTrajectories(args.TopTrajectories, args.MinEdgeRR)
+	if args.MinCellSize > 0 {
+		manifest.SmallCells = exp.SuppressSmallCells()
+	}
+	if manifest.Privacy == nil { // the time gaps are derived from the exact dates
+		exp.InitTransitionGaps(args.MinYears, args.MaxYears)
+		exp.InitPairGaps(args.MinYears, args.MaxYears)
+		exp.InitPairAges(args.MinYears, args.MaxYears)
+	}
 
 	// 4. Plot trajectories to file
+	telemetry.Begin(StageExport)
 	exp.PrintTrajectoriesToFile(outputDir)
+	if exp.IndexDate != "" && exp.IndexDate != IndexNone {
+		audit.Wrote(WriteIndexTimes(exp, outputDir, args.MinYears, args.MaxYears), false)
+	}
+	if args.PairsBySex {
+		for sex := range exp.DxDSexRR {
+			audit.Wrote(WriteSexPairs(exp, outputDir, sex), false)
+		}
+	}
+	if args.PairsByAge {
+		audit.Wrote(WriteAgePairs(exp, outputDir), false)
+	}
+	if exp.PairGaps != nil {
+		audit.Wrote(WritePairGaps(exp, outputDir), false)
+	}
+	if exp.PairAges != nil {
+		audit.Wrote(WritePairAges(exp, outputDir), false)
+	}
+	if args.PermutationGroup != "" {
+		permutations := args.Permutations
+		if permutations == 0 {
+			permutations = DefaultPermutations
+		}
+		differences := exp.PermutationTest(patients, GetPatientFilter(args.PermutationGroup, tinfo), permutations)
+		audit.Wrote(WriteGroupDifferences(exp, differences, outputDir), false)
+	}
+	if args.Bootstrap > 0 {
+		stability := exp.BootstrapStability(patients, args.Bootstrap, args.Iter, args.MinPatients,
+			args.MaxTrajectoryLength, args.MinTrajectoryLength, args.MinYears, args.MaxYears, args.RR,
+			GetTrajectoryFilters(args.TFilters, exp), args.MatchComorbidities)
+		audit.Wrote(WriteBootstrapStability(exp, stability, outputDir), false)
+	}
+	if validationResults != nil {
+		validated := exp.ValidateTrajectories(validationResults, patients, args.MinPatients, args.RR, args.MinYears,
+			args.MaxYears)
+		audit.Wrote(WriteValidatedTrajectories(exp, validated, outputDir), false)
+		replicated := 0
+		for _, v := range validated {
+			if v.Replicated {
+				replicated++
+			}
+		}
+		fmt.Println("Replicated ", replicated, " of ", len(validated), " trajectories of ", args.ValidateTrajectories)
+	}
+	if mortalityWindows != nil {
+		mortality := exp.Mortality(patients, mortalityWindows, args.MinYears, args.MaxYears)
+		audit.Wrote(WriteMortality(exp, mortality, outputDir), false)
+	}
 	fmt.Println("Collected trajectories: ")
 	for i := 0; i < utils.MinInt(len(exp.Trajectories), 100); i++ {
 		LogTrajectory(exp.Trajectories[i], exp)
 	}
-
 	// 5. Perform clustering
 	if args.Cluster {
+		telemetry.Begin(StageCluster)
 		var clusterGranularityList []int
 		for _, g := range strings.Split(args.ClusterGranularities, ",") {
 			gi, _ := strconv.ParseInt(g, 10, 0)
 			clusterGranularityList = append(clusterGranularityList, int(gi))
 		}
-		clusteringErr := ClusterTrajectories(exp, clusterGranularityList, outputDir)
+		clusteringErr := ClusterTrajectories(exp, NewClusterBackground(exp, patients, tinfo), clusterGranularityList,
+			outputDir)
 		if clusteringErr != nil {
 			return clusteringErr
 		}
 	}
 
+	audit.Wrote(WriteCytoscapeElements(exp, outputDir), false)
+	if args.Neo4j {
+		WriteNeo4jImport(exp, outputDir)
+	}
+	if args.Parquet {
+		WriteParquetTables(exp, outputDir)
+	}
+	if args.PatientTrajectories {
+		audit.Wrote(WritePatientTrajectories(exp, outputDir, args.MinYears, args.MaxYears), true)
+	}
+	if args.TimelinePatients != "" {
+		csvFile, htmlFile := WriteTimelines(exp, patients, ParseTimelinePatients(args.TimelinePatients), outputDir,
+			args.MinYears, args.MaxYears)
+		audit.Wrote(csvFile, true)
+		audit.Wrote(htmlFile, true)
+	}
+
+	if args.PseudonymMapFile != "" {
+		exp.Pseudonymizer.SaveMapping(args.PseudonymMapFile)
+		audit.Wrote(args.PseudonymMapFile, true)
+	}
+
+	// 6. Report the summary and the resources used per stage
+	summary.AddTrajectories(exp)
+	summary.Log()
+	audit.Wrote(WriteSummaryReport(exp, summary, outputDir), false)
+	if args.Xlsx {
+		audit.Wrote(WriteWorkbook(exp, summary, outputDir), false)
+	}
+	telemetry.End()
+	telemetry.Log()
+	manifest.Summary = newRunSummary(exp, len(patients.PIDMap))
+	if !args.Deterministic { // resource usage differs from run to run
+		manifest.Telemetry = telemetry.Stages
+		manifest.RuntimeSeconds = time.Since(start).Seconds()
+	}
+	WriteRunManifest(manifest, outputDir)
+	audit.Wrote(path.Join(outputDir, fmt.Sprintf("%s-manifest.json", args.Name)), false)
+	audit.Wrote(WriteResults(exp, manifest, &ResultParameters{Level: args.Lvl, NofAgeGroups: args.NofAgeGroups,
+		MinPatients: args.MinPatients, MinYears: args.MinYears, MaxYears: args.MaxYears, MinRR: args.RR,
+		MinTrajectoryLength: args.MinTrajectoryLength, MaxTrajectoryLength: args.MaxTrajectoryLength,
+		PFilters: args.PFilters, TFilters: args.TFilters, Metric: exp.Metric, MaxPValue: exp.maxPValue(),
+		RRBound: exp.RRBound}, outputDir), false)
+
+	// 7. Render figures of the trajectories
+	if args.Render != "" {
+		figures, renderErr := RenderTrajectoryGraphs(exp, outputDir, args.Render)
+		for _, figure := range figures {
+			audit.Wrote(figure, false)
+		}
+		if renderErr != nil {
+			return renderErr
+		}
+	}
+
+	if finish != nil {
+		finish(exp, patients)
+	}
 	return nil
 }
@@ -0,0 +1,140 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// External validation of the trajectories of a previous run, e.g. on the data of another site, for replication studies.
+// The trajectories are read from the json results of the previous run, cf. ReadResults, and their diagnoses are mapped
+// onto the diagnoses of the experiment by their codes. For each trajectory, the RR scores of its transitions are
+// recomputed on the patients of the experiment, and its support is recounted: the nr of patients that match the
+// diagnoses of the trajectory up to each transition, cf. matchPatientTrajectory. A trajectory is replicated if each of
+// its transitions would be selected as a diagnosis pair of the experiment, cf. selectDiagnosisPairs, and enough
+// patients match the whole trajectory.
+
+// ValidatedTrajectory is a trajectory of a previous run, evaluated on the patients of the experiment.
+type ValidatedTrajectory struct {
+	ID         int      // ID of the trajectory in the previous run
+	Hash       string   // hash of the diagnosis codes, cf. TrajectoryHash
+	Codes      []string // codes of the diagnoses
+	Names      []string // medical terms of the diagnoses
+	Patients   []int    // nr of patients per transition in the previous run
+	Support    []int    // nr of patients of the experiment per transition
+	RR         []float64
+	Replicated bool
+}
+
+// ValidateTrajectories evaluates the trajectories of the given results of a previous run on the given patients of the
+// experiment, of which the RR scores are computed, cf. InitRR. The transitions must have the given minimum RR and nr
+// of patients, and the diagnoses of the patients are matched within the given time frame. Diagnoses of which the code
+// is not a diagnosis of the experiment are matched by no patient.
+func (exp *Experiment) ValidateTrajectories(results *Results, patients *PatientMap, minPatients int, minRR, minTime,
+	maxTime float64) []*ValidatedTrajectory {
+	diagnoses := map[int]*ResultDiagnosis{}
+	for _, d := range results.Diagnoses {
+		diagnoses[d.DID] = d
+	}
+	dids := map[string]int{}
+	for did, code := range exp.IdMap {
+		dids[code] = did
+	}
+	pids := patients.sortedPIDs()
+	var validated []*ValidatedTrajectory
+	for _, t := range results.Trajectories {
+		v := &ValidatedTrajectory{ID: t.ID, Hash: t.Hash, Patients: t.Patients, Replicated: true}
+		trajectory := make([]int, len(t.Diagnoses))
+		for i, did := range t.Diagnoses {
+			code := diagnoses[did].Code
+			v.Codes = append(v.Codes, code)
+			v.Names = append(v.Names, diagnoses[did].Name)
+			if d, ok := dids[code]; ok {
+				trajectory[i] = d
+			} else {
+				trajectory[i] = -1
+			}
+		}
+		for i := 1; i < len(trajectory); i++ {
+			d1, d2 := trajectory[i-1], trajectory[i]
+			support := 0
+			if d1 != -1 && d2 != -1 {
+				for _, pid := range pids {
+					if matchPatientTrajectory(patients.PIDMap[pid], trajectory[:i+1], minTime, maxTime) != nil {
+						support++
+					}
+				}
+				v.RR = append(v.RR, exp.DxDRR[d1][d2])
+				v.Replicated = v.Replicated && len(exp.DxDPatients[d1][d2]) >= minPatients &&
+					exp.selectionRR(d1, d2) > minRR && exp.directional(d1, d2)
+			} else {
+				v.RR = append(v.RR, 0)
+				v.Replicated = false
+			}
+			v.Support = append(v.Support, support)
+		}
+		v.Replicated = v.Replicated && v.Support[len(v.Support)-1] >= minPatients
+		validated = append(validated, v)
+	}
+	return validated
+}
+
+// WriteValidatedTrajectories writes the trajectories of a previous run evaluated on the experiment to a file
+// name-validation.tab, with a line per trajectory: the ID and hash of the trajectory in the previous run, the terms and
+// codes of the diagnoses, the comma separated nrs of patients of the transitions in the previous run, the comma
+// separated nrs of patients and RR scores of the transitions in the experiment, and whether the trajectory is
+// replicated (1 or 0): TID tab hash tab terms tab codes tab patients tab support tab RRs tab replicated. The counts of
+// patients of the experiment that are small cells are binned, cf. exp. It returns the file name.
+func WriteValidatedTrajectories(exp *Experiment, validated []*ValidatedTrajectory, path string) string {
+	name := filepath.Join(path, fmt.Sprintf("%s-validation.tab", exp.Name))
+	file, err := os.Create(name)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	for _, v := range validated {
+		patients, support, rrs := make([]string, len(v.Patients)), make([]string, len(v.Support)),
+			make([]string, len(v.RR))
+		for i, n := range v.Patients {
+			patients[i] = strconv.Itoa(n)
+		}
+		for i, n := range v.Support {
+			support[i] = fmt.Sprint(exp.cellValue(float64(n), n))
+		}
+		for i, rr := range v.RR {
+			rrs[i] = formatRRFloat(rr)
+		}
+		replicated := 0
+		if v.Replicated {
+			replicated = 1
+		}
+		fmt.Fprintf(file, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%d\n", v.ID, v.Hash, strings.Join(v.Names, " -> "),
+			strings.Join(v.Codes, " -> "), strings.Join(patients, ","), strings.Join(support, ","),
+			strings.Join(rrs, ","), replicated)
+	}
+	return name
+}
@@ -0,0 +1,214 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Parsing FHIR R4 data. Patients are read from Patient resources and diagnoses from Condition resources. The input files
+// may contain FHIR bundles, single resources, or ndjson as produced by a FHIR bulk data export, with one resource per
+// line. Patients and conditions can be in the same file or in separate files.
+
+// FHIR code systems for diagnosis codes.
+var fhirCodeSystems = map[string]string{
+	"http://hl7.org/fhir/sid/icd-10-cm":    CodeSystemICD10,
+	"http://hl7.org/fhir/sid/icd-10":       CodeSystemICD10,
+	"http://hl7.org/fhir/sid/icd-9-cm":     CodeSystemICD9,
+	"http://snomed.info/sct":               CodeSystemSNOMED,
+	"http://id.who.int/icd/release/11/mms": CodeSystemICD11,
+}
+
+// fhirResource contains the fields of the FHIR Bundle, Patient and Condition resources that are used for the analysis.
+type fhirResource struct {
+	ResourceType string `json:"resourceType"`
+	ID           string `json:"id"`
+	// Bundle
+	Entry []struct {
+		FullURL  string          `json:"fullUrl"`
+		Resource json.RawMessage `json:"resource"`
+	} `json:"entry"`
+	// Patient
+	Gender           string `json:"gender"`
+	BirthDate        string `json:"birthDate"`
+	DeceasedDateTime string `json:"deceasedDateTime"`
+	Address          []struct {
+		State   string `json:"state"`
+		Country string `json:"country"`
+	} `json:"address"`
+	// Condition
+	Subject struct {
+		Reference string `json:"reference"`
+	} `json:"subject"`
+	Code struct {
+		Coding []struct {
+			System string `json:"system"`
+			Code   string `json:"code"`
+		} `json:"coding"`
+	} `json:"code"`
+	OnsetDateTime string `json:"onsetDateTime"`
+	RecordedDate  string `json:"recordedDate"`
+}
+
+// readFHIRResources reads all resources from a file with FHIR bundles, resources, or ndjson, and calls the given
+// function for each resource. Resources in bundles are passed with the full URL of their bundle entry.
+func readFHIRResources(fileName string, f func(resource *fhirResource, fullURL string)) {
+	file, err := openInput(fileName)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	decoder := json.NewDecoder(file) // reads a sequence of json values, which covers both json and ndjson files
+	for {
+		resource := &fhirResource{}
+		if err := decoder.Decode(resource); err == io.EOF {
+			return
+		} else if err != nil {
+			panic(fmt.Sprint("Malformed FHIR resource in ", fileName, ": ", err))
+		}
+		visitFHIRResource(resource, "", f)
+	}
+}
+
+// visitFHIRResource calls the given function for a resource, or for each resource in a bundle.
+func visitFHIRResource(resource *fhirResource, fullURL string, f func(resource *fhirResource, fullURL string)) {
+	if resource.ResourceType != "Bundle" {
+		f(resource, fullURL)
+		return
+	}
+	for _, entry := range resource.Entry {
+		entryResource := &fhirResource{}
+		if err := json.Unmarshal(entry.Resource, entryResource); err != nil {
+			panic(fmt.Sprint("Malformed FHIR resource in bundle entry ", entry.FullURL, ": ", err))
+		}
+		visitFHIRResource(entryResource, entry.FullURL, f)
+	}
+}
+
+// parseFHIRDate parses a FHIR date or dateTime. Missing months and days are taken to be the first month and day.
+func parseFHIRDate(date string) (DiagnosisDate, error) {
+	if i := strings.IndexByte(date, 'T'); i != -1 {
+		date = date[:i]
+	}
+	for _, layout := range []string{"2006-01-02", "2006-01", "2006"} {
+		if t, err := time.Parse(layout, date); err == nil {
+			return DiagnosisDate{Year: t.Year(), Month: int(t.Month()), Day: t.Day()}, nil
+		}
+	}
+	return DiagnosisDate{}, errors.New("invalid FHIR date: " + date)
+}
+
+// fhirSexCodes maps FHIR administrative genders onto the sex codes of the patient loader.
+var fhirSexCodes = map[string]string{"male": "M", "female": "F"}
+
+// parseFHIRPatients parses the Patient resources in a file. Patients without a valid birth date are skipped. It returns
+// the PatientMap, the number of regions, and a map from the references used for the patients in bundles (full URLs) to
+// their patient IDs.
+func parseFHIRPatients(file string, nofCohortAges int, duplicates *DuplicateReport) (*PatientMap, int, map[string]string) {
+	loader := newPatientLoader(duplicates)
+	references := map[string]string{}
+	skipped := 0
+	readFHIRResources(file, func(resource *fhirResource, fullURL string) {
+		if resource.ResourceType != "Patient" {
+			return
+		}
+		birthDate, err := parseFHIRDate(resource.BirthDate)
+		if resource.ID == "" || err != nil {
+			skipped++
+			return //skip patients without id or birth date
+		}
+		var dateOfDeath *DiagnosisDate
+		if d, err := parseFHIRDate(resource.DeceasedDateTime); err == nil {
+			dateOfDeath = &d
+		}
+		region := ""
+		if len(resource.Address) > 0 {
+			region = resource.Address[0].State
+			if region == "" {
+				region = resource.Address[0].Country
+			}
+		}
+		loader.add(resource.ID, fhirSexCodes[resource.Gender], birthDate.Year, dateOfDeath, region)
+		if fullURL != "" {
+			references[fullURL] = resource.ID
+		}
+	})
+	fmt.Println("Skipped ", skipped, " FHIR patients without id or birth date.")
+	patients, nofRegions := loader.finish(nofCohortAges)
+	return patients, nofRegions, references
+}
+
+// fhirPatientID returns the patient ID for a reference to a patient, either relative (Patient/id) or a full URL of a
+// bundle entry.
+func fhirPatientID(reference string, references map[string]string) string {
+	if id, ok := references[reference]; ok {
+		return id
+	}
+	return strings.TrimPrefix(reference, "Patient/")
+}
+
+// parseFHIRConditions parses the Condition resources in a file, and fills in the diagnoses of the given patients. Only
+// ICD-10, ICD-9, ICD-11, and SNOMED CT codings are used, preferably of the code system of the vocabulary. The diagnosis
+// date is the onset date, or else the recorded date. Conditions without a date are skipped. It returns a report of the
+// diagnosis codes that could not be mapped.
+func parseFHIRConditions(file, treatmentInfoFile string, treatmentSchema *TreatmentSchema, patients *PatientMap,
+	references map[string]string, icd10AnalysisMap AnalysisMaps, icd9ToIcd10Map map[string]string,
+	duplicates *DuplicateReport, report *ValidationReport) *UnmappedCodeReport {
+	loader := newDiagnosisLoader(patients, icd10AnalysisMap, icd9ToIcd10Map, duplicates)
+	skipped := 0
+	readFHIRResources(file, func(resource *fhirResource, _ string) {
+		if resource.ResourceType != "Condition" {
+			return
+		}
+		date, err := parseFHIRDate(resource.OnsetDateTime)
+		if err != nil {
+			if date, err = parseFHIRDate(resource.RecordedDate); err != nil {
+				skipped++
+				return //skip conditions without date
+			}
+		}
+		pidString := fhirPatientID(resource.Subject.Reference, references)
+		codeSystem, code := "", ""
+		for _, coding := range resource.Code.Coding {
+			if system, ok := fhirCodeSystems[coding.System]; ok && (code == "" || system == loader.vocabulary()) {
+				codeSystem, code = system, coding.Code
+			}
+			if codeSystem == loader.vocabulary() {
+				break // use the first coding of the vocabulary, or else the first supported coding
+			}
+		}
+		if code == "" {
+			skipped++
+			return
+		}
+		loader.add(pidString, codeSystem, code, date)
+	})
+	fmt.Println("Skipped ", skipped, " FHIR conditions without date or supported coding.")
+	fillInTreatments(treatmentInfoFile, treatmentSchema, patients, icd10AnalysisMap, report)
+	return loader.finish()
+}
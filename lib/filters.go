@@ -78,6 +78,8 @@ func GetPatientFilter(s string, tinfo map[string][]*TumorInfo) PatientFilter {
 		return NMIBCAggregator(tinfo)
 	case "mUC":
 		return MUCAggregator(tinfo)
+	case HistologyUrothelial, HistologySquamous, HistologyAdenocarcinoma, HistologyNeuroendocrine:
+		return HistologyAggregator(s, tinfo)
 	default:
 		return id
 	}
@@ -150,6 +152,18 @@ func cancerStageAggregator(predicate func(tInfo *TumorInfo) bool, tInfoMap map[s
 	}
 }
 
+// HistologyAggregator collects patients with a bladder tumor of the given histology, cf. ICDO3Histology.
+func HistologyAggregator(histology string, tinfoMap map[string][]*TumorInfo) PatientFilter {
+	return func(p *Patient) bool {
+		for _, tInfo := range tinfoMap[p.PIDString] {
+			if tInfo.Histology == histology {
+				return true
+			}
+		}
+		return false
+	}
+}
+
 // NMIBCAggregator checks all patients if they match the cancer criteria to be defined as non muscle invasive bladder
 // cancer patients.
 func NMIBCAggregator(tinfoMap map[string][]*TumorInfo) PatientFilter {
@@ -451,11 +465,10 @@ func EOIAfterFilter() PatientFilter {
 // ageLessAggregator collects all patients younger than a specific age or trims down their data up until that age.
 func ageLessAggregator(age int) PatientFilter {
 	return func(p *Patient) bool {
-		fYear := p.YOB + age - 1 // last year with diagnosis accepted
 		//remove all diagnoses past a specific age
 		newD := []*Diagnosis{}
 		for _, d := range p.Diagnoses {
-			if d.Date.Year > fYear {
+			if AgeAt(p, d.Date) >= age {
 				break
 			}
 			newD = append(newD, d)
@@ -471,11 +484,10 @@ func ageLessAggregator(age int) PatientFilter {
 // ageAboveAggretator collects all patients older than a specific age and removes all diagnoses before that date.
 func ageAboveAggregator(age int) PatientFilter {
 	return func(p *Patient) bool {
-		mYear := p.YOB + age // min year with diagnosis accepted
 		//remove all diagnoses before a specific age
 		newD := []*Diagnosis{}
 		for _, d := range p.Diagnoses {
-			if d.Date.Year <= mYear {
+			if AgeAt(p, d.Date) < age {
 				continue
 			}
 			newD = append(newD, d)
@@ -0,0 +1,79 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import "math"
+
+// Fisher's exact test of the diagnosis pairs. InitRR estimates the p-value of d1 -> d2 by sampling comparison groups,
+// which is noisy for rare diagnosis pairs, where a handful of patients makes the difference. The exact test instead
+// compares the exposed group with a single sampled comparison group, i.e. the patients without d1 from similar cohorts
+// or the matched controls, and computes the one-sided p-value of the 2x2 table of the cases and non-cases of d2 in
+// both groups from the hypergeometric distribution. The test is selected per experiment, or automatically for pairs
+// with low counts, as estimated from the expected nr of d2 diagnoses in similar cohorts, cf. probNotExposed.
+
+// Tests of the significance of the diagnosis pairs.
+const (
+	PairTestSampling = "sampling" // sample comparison groups, cf. InitRR
+	PairTestFisher   = "fisher"   // Fisher's exact test
+	PairTestAuto     = "auto"     // Fisher's exact test for pairs with low counts, sampling otherwise
+)
+
+// pairTestAutoMaxCount is the nr of d2 diagnoses in the exposed or comparison group below which the auto test uses
+// Fisher's exact test.
+const pairTestAutoMaxCount = 10
+
+// fisherTermPrecision is the relative size of the terms of the p-value below which the remaining terms are dropped.
+const fisherTermPrecision = 1e-15
+
+// logChoose returns the logarithm of the binomial coefficient n over k.
+func logChoose(n, k int) float64 {
+	lgn, _ := math.Lgamma(float64(n + 1))
+	lgk, _ := math.Lgamma(float64(k + 1))
+	lgnk, _ := math.Lgamma(float64(n - k + 1))
+	return lgn - lgk - lgnk
+}
+
+// fisherExactGreater returns the one-sided p-value of Fisher's exact test for the 2x2 table with a cases and b
+// non-cases in the first group, and c cases and d non-cases in the second group: the probability of at least a cases
+// in the first group, given the sizes of the groups and the total nr of cases.
+func fisherExactGreater(a, b, c, d int) float64 {
+	n1, n2, cases := a+b, c+d, a+c
+	total := logChoose(n1+n2, cases)
+	pValue := 0.0
+	for x := a; x <= n1 && x <= cases; x++ {
+		term := math.Exp(logChoose(n1, x) + logChoose(n2, cases-x) - total)
+		pValue += term
+		if x > a && term < pValue*fisherTermPrecision {
+			break // the terms decrease beyond the mode of the distribution
+		}
+	}
+	return math.Min(pValue, 1.0)
+}
+
+// useFisherTest checks if the diagnosis pair with the given nr of d2 diagnoses in the exposed group and expected nr
+// of d2 diagnoses in the comparison group is tested with Fisher's exact test.
+func (exp *Experiment) useFisherTest(exposedD2, comparisonD2 float64) bool {
+	switch exp.PairTest {
+	case PairTestFisher:
+		return true
+	case PairTestAuto:
+		return exposedD2 < pairTestAutoMaxCount || comparisonD2 < pairTestAutoMaxCount
+	}
+	return false
+}
@@ -0,0 +1,178 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Plotting of trajectories in GraphML. The GraphML files hold the same graphs as the GML files, cf. printTrajectories
+// and printIndividualTrajectories, with typed node and edge attributes, which tools such as Gephi and yEd import
+// without conversion. Unlike in GML, the ids of the nodes are unique in a GraphML document, so the merged graph has a
+// single node per diagnosis, and the nodes of the individual graphs are prefixed with the trajectory ID.
+
+// graphMLHeader opens a GraphML document and declares the attributes of the nodes and edges.
+const graphMLHeader = `<?xml version="1.0" encoding="UTF-8"?>
+<graphml xmlns="http://graphml.graphdrawing.org/xmlns" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance"
+	xsi:schemaLocation="http://graphml.graphdrawing.org/xmlns http://graphml.graphdrawing.org/xmlns/1.0/graphml.xsd">
+	<key id="did" for="node" attr.name="did" attr.type="int"/>
+	<key id="label" for="node" attr.name="label" attr.type="string"/>
+	<key id="code" for="node" attr.name="code" attr.type="string"/>
+	<key id="level" for="node" attr.name="level" attr.type="int"/>
+	<key id="cat0" for="node" attr.name="cat0" attr.type="string"/>
+	<key id="cat1" for="node" attr.name="cat1" attr.type="string"/>
+	<key id="cat2" for="node" attr.name="cat2" attr.type="string"/>
+	<key id="cat3" for="node" attr.name="cat3" attr.type="string"/>
+	<key id="cat4" for="node" attr.name="cat4" attr.type="string"/>
+	<key id="cat5" for="node" attr.name="cat5" attr.type="string"/>
+	<key id="tid" for="edge" attr.name="tid" attr.type="int"/>
+	<key id="thash" for="edge" attr.name="thash" attr.type="string"/>
+	<key id="tlen" for="edge" attr.name="tlen" attr.type="int"/>
+	<key id="tidx" for="edge" attr.name="tidx" attr.type="int"/>
+	<key id="patients" for="edge" attr.name="patients" attr.type="int"/>
+	<key id="RR" for="edge" attr.name="RR" attr.type="double"/>
+	<key id="gapMin" for="edge" attr.name="gapMin" attr.type="int"/>
+	<key id="gapQ1" for="edge" attr.name="gapQ1" attr.type="int"/>
+	<key id="gapMedian" for="edge" attr.name="gapMedian" attr.type="int"/>
+	<key id="gapQ3" for="edge" attr.name="gapQ3" attr.type="int"/>
+	<key id="gapIQR" for="edge" attr.name="gapIQR" attr.type="int"/>
+	<key id="gapMax" for="edge" attr.name="gapMax" attr.type="int"/>
+`
+
+// graphMLClusterKey declares the cluster attribute of the edges of the GraphML documents of clustered trajectories.
+const graphMLClusterKey = "\t<key id=\"cluster\" for=\"edge\" attr.name=\"cluster\" attr.type=\"int\"/>\n"
+
+// graphMLText escapes a string for use in a GraphML document.
+func graphMLText(s string) string {
+	var escaped strings.Builder
+	xml.EscapeText(&escaped, []byte(s))
+	return escaped.String()
+}
+
+// printGraphMLNode prints a diagnosis as a GraphML node with the given id.
+func printGraphMLNode(id string, did int, exp *Experiment, w io.Writer) {
+	icd10 := exp.Icd10Map[did]
+	fmt.Fprintf(w, "\t\t<node id=\"%s\">\n", id)
+	fmt.Fprintf(w, "\t\t\t<data key=\"did\">%d</data>\n", did)
+	fmt.Fprintf(w, "\t\t\t<data key=\"label\">%s</data>\n", graphMLText(icd10.Name))
+	fmt.Fprintf(w, "\t\t\t<data key=\"code\">%s</data>\n", graphMLText(exp.IdMap[did]))
+	fmt.Fprintf(w, "\t\t\t<data key=\"level\">%d</data>\n", icd10.Level)
+	for idx, cat := range icd10.Categories {
+		if cat == "NONE" {
+			break
+		}
+		fmt.Fprintf(w, "\t\t\t<data key=\"cat%d\">%s</data>\n", idx, graphMLText(cat))
+	}
+	fmt.Fprintf(w, "\t\t</node>\n")
+}
+
+// printGraphMLEdges prints the transitions of a trajectory as GraphML edges between the nodes with the given prefix.
+// If clustered, the edges carry the cluster of the trajectory.
+func printGraphMLEdges(trajectory *Trajectory, exp *Experiment, prefix string, clustered bool, w io.Writer) {
+	diagnoses := trajectory.Diagnoses
+	tlen := len(diagnoses) - 1
+	for idx := 0; idx < tlen; idx++ {
+		source := diagnoses[idx]
+		target := diagnoses[idx+1]
+		fmt.Fprintf(w, "\t\t<edge id=\"t%d.e%d\" source=\"%s%d\" target=\"%s%d\">\n", trajectory.ID, idx, prefix, source,
+			prefix, target)
+		fmt.Fprintf(w, "\t\t\t<data key=\"tid\">%d</data>\n", trajectory.ID)
+		fmt.Fprintf(w, "\t\t\t<data key=\"thash\">%s</data>\n", trajectory.Hash)
+		fmt.Fprintf(w, "\t\t\t<data key=\"tlen\">%d</data>\n", tlen)
+		fmt.Fprintf(w, "\t\t\t<data key=\"tidx\">%d</data>\n", idx)
+		fmt.Fprintf(w, "\t\t\t<data key=\"patients\">%d</data>\n", trajectory.PatientNumbers[idx])
+		fmt.Fprintf(w, "\t\t\t<data key=\"RR\">%s</data>\n",
+			strconv.FormatFloat(exp.DxDRR[source][target], 'f', 2, 64))
+		if gaps := trajectory.transitionGaps(idx); gaps != nil {
+			for _, gap := range gaps.attributes() {
+				fmt.Fprintf(w, "\t\t\t<data key=\"%s\">%d</data>\n", gap.name, gap.days)
+			}
+		}
+		if clustered {
+			fmt.Fprintf(w, "\t\t\t<data key=\"cluster\">%d</data>\n", trajectory.Cluster)
+		}
+		fmt.Fprintf(w, "\t\t</edge>\n")
+	}
+}
+
+// printTrajectoriesGraphML plots the given trajectories of an experiment as a single graph to a GraphML file, cf.
+// printTrajectories.
+func printTrajectoriesGraphML(exp *Experiment, trajectories []*Trajectory, clustered bool, name string) {
+	file, err := os.Create(name)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	fmt.Fprint(file, graphMLHeader)
+	if clustered {
+		fmt.Fprint(file, graphMLClusterKey)
+	}
+	fmt.Fprintf(file, "\t<graph id=\"%s\" edgedefault=\"directed\">\n", graphMLText(exp.Name))
+	printed := map[int]bool{}
+	for _, t := range trajectories {
+		for _, did := range t.Diagnoses {
+			if !printed[did] {
+				printed[did] = true
+				printGraphMLNode(fmt.Sprint("n", did), did, exp, file)
+			}
+		}
+	}
+	for _, t := range trajectories {
+		printGraphMLEdges(t, exp, "n", clustered, file)
+	}
+	fmt.Fprintf(file, "\t</graph>\n</graphml>\n")
+}
+
+// printIndividualTrajectoriesGraphML prints each trajectory as a separate graph to the same GraphML file, cf.
+// printIndividualTrajectories.
+func printIndividualTrajectoriesGraphML(exp *Experiment, name string) {
+	file, err := os.Create(name)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	fmt.Fprint(file, graphMLHeader)
+	for _, t := range exp.Trajectories {
+		prefix := fmt.Sprintf("t%d.n", t.ID)
+		fmt.Fprintf(file, "\t<graph id=\"t%d\" edgedefault=\"directed\">\n", t.ID)
+		printed := map[int]bool{}
+		for _, did := range t.Diagnoses {
+			if !printed[did] {
+				printed[did] = true
+				printGraphMLNode(fmt.Sprint(prefix, did), did, exp, file)
+			}
+		}
+		printGraphMLEdges(t, exp, prefix, false, file)
+		fmt.Fprintf(file, "\t</graph>\n")
+	}
+	fmt.Fprintf(file, "</graphml>\n")
+}
@@ -0,0 +1,211 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"fmt"
+	"github.com/exascience/pargo/parallel"
+	"math"
+	"sort"
+)
+
+// Hazard ratios of the diagnosis pairs, as a time-to-event alternative to the RR scores. The RR of d1 -> d2 only counts
+// whether d2 follows d1 within the time frame, while the hazard ratio also takes into account how soon d2 follows, and
+// for how long the patients are observed. The patients with d1 are followed from their first d1 diagnosis until their
+// first d2 diagnosis, and are censored at their death or their last diagnosis, the end of their observation. Each of
+// them is compared with controls from the same cohort and region without d1, cf. controlRatio, that are followed from
+// the same index date. The hazard ratio is estimated with a Cox proportional-hazards model with d1 as the only
+// covariate, with Breslow's approximation for tied event times.
+
+// Newton-Raphson iterations of the Cox model.
+const (
+	coxMaxIterations = 50    // maximum nr of iterations
+	coxPrecision     = 1e-10 // change of the log hazard ratio below which the iterations stop
+)
+
+// SurvivalTime is the follow-up of a patient for the hazard ratio of a diagnosis pair.
+type SurvivalTime struct {
+	Years   float64 // years from the index date until the event or the censoring
+	Event   bool    // whether the follow-up ends with d2
+	Exposed bool    // whether the patient has d1
+}
+
+// followUp returns the follow-up of a patient from an index date until the first diagnosis d2 after it, censored at the
+// death of the patient, the last diagnosis of the patient, or after maxYears. It returns false if the patient is not at
+// risk at the index date: the patient is not yet observed, has d2 before or on the index date, or is not observed after
+// it.
+func followUp(p *Patient, index DiagnosisDate, d2 int, maxYears float64) (SurvivalTime, bool) {
+	if len(p.Diagnoses) == 0 || DiagnosisDateSmallerThan(index, p.Diagnoses[0].Date) {
+		return SurvivalTime{}, false
+	}
+	end := p.Diagnoses[len(p.Diagnoses)-1].Date
+	if p.DeathDate != nil && DiagnosisDateSmallerThan(*p.DeathDate, end) {
+		end = *p.DeathDate
+	}
+	event := false
+	for _, d := range p.Diagnoses {
+		if d.DID != d2 {
+			continue
+		}
+		if !DiagnosisDateSmallerThan(index, d.Date) {
+			return SurvivalTime{}, false
+		}
+		if DiagnosisDateSmallerThan(d.Date, end) || d.Date == end {
+			end, event = d.Date, true
+		}
+		break
+	}
+	years := float64(DaysBetween(index, end)) / 365.25
+	if years <= 0 {
+		return SurvivalTime{}, false
+	}
+	if years > maxYears {
+		years, event = maxYears, false
+	}
+	return SurvivalTime{Years: years, Event: event}, true
+}
+
+// coxHazardRatio returns the hazard ratio of the exposed versus the unexposed patients of the given follow-ups, from a
+// Cox proportional-hazards model with the exposure as the only covariate. Tied event times are handled with Breslow's
+// approximation. The hazard ratio is 0 if no exposed patient has the event, +Inf if only exposed patients have it, and
+// NaN if no patient has it.
+func coxHazardRatio(times []SurvivalTime) float64 {
+	sort.Slice(times, func(i, j int) bool {
+		return times[i].Years > times[j].Years
+	})
+	// collect the nr of unexposed and exposed patients at risk, and the nr of all and exposed events, per event time
+	type eventTime struct {
+		atRisk0, atRisk1, events, events1 float64
+	}
+	var eventTimes []eventTime
+	atRisk0, atRisk1, events, events1 := 0.0, 0.0, 0.0, 0.0
+	for i := 0; i < len(times); {
+		e := eventTime{}
+		j := i
+		for ; j < len(times) && times[j].Years == times[i].Years; j++ {
+			if times[j].Exposed {
+				atRisk1++
+			} else {
+				atRisk0++
+			}
+			if times[j].Event {
+				e.events++
+				if times[j].Exposed {
+					e.events1++
+				}
+			}
+		}
+		if e.events > 0 {
+			e.atRisk0, e.atRisk1 = atRisk0, atRisk1
+			eventTimes = append(eventTimes, e)
+			events, events1 = events+e.events, events1+e.events1
+		}
+		i = j
+	}
+	switch {
+	case events == 0:
+		return math.NaN()
+	case events1 == 0:
+		return 0
+	case events1 == events:
+		return math.Inf(1)
+	}
+	// maximize the partial likelihood of the log hazard ratio with Newton-Raphson
+	beta := 0.0
+	for i := 0; i < coxMaxIterations; i++ {
+		score, information := 0.0, 0.0
+		for _, e := range eventTimes {
+			risk1 := e.atRisk1 * math.Exp(beta)
+			p := risk1 / (e.atRisk0 + risk1)
+			score += e.events1 - e.events*p
+			information += e.events * p * (1 - p)
+		}
+		if information == 0 {
+			break
+		}
+		step := score / information
+		beta += step
+		if math.Abs(step) < coxPrecision {
+			break
+		}
+	}
+	return math.Exp(beta)
+}
+
+// firstDiagnosisDate returns the date of the first diagnosis d of a patient, which the patient must have.
+func firstDiagnosisDate(p *Patient, d int) DiagnosisDate {
+	for _, diagnosis := range p.Diagnoses {
+		if diagnosis.DID == d {
+			return diagnosis.Date
+		}
+	}
+	panic(fmt.Sprint("Disease d: ", d, " not present in patient"))
+}
+
+// hazardRatio returns the hazard ratio of d1 -> d2, or NaN if it is unknown, cf. InitHazardRatios.
+func (exp *Experiment) hazardRatio(d1, d2 int) float64 {
+	if exp.DxDHazardRatios == nil || exp.DxDHazardRatios[d1] == nil {
+		return math.NaN()
+	}
+	return exp.DxDHazardRatios[d1][d2]
+}
+
+// InitHazardRatios computes the hazard ratios of the diagnosis pairs with an RR score, cf. InitRR, with follow-ups of
+// at most maxYears, the time frame of the RR scores. This requires the patients per diagnosis and the cohorts, cf.
+// DPatients and Cohorts.
+func (exp *Experiment) InitHazardRatios(maxYears float64) {
+	fmt.Println("Computing the hazard ratios of the diagnosis pairs...")
+	exp.DxDHazardRatios = make([][]float64, exp.NofDiagnosisCodes)
+	ratio := exp.controlRatio()
+	parallel.Range(0, exp.NofDiagnosisCodes, 0, func(low, high int) {
+		for d1 := low; d1 < high; d1++ {
+			exposed := exp.DPatients[d1]
+			pids := patientsToIdMap(exposed)
+			for d2, patients := range exp.DxDPatients[d1] {
+				if len(patients) == 0 {
+					continue
+				}
+				if exp.DxDHazardRatios[d1] == nil {
+					exp.DxDHazardRatios[d1] = make([]float64, exp.NofDiagnosisCodes)
+					for i := range exp.DxDHazardRatios[d1] {
+						exp.DxDHazardRatios[d1][i] = math.NaN()
+					}
+				}
+				rng := exp.Rand(hazardStreams + uint64(d1*exp.NofDiagnosisCodes+d2))
+				var times []SurvivalTime
+				for _, p := range exposed {
+					index := firstDiagnosisDate(p, d1)
+					if t, ok := followUp(p, index, d2, maxYears); ok {
+						t.Exposed = true
+						times = append(times, t)
+					}
+					cohort := exp.comparisonCohort(p, d1)
+					for i := 0; i < ratio; i++ {
+						if control := drawControl(cohort.Patients, p.Region, pids, rng); control != nil {
+							if t, ok := followUp(control, index, d2, maxYears); ok {
+								times = append(times, t)
+							}
+						}
+					}
+				}
+				exp.DxDHazardRatios[d1][d2] = coxHazardRatio(times)
+			}
+		}
+	})
+}
@@ -0,0 +1,193 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/imec-int/ptra/lib/utils"
+	"strings"
+)
+
+// Reading the ICD-11 vocabulary. The WHO publishes the ICD-11 Mortality and Morbidity Statistics (MMS) linearization as
+// a tab separated file with a row per chapter, block, and category, in the order of the classification. The dashes in
+// front of the titles give the depth of the rows in the hierarchy, so that diagnoses can be grouped on a level of the
+// hierarchy, as for ICD-10. Datasets that mix ICD-10 and ICD-11 codes are harmonized by mapping the ICD-10 codes onto
+// ICD-11 codes.
+
+// icd11ExcludedChapters are the chapters of ICD-11 that are excluded from analysis, cf. the excluded chapters of ICD-10,
+// and the chapters that do not classify diagnoses: functioning assessment (V) and extension codes (X).
+var icd11ExcludedChapters = map[string]bool{
+	"18": true, // Pregnancy, childbirth or the puerperium
+	"19": true, // Certain conditions originating in the perinatal period
+	"21": true, // Symptoms, signs or clinical findings, not elsewhere classified
+	"22": true, // Injury, poisoning or certain other consequences of external causes
+	"23": true, // External causes of morbidity or mortality
+	"24": true, // Factors influencing health status or contact with health services
+	"V":  true, // Supplementary section for functioning assessment
+	"X":  true, // Extension codes
+}
+
+// icd11AnalysisMaps maps ICD-11 MMS codes onto analysis DIDs. Its Icd10Map describes ICD-11 codes rather than ICD-10
+// codes.
+type icd11AnalysisMaps struct {
+	icd10AnalysisMapsFromXML
+	ICD10ToICD11Map map[string]string // maps ICD-10 codes onto ICD-11 codes
+}
+
+// icd11StemCode returns the stem code of an ICD-11 code, without the codes that are postcoordinated with & or /, e.g.
+// 2C94.0&XH0GJ3 becomes 2C94.0.
+func icd11StemCode(code string) string {
+	if i := strings.IndexAny(code, "&/"); i != -1 {
+		return code[:i]
+	}
+	return code
+}
+
+func (analysisMap icd11AnalysisMaps) fillInPatientDiagnoses(patient *Patient, DIDString string, date DiagnosisDate) int {
+	return analysisMap.icd10AnalysisMapsFromXML.fillInPatientDiagnoses(patient, icd11StemCode(DIDString), date)
+}
+
+func (analysisMap icd11AnalysisMaps) isExcluded(icd11Code string) bool {
+	return analysisMap.Excluded[icd11StemCode(icd11Code)]
+}
+
+func (analysisMap icd11AnalysisMaps) codeSystem() string {
+	return CodeSystemICD11
+}
+
+// isEventOfInterest checks if the ICD-11 code is a bladder cancer, cf. TriNetXEventOfInterest.
+func (analysisMap icd11AnalysisMaps) isEventOfInterest(code string) bool {
+	return strings.HasPrefix(code, "2C94")
+}
+
+func (analysisMap icd11AnalysisMaps) fromICD10(icd10Code string) (string, bool) {
+	code, ok := analysisMap.ICD10ToICD11Map[icd10Code]
+	return code, ok
+}
+
+// icd11Depth splits the title of a row of the ICD-11 linearization into its depth, the number of dashes in front of
+// it, and the title without dashes.
+func icd11Depth(title string) (int, string) {
+	depth := 0
+	for strings.HasPrefix(title, "-") {
+		depth++
+		title = strings.TrimSpace(title[1:])
+	}
+	return depth, title
+}
+
+// isICD11Linearization checks if a file is an ICD-11 linearization, by the Code and Title columns in its header.
+func isICD11Linearization(file string) bool {
+	f, err := openInput(file)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	header, _ := bufio.NewReader(f).ReadString('\n')
+	columns := map[string]bool{}
+	for _, column := range strings.Split(header, "\t") {
+		columns[strings.TrimSpace(column)] = true
+	}
+	return columns["Code"] && columns["Title"]
+}
+
+// initializeICD11NameMap reads the ICD-11 MMS linearization from a tab separated file, and returns a map ICD-11 code ->
+// entry (title, titles of the ancestors, level), and the set of codes of the excluded chapters. Chapters and blocks
+// have no code, but are the ancestors of the categories. As for ICD-10, at most 6 levels are distinguished.
+func initializeICD11NameMap(file string) (map[string]Icd10Entry, map[string]bool) {
+	icd11Map := map[string]Icd10Entry{}
+	excluded := map[string]bool{}
+	var ancestors []string // titles of the ancestors of the current row
+	err := readCSVTable(file, []string{"Code", "Title", "ChapterNo"}, func(values []string) {
+		depth, title := icd11Depth(values[1])
+		if depth > len(ancestors) {
+			depth = len(ancestors) // rows without dashes for all of their ancestors
+		}
+		ancestors = append(ancestors[:depth], title)
+		code := values[0]
+		if code == "" {
+			return // chapter or block
+		}
+		if icd11ExcludedChapters[values[2]] {
+			excluded[code] = true
+			return
+		}
+		entry := Icd10Entry{Name: title, Categories: [6]string{"NONE", "NONE", "NONE", "NONE", "NONE", "NONE"}}
+		for i := 0; i < depth && i < len(entry.Categories); i++ {
+			entry.Categories[i] = ancestors[i]
+		}
+		entry.Level = utils.MinInt(depth, len(entry.Categories))
+		icd11Map[code] = entry
+	})
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println("Parsed ", len(icd11Map), " ICD-11 codes.")
+	return icd11Map, excluded
+}
+
+// parseIcd10ToIcd11Mapping reads a mapping from ICD-10 to ICD-11 codes. This is either a json file that maps ICD-10
+// codes onto ICD-11 codes, or the tab separated 10To11MapToOneCategory file of the WHO, with icd10Code and icd11Code
+// columns. The ICD-10 codes are normalized, cf. normalizeICDCode.
+func parseIcd10ToIcd11Mapping(file string) map[string]string {
+	mapping := map[string]string{}
+	if inputExt(file) == ".json" {
+		fmt.Println("Parsing ICD10 to ICD11 mapping from a json file.")
+		jsonFile, err := openInput(file)
+		if err != nil {
+			panic(err)
+		}
+		defer jsonFile.Close()
+		codes := map[string]string{}
+		if err := json.NewDecoder(jsonFile).Decode(&codes); err != nil {
+			panic(fmt.Sprint(file, ": ", err))
+		}
+		for icd10Code, icd11Code := range codes {
+			mapping[normalizeICDCode(CodeSystemICD10, icd10Code)] = icd11Code
+		}
+		return mapping
+	}
+	fmt.Println("Parsing ICD10 to ICD11 mapping from a WHO mapping table.")
+	err := readCSVTable(file, []string{"icd10Code", "icd11Code"}, func(values []string) {
+		if values[0] != "" && values[1] != "" {
+			mapping[normalizeICDCode(CodeSystemICD10, values[0])] = values[1]
+		}
+	})
+	if err != nil {
+		panic(err)
+	}
+	return mapping
+}
+
+// initializeICD11AnalysisMaps returns a map ICD-11 code -> internal analysis DID and a map analysis DID -> medical Name
+// for the ICD-11 MMS linearization passed as a tab separated file and a requested hierarchy Level. Level 0 are the
+// chapters. ICD-10 codes are mapped onto ICD-11 codes with the given mapping file, if any. The custom events are added
+// after the codes, nil for the default bladder cancer events.
+func initializeICD11AnalysisMaps(file string, level int, icd10ToIcd11File string, events []*CustomEvent) icd11AnalysisMaps {
+	icd11Map, excluded := initializeICD11NameMap(file)
+	analysisIdMap, analysisMap, ctr, _ := initializeIcd10AnalysisMaps(icd11Map, level, events)
+	icd10ToIcd11Map := map[string]string{}
+	if icd10ToIcd11File != "" {
+		icd10ToIcd11Map = parseIcd10ToIcd11Mapping(icd10ToIcd11File)
+	}
+	return icd11AnalysisMaps{icd10AnalysisMapsFromXML: icd10AnalysisMapsFromXML{DIDMap: analysisIdMap,
+		Icd10Map: analysisMap, NofDiagnosisCodes: ctr, Excluded: excluded}, ICD10ToICD11Map: icd10ToIcd11Map}
+}
@@ -0,0 +1,190 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+)
+
+// Reading the ICD-9-CM vocabulary. The CMS publishes the ICD-9-CM diagnosis codes as a list of codes with their
+// descriptions, e.g. CMS32_DESC_LONG_DX.txt. The hierarchy of ICD-9-CM follows from the codes: the chapters are ranges
+// of 3 digit categories, and each digit after the category is one level deeper, so that ICD-9 coded datasets can be
+// analysed on a level of the hierarchy without converting them to ICD-10.
+
+// icd9Chapter is a chapter of ICD-9-CM, a range of categories.
+type icd9Chapter struct {
+	first, last string // first and last category of the chapter
+	name        string
+}
+
+// icd9Chapters are the chapters of ICD-9-CM, including the supplementary classifications of V and E codes.
+var icd9Chapters = []icd9Chapter{
+	{"001", "139", "Infectious and parasitic diseases (001-139)"},
+	{"140", "239", "Neoplasms (140-239)"},
+	{"240", "279", "Endocrine, nutritional and metabolic diseases, and immunity disorders (240-279)"},
+	{"280", "289", "Diseases of the blood and blood-forming organs (280-289)"},
+	{"290", "319", "Mental disorders (290-319)"},
+	{"320", "389", "Diseases of the nervous system and sense organs (320-389)"},
+	{"390", "459", "Diseases of the circulatory system (390-459)"},
+	{"460", "519", "Diseases of the respiratory system (460-519)"},
+	{"520", "579", "Diseases of the digestive system (520-579)"},
+	{"580", "629", "Diseases of the genitourinary system (580-629)"},
+	{"630", "679", "Complications of pregnancy, childbirth, and the puerperium (630-679)"},
+	{"680", "709", "Diseases of the skin and subcutaneous tissue (680-709)"},
+	{"710", "739", "Diseases of the musculoskeletal system and connective tissue (710-739)"},
+	{"740", "759", "Congenital anomalies (740-759)"},
+	{"760", "779", "Certain conditions originating in the perinatal period (760-779)"},
+	{"780", "799", "Symptoms, signs, and ill-defined conditions (780-799)"},
+	{"800", "999", "Injury and poisoning (800-999)"},
+	{"V01", "V91", "Supplementary classification of factors influencing health status and contact with health services (V01-V91)"},
+	{"E000", "E999", "Supplementary classification of external causes of injury and poisoning (E000-E999)"},
+}
+
+// icd9ExcludedChapters are the chapters of ICD-9-CM that are excluded from analysis, cf. the excluded chapters of ICD-10.
+var icd9ExcludedChapters = map[string]bool{
+	"630":  true, // Complications of pregnancy, childbirth, and the puerperium
+	"760":  true, // Certain conditions originating in the perinatal period
+	"780":  true, // Symptoms, signs, and ill-defined conditions
+	"800":  true, // Injury and poisoning
+	"V01":  true, // Factors influencing health status and contact with health services
+	"E000": true, // External causes of injury and poisoning
+}
+
+// icd9AnalysisMaps maps ICD-9-CM codes onto analysis DIDs. Its Icd10Map describes ICD-9 codes rather than ICD-10 codes.
+type icd9AnalysisMaps struct {
+	icd10AnalysisMapsFromXML
+}
+
+func (analysisMap icd9AnalysisMaps) codeSystem() string {
+	return CodeSystemICD9
+}
+
+// isEventOfInterest checks if the ICD-9 code is related to bladder cancer, cf. TriNetXEventOfInterest.
+func (analysisMap icd9AnalysisMaps) isEventOfInterest(code string) bool {
+	return strings.HasPrefix(code, "188") || code == "V10.51"
+}
+
+func (analysisMap icd9AnalysisMaps) fromICD10(string) (string, bool) {
+	return "", false
+}
+
+// icd9Category returns the category of an ICD-9 code: the part before the dot.
+func icd9Category(code string) string {
+	if i := strings.Index(code, "."); i != -1 {
+		return code[:i]
+	}
+	return code
+}
+
+// icd9Kind returns the kind of an ICD-9 category: V or E for the supplementary classifications, empty for the
+// numeric categories.
+func icd9Kind(category string) string {
+	if category != "" && (category[0] < '0' || category[0] > '9') {
+		return category[0:1]
+	}
+	return ""
+}
+
+// icd9ChapterOf returns the chapter of an ICD-9 category.
+func icd9ChapterOf(category string) (icd9Chapter, bool) {
+	for _, chapter := range icd9Chapters {
+		if len(category) == len(chapter.first) && icd9Kind(category) == icd9Kind(chapter.first) &&
+			category >= chapter.first && category <= chapter.last {
+			return chapter, true
+		}
+	}
+	return icd9Chapter{}, false
+}
+
+// initializeICD9NameMap reads the ICD-9-CM codes and their descriptions from a file with a code and a description per
+// line, separated by a tab or spaces. The codes may be written with or without dot. It returns a map ICD-9 code ->
+// entry (description, descriptions of the chapter and the parent codes, level), and the set of codes of the excluded
+// chapters. The level of a category is 1, each next digit is one level deeper. Parent codes that are not in the file
+// are described by their code.
+func initializeICD9NameMap(file string) (map[string]Icd10Entry, map[string]bool) {
+	descriptions := map[string]string{}
+	icd9File, err := openInput(file)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := icd9File.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	scanner := bufio.NewScanner(icd9File)
+	for scanner.Scan() {
+		fields := strings.SplitN(strings.TrimSpace(scanner.Text()), "\t", 2)
+		if len(fields) != 2 {
+			fields = strings.SplitN(strings.TrimSpace(scanner.Text()), " ", 2)
+		}
+		if len(fields) != 2 {
+			continue
+		}
+		code := dottedICDCode(CodeSystemICD9, strings.TrimSpace(fields[0]))
+		if _, ok := icd9ChapterOf(icd9Category(code)); !ok {
+			continue // e.g. a header
+		}
+		descriptions[code] = strings.TrimSpace(fields[1])
+	}
+	if err := scanner.Err(); err != nil {
+		panic(err)
+	}
+	description := func(code string) string {
+		if d, ok := descriptions[code]; ok {
+			return d
+		}
+		return code
+	}
+	icd9Map := map[string]Icd10Entry{}
+	excluded := map[string]bool{}
+	for code, name := range descriptions {
+		category := icd9Category(code)
+		chapter, _ := icd9ChapterOf(category)
+		if icd9ExcludedChapters[chapter.first] {
+			excluded[code] = true
+			continue
+		}
+		entry := Icd10Entry{Name: name, Categories: [6]string{chapter.name, "NONE", "NONE", "NONE", "NONE", "NONE"}}
+		entry.Level = 1
+		if category != code {
+			entry.Categories[1] = description(category)
+			entry.Level = 1 + len(code) - len(category) - 1 // the digits after the dot
+			if entry.Level == 3 {
+				entry.Categories[2] = description(code[:len(code)-1])
+			}
+		}
+		icd9Map[code] = entry
+	}
+	fmt.Println("Parsed ", len(icd9Map)+len(excluded), " ICD-9-CM codes.")
+	return icd9Map, excluded
+}
+
+// initializeICD9AnalysisMaps returns a map ICD-9 code -> internal analysis DID and a map analysis DID -> medical Name
+// for the ICD-9-CM codes passed as a file with their descriptions and a requested hierarchy Level. Level 0 are the
+// chapters, level 1 the categories. The custom events are added after the codes, nil for the default bladder cancer
+// events.
+func initializeICD9AnalysisMaps(file string, level int, events []*CustomEvent) icd9AnalysisMaps {
+	icd9Map, excluded := initializeICD9NameMap(file)
+	analysisIdMap, analysisMap, ctr, _ := initializeIcd10AnalysisMaps(icd9Map, level, events)
+	return icd9AnalysisMaps{icd10AnalysisMapsFromXML{DIDMap: analysisIdMap, Icd10Map: analysisMap,
+		NofDiagnosisCodes: ctr, Excluded: excluded}}
+}
@@ -0,0 +1,135 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Support for ICD-O-3 codes in the tumor data. Cancer registries encode tumors with an ICD-O-3 topography (site) code and
+// an ICD-O-3 morphology code. Topography codes share their C00-C80 prefixes with the ICD-10 neoplasm codes, but are
+// often written without a dot, e.g. C679. Morphology codes consist of a 4-digit histology code and a 1-digit behavior
+// code, e.g. 8120/3 for a malignant transitional cell carcinoma. The histology codes are grouped into the histologies
+// that are distinguished for bladder cancer. Only the tumors of the studied primary sites are recorded, by default the
+// bladder. The sites are given as topography prefixes, e.g. C50 for breast or C34 for lung, which match both ICD-10 and
+// ICD-O-3 site codes.
+
+// Histologies of bladder tumors.
+const (
+	HistologyUrothelial     = "urothelial"
+	HistologySquamous       = "squamous"
+	HistologyAdenocarcinoma = "adenocarcinoma"
+	HistologyNeuroendocrine = "neuroendocrine"
+	HistologyOther          = "other"
+)
+
+// histologyRange maps a range of ICD-O-3 histology codes, bounds included, onto a histology.
+type histologyRange struct {
+	from, to  int
+	histology string
+}
+
+// histologyRanges lists the ICD-O-3 histology code ranges of the bladder cancer histologies. The first matching range
+// applies, so the neuroendocrine ranges precede the adenocarcinoma range that contains them.
+var histologyRanges = []histologyRange{
+	{8041, 8045, HistologyNeuroendocrine}, // small cell carcinomas
+	{8240, 8249, HistologyNeuroendocrine}, // carcinoid and neuroendocrine tumors
+	{8050, 8089, HistologySquamous},       // squamous cell neoplasms
+	{8120, 8131, HistologyUrothelial},     // transitional cell carcinomas
+	{8140, 8389, HistologyAdenocarcinoma}, // adenomas and adenocarcinomas
+}
+
+// parseICDO3Morphology parses an ICD-O-3 morphology code, e.g. 8120/3, 81203, M8120/3 or 8120, into its histology and
+// behavior code. The behavior is -1 if it is missing.
+func parseICDO3Morphology(code string) (histology, behavior int, err error) {
+	code = strings.TrimPrefix(strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(code)), "M"), "-")
+	code = strings.Replace(code, "/", "", 1)
+	if len(code) != 4 && len(code) != 5 {
+		return 0, 0, errors.New("ICD-O-3 morphology code must have 4 histology digits and 1 behavior digit: " + code)
+	}
+	if histology, err = strconv.Atoi(code[:4]); err != nil {
+		return 0, 0, err
+	}
+	behavior = -1
+	if len(code) == 5 {
+		if behavior, err = strconv.Atoi(code[4:]); err != nil {
+			return 0, 0, err
+		}
+	}
+	return histology, behavior, nil
+}
+
+// ICDO3Histology returns the bladder cancer histology of an ICD-O-3 morphology code, or an empty string if the code
+// cannot be parsed.
+func ICDO3Histology(code string) string {
+	histology, _, err := parseICDO3Morphology(code)
+	if err != nil {
+		return ""
+	}
+	for _, r := range histologyRanges {
+		if histology >= r.from && histology <= r.to {
+			return r.histology
+		}
+	}
+	return HistologyOther
+}
+
+// normalizeSiteCode removes the dot from an ICD-10 or ICD-O-3 site code, so that e.g. C67.9 and C679 compare equal.
+func normalizeSiteCode(code string) string {
+	return strings.Replace(strings.ToUpper(strings.TrimSpace(code)), ".", "", 1)
+}
+
+// DefaultTumorSites returns the topography prefixes of the default tumor sites: the bladder (C67).
+func DefaultTumorSites() []string {
+	return []string{"C67"}
+}
+
+// ParseTumorSites parses a comma separated list of topography prefixes, e.g. C50,C34 or C61.9. Empty entries are
+// ignored. It returns nil for the default tumor sites if the list is empty.
+func ParseTumorSites(s string) []string {
+	var sites []string
+	for _, site := range strings.Split(s, ",") {
+		if site = normalizeSiteCode(site); site != "" {
+			sites = append(sites, site)
+		}
+	}
+	return sites
+}
+
+// isTumorSite checks if an ICD-10 or ICD-O-3 site code starts with one of the topography prefixes, nil for the default
+// tumor sites.
+func isTumorSite(code string, sites []string) bool {
+	if sites == nil {
+		sites = DefaultTumorSites()
+	}
+	code = normalizeSiteCode(code)
+	for _, site := range sites {
+		if strings.HasPrefix(code, site) {
+			return true
+		}
+	}
+	return false
+}
+
+// isBladderSite checks if an ICD-10 or ICD-O-3 site code denotes the bladder (C67).
+func isBladderSite(code string) bool {
+	return isTumorSite(code, DefaultTumorSites())
+}
@@ -0,0 +1,394 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Configuration of the layout of generic csv input files. Sites without TriNetX extracts describe the columns of their
+// patient and diagnosis dumps with an InputSchema, and parse them with the csv input format, without code changes. The
+// default schema matches the TriNetX patient and diagnosis files.
+
+// CSVColumn is a column of a csv file, given by its index, counted from 0, or by its name in the header. In json, a
+// column is a number for an index, a string for a name, or null for an optional column that is absent.
+type CSVColumn struct {
+	Index int    // index of the column, -1 if it is absent or its name is not resolved yet
+	Name  string // name of the column in the header, empty if the column is given by index
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (column *CSVColumn) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	switch v := value.(type) {
+	case nil:
+		*column = CSVColumn{Index: -1}
+	case float64:
+		if v != math.Trunc(v) || v < 0 {
+			return fmt.Errorf("column index must be a non-negative integer, got %v", v)
+		}
+		*column = CSVColumn{Index: int(v)}
+	case string:
+		if v == "" {
+			return errors.New("column name is empty")
+		}
+		*column = CSVColumn{Index: -1, Name: v}
+	default:
+		return fmt.Errorf("column must be an index or a name, got %s", data)
+	}
+	return nil
+}
+
+// absent checks if an optional column is absent.
+func (column *CSVColumn) absent() bool {
+	return column.Index == -1 && column.Name == ""
+}
+
+// value returns the value of the column in a row, or the empty string if the column is absent.
+func (column *CSVColumn) value(record []string) string {
+	if column.Index == -1 {
+		return ""
+	}
+	return record[column.Index]
+}
+
+// PatientColumns describes the columns of a patient file. The death date and region columns are optional.
+type PatientColumns struct {
+	PID             CSVColumn `json:"pid"`             // column with the patient id
+	Sex             CSVColumn `json:"sex"`             // column with the sex
+	YearOfBirth     CSVColumn `json:"yearOfBirth"`     // column with the year of birth
+	DeathDate       CSVColumn `json:"deathDate"`       // column with the date of death
+	Region          CSVColumn `json:"region"`          // column with the region
+	Male            string    `json:"male"`            // value of the sex column for males
+	Female          string    `json:"female"`          // value of the sex column for females
+	DeathDateFormat string    `json:"deathDateFormat"` // layout of the dates of death, the day may be omitted
+}
+
+// DiagnosisColumns describes the columns of a diagnosis file. The code system column is optional.
+type DiagnosisColumns struct {
+	PID               CSVColumn         `json:"pid"`               // column with the patient id
+	CodeSystem        CSVColumn         `json:"codeSystem"`        // column with the code system
+	Code              CSVColumn         `json:"code"`              // column with the diagnosis code
+	Date              CSVColumn         `json:"date"`              // column with the date of diagnosis
+	DateFormat        string            `json:"dateFormat"`        // layout of the dates of diagnosis
+	CodeSystems       map[string]string `json:"codeSystems"`       // maps values of the code system column onto code systems, e.g. 10 onto ICD-10-CM
+	DefaultCodeSystem string            `json:"defaultCodeSystem"` // code system of the codes if there is no code system column
+}
+
+// InputSchema describes the layout of the patient and diagnosis files of the csv input format. Date formats are Go time
+// layouts, e.g. 2006-01-02 or 02/01/2006.
+type InputSchema struct {
+	Header    bool             `json:"header"`    // the first row of the files holds the column names
+	Separator string           `json:"separator"` // field separator, a single character
+	Patients  PatientColumns   `json:"patients"`
+	Diagnoses DiagnosisColumns `json:"diagnoses"`
+}
+
+// DefaultInputSchema returns the schema of the TriNetX patient and diagnosis files.
+func DefaultInputSchema() *InputSchema {
+	return &InputSchema{
+		Separator: ",",
+		Patients: PatientColumns{PID: CSVColumn{Index: 0}, Sex: CSVColumn{Index: 1}, YearOfBirth: CSVColumn{Index: 4},
+			DeathDate: CSVColumn{Index: 10}, Region: CSVColumn{Index: 6}, Male: "M", Female: "F", DeathDateFormat: "200601"},
+		Diagnoses: DiagnosisColumns{PID: CSVColumn{Index: 0}, CodeSystem: CSVColumn{Index: 2}, Code: CSVColumn{Index: 3},
+			Date: CSVColumn{Index: 7}, DateFormat: "2006-01-02", DefaultCodeSystem: CodeSystemICD10},
+	}
+}
+
+// LoadInputSchema loads an input schema from a json file. Fields that are omitted keep their default value. The schema
+// is validated.
+func LoadInputSchema(path string) (*InputSchema, error) {
+	schema := DefaultInputSchema()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, schema); err != nil {
+		return nil, fmt.Errorf("input schema %s: %v", path, err)
+	}
+	if err := schema.Validate(); err != nil {
+		return nil, fmt.Errorf("input schema %s: %v", path, err)
+	}
+	return schema, nil
+}
+
+// columns returns the named columns of the patient file.
+func (columns *PatientColumns) columns() ([]string, []*CSVColumn) {
+	return []string{"pid", "sex", "yearOfBirth", "deathDate", "region"},
+		[]*CSVColumn{&columns.PID, &columns.Sex, &columns.YearOfBirth, &columns.DeathDate, &columns.Region}
+}
+
+// columns returns the named columns of the diagnosis file.
+func (columns *DiagnosisColumns) columns() ([]string, []*CSVColumn) {
+	return []string{"pid", "codeSystem", "code", "date"},
+		[]*CSVColumn{&columns.PID, &columns.CodeSystem, &columns.Code, &columns.Date}
+}
+
+// Validate checks that the required columns are present, that columns are only given by name if the files have a
+// header, that the separator is a single character, that the code systems are supported, and that the date formats
+// describe a year, month and day, or a year and month for the dates of death.
+func (schema *InputSchema) Validate() error {
+	if utf8.RuneCountInString(schema.Separator) != 1 {
+		return fmt.Errorf("separator must be a single character, got %q", schema.Separator)
+	}
+	required := map[string]bool{"pid": true, "sex": true, "yearOfBirth": true, "code": true, "date": true}
+	patientNames, patientColumns := schema.Patients.columns()
+	diagnosisNames, diagnosisColumns := schema.Diagnoses.columns()
+	for _, file := range []struct {
+		names   []string
+		columns []*CSVColumn
+	}{{patientNames, patientColumns}, {diagnosisNames, diagnosisColumns}} {
+		for i, column := range file.columns {
+			if column.absent() && required[file.names[i]] {
+				return fmt.Errorf("column for %s is required", file.names[i])
+			}
+			if column.Name != "" && !schema.Header {
+				return fmt.Errorf("column for %s is given by name, but the files have no header", file.names[i])
+			}
+		}
+	}
+	if schema.Patients.Male == "" || schema.Patients.Female == "" || schema.Patients.Male == schema.Patients.Female {
+		return errors.New("values for male and female must be distinct and not empty")
+	}
+	if schema.Diagnoses.CodeSystem.absent() && schema.Diagnoses.DefaultCodeSystem == "" {
+		return errors.New("default code system is required without code system column")
+	}
+	for _, codeSystem := range schema.Diagnoses.CodeSystems {
+		if _, ok := checkCodeSystem(codeSystem); !ok {
+			return fmt.Errorf("unknown code system %s in code system mapping", codeSystem)
+		}
+	}
+	if _, ok := checkCodeSystem(schema.Diagnoses.DefaultCodeSystem); schema.Diagnoses.DefaultCodeSystem != "" && !ok {
+		return fmt.Errorf("unknown default code system %s", schema.Diagnoses.DefaultCodeSystem)
+	}
+	if err := checkDateFormat(schema.Patients.DeathDateFormat, false); err != nil {
+		return fmt.Errorf("death date: %v", err)
+	}
+	return checkDateFormat(schema.Diagnoses.DateFormat, true)
+}
+
+// resolveColumns sets the index of the columns that are given by name to the index of that name in the header.
+func resolveColumns(header []string, columns []*CSVColumn) error {
+	for _, column := range columns {
+		if column.Name == "" {
+			continue
+		}
+		column.Index = -1
+		for i, name := range header {
+			if strings.EqualFold(strings.TrimSpace(name), column.Name) {
+				column.Index = i
+				break
+			}
+		}
+		if column.Index == -1 {
+			return fmt.Errorf("no column %q in header", column.Name)
+		}
+	}
+	return nil
+}
+
+// minColumns returns the number of columns a row needs to contain all given columns.
+func minColumns(columns []*CSVColumn) int {
+	max := -1
+	for _, column := range columns {
+		if column.Index > max {
+			max = column.Index
+		}
+	}
+	return max + 1
+}
+
+// open opens a csv file of the schema. If the files have a header, it is read and used to resolve the given columns.
+// The reader is positioned at the first row after the header.
+func (schema *InputSchema) open(fileName string, columns []*CSVColumn) (io.ReadCloser, *csv.Reader) {
+	file, err := openInput(fileName)
+	if err != nil {
+		panic(err)
+	}
+	reader := newCSVReader(file)
+	reader.Comma, _ = utf8.DecodeRuneInString(schema.Separator)
+	reader.FieldsPerRecord = -1
+	if schema.Header {
+		header, err := reader.Read()
+		if err == nil {
+			err = resolveColumns(header, columns)
+		}
+		if err != nil {
+			_ = file.Close()
+			panic(fmt.Sprint(fileName, ": ", err))
+		}
+	}
+	return file, reader
+}
+
+// checkRow checks a row of a patient file, cf. rowCheck.
+func (columns *PatientColumns) checkRow(record []string) (reasons, details []string) {
+	_, all := columns.columns()
+	if detail, ok := checkColumns(record, minColumns(all), false); !ok {
+		return []string{ReasonColumnCount}, []string{detail}
+	}
+	if isMissing(columns.PID.value(record)) {
+		reasons, details = append(reasons, ReasonMissingPID), append(details, "pid is empty")
+	}
+	if sex := columns.Sex.value(record); sex != columns.Male && sex != columns.Female {
+		reasons, details = append(reasons, ReasonUnknownSex), append(details, fmt.Sprint("sex: ", sex))
+	}
+	if yob := columns.YearOfBirth.value(record); !isMissing(yob) {
+		if _, err := strconv.Atoi(yob); err != nil {
+			reasons, details = append(reasons, ReasonBadDate), append(details, fmt.Sprint("yearOfBirth: ", yob))
+		}
+	}
+	if date := columns.DeathDate.value(record); !isMissing(date) {
+		if _, err := parseDateLayout(columns.DeathDateFormat, date); err != nil {
+			reasons, details = append(reasons, ReasonBadDate), append(details, fmt.Sprint("deathDate: ", date))
+		}
+	}
+	return reasons, details
+}
+
+// checkRow checks a row of a diagnosis file, cf. rowCheck.
+func (columns *DiagnosisColumns) checkRow(record []string) (reasons, details []string) {
+	_, all := columns.columns()
+	if detail, ok := checkColumns(record, minColumns(all), false); !ok {
+		return []string{ReasonColumnCount}, []string{detail}
+	}
+	if isMissing(columns.PID.value(record)) {
+		reasons, details = append(reasons, ReasonMissingPID), append(details, "pid is empty")
+	}
+	if isMissing(columns.Code.value(record)) {
+		reasons, details = append(reasons, ReasonMissingCode), append(details, "code is empty")
+	}
+	if detail, ok := checkCodeSystem(columns.codeSystem(record)); !ok {
+		reasons, details = append(reasons, ReasonCodeSystem), append(details, detail)
+	}
+	if date := columns.Date.value(record); isMissing(date) {
+		reasons, details = append(reasons, ReasonBadDate), append(details, "date is empty")
+	} else if _, err := parseDateLayout(columns.DateFormat, date); err != nil {
+		reasons, details = append(reasons, ReasonBadDate), append(details, fmt.Sprint("date: ", date))
+	}
+	return reasons, details
+}
+
+// codeSystem returns the code system of the diagnosis in a row.
+func (columns *DiagnosisColumns) codeSystem(record []string) string {
+	if columns.CodeSystem.Index == -1 {
+		return columns.DefaultCodeSystem
+	}
+	value := columns.CodeSystem.value(record)
+	if codeSystem, ok := columns.CodeSystems[value]; ok {
+		return codeSystem
+	}
+	return detectCodeSystem(value)
+}
+
+// parseCSVPatientData parses a patient file described by the input schema. Patients without year of birth are skipped.
+// The malformed rows are added to the report.
+func parseCSVPatientData(fileName string, schema *InputSchema, nofCohortAges int, duplicates *DuplicateReport,
+	report *ValidationReport) (*PatientMap, int) {
+	columns := &schema.Patients
+	_, all := columns.columns()
+	file, reader := schema.open(fileName, all)
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	loader := newPatientLoader(duplicates)
+	rows := newRowReader(reader, fileName, columns.checkRow, report)
+	for {
+		record, err := rows.read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			panic(err)
+		}
+		yob, err := strconv.Atoi(columns.YearOfBirth.value(record))
+		if err != nil {
+			continue //skip patients without year of birth
+		}
+		var dateOfDeath *DiagnosisDate
+		if d, err := parseDateLayout(columns.DeathDateFormat, columns.DeathDate.value(record)); err == nil {
+			dateOfDeath = &d
+		}
+		sex := "M"
+		if columns.Sex.value(record) == columns.Female {
+			sex = "F"
+		}
+		loader.add(columns.PID.value(record), sex, yob, dateOfDeath, columns.Region.value(record))
+	}
+	return loader.finish(nofCohortAges)
+}
+
+// parseCSVDiagnoses parses a diagnosis file described by the input schema, and fills in the diagnoses for the given
+// patients. ICD codes without dot are dotted. The diagnoses may be split over several shards with the same layout, cf.
+// shardFiles. The malformed rows are added to the report. It returns a report of the diagnosis codes that could not be
+// mapped.
+func parseCSVDiagnoses(fileName, treatmentInfoFile string, treatmentSchema *TreatmentSchema, schema *InputSchema,
+	patients *PatientMap, icd10AnalysisMap AnalysisMaps, icd9ToIcd10Map map[string]string,
+	duplicates *DuplicateReport, report *ValidationReport) *UnmappedCodeReport {
+	loader := newDiagnosisLoader(patients, icd10AnalysisMap, icd9ToIcd10Map, duplicates)
+	shards := shardFiles(fileName)
+	report.addFiles(shards...)
+	readShards(shards, func(fileName string, emit func(row []string)) {
+		columns := schema.Diagnoses // each shard resolves the column names against its own header
+		_, all := columns.columns()
+		file, reader := schema.open(fileName, all)
+		defer func() {
+			if err := file.Close(); err != nil {
+				panic(err)
+			}
+		}()
+		rows := newRowReader(reader, fileName, columns.checkRow, report)
+		for {
+			record, err := rows.read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				panic(err)
+			}
+			emit(withRowRef([]string{columns.PID.value(record), columns.codeSystem(record), columns.Code.value(record),
+				columns.Date.value(record)}, fileName, reader))
+		}
+	}, func(row []string) {
+		row, fileName, line := splitRowRef(row)
+		loader.at(fileName, line)
+		date, _ := parseDateLayout(schema.Diagnoses.DateFormat, row[3])
+		codeSystem, code := row[1], row[2]
+		if codeSystem == CodeSystemICD10 || codeSystem == CodeSystemICD9 {
+			code = dottedICDCode(codeSystem, code)
+		}
+		loader.add(row[0], codeSystem, code, date)
+	})
+	fillInTreatments(treatmentInfoFile, treatmentSchema, patients, icd10AnalysisMap, report)
+	return loader.finish()
+}
@@ -0,0 +1,535 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"compress/gzip"
+	"fmt"
+	"github.com/imec-int/ptra/lib/utils"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Loading patients and diagnoses. The parsers of the different input formats (TriNetX, FHIR, ...) extract patients and
+// diagnoses from their input files, and use a patientLoader and a diagnosisLoader to fill in the PatientMap and the
+// diagnoses of the patients in the same way, independent of the input format.
+
+// Input formats.
+const (
+	InputTriNetX = "trinetx" // TriNetX csv files
+	InputFHIR    = "fhir"    // FHIR R4 json bundles or ndjson bulk exports
+	InputOMOP    = "omop"    // OMOP Common Data Model tables
+	InputMIMIC   = "mimic"   // MIMIC-IV hosp tables
+	InputCSV     = "csv"     // csv files described by an InputSchema
+	InputSQL     = "sql"     // SQL queries on a database, cf. SQLSource
+)
+
+// Code systems of diagnosis codes. The vocabulary of the analysis determines the code system of the diagnoses:
+// ICD-10-CM for the ICD-10 hierarchy and the CCSR categories, ICD-11 MMS for the ICD-11 linearization, ICD-9-CM for the
+// ICD-9-CM codes, SNOMED CT for a SNOMED CT release. With an ICD-10 or ICD-11 vocabulary, diagnosis codes of other code
+// systems than ICD-10-CM, ICD-11, and SNOMED CT are mapped to ICD-10-CM with an ICD9 to ICD10 mapping, and ICD-10-CM
+// codes are mapped to ICD-11 with an ICD10 to ICD11 mapping. With a custom vocabulary, diagnoses are coded in the
+// custom code system, or are mapped onto it from ICD-10-CM, cf. CustomVocabulary.
+const (
+	CodeSystemICD10  = "ICD-10-CM"
+	CodeSystemICD9   = "ICD-9-CM"
+	CodeSystemSNOMED = "SNOMED-CT"
+	CodeSystemICD11  = "ICD-11-MMS"
+	CodeSystemCustom = "CUSTOM"
+)
+
+// patientLoader fills in a PatientMap. Patients that occur more than once are counted in the duplicate report, and
+// handled according to its strategy for duplicate patients.
+type patientLoader struct {
+	patients       *PatientMap
+	duplicates     *DuplicateReport
+	minYOB, maxYOB int
+	deathCtr       int
+	regions        map[string]int // counts per region
+	regionIds      map[string]int
+}
+
+// newPatientLoader creates a loader for an empty PatientMap.
+func newPatientLoader(duplicates *DuplicateReport) *patientLoader {
+	return &patientLoader{
+		patients:   &PatientMap{PIDMap: map[int]*Patient{}, PIDStringMap: map[string]int{}, Warnings: NewWarningLog()},
+		duplicates: duplicates,
+		minYOB:     time.Now().Year() - 1,
+		maxYOB:     1850,
+		regions:    map[string]int{},
+		regionIds:  map[string]int{},
+	}
+}
+
+// add adds a patient with the given ID, sex (M or F), year of birth, date of death (nil if unknown), and region. It
+// returns false if the patient was skipped or merged as a duplicate.
+func (loader *patientLoader) add(pidString, sexCode string, yob int, dateOfDeath *DiagnosisDate, region string) bool {
+	patientMap := loader.patients
+	var sex int
+	if sexCode == "F" {
+		sex = Female
+	}
+	if first, ok := patientMap.PIDStringMap[pidString]; ok {
+		loader.duplicates.Patients++
+		patient := patientMap.PIDMap[first]
+		if patient.Sex != sex || patient.YOB != yob || (patient.DeathDate != nil && dateOfDeath != nil &&
+			*patient.DeathDate != *dateOfDeath) {
+			loader.duplicates.Conflicts++
+		}
+		switch loader.duplicates.patientStrategy() {
+		case DuplicateFirst:
+			return false // keep the first occurrence of a duplicate patient
+		case DuplicateMerge:
+			if patient.DeathDate == nil && dateOfDeath != nil {
+				patient.DeathDate = dateOfDeath // only fill in what the first occurrence misses
+				loader.deathCtr++
+			}
+			return false
+		case DuplicateFail:
+			panic(fmt.Sprint("Duplicate patient in the input: ", pidString))
+		}
+	}
+	patientMap.Ctr++      // avoid using 0 as PID
+	pid := patientMap.Ctr //analysis ID
+	if sexCode == "M" {
+		patientMap.MaleCtr++
+	}
+	if sexCode == "F" {
+		patientMap.FemaleCtr++
+	}
+	if dateOfDeath != nil {
+		loader.deathCtr++
+	}
+	if _, ok := loader.regions[region]; !ok {
+		loader.regions[region] = 0
+		loader.regionIds[region] = len(loader.regionIds)
+	} else {
+		loader.regions[region]++
+	}
+	patient := Patient{
+		PID:       pid,
+		PIDString: pidString,
+		YOB:       yob,
+		CohortAge: 0,
+		Sex:       sex,
+		Diagnoses: []*Diagnosis{},
+		DeathDate: dateOfDeath,
+		Region:    loader.regionIds[region],
+	}
+	patientMap.PIDMap[pid] = &patient
+	patientMap.PIDStringMap[pidString] = pid
+	loader.maxYOB = utils.MaxInt(yob, loader.maxYOB)
+	loader.minYOB = utils.MinInt(yob, loader.minYOB)
+	return true
+}
+
+// addDemographics sets the race and ethnicity of the patient with the given ID, as added last. Missing values are
+// ignored, and values that are already known are kept, so that the first occurrence of a duplicate patient prevails.
+func (loader *patientLoader) addDemographics(pidString, race, ethnicity string) {
+	pid, ok := loader.patients.PIDStringMap[pidString]
+	if !ok {
+		return
+	}
+	patient := loader.patients.PIDMap[pid]
+	if patient.Race == "" && !isMissing(race) {
+		patient.Race = strings.Clone(race)
+	}
+	if patient.Ethnicity == "" && !isMissing(ethnicity) {
+		patient.Ethnicity = strings.Clone(ethnicity)
+	}
+}
+
+// finish assigns the patients to the given number of age groups and prints a summary. It returns the PatientMap and
+// the number of regions.
+func (loader *patientLoader) finish(nofCohortAges int) (*PatientMap, int) {
+	patientMap := loader.patients
+	minYOB, maxYOB := loader.minYOB, loader.maxYOB
+	// initialize patient age groups
+	ageRange := float64(maxYOB-minYOB) / float64(nofCohortAges)
+	ageRange = math.Ceil(ageRange)
+	if nofCohortAges > 1 {
+		for _, p := range patientMap.PIDMap {
+			p.CohortAge = int(math.Floor(float64(p.YOB-minYOB) / float64(ageRange)))
+			if p.CohortAge >= nofCohortAges { // the youngest patients fall on the upper bound of the last age range
+				p.CohortAge = nofCohortAges - 1
+			}
+		}
+	}
+	fmt.Println("Parsed patient data.")
+	fmt.Print("Parsed ", patientMap.Ctr, " patients with year of birth known ")
+	fmt.Print("of which ", patientMap.FemaleCtr, " females and ")
+	fmt.Println(patientMap.MaleCtr, "males; and of which ", loader.deathCtr, " have a known date of death.")
+	fmt.Println("Year of birth oldest patient:", minYOB)
+	fmt.Println("Year of birth youngest patient:", maxYOB)
+	fmt.Println("Patients are of ", len(loader.regions), " regions: ")
+	for region, nr := range loader.regions {
+		fmt.Print(region, ": ", nr, ", ")
+	}
+	fmt.Println("")
+	return patientMap, len(loader.regions)
+}
+
+// diagnosisLoader fills in the diagnoses of patients. It uses the analysis maps to assign internal analysis DIDs to
+// the diagnoses, and records the diagnosis codes that could not be mapped. Diagnoses that occur more than once are
+// counted in the duplicate report, and depending on its policy, removed. In the streaming mode of the duplicate
+// report, the loader keeps no state per row: the diagnoses of a patient are compacted whenever they have doubled since
+// their last compaction, so that memory use is bounded by the compacted diagnoses rather than the nr of rows.
+type diagnosisLoader struct {
+	patients       *PatientMap
+	analysisMap    AnalysisMaps
+	icd9ToIcd10Map map[string]string
+	duplicates     *DuplicateReport
+	unmapped       *UnmappedCodeReport
+	seen           map[diagnosisRowKey]bool
+	compacted      map[int]int // nr of diagnoses per PID after their last compaction, in the streaming mode
+	file           string      // input file of the diagnoses that are added, for the warnings
+	line           int         // line of the diagnosis that is added in the input file, 0 if unknown
+	ctr            int         // for counting the number of parsed diagnoses
+	ctrICD9        int
+	ctrSNOMED      int
+	ctrExcl        int
+	eoiCtr         int
+}
+
+// newDiagnosisLoader creates a loader for the diagnoses of the given patients.
+func newDiagnosisLoader(patients *PatientMap, analysisMap AnalysisMaps, icd9ToIcd10Map map[string]string,
+	duplicates *DuplicateReport) *diagnosisLoader {
+	return &diagnosisLoader{patients: patients, analysisMap: analysisMap, icd9ToIcd10Map: icd9ToIcd10Map,
+		duplicates: duplicates, unmapped: NewUnmappedCodeReport(), seen: map[diagnosisRowKey]bool{},
+		compacted: map[int]int{}}
+}
+
+// streamCompactMin is the nr of diagnoses a patient may gain before they are compacted in the streaming mode.
+const streamCompactMin = 64
+
+// add adds a diagnosis with the given code to a patient. ICD codes are normalized first, cf. normalizeICDCode.
+func (loader *diagnosisLoader) add(pidString, codeSystem, code string, date DiagnosisDate) {
+	loader.addInEncounter(pidString, "", codeSystem, code, false, date)
+}
+
+// addInEncounter adds a diagnosis that was made during the given encounter to a patient, cf. add and GroupVisits, and
+// marks whether it is a secondary diagnosis. A missing encounter ID is recorded as empty.
+func (loader *diagnosisLoader) addInEncounter(pidString, encounter, codeSystem, code string, secondary bool,
+	date DiagnosisDate) {
+	if isMissing(encounter) {
+		encounter = ""
+	}
+	loader.ctr++
+	loader.unmapped.Rows++
+	codeSystem = detectCodeSystem(codeSystem)
+	loader.unmapped.CodeSystems[codeSystem]++
+	code = normalizeICDCode(codeSystem, code)
+	patient, ok := GetPatient(pidString, loader.patients)
+	if !ok {
+		loader.drop(codeSystem, code, UnmappedUnknownPatient)
+		return //skip unknown patients
+	}
+	if !loader.duplicates.Streaming {
+		key := newDiagnosisRowKey(patient.PID, codeSystem, code, date)
+		if loader.seen[key] {
+			loader.duplicates.Diagnoses++
+			if loader.duplicates.dedupDiagnoses() {
+				return
+			}
+		} else {
+			loader.seen[key] = true
+		}
+	}
+	if vocabulary := loader.vocabulary(); codeSystem != vocabulary {
+		if code, ok = loader.remap(codeSystem, code); !ok {
+			return
+		}
+		codeSystem = vocabulary
+	}
+	nofDiagnoses := len(patient.Diagnoses)
+	nr := loader.analysisMap.fillInPatientDiagnoses(patient, code, date)
+	for _, d := range patient.Diagnoses[nofDiagnoses:] {
+		d.Encounter = encounter
+		d.Secondary = secondary
+	}
+	if nr > 0 {
+		loader.ctrExcl++
+		if loader.analysisMap.isExcluded(code) {
+			loader.drop(codeSystem, code, UnmappedExcluded)
+		} else {
+			loader.drop(codeSystem, code, UnmappedNotInVocabulary)
+		}
+		return
+	}
+	if loader.duplicates.Streaming && len(patient.Diagnoses) >= 2*loader.compacted[patient.PID]+streamCompactMin {
+		compactPatientDiagnoses(patient)
+		loader.compacted[patient.PID] = len(patient.Diagnoses)
+	}
+	//Check if diagnosis is event of interest.
+	if patient.EOIDate == nil && loader.analysisMap.isEventOfInterest(code) {
+		loader.eoiCtr++
+		patient.EOIDate = &date // mark first event of interest (e.g. bladder cancers diagnosis)
+	}
+}
+
+// compactPatientDiagnoses sorts the diagnoses of a patient by date and DID, and removes the duplicates. Unlike
+// SortDiagnoses, equal diagnoses are always adjacent, so that none are left after CompactDiagnoses.
+func compactPatientDiagnoses(patient *Patient) {
+	diagnoses := patient.Diagnoses
+	sort.Slice(diagnoses, func(i, j int) bool {
+		if !diagnosisDateEqual(diagnoses[i].Date, diagnoses[j].Date) {
+			return DiagnosisDateSmallerThan(diagnoses[i].Date, diagnoses[j].Date)
+		}
+		return diagnoses[i].DID < diagnoses[j].DID
+	})
+	CompactDiagnoses(patient)
+}
+
+// remap maps a diagnosis code onto the code system of the vocabulary: ICD-9 codes and SNOMED CT concepts onto ICD-10
+// codes, and ICD-10 codes onto ICD-11 codes for an ICD-11 vocabulary. It records the codes that cannot be mapped, and
+// returns false for them. Codes are not mapped onto SNOMED CT or ICD-9 vocabularies.
+func (loader *diagnosisLoader) remap(codeSystem, code string) (string, bool) {
+	vocabulary := loader.vocabulary()
+	if vocabulary == CodeSystemSNOMED || vocabulary == CodeSystemICD9 || codeSystem == CodeSystemICD11 ||
+		codeSystem == CodeSystemCustom {
+		loader.drop(codeSystem, code, UnmappedOtherCodeSystem)
+		return "", false // skip codes that cannot be mapped onto the vocabulary
+	}
+	if codeSystem != CodeSystemICD10 {
+		// try to remap ICD9 codes and SNOMED CT concepts to ICD10 codes, cf. mergeToIcd10Mappings
+		icd10Code, ok := loader.icd9ToIcd10Map[code]
+		if !ok && codeSystem == CodeSystemSNOMED {
+			loader.drop(codeSystem, code, UnmappedSNOMED)
+			return "", false // skip unknown SNOMED CT concepts
+		}
+		if !ok {
+			loader.drop(codeSystem, code, UnmappedICD9)
+			return "", false // skip unkown ICD9 codes
+		}
+		if codeSystem == CodeSystemSNOMED {
+			loader.ctrSNOMED++
+		} else {
+			loader.ctrICD9++
+		}
+		code = icd10Code
+	}
+	remapped, ok := loader.analysisMap.fromICD10(code)
+	if !ok {
+		reason := UnmappedICD10
+		if vocabulary == CodeSystemCustom {
+			reason = UnmappedICD10Custom
+		}
+		loader.drop(CodeSystemICD10, code, reason)
+		return "", false // skip unknown ICD10 codes
+	}
+	return remapped, true
+}
+
+// vocabulary returns the code system of the vocabulary that the diagnoses are mapped onto.
+func (loader *diagnosisLoader) vocabulary() string {
+	return loader.analysisMap.codeSystem()
+}
+
+// at sets the input file and line of the next diagnoses that are added, for the warnings. A line of 0 means that the
+// line is unknown.
+func (loader *diagnosisLoader) at(file string, line int) {
+	loader.file, loader.line = file, line
+}
+
+// drop counts a diagnosis that is dropped for the given reason, and records a warning for it, unless it is excluded
+// from analysis by design.
+func (loader *diagnosisLoader) drop(codeSystem, code, reason string) {
+	loader.unmapped.add(codeSystem, code, reason)
+	if reason != UnmappedExcluded {
+		loader.patients.Warnings.add(loader.file, loader.line, reason, codeSystem+" "+code)
+	}
+}
+
+// skip counts a diagnosis that cannot be added, e.g. because it has no diagnosis code of a supported code system.
+func (loader *diagnosisLoader) skip(codeSystem, code, reason string) {
+	loader.ctr++
+	loader.unmapped.Rows++
+	loader.unmapped.CodeSystems[codeSystem]++
+	loader.drop(codeSystem, code, reason)
+}
+
+// dottedICDCode inserts the dot in an ICD-10 or ICD-9 code that is written without dot, e.g. E119 becomes E11.9. The
+// dot follows the category, which has 3 characters, or 4 characters for the ICD-9 E codes.
+func dottedICDCode(codeSystem, code string) string {
+	if strings.Contains(code, ".") {
+		return code
+	}
+	category := 3
+	if codeSystem == CodeSystemICD9 && strings.HasPrefix(code, "E") {
+		category = 4
+	}
+	if len(code) <= category {
+		return code
+	}
+	return code[:category] + "." + code[category:]
+}
+
+// normalizeICDCode reconciles the notations of an ICD-10 or ICD-9 code, so that the same code matches the vocabulary, the
+// ICD9 to ICD10 mapping, and the other diagnoses however it is written: the code is trimmed and in upper case, the dot
+// is inserted if it is missing, e.g. c671 becomes C67.1, and for ICD-10, the trailing X placeholders of codes that
+// are not further specified are removed, e.g. C67.X becomes C67. Codes of other code systems are only trimmed.
+func normalizeICDCode(codeSystem, code string) string {
+	code = strings.TrimSpace(code)
+	if codeSystem != CodeSystemICD10 && codeSystem != CodeSystemICD9 {
+		return code
+	}
+	code = strings.ToUpper(code)
+	if codeSystem == CodeSystemICD10 && len(code) > 3 {
+		code = code[:3] + strings.TrimRight(code[3:], "X.")
+	}
+	return dottedICDCode(codeSystem, code)
+}
+
+// finish sorts the diagnoses of the patients and prints a summary. It returns the report of the diagnosis codes that
+// could not be mapped.
+func (loader *diagnosisLoader) finish() *UnmappedCodeReport {
+	for _, patient := range loader.patients.PIDMap {
+		if loader.duplicates.Streaming {
+			compactPatientDiagnoses(patient)
+		} else {
+			SortDiagnoses(patient)
+			CompactDiagnoses(patient)
+		}
+	}
+	fmt.Println("Parsed diagnosis data.")
+	fmt.Print("Parsed ", loader.ctr, " diagnoses ")
+	fmt.Println("of which ", loader.ctrICD9, " ICD09 diagnoses, ", loader.ctrSNOMED, " SNOMED CT diagnoses, and ",
+		loader.ctr-loader.ctrICD9-loader.ctrSNOMED, " ICD10 diagnoses, and ", loader.ctrExcl,
+		" diagnoses excluded from analysis")
+	fmt.Println("and of which ", loader.eoiCtr, " events of interest.")
+	return loader.unmapped
+}
+
+// decompressedFile is an input file that is decompressed while it is read. Closing it closes both the decompressor and
+// the file.
+type decompressedFile struct {
+	io.ReadCloser
+	file io.Closer
+}
+
+// Close implements io.Closer.
+func (input *decompressedFile) Close() error {
+	err := input.ReadCloser.Close()
+	if fileErr := input.file.Close(); err == nil {
+		err = fileErr
+	}
+	return err
+}
+
+// openInput opens an input file for reading. Files with a .gz (gzip) or .zst (Zstandard) extension are decompressed
+// while they are read, so that compressed extracts need not be inflated on disk first. Remote files, given as s3:// or
+// http(s):// URLs, are downloaded while they are read, cf. openRemoteInput.
+func openInput(fileName string) (io.ReadCloser, error) {
+	var file io.ReadCloser
+	var err error
+	if isRemoteInput(fileName) {
+		file, err = openRemoteInput(fileName)
+	} else {
+		file, err = os.Open(fileName)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var decompressor io.ReadCloser
+	switch strings.ToLower(filepath.Ext(remotePath(fileName))) {
+	case ".gz":
+		decompressor, err = gzip.NewReader(file)
+	case ".zst":
+		var decoder *zstd.Decoder
+		if decoder, err = zstd.NewReader(file); err == nil {
+			decompressor = decoder.IOReadCloser()
+		}
+	default:
+		return file, nil
+	}
+	if err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("%s: %v", remotePath(fileName), err)
+	}
+	return &decompressedFile{ReadCloser: decompressor, file: file}, nil
+}
+
+// inputExt returns the extension of an input file in lower case, without the extension of its compression, e.g. .csv for
+// patients.csv.gz. The query of a URL is ignored.
+func inputExt(fileName string) string {
+	fileName = remotePath(fileName)
+	ext := strings.ToLower(filepath.Ext(fileName))
+	if ext == ".gz" || ext == ".zst" {
+		ext = strings.ToLower(filepath.Ext(strings.TrimSuffix(fileName, filepath.Ext(fileName))))
+	}
+	return ext
+}
+
+// readCSVTable calls f for each row of a csv file with a header, with the values of the given columns. The header names
+// the columns, so the order of the columns does not matter. Missing values are empty strings. The file is comma or tab
+// separated, tab for .tsv and .txt files, and may be compressed, cf. openInput. It returns an error if the file cannot be
+// read.
+func readCSVTable(fileName string, columns []string, f func(values []string)) error {
+	file, err := openInput(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader := newCSVReader(file)
+	if ext := inputExt(fileName); ext == ".tsv" || ext == ".txt" {
+		reader.Comma = '\t'
+	}
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	header, err := reader.Read()
+	if err != nil {
+		return fmt.Errorf("%s: %v", fileName, err)
+	}
+	if len(header) == 1 && strings.Contains(header[0], "\t") { // tab separated file with a csv extension
+		header = strings.Split(header[0], "\t")
+		reader.Comma = '\t'
+	}
+	indices := make([]int, len(columns))
+	for i, column := range columns {
+		indices[i] = -1
+		for j, name := range header {
+			if strings.EqualFold(strings.TrimSpace(name), column) {
+				indices[i] = j
+			}
+		}
+	}
+	values := make([]string, len(columns))
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", fileName, err)
+		}
+		for i, j := range indices {
+			values[i] = ""
+			if j != -1 && j < len(record) {
+				values[i] = strings.TrimSpace(record[j])
+			}
+		}
+		f(values)
+	}
+}
@@ -0,0 +1,170 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sort"
+)
+
+// Validation of the input files without running an experiment, for the ptra validate command. Besides the malformed
+// rows found while parsing, cf. rowReader, it checks the referential integrity of the input: the diagnoses, tumors, and
+// treatments must refer to patients in the patient file, the diagnosis codes must map onto the vocabulary, directly or
+// via the ICD9 to ICD10 mapping, and the dates must be consistent with the dates of birth and death of the patients.
+
+// ValidateParams contains the parameters of the validate command.
+type ValidateParams struct {
+	PatientInfo       string // TriNetX patient file
+	DiagnosisInfo     string // vocabulary, as for ExperimentParams
+	PatientDiagnoses  string // TriNetX diagnosis file, or a directory or glob pattern with its shards
+	Lvl               int
+	ICD9ToICD10File   string
+	ICD10ToICD11File  string
+	SNOMEDToICD10File string
+	TumorInfo         string // TriNetX tumor file, none if empty
+	TumorSites        string // comma separated topography prefixes of the tumors to check, bladder (C67) if empty
+	TreatmentInfo     string // treatment file, none if empty
+	TreatmentSchema   string // json file describing the columns of the treatment file, default TriNetX layout if empty
+	CustomEvents      string // json file with the custom events of the treatment file, bladder cancer treatments if empty
+	MaxBadRows        int    // the nr of malformed rows that is not yet fatal
+	RejectsFile       string // file to which the malformed rows are written, none if empty
+}
+
+// IntegrityReport collects the problems found by the validate command.
+type IntegrityReport struct {
+	Validation      *ValidationReport   // malformed rows, and the temporal checks of the diagnosis dates
+	Unmapped        *UnmappedCodeReport // diagnoses with an unknown patient or code
+	Patients        int                 // nr of patients in the patient file
+	UnknownPatients map[string]int      // nr of patients per tumor or treatment file that are not in the patient file
+	ICD9Mappings    int                 // nr of entries in the ICD9 to ICD10 mapping
+	maxBadRows      int
+}
+
+// Fatal returns an error if the report has problems that prevent a meaningful run: more malformed rows than allowed, no
+// patients, or no diagnosis that refers to a known patient. Other problems are warnings, as a run skips them.
+func (report *IntegrityReport) Fatal() error {
+	if report.Validation.NofBadRows() > report.maxBadRows {
+		return report.Validation.Error()
+	}
+	if report.Patients == 0 {
+		return errors.New("no patients with a year of birth in the patient file")
+	}
+	if rows := report.Unmapped.Rows; rows > 0 && report.Unmapped.Reasons[UnmappedUnknownPatient] == rows {
+		return errors.New("none of the diagnoses refers to a patient in the patient file")
+	}
+	return nil
+}
+
+// Log prints a summary of the report to standard output.
+func (report *IntegrityReport) Log(max int) {
+	report.Validation.Log(max)
+	report.Validation.LogChecks()
+	fmt.Println("Patients: ", report.Patients)
+	report.Unmapped.Log(max)
+	files := []string{}
+	for file := range report.UnknownPatients {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		fmt.Println(file, ": ", report.UnknownPatients[file], " patients not in the patient file.")
+	}
+	if report.ICD9Mappings > 0 {
+		fmt.Println("ICD9 to ICD10 mapping: ", report.ICD9Mappings, " codes.")
+	}
+}
+
+// ValidateInput checks the input files for malformed rows and for their referential integrity. Files that cannot be
+// read result in an error, the other problems are collected in the report, cf. IntegrityReport.Fatal.
+func ValidateInput(params *ValidateParams) (report *IntegrityReport, err error) {
+	defer func() {
+		// converts any panics into errors, as for Run
+		if r := recover(); r != nil {
+			fmt.Println("Recovered from panic during validation: ", r)
+			err = errors.New(fmt.Sprintf("%v", r))
+			fmt.Println(string(debug.Stack()))
+		}
+	}()
+	report, _, err = validateInput(params)
+	return report, err
+}
+
+// validateInput implements ValidateInput, and also returns the parsed patients with their diagnoses.
+func validateInput(params *ValidateParams) (*IntegrityReport, *PatientMap, error) {
+	var treatmentSchema *TreatmentSchema
+	var err error
+	if params.TreatmentSchema != "" {
+		if treatmentSchema, err = LoadTreatmentSchema(params.TreatmentSchema); err != nil {
+			return nil, nil, err
+		}
+	}
+	if params.CustomEvents != "" {
+		if treatmentSchema, err = withCustomEvents(treatmentSchema, params.CustomEvents); err != nil {
+			return nil, nil, err
+		}
+	}
+	icd9ToIcd10Map := map[string]string{}
+	if params.ICD9ToICD10File != "" {
+		if icd9ToIcd10Map, err = readIcd9ToIcd10Mapping(params.ICD9ToICD10File); err != nil {
+			return nil, nil, err
+		}
+	}
+	icd9Mappings := len(icd9ToIcd10Map)
+	if params.SNOMEDToICD10File != "" {
+		icd9ToIcd10Map = mergeToIcd10Mappings(icd9ToIcd10Map, parseSNOMEDToIcd10Mapping(params.SNOMEDToICD10File))
+	}
+	analysisMaps, _, _, idMap := initializeAnalysisMaps(params.DiagnosisInfo, params.Lvl, params.ICD10ToICD11File,
+		treatmentSchema.vocabularyEvents())
+	if analysisMaps == nil {
+		return nil, nil, errors.New(fmt.Sprint("unknown vocabulary: ", params.DiagnosisInfo))
+	}
+	validation := NewValidationReport() // the input files are validated while they are parsed
+	report := &IntegrityReport{Validation: validation, UnknownPatients: map[string]int{},
+		ICD9Mappings: icd9Mappings, maxBadRows: params.MaxBadRows}
+	duplicates := NewDuplicateReport(DedupNone)
+	patients, _ := parseTriNetXPatientData(params.PatientInfo, 1, duplicates, validation)
+	report.Patients = len(patients.PIDMap)
+	report.Unmapped = parseTrinetXPatientDiagnoses(params.PatientDiagnoses, "", nil, patients, analysisMaps,
+		icd9ToIcd10Map, duplicates, validation)
+	today, _ := ParseReferenceDate("")
+	CheckTemporalSanity(patients, TemporalFlag, today, func(did int) bool {
+		return analysisMaps.isEventOfInterest(idMap[did])
+	}, validation)
+	countUnknown := func(file string, pids []string) {
+		for _, pid := range pids {
+			if _, ok := patients.PIDStringMap[pid]; !ok {
+				report.UnknownPatients[file]++
+			}
+		}
+	}
+	if params.TumorInfo != "" {
+		tumors := ParsetTriNetXTumorData(params.TumorInfo, ParseTumorSites(params.TumorSites), nil, validation)
+		countUnknown(params.TumorInfo, sortedKeys(tumors))
+	}
+	if params.TreatmentInfo != "" {
+		countUnknown(params.TreatmentInfo, sortedKeys(parseTriNetXTreatmentFile(params.TreatmentInfo, treatmentSchema,
+			validation)))
+	}
+	if !validation.OK() && params.RejectsFile != "" {
+		validation.Save(params.RejectsFile)
+	}
+	return report, patients, nil
+}
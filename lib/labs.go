@@ -0,0 +1,158 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Lab results as events. Lab results from a lab file, coded in LOINC, are turned into diagnosis-like events with lab
+// rules: a rule compares the value of a lab test with a threshold, e.g. eGFR < 60, and names the event of the abnormal
+// values, e.g. renal impairment. Each event gets its own analysis DID, after the diagnosis codes, and the abnormal lab
+// results are added as diagnoses of the patients, so that they are part of the trajectories as any other event.
+
+// Comparators of lab rules.
+var labComparators = map[string]func(value, threshold float64) bool{
+	"<":  func(value, threshold float64) bool { return value < threshold },
+	"<=": func(value, threshold float64) bool { return value <= threshold },
+	">":  func(value, threshold float64) bool { return value > threshold },
+	">=": func(value, threshold float64) bool { return value >= threshold },
+	"=":  func(value, threshold float64) bool { return value == threshold },
+}
+
+// LabRule turns the lab results of a LOINC code that pass the comparison with the threshold into an event.
+type LabRule struct {
+	LOINC      string  `json:"loinc"`          // LOINC code of the lab test, e.g. 33914-3 for eGFR
+	Comparator string  `json:"comparator"`     // <, <=, >, >=, or =
+	Threshold  float64 `json:"threshold"`      // the value to compare with
+	Unit       string  `json:"unit,omitempty"` // unit of the values, e.g. mL/min/{1.73_m2}, any unit if empty
+	Event      string  `json:"event"`          // name of the event, e.g. Renal impairment
+}
+
+// matches checks if a lab result is an event of the rule.
+func (rule *LabRule) matches(code string, value float64, unit string) bool {
+	if rule.LOINC != code || (rule.Unit != "" && !strings.EqualFold(rule.Unit, unit)) {
+		return false
+	}
+	return labComparators[rule.Comparator](value, rule.Threshold)
+}
+
+// Validate checks that the rule has a LOINC code, a known comparator, and an event.
+func (rule *LabRule) Validate() error {
+	if rule.LOINC == "" {
+		return errors.New("LOINC code is empty")
+	}
+	if _, ok := labComparators[rule.Comparator]; !ok {
+		return fmt.Errorf("unknown comparator %q for %s", rule.Comparator, rule.LOINC)
+	}
+	if rule.Event == "" {
+		return fmt.Errorf("event is empty for %s", rule.LOINC)
+	}
+	return nil
+}
+
+// LoadLabRules loads lab rules from a json file with a list of rules. The rules are validated.
+func LoadLabRules(path string) ([]*LabRule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules []*LabRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("lab rules %s: %v", path, err)
+	}
+	for _, rule := range rules {
+		if err := rule.Validate(); err != nil {
+			return nil, fmt.Errorf("lab rules %s: %v", path, err)
+		}
+	}
+	return rules, nil
+}
+
+// parseTriNetXLabResults parses a TriNetX lab result file, and adds the lab results that match a lab rule as diagnoses
+// of their events to the given patients. The header is omitted from the file, but it should be: patient_id,
+// encounter_id, code_system, code, date, lab_result_num_val, lab_result_text_val, units_of_measure, derived_by_TriNetX,
+// source_id. Lab results without numeric value are skipped. It returns the new number of diagnosis codes.
+func parseTriNetXLabResults(labFile string, rules []*LabRule, patients *PatientMap, icd10Map map[int]Icd10Entry,
+	idMap map[int]string, nofDiagnosisCodes int, report *ValidationReport) int {
+	events := map[string]bool{}
+	for _, rule := range rules {
+		events[rule.Event] = true
+	}
+	eventDIDs, nofDiagnosisCodes := addEventCodes(events, "LAB:", icd10Map, idMap, nofDiagnosisCodes)
+	file, err := openInput(labFile)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	reader := newCSVReader(file)
+	rows := newRowReader(reader, labFile, checkTriNetXLabRow, report)
+	ctr, abnormal, unknown := 0, 0, 0
+	changed := map[*Patient]bool{}
+	for {
+		record, err := rows.read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			panic(err)
+		}
+		ctr++
+		line, _ := reader.FieldPos(0)
+		value, err := strconv.ParseFloat(record[triNetXLabValue], 64)
+		if err != nil {
+			continue //skip lab results without numeric value
+		}
+		patient, ok := GetPatient(record[0], patients)
+		if !ok {
+			unknown++
+			patients.Warnings.add(labFile, line, UnmappedUnknownPatient, record[3])
+			continue //skip unknown patients
+		}
+		date := parseTriNetXDiagnosisDate(record[triNetXLabDate])
+		found := false
+		for _, rule := range rules {
+			if rule.matches(record[3], value, record[triNetXLabUnit]) {
+				patient.AddDiagnosis(&Diagnosis{PID: patient.PID, DID: eventDIDs[rule.Event], Date: date})
+				found = true
+			}
+		}
+		if found {
+			abnormal++
+			changed[patient] = true
+		}
+	}
+	for patient := range changed {
+		SortDiagnoses(patient)
+		CompactDiagnoses(patient)
+	}
+	fmt.Println("Parsed ", ctr, " lab results of which ", abnormal, " in ", len(eventDIDs), " lab events, and ",
+		unknown, " of unknown patients.")
+	return nofDiagnosisCodes
+}
@@ -0,0 +1,196 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"time"
+)
+
+// RunManifest describes a ptra run. It is written as a json file next to the other outputs of the run.
+type RunManifest struct {
+	Name             string                `json:"name"`                       // name of the experiment
+	RunID            string                `json:"runID,omitempty"`            // run ID recorded in the audit log, if audit logging was enabled
+	Created          string                `json:"created"`                    // time of the run, fixed in deterministic mode
+	Deterministic    bool                  `json:"deterministic,omitempty"`    // whether the run used a fixed seed and timestamps
+	Privacy          *PrivacyBudget        `json:"privacy,omitempty"`          // privacy budget spent, if differential privacy was enabled
+	SmallCells       *SmallCellSuppression `json:"smallCells,omitempty"`       // small cells suppressed, if a minimum cell size was set
+	Pseudonymization string                `json:"pseudonymization,omitempty"` // method used to pseudonymize patient IDs in outputs
+	Duplicates       *DuplicateReport      `json:"duplicates,omitempty"`       // duplicate records found in the input
+	Warnings         map[string]int        `json:"warnings,omitempty"`         // nr of skipped input rows per reason, cf. WarningLog
+	IndexDate        string                `json:"indexDate,omitempty"`        // index date of the timelines, if any
+	Stratification   string                `json:"stratification,omitempty"`   // dimensions of the cohorts, e.g. race,period=5, if any
+	Telemetry        []*StageTelemetry     `json:"telemetry,omitempty"`        // resources used per stage, omitted in deterministic mode
+	Version          string                `json:"version,omitempty"`          // version of ptra, if known
+	Revision         string                `json:"revision,omitempty"`         // vcs revision from which ptra was built, if known
+	RuntimeSeconds   float64               `json:"runtimeSeconds,omitempty"`   // wall time of the run, omitted in deterministic mode
+	Parameters       *ExperimentParams     `json:"parameters,omitempty"`       // all parameters of the run
+	Inputs           []*InputChecksum      `json:"inputs,omitempty"`           // checksums of the input files
+	Summary          *RunSummary           `json:"summary,omitempty"`          // summary metrics of the results
+}
+
+// InputChecksum is the SHA-256 checksum of an input file of a run. Remote files are listed without checksum.
+type InputChecksum struct {
+	File   string `json:"file"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// RunSummary holds the summary metrics of the results of a run.
+type RunSummary struct {
+	Patients     int         `json:"patients"`           // nr of patients after the patient filters
+	Pairs        int         `json:"pairs"`              // nr of selected diagnosis pairs
+	Trajectories int         `json:"trajectories"`       // nr of trajectories
+	Clusters     map[int]int `json:"clusters,omitempty"` // nr of clusters per granularity, with clustering
+	// nr of matched controls drawn from the whole comparison cohort for lack of controls with the same nr of
+	// comorbidities, with comorbidity matching
+	ComorbidityFallbacks int64 `json:"comorbidityFallbacks,omitempty"`
+}
+
+// newRunSummary returns the summary metrics of an experiment with the given nr of patients after the filters.
+func newRunSummary(exp *Experiment, patients int) *RunSummary {
+	summary := &RunSummary{Patients: patients, Pairs: len(exp.Pairs), Trajectories: len(exp.Trajectories),
+		ComorbidityFallbacks: exp.ComorbidityFallbacks}
+	if len(exp.Clusterings) > 0 {
+		summary.Clusters = map[int]int{}
+		for _, clustering := range exp.Clusterings {
+			summary.Clusters[clustering.Granularity] = len(clustering.Clusters)
+		}
+	}
+	return summary
+}
+
+// buildRevision returns the vcs revision from which ptra was built, with a +modified suffix if the working tree had
+// local modifications, or the empty string if the build did not record it, e.g. in tests.
+func buildRevision() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return ""
+	}
+	revision, modified := "", false
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			revision = setting.Value
+		case "vcs.modified":
+			modified = setting.Value == "true"
+		}
+	}
+	if revision != "" && modified {
+		revision += "+modified"
+	}
+	return revision
+}
+
+// fileChecksum returns the hex encoded SHA-256 checksum of a file.
+func fileChecksum(fileName string) (string, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// inputFiles returns the parameters of a run that are input files, in the order of the parameters.
+func inputFiles(args *ExperimentParams) []*string {
+	return []*string{&args.PatientInfo, &args.DiagnosisInfo, &args.PatientDiagnoses, &args.ICD9ToICD10File,
+		&args.ICD10ToICD11File, &args.SNOMEDToICD10File, &args.LoadRR, &args.TumorInfo, &args.StagingRules,
+		&args.TreatmentInfo, &args.TreatmentSchema, &args.CustomEvents, &args.ProcedureInfo, &args.ProcedureGroups,
+		&args.LabInfo, &args.LabRules, &args.EnrollmentInfo, &args.InputSchema, &args.LoadState, &args.DIDMap}
+}
+
+// manifestParameters returns the parameters of a run as they are recorded in its run manifest: the parameters that
+// are 0 for their default are resolved to that default, and remote input files are listed without the credentials and
+// the query of their URLs, cf. redactURL.
+func manifestParameters(args *ExperimentParams) *ExperimentParams {
+	params := *args
+	if params.MaxPValue == 0 {
+		params.MaxPValue = DefaultMaxPValue
+	}
+	for _, file := range inputFiles(&params) {
+		*file = redactURL(*file)
+	}
+	return &params
+}
+
+// inputChecksums returns the checksums of the input files of a run, in the order of the parameters. A diagnosis file
+// that is a directory or a glob pattern is listed per shard, cf. shardFiles. Files that do not exist yet, e.g. a DID
+// mapping file that the run creates, are left out.
+func inputChecksums(args *ExperimentParams) []*InputChecksum {
+	var checksums []*InputChecksum
+	for _, file := range inputFiles(args) {
+		if *file == "" {
+			continue
+		}
+		for _, shard := range shardFiles(*file) {
+			if isRemoteInput(shard) {
+				checksums = append(checksums, &InputChecksum{File: redactURL(shard)})
+				continue
+			}
+			if info, err := os.Stat(shard); err != nil || info.IsDir() {
+				continue
+			}
+			checksum, err := fileChecksum(shard)
+			if err != nil {
+				panic(err)
+			}
+			checksums = append(checksums, &InputChecksum{File: shard, SHA256: checksum})
+		}
+	}
+	return checksums
+}
+
+// runTimestamp returns the current time in RFC 3339 format. In deterministic mode, it returns the Unix epoch instead, so
+// that the outputs of a run do not depend on when it was started.
+func runTimestamp(deterministic bool) string {
+	if deterministic {
+		return time.Unix(0, 0).UTC().Format(time.RFC3339)
+	}
+	return time.Now().UTC().Format(time.RFC3339)
+}
+
+// WriteRunManifest writes a run manifest as a json file to the given output path.
+func WriteRunManifest(manifest *RunManifest, path string) {
+	fileName := filepath.Join(path, fmt.Sprintf("%s-manifest.json", manifest.Name))
+	file, err := os.Create(fileName)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(manifest); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,188 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"fmt"
+	"github.com/valyala/fastrand"
+	"math/rand/v2"
+	"sync/atomic"
+)
+
+// Matched comparison groups. By default, InitRR samples a comparison group of the same size as the exposed group from
+// the cohorts of the exposed patients, cf. selectRandomPatientsFromSimilarCohorts, which takes the first eligible
+// patients of a cohort with a bias towards the start of the cohort. With matched controls, each exposed patient is
+// instead matched to a given nr of controls that are drawn uniformly from the patients without d1 of the same sex, age
+// group, region, race/ethnicity stratum, and calendar period, and optionally with the same nr of distinct diagnoses
+// (comorbidities). This improves the control of confounding for skewed cohorts. The controls are drawn with
+// replacement, and the nr of d2 diagnoses of the comparison group is scaled to the size of the exposed group.
+
+// maxMatchAttempts is the nr of random draws per control after which the eligible candidates are searched exhaustively.
+// The draws are rejected if they hit exposed patients or patients of another region, which may make up most of the
+// candidates for a common d1 or a small region.
+const maxMatchAttempts = 32
+
+// comorbidityCount returns the nr of distinct diagnoses of a patient.
+func comorbidityCount(p *Patient) int {
+	dids := map[int]bool{}
+	for _, d := range p.Diagnoses {
+		dids[d.DID] = true
+	}
+	return len(dids)
+}
+
+// InitComorbidityMatching counts the comorbidities of the patients and groups the patients of each cohort by their nr
+// of comorbidities, so that matched controls can be drawn with the same nr of comorbidities, cf.
+// selectMatchedControls.
+func (exp *Experiment) InitComorbidityMatching() {
+	fmt.Println("Grouping the patients of the cohorts by their nr of comorbidities...")
+	for _, cohort := range exp.Cohorts {
+		cohort.Comorbidities = map[int][]*Patient{}
+		for _, p := range cohort.Patients {
+			p.Comorbidities = comorbidityCount(p)
+			cohort.Comorbidities[p.Comorbidities] = append(cohort.Comorbidities[p.Comorbidities], p)
+		}
+		for _, period := range cohort.Periods {
+			period.Comorbidities = map[int][]*Patient{}
+			for _, p := range period.Patients {
+				period.Comorbidities[p.Comorbidities] = append(period.Comorbidities[p.Comorbidities], p)
+			}
+		}
+	}
+}
+
+// controlRatio returns the nr of controls per exposed patient in the comparison groups of the experiment.
+func (exp *Experiment) controlRatio() int {
+	if exp.MatchedControls > 0 {
+		return exp.MatchedControls
+	}
+	return 1
+}
+
+// selectComparisonGroup selects a comparison group for the given patients exposed to d1, which excludes the patients
+// with the given IDs: matched controls if the experiment has them, otherwise patients from similar cohorts.
+func (exp *Experiment) selectComparisonGroup(patients []*Patient, pids map[int]bool, d1 int,
+	rng *rand.Rand) []*Patient {
+	if exp.MatchedControls > 0 {
+		return selectMatchedControls(exp, patients, pids, d1, rng)
+	}
+	return selectRandomPatientsFromSimilarCohorts(exp, patients, pids, d1, rng)
+}
+
+// nofPeriods returns the nr of calendar periods of the cohorts, 1 without period stratification.
+func (exp *Experiment) nofPeriods() int {
+	if exp.Periods == nil {
+		return 1
+	}
+	return exp.Periods.Count
+}
+
+// comparisonIndex returns the index of the comparison cohort of a patient exposed to d1 among the cohorts and their
+// calendar periods, cf. comparisonCohort.
+func (exp *Experiment) comparisonIndex(p *Patient, d1 int) int {
+	index := cohortIndex(exp.NofAgeGroups, exp.NofRegions, p.Sex, p.CohortAge, p.Region, p.Stratum) * exp.nofPeriods()
+	if exp.Periods != nil {
+		index += exp.Periods.index(firstDiagnosisDate(p, d1))
+	}
+	return index
+}
+
+// comparisonCohortAt returns the comparison cohort with the given index, cf. comparisonIndex.
+func (exp *Experiment) comparisonCohortAt(index int) *Cohort {
+	cohort := exp.Cohorts[index/exp.nofPeriods()]
+	if exp.Periods != nil {
+		return cohort.Periods[index%exp.Periods.Count]
+	}
+	return cohort
+}
+
+// comparisonCohort returns the cohort from which the comparison patients of a patient exposed to d1 are drawn: the
+// cohort of the patient, or with period stratification, the patients of that cohort that are observed in the calendar
+// period of the first d1 diagnosis of the patient, cf. strata.go.
+func (exp *Experiment) comparisonCohort(p *Patient, d1 int) *Cohort {
+	return exp.comparisonCohortAt(exp.comparisonIndex(p, d1))
+}
+
+// randomIndex returns a random index below n, drawn from the given generator, or from a fast non-deterministic
+// generator if rng is nil.
+func randomIndex(rng *rand.Rand, n int) int {
+	if rng == nil {
+		return int(fastrand.Uint32n(uint32(n)))
+	}
+	return rng.IntN(n)
+}
+
+// drawControl draws a random patient from the candidates that lives in the given region and is not one of the patients
+// with the given IDs. The cohorts do not distinguish regions, cf. cohortIndex, so the region is checked here. The
+// patient is drawn by rejection sampling, or if that fails maxMatchAttempts times, uniformly from the eligible
+// candidates, so that it returns nil only if there are no eligible candidates.
+func drawControl(candidates []*Patient, region int, pids map[int]bool, rng *rand.Rand) *Patient {
+	if len(candidates) == 0 {
+		return nil
+	}
+	eligible := func(p *Patient) bool {
+		return p.Region == region && !pids[p.PID]
+	}
+	for i := 0; i < maxMatchAttempts; i++ {
+		if p := candidates[randomIndex(rng, len(candidates))]; eligible(p) {
+			return p
+		}
+	}
+	var eligibleCandidates []*Patient
+	for _, p := range candidates {
+		if eligible(p) {
+			eligibleCandidates = append(eligibleCandidates, p)
+		}
+	}
+	if len(eligibleCandidates) == 0 {
+		return nil
+	}
+	return eligibleCandidates[randomIndex(rng, len(eligibleCandidates))]
+}
+
+// selectMatchedControls collects for a given list of patients exposed to d1 the matched controls of each patient, which
+// are drawn from the patients of the comparison cohort that are not in the given IDs, cf. comparisonCohort. With
+// comorbidity matching, the controls also have the same nr of comorbidities as the patient, if there are such controls,
+// and are otherwise drawn from the whole comparison cohort, which is counted in Experiment.ComorbidityFallbacks. A
+// patient for which no control is found gets no controls, so that the comparison group is smaller than required.
+func selectMatchedControls(exp *Experiment, patients []*Patient, pids map[int]bool, d1 int,
+	rng *rand.Rand) []*Patient {
+	collectedPatients := make([]*Patient, 0, len(patients)*exp.MatchedControls)
+	for _, p := range patients {
+		cohort := exp.comparisonCohort(p, d1)
+		var matched []*Patient
+		if cohort.Comorbidities != nil {
+			matched = cohort.Comorbidities[p.Comorbidities]
+		}
+		for i := 0; i < exp.MatchedControls; i++ {
+			control := drawControl(matched, p.Region, pids, rng)
+			if control == nil {
+				control = drawControl(cohort.Patients, p.Region, pids, rng)
+				if control != nil && cohort.Comorbidities != nil {
+					atomic.AddInt64(&exp.ComorbidityFallbacks, 1)
+				}
+			}
+			if control == nil {
+				break
+			}
+			collectedPatients = append(collectedPatients, control)
+		}
+	}
+	return collectedPatients
+}
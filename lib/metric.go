@@ -0,0 +1,81 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import "math"
+
+// Effect sizes of the diagnosis pairs besides the RR. Some downstream consumers and publications require odds ratios or
+// absolute risk differences. Both are derived from the same 2x2 table as the RR, cf. RRStats: the exposed group with
+// and without d2, and a comparison group of the same size with and without d2. Hazard ratios are computed from the
+// times to d2 instead, cf. hazard-ratio.go. The selected metric is reported for the pairs next to the RR, while the
+// pairs that trajectories are built from are still selected on their RR scores.
+
+// Metrics of the effect size of the diagnosis pairs.
+const (
+	MetricRR = "rr" // relative risk
+	MetricOR = "or" // odds ratio
+	MetricRD = "rd" // absolute risk difference
+	MetricHR = "hr" // hazard ratio, cf. hazard-ratio.go
+)
+
+// OddsRatio returns the odds ratio of d2 in the exposed group versus the comparison group. It is +Inf if all exposed
+// patients or none of the comparison group are diagnosed with d2.
+func (stats *RRStats) OddsRatio() float64 {
+	n, a, c := stats.table()
+	return (a * (n - c)) / ((n - a) * c)
+}
+
+// RiskDifference returns the absolute difference between the risk of d2 in the exposed group and in the comparison
+// group.
+func (stats *RRStats) RiskDifference() float64 {
+	n := float64(stats.Exposed)
+	return stats.ExposedD2/n - stats.ComparisonD2/n
+}
+
+// effect returns the effect size of d1 -> d2 for the metric of the experiment, or NaN if it is unknown, e.g. for RR
+// scores without statistics, cf. rrStats.
+func (exp *Experiment) effect(d1, d2 int) float64 {
+	if exp.Metric == "" || exp.Metric == MetricRR {
+		return exp.DxDRR[d1][d2]
+	}
+	if exp.Metric == MetricHR {
+		return exp.hazardRatio(d1, d2)
+	}
+	stats := exp.rrStats(d1, d2)
+	if stats == nil || stats.Exposed == 0 {
+		return math.NaN()
+	}
+	if exp.Metric == MetricOR {
+		return stats.OddsRatio()
+	}
+	return stats.RiskDifference()
+}
+
+// metricName returns the name of the metric of the experiment, for column headers.
+func (exp *Experiment) metricName() string {
+	switch exp.Metric {
+	case MetricOR:
+		return "OR"
+	case MetricRD:
+		return "RD"
+	case MetricHR:
+		return "HR"
+	}
+	return "RR"
+}
@@ -24,7 +24,6 @@ import "math"
 
 // AgeAtDiagnosis calculates the age of a patient at a specific diagnosis
 func AgeAtDiagnosis(p *Patient, DID int) int {
-	yob := p.YOB
 	var diagnosis *Diagnosis
 	for _, d := range p.Diagnoses {
 		if d.DID == DID {
@@ -32,15 +31,13 @@ func AgeAtDiagnosis(p *Patient, DID int) int {
 			break
 		}
 	}
-	date := diagnosis.Date
-	return date.Year - yob
+	return AgeAt(p, diagnosis.Date)
 }
 
 // AgeAtEOI calculates the age of a patient at the event of interest (e.g. cancer diagnosis)
 func AgeAtEOI(p *Patient) int {
-	yob := p.YOB
 	if p.EOIDate != nil {
-		return p.EOIDate.Year - yob
+		return AgeAt(p, *p.EOIDate)
 	}
 	return -1
 }
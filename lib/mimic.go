@@ -0,0 +1,128 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// Reading MIMIC-IV hosp tables. Patients are read from the patients table, diagnoses from the diagnoses_icd table. The
+// diagnoses of MIMIC-IV are coded per hospital admission, with ICD-9 or ICD-10 codes, and are dated by the admission
+// time from the admissions table. The tables are csv files with a header, possibly gzipped as in the MIMIC-IV
+// distribution. MIMIC-IV shifts all dates of a patient into the future by the same offset, so the intervals between
+// the dates are preserved.
+
+// ICD versions of MIMIC-IV diagnoses.
+var mimicICDVersions = map[string]string{
+	"9":  CodeSystemICD9,
+	"10": CodeSystemICD10,
+}
+
+// mimicTableFile returns the file of a MIMIC-IV table in the given directory, e.g. admissions.csv, admissions.csv.gz,
+// or admissions.csv.zst.
+func mimicTableFile(dir, table string) string {
+	for _, ext := range []string{".csv", ".csv.gz", ".csv.zst"} {
+		file := filepath.Join(dir, table+ext)
+		if _, err := os.Stat(file); err == nil {
+			return file
+		}
+	}
+	return filepath.Join(dir, table+".csv.gz")
+}
+
+// parseMIMICPatients reads the patients from the patients table. The year of birth is the anchor year minus the anchor
+// age. Patients without anchor year or age are skipped. MIMIC-IV has no regions.
+func parseMIMICPatients(patientFile string, nofCohortAges int, duplicates *DuplicateReport) (*PatientMap, int) {
+	loader := newPatientLoader(duplicates)
+	err := readCSVTable(patientFile, []string{"subject_id", "gender", "anchor_age", "anchor_year", "dod"},
+		func(values []string) {
+			age, err1 := strconv.Atoi(values[2])
+			year, err2 := strconv.Atoi(values[3])
+			if values[0] == "" || err1 != nil || err2 != nil {
+				return //skip patients without id or year of birth
+			}
+			var dateOfDeath *DiagnosisDate
+			if date, err := parseOMOPDate(values[4]); err == nil {
+				dateOfDeath = &date
+			}
+			loader.add(values[0], values[1], year-age, dateOfDeath, "")
+		})
+	if err != nil {
+		panic(err)
+	}
+	return loader.finish(nofCohortAges)
+}
+
+// parseMIMICAdmissions reads the admission times of the hospital admissions from the admissions table.
+func parseMIMICAdmissions(admissionsFile string) map[string]DiagnosisDate {
+	admissions := map[string]DiagnosisDate{}
+	err := readCSVTable(admissionsFile, []string{"hadm_id", "admittime"}, func(values []string) {
+		if date, err := parseOMOPDate(values[1]); err == nil {
+			admissions[values[0]] = date
+		}
+	})
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println("Parsed ", len(admissions), " MIMIC-IV admissions.")
+	return admissions
+}
+
+// parseMIMICDiagnoses reads the diagnoses from the diagnoses_icd table, and fills them in for the given patients. A
+// diagnosis is dated by the admission time of its hospital admission, read from the admissions table in the directory
+// of the diagnosis file. The ICD version of a diagnosis determines whether its code is an ICD-9 or ICD-10 code, and the
+// diagnosis with the first sequence nr of an admission is its primary diagnosis. It returns a report of the diagnosis
+// codes that could not be mapped.
+func parseMIMICDiagnoses(diagnosisFile, treatmentInfoFile string, treatmentSchema *TreatmentSchema,
+	patients *PatientMap, icd10AnalysisMap AnalysisMaps, icd9ToIcd10Map map[string]string,
+	duplicates *DuplicateReport, report *ValidationReport) *UnmappedCodeReport {
+	admissionsFile := mimicTableFile(filepath.Dir(diagnosisFile), "admissions")
+	if isRemoteInput(diagnosisFile) {
+		admissionsFile = remoteSibling(diagnosisFile, "admissions")
+	}
+	admissions := parseMIMICAdmissions(admissionsFile)
+	loader := newDiagnosisLoader(patients, icd10AnalysisMap, icd9ToIcd10Map, duplicates)
+	loader.at(diagnosisFile, 0)
+	skipped := 0
+	err := readCSVTable(diagnosisFile, []string{"subject_id", "hadm_id", "icd_code", "icd_version", "seq_num"},
+		func(values []string) {
+			date, ok := admissions[values[1]]
+			if !ok {
+				skipped++
+				patients.Warnings.add(diagnosisFile, 0, WarningMissingAdmission, values[1])
+				return //skip diagnoses without admission time
+			}
+			codeSystem, ok := mimicICDVersions[values[3]]
+			if !ok {
+				loader.skip("ICD-"+values[3], values[2], UnmappedNoICDConcept)
+				return
+			}
+			loader.addInEncounter(values[0], values[1], codeSystem, dottedICDCode(codeSystem, values[2]), values[4] != "1",
+				date)
+		})
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println("Skipped ", skipped, " MIMIC-IV diagnoses without admission time.")
+	fillInTreatments(treatmentInfoFile, treatmentSchema, patients, icd10AnalysisMap, report)
+	return loader.finish()
+}
@@ -0,0 +1,227 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"fmt"
+	"github.com/exascience/pargo/parallel"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Mortality of the trajectories. The patients that follow a trajectory are followed from the date of the last
+// diagnosis of the trajectory, and the proportion of them that die within given windows of years is compared with that
+// of matched non-followers. As for the hazard ratios, cf. hazard-ratio.go, the non-followers are controls from the same
+// cohort and region as the followers that do not follow the trajectory, and they are followed from the same index date.
+// Only the patients that are observed and alive at the index date are counted. The follow-up is censored at the end of
+// the data, cf. Experiment.EndDate, so that a window only counts the patients that die within it or that are followed
+// for the whole window. Patients without a date of death, or that die after the end of the data, count as surviving.
+
+// TrajectoryMortality is the nr of followers and matched non-followers of a trajectory that die within each window.
+type TrajectoryMortality struct {
+	Trajectory     *Trajectory
+	Windows        []float64 // the windows in years after the index date
+	Followers      []int     // nr of followers alive at the index date and not censored within each window
+	FollowerDeaths []int     // nr of followers that die within each window
+	Controls       []int     // nr of matched non-followers alive at the index date and not censored within each window
+	ControlDeaths  []int     // nr of non-followers that die within each window
+}
+
+// FollowerMortality returns the proportion of the followers that die within the i-th window, NaN without followers.
+func (m *TrajectoryMortality) FollowerMortality(i int) float64 {
+	return proportion(m.FollowerDeaths[i], m.Followers[i])
+}
+
+// ControlMortality returns the proportion of the non-followers that die within the i-th window, NaN without
+// non-followers.
+func (m *TrajectoryMortality) ControlMortality(i int) float64 {
+	return proportion(m.ControlDeaths[i], m.Controls[i])
+}
+
+// MortalityRatio returns the ratio of the mortality of the followers and the non-followers within the i-th window, NaN
+// if the mortality of the non-followers is unknown or zero.
+func (m *TrajectoryMortality) MortalityRatio(i int) float64 {
+	control := m.ControlMortality(i)
+	if control == 0 {
+		return math.NaN()
+	}
+	return m.FollowerMortality(i) / control
+}
+
+// proportion returns n / total, or NaN if total is zero.
+func proportion(n, total int) float64 {
+	if total == 0 {
+		return math.NaN()
+	}
+	return float64(n) / float64(total)
+}
+
+// formatMortality formats a proportion or ratio of the mortality, NA if it is unknown.
+func formatMortality(f float64) string {
+	if math.IsNaN(f) {
+		return "NA"
+	}
+	return formatRRFloat(f)
+}
+
+// ParseMortalityWindows parses a comma separated list of windows in years, e.g. 1,5.
+func ParseMortalityWindows(s string) ([]float64, error) {
+	var windows []float64
+	for _, value := range strings.Split(s, ",") {
+		window, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || window <= 0 {
+			return nil, fmt.Errorf("invalid mortality window, expected a positive nr of years: %s", value)
+		}
+		windows = append(windows, window)
+	}
+	return windows, nil
+}
+
+// aliveAt returns whether a patient is observed and alive at the given date.
+func aliveAt(p *Patient, date DiagnosisDate) bool {
+	if len(p.Diagnoses) == 0 || DiagnosisDateSmallerThan(date, p.Diagnoses[0].Date) {
+		return false
+	}
+	return p.DeathDate == nil || !DiagnosisDateSmallerThan(*p.DeathDate, date)
+}
+
+// countDeaths counts a patient that is alive at the given date in each window within which the patient dies or that
+// ends before the end of the data, and increments the nr of deaths of each window within which the patient dies.
+func countDeaths(p *Patient, date, end DiagnosisDate, windows []float64, patients, deaths []int) {
+	followed := float64(DaysBetween(date, end)) / daysPerYear
+	died := math.Inf(1)
+	if p.DeathDate != nil && !DiagnosisDateSmallerThan(end, *p.DeathDate) {
+		died = float64(DaysBetween(date, *p.DeathDate)) / daysPerYear
+	}
+	for i, window := range windows {
+		if died <= window {
+			patients[i]++
+			deaths[i]++
+		} else if followed >= window {
+			patients[i]++
+		}
+	}
+}
+
+// Mortality computes the mortality of the trajectories of the experiment within the given windows, cf.
+// TrajectoryMortality. The diagnoses of the followers are matched within the given time frame, cf.
+// matchPatientTrajectory, and each follower gets as many non-followers as the experiment has matched controls, or one.
+// The non-followers are drawn from the given patients, since the cohorts of the experiment are released after the RR
+// scores are computed. With period stratification, they are observed in the calendar period of the index date, cf.
+// strata.go. The data ends at the end date of the experiment with censoring, and at the last diagnosis of the
+// given patients otherwise.
+func (exp *Experiment) Mortality(patients *PatientMap, windows []float64,
+	minTime, maxTime float64) []*TrajectoryMortality {
+	cohorts := map[int][]*Patient{}
+	for _, pid := range patients.sortedPIDs() {
+		p := patients.PIDMap[pid]
+		index := exp.nofPeriods() * cohortIndex(exp.NofAgeGroups, exp.NofRegions, p.Sex, p.CohortAge, p.Region,
+			p.Stratum)
+		if exp.Periods == nil {
+			cohorts[index] = append(cohorts[index], p)
+			continue
+		}
+		first, last := exp.Periods.observed(p)
+		for i := first; i <= last; i++ {
+			cohorts[index+i] = append(cohorts[index+i], p)
+		}
+	}
+	end := exp.EndDate
+	if !exp.Censoring {
+		end = LastDiagnosisDate(patients.PIDMap)
+	}
+	mortality := make([]*TrajectoryMortality, len(exp.Trajectories))
+	ratio := exp.controlRatio()
+	parallel.Range(0, len(exp.Trajectories), 0, func(low, high int) {
+		for i := low; i < high; i++ {
+			t := exp.Trajectories[i]
+			m := &TrajectoryMortality{Trajectory: t, Windows: windows, Followers: make([]int, len(windows)),
+				FollowerDeaths: make([]int, len(windows)), Controls: make([]int, len(windows)),
+				ControlDeaths: make([]int, len(windows))}
+			followers := t.Patients[len(t.Patients)-1]
+			pids := patientsToIdMap(followers)
+			rng := exp.Rand(mortalityStreams + uint64(i))
+			for _, p := range followers {
+				matches := matchPatientTrajectory(p, t.Diagnoses, minTime, maxTime)
+				if matches == nil {
+					continue
+				}
+				index := matches[len(matches)-1].Date
+				if !aliveAt(p, index) {
+					continue
+				}
+				countDeaths(p, index, end, windows, m.Followers, m.FollowerDeaths)
+				cohortIndex := cohortIndex(exp.NofAgeGroups, exp.NofRegions, p.Sex, p.CohortAge, p.Region, p.Stratum) *
+					exp.nofPeriods()
+				if exp.Periods != nil {
+					cohortIndex += exp.Periods.index(index)
+				}
+				cohort := cohorts[cohortIndex]
+				for j := 0; j < ratio; j++ {
+					if control := drawControl(cohort, p.Region, pids, rng); control != nil &&
+						aliveAt(control, index) {
+						countDeaths(control, index, end, windows, m.Controls, m.ControlDeaths)
+					}
+				}
+			}
+			mortality[i] = m
+		}
+	})
+	return mortality
+}
+
+// WriteMortality writes the mortality of the trajectories to a tab file, cf. Mortality, and returns the name of the
+// file. For each trajectory and window, it prints one line with the trajectory ID, the hash, the diagnoses, the codes,
+// the window in years, the nr of followers, the nr of them that die within the window and its proportion, the nr of
+// non-followers, the nr of them that die within the window and its proportion, and the ratio of both proportions. A
+// proportion without patients and a ratio without deaths of the non-followers are NA:
+// ID tab hash tab diagnoses tab codes tab window tab followers tab deaths tab mortality tab controls tab deaths tab
+// mortality tab ratio.
+func WriteMortality(exp *Experiment, mortality []*TrajectoryMortality, path string) string {
+	name := filepath.Join(path, fmt.Sprintf("%s-mortality.tab", exp.Name))
+	file, err := os.Create(name)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	for _, m := range mortality {
+		t := m.Trajectory
+		terms, codes := make([]string, len(t.Diagnoses)), make([]string, len(t.Diagnoses))
+		for i, did := range t.Diagnoses {
+			terms[i], codes[i] = exp.Icd10Map[did].Name, exp.IdMap[did]
+		}
+		for i, window := range m.Windows {
+			fmt.Fprintf(file, "%d\t%s\t%s\t%s\t%s\t%v\t%v\t%s\t%v\t%v\t%s\t%s\n", t.ID, t.Hash,
+				strings.Join(terms, " -> "), strings.Join(codes, " -> "), strconv.FormatFloat(window, 'f', -1, 64),
+				exp.cellValue(float64(m.Followers[i]), m.Followers[i]),
+				exp.cellValue(float64(m.FollowerDeaths[i]), m.FollowerDeaths[i]),
+				formatMortality(m.FollowerMortality(i)), exp.cellValue(float64(m.Controls[i]), m.Controls[i]),
+				exp.cellValue(float64(m.ControlDeaths[i]), m.ControlDeaths[i]),
+				formatMortality(m.ControlMortality(i)), formatMortality(m.MortalityRatio(i)))
+		}
+	}
+	return name
+}
@@ -0,0 +1,143 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"encoding/csv"
+	"fmt"
+	"github.com/imec-int/ptra/lib/utils"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Export of the trajectories as csv files for the bulk importer of Neo4j, so that the results can be queried with
+// Cypher. The files are written to a neo4j folder in the output folder, and are imported with e.g.:
+//
+//	neo4j-admin database import full --nodes=neo4j/diagnoses.csv --nodes=neo4j/trajectories.csv
+//		--nodes=neo4j/patients.csv --relationships=neo4j/progresses-to.csv --relationships=neo4j/matches.csv
+//
+// The nodes are the diagnoses (:Diagnosis), the trajectories (:Trajectory), and the patients that match the
+// trajectories (:Patient). A diagnosis PROGRESSES_TO another diagnosis for each transition in the trajectories, with
+// the RR of the diagnosis pair, the largest nr of patients of the transition, cf. printTrajectoriesDot, and the IDs of
+// the trajectories with the transition. A patient MATCHES the trajectories of which the patient has all diagnoses. The
+// patients are identified by their pseudonyms, cf. Pseudonymizer.
+
+// Neo4jFolder is the folder in the output folder to which the Neo4j import files are written.
+const Neo4jFolder = "neo4j"
+
+// neo4jArray formats a list of ints as an array value of the Neo4j importer, which separates the elements with ;.
+func neo4jArray(values []int) string {
+	elements := make([]string, len(values))
+	for i, value := range values {
+		elements[i] = strconv.Itoa(value)
+	}
+	return strings.Join(elements, ";")
+}
+
+// writeNeo4jFile writes a csv file with the given header and rows for the Neo4j importer, and returns the file name.
+func writeNeo4jFile(path, name string, header []string, rows [][]string) string {
+	fileName := filepath.Join(path, name)
+	file, err := os.Create(fileName)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	writer := csv.NewWriter(file)
+	writer.Write(header)
+	writer.WriteAll(rows)
+	if err := writer.Error(); err != nil {
+		panic(err)
+	}
+	return fileName
+}
+
+// WriteNeo4jImport writes the trajectories of an experiment as Neo4j import files to the neo4j folder in the given
+// output path.
+func WriteNeo4jImport(exp *Experiment, path string) {
+	path = filepath.Join(path, Neo4jFolder)
+	if err := os.MkdirAll(path, 0700); err != nil {
+		panic(err)
+	}
+	var diagnoses, trajectories, patients, progressions, matches [][]string
+	var edges [][2]int
+	edgePatients := map[[2]int]int{}
+	edgeTrajectories := map[[2]int][]int{}
+	diagnosisSeen := map[int]bool{}
+	patientSeen := map[int]bool{}
+	for _, t := range exp.Trajectories {
+		for idx, did := range t.Diagnoses {
+			if !diagnosisSeen[did] {
+				diagnosisSeen[did] = true
+				entry := exp.Icd10Map[did]
+				diagnoses = append(diagnoses, []string{strconv.Itoa(did), exp.IdMap[did], entry.Name,
+					strconv.Itoa(entry.Level), "Diagnosis"})
+			}
+			if idx == 0 {
+				continue
+			}
+			edge := [2]int{t.Diagnoses[idx-1], did}
+			if _, ok := edgePatients[edge]; !ok {
+				edges = append(edges, edge)
+			}
+			edgePatients[edge] = utils.MaxInt(edgePatients[edge], t.PatientNumbers[idx-1])
+			edgeTrajectories[edge] = append(edgeTrajectories[edge], t.ID)
+		}
+		trajectories = append(trajectories, []string{strconv.Itoa(t.ID), t.Hash,
+			neo4jArray(t.Diagnoses), neo4jArray(t.PatientNumbers), "Trajectory"})
+		if len(t.Patients) == 0 {
+			continue
+		}
+		for _, p := range t.Patients[len(t.Patients)-1] {
+			if !patientSeen[p.PID] {
+				patientSeen[p.PID] = true
+				sex := "F"
+				if p.Sex == Male {
+					sex = "M"
+				}
+				patients = append(patients, []string{strconv.Itoa(p.PID), exp.Pseudonymizer.Pseudonym(p.PIDString), sex,
+					strconv.Itoa(p.YOB), "Patient"})
+			}
+			matches = append(matches, []string{strconv.Itoa(p.PID), strconv.Itoa(t.ID), "MATCHES"})
+		}
+	}
+	for _, edge := range edges {
+		progressions = append(progressions, []string{strconv.Itoa(edge[0]), strconv.Itoa(edge[1]),
+			strconv.FormatFloat(exp.DxDRR[edge[0]][edge[1]], 'f', -1, 64), strconv.Itoa(edgePatients[edge]),
+			neo4jArray(edgeTrajectories[edge]), "PROGRESSES_TO"})
+	}
+	exp.Audit.Wrote(writeNeo4jFile(path, "diagnoses.csv",
+		[]string{"did:ID(Diagnosis)", "code", "name", "level:int", ":LABEL"}, diagnoses), false)
+	exp.Audit.Wrote(writeNeo4jFile(path, "trajectories.csv",
+		[]string{"tid:ID(Trajectory)", "hash", "diagnoses:int[]", "patients:int[]", ":LABEL"}, trajectories), false)
+	exp.Audit.Wrote(writeNeo4jFile(path, "patients.csv",
+		[]string{"pid:ID(Patient)", "id", "sex", "yob:int", ":LABEL"}, patients), true)
+	exp.Audit.Wrote(writeNeo4jFile(path, "progresses-to.csv",
+		[]string{":START_ID(Diagnosis)", ":END_ID(Diagnosis)", "rr:double", "patients:int", "trajectories:int[]",
+			":TYPE"}, progressions), false)
+	exp.Audit.Wrote(writeNeo4jFile(path, "matches.csv",
+		[]string{":START_ID(Patient)", ":END_ID(Trajectory)", ":TYPE"}, matches), true)
+	fmt.Println("Wrote Neo4j import files for ", len(diagnoses), " diagnoses, ", len(trajectories),
+		" trajectories, and ", len(patients), " patients to ", path)
+}
@@ -0,0 +1,220 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Reading OMOP Common Data Model tables. Patients are read from the person and death tables, diagnoses from the
+// condition_occurrence table. The OMOP concept IDs of the conditions are mapped onto ICD-10 (or ICD-9) codes with the
+// concept table, which are then mapped onto analysis DIDs as for the other input formats. The tables are read from csv
+// files with a header, or from a database.
+
+// OMOP concept IDs of the genders.
+const (
+	omopMale   = "8507"
+	omopFemale = "8532"
+)
+
+// omopVocabularies maps the OMOP vocabularies of ICD codes onto their code systems.
+var omopVocabularies = map[string]string{
+	"ICD10CM": CodeSystemICD10,
+	"ICD10":   CodeSystemICD10,
+	"ICD9CM":  CodeSystemICD9,
+	"SNOMED":  CodeSystemSNOMED,
+}
+
+// OMOPSource reads OMOP tables.
+type OMOPSource interface {
+	// ReadTable calls f for each row of a table with the values of the given columns. Missing values are empty
+	// strings. It returns an error if the table cannot be read.
+	ReadTable(table string, columns []string, f func(values []string)) error
+}
+
+// OMOPCSVSource reads OMOP tables from csv files with a header. The header names the columns, so the order of the
+// columns does not matter. Files are comma or tab separated, and may be compressed, cf. openInput.
+type OMOPCSVSource struct {
+	Dir   string            // directory with a csv file per table, e.g. person.csv or PERSON.csv
+	Files map[string]string // files for specific tables, overrides the files in Dir
+}
+
+// NewOMOPCSVSource creates a source that reads the person table from the given patient file, the condition_occurrence
+// table from the given diagnosis file, and the other tables from csv files in the directory of the patient file. For a
+// remote patient file, the other tables have the same extension as the patient file.
+func NewOMOPCSVSource(patientFile, diagnosisFile string) *OMOPCSVSource {
+	source := &OMOPCSVSource{Dir: filepath.Dir(patientFile),
+		Files: map[string]string{"person": patientFile, "condition_occurrence": diagnosisFile}}
+	if isRemoteInput(patientFile) {
+		for _, table := range []string{"death", "concept"} {
+			source.Files[table] = remoteSibling(patientFile, table)
+		}
+	}
+	return source
+}
+
+// tableFile returns the file for a table.
+func (source *OMOPCSVSource) tableFile(table string) string {
+	if file, ok := source.Files[table]; ok {
+		return file
+	}
+	for _, name := range []string{table, strings.ToUpper(table)} {
+		for _, ext := range []string{".csv", ".tsv", ".CSV", ".TSV", ".csv.gz", ".csv.zst"} {
+			file := filepath.Join(source.Dir, name+ext)
+			if _, err := os.Stat(file); err == nil {
+				return file
+			}
+		}
+	}
+	return filepath.Join(source.Dir, table+".csv")
+}
+
+// ReadTable implements OMOPSource.
+func (source *OMOPCSVSource) ReadTable(table string, columns []string, f func(values []string)) error {
+	return readCSVTable(source.tableFile(table), columns, f)
+}
+
+// OMOPSQLSource reads OMOP tables from a database. The caller opens the database with the driver of their choice.
+type OMOPSQLSource struct {
+	DB     *sql.DB
+	Schema string // schema of the OMOP tables, e.g. cdm, none if empty
+}
+
+// ReadTable implements OMOPSource.
+func (source *OMOPSQLSource) ReadTable(table string, columns []string, f func(values []string)) error {
+	if source.Schema != "" {
+		table = source.Schema + "." + table
+	}
+	return readSQLRows(source.DB, fmt.Sprintf("SELECT %s FROM %s", strings.Join(columns, ", "), table), f)
+}
+
+// parseOMOPDate parses an OMOP date or datetime, e.g. 2010-05-01, 2010-05-01 00:00:00, or 20100501.
+func parseOMOPDate(date string) (DiagnosisDate, error) {
+	if i := strings.IndexAny(date, " T"); i != -1 {
+		date = date[:i]
+	}
+	for _, layout := range []string{"2006-01-02", "20060102"} {
+		if t, err := time.Parse(layout, date); err == nil {
+			return DiagnosisDate{Year: t.Year(), Month: int(t.Month()), Day: t.Day()}, nil
+		}
+	}
+	return DiagnosisDate{}, errors.New("invalid OMOP date: " + date)
+}
+
+// parseOMOPPatients reads the patients from the person and death tables. Persons without year of birth are skipped. The
+// death table is optional. The location is used as region.
+func parseOMOPPatients(source OMOPSource, nofCohortAges int, duplicates *DuplicateReport) (*PatientMap, int) {
+	deaths := map[string]*DiagnosisDate{}
+	err := source.ReadTable("death", []string{"person_id", "death_date"}, func(values []string) {
+		if date, err := parseOMOPDate(values[1]); err == nil {
+			deaths[values[0]] = &date
+		}
+	})
+	if err != nil {
+		fmt.Println("No OMOP death table, dates of death are unknown: ", err)
+	}
+	loader := newPatientLoader(duplicates)
+	err = source.ReadTable("person", []string{"person_id", "gender_concept_id", "year_of_birth", "location_id"},
+		func(values []string) {
+			yob, err := strconv.Atoi(values[2])
+			if values[0] == "" || err != nil {
+				return //skip persons without id or year of birth
+			}
+			sex := ""
+			switch values[1] {
+			case omopMale:
+				sex = "M"
+			case omopFemale:
+				sex = "F"
+			}
+			loader.add(values[0], sex, yob, deaths[values[0]], values[3])
+		})
+	if err != nil {
+		panic(err)
+	}
+	return loader.finish(nofCohortAges)
+}
+
+// omopConcept is an ICD code from the OMOP concept table.
+type omopConcept struct {
+	codeSystem, code string
+}
+
+// parseOMOPConcepts reads the ICD and SNOMED CT concepts from the concept table. It returns nil if there is no concept
+// table.
+func parseOMOPConcepts(source OMOPSource) map[string]omopConcept {
+	concepts := map[string]omopConcept{}
+	err := source.ReadTable("concept", []string{"concept_id", "vocabulary_id", "concept_code"}, func(values []string) {
+		if codeSystem, ok := omopVocabularies[values[1]]; ok {
+			concepts[values[0]] = omopConcept{codeSystem: codeSystem, code: values[2]}
+		}
+	})
+	if err != nil {
+		fmt.Println("No OMOP concept table, condition source values are used as ICD-10-CM codes: ", err)
+		return nil
+	}
+	fmt.Println("Parsed ", len(concepts), " ICD and SNOMED CT concepts from the OMOP concept table.")
+	return concepts
+}
+
+// parseOMOPConditions reads the diagnoses from the condition_occurrence table, and fills them in for the given
+// patients. The code of a condition is looked up in the concept table, by its source concept ID, or else by its concept
+// ID. The concept ID is preferred if it is in the code system of the vocabulary, e.g. SNOMED CT. Without concept table,
+// the source value of the condition is used as ICD-10-CM code. It returns a report of the diagnosis codes that could
+// not be mapped.
+func parseOMOPConditions(source OMOPSource, treatmentInfoFile string, treatmentSchema *TreatmentSchema,
+	patients *PatientMap, icd10AnalysisMap AnalysisMaps, icd9ToIcd10Map map[string]string,
+	duplicates *DuplicateReport, report *ValidationReport) *UnmappedCodeReport {
+	concepts := parseOMOPConcepts(source)
+	loader := newDiagnosisLoader(patients, icd10AnalysisMap, icd9ToIcd10Map, duplicates)
+	skipped := 0
+	err := source.ReadTable("condition_occurrence", []string{"person_id", "condition_concept_id",
+		"condition_start_date", "condition_source_value", "condition_source_concept_id"}, func(values []string) {
+		date, err := parseOMOPDate(values[2])
+		if err != nil {
+			skipped++
+			return //skip conditions without start date
+		}
+		concept, ok := concepts[values[4]]
+		if standard, found := concepts[values[1]]; found && (!ok || standard.codeSystem == loader.vocabulary()) {
+			concept, ok = standard, true
+		}
+		if !ok && concepts == nil && values[3] != "" {
+			concept, ok = omopConcept{codeSystem: CodeSystemICD10, code: dottedICDCode(CodeSystemICD10, values[3])}, true
+		}
+		if !ok {
+			loader.skip("OMOP", values[1], UnmappedNoICDConcept)
+			return
+		}
+		loader.add(values[0], concept.codeSystem, concept.code, date)
+	})
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println("Skipped ", skipped, " OMOP conditions without start date.")
+	fillInTreatments(treatmentInfoFile, treatmentSchema, patients, icd10AnalysisMap, report)
+	return loader.finish()
+}
@@ -0,0 +1,113 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"fmt"
+	"github.com/exascience/pargo/parallel"
+	"github.com/imec-int/ptra/lib/utils"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Ages at the transitions of the selected diagnosis pairs. For the patients diagnosed with a pair, the age in years at
+// the date of the second diagnosis is the age at which the transition from the first to the second diagnosis occurs.
+// As the time gaps of the pairs, cf. pair-gaps.go, the ages are summarized by their minimum, quartiles, and maximum,
+// together with a histogram of the ages per age band. This shows when in life a trajectory step typically happens.
+
+// ageBandYears is the width in years of the age bands of the histograms of the transition ages, and ageBands the nr
+// of age bands. Ages beyond the last band are counted in the last band.
+const (
+	ageBandYears = 10
+	ageBands     = 10
+)
+
+// PairAges summarizes the ages in years of the patients diagnosed with a diagnosis pair at the second diagnosis.
+type PairAges struct {
+	TransitionGaps       // the minimum, quartiles, and maximum of the ages in years
+	Histogram      []int // nr of patients per age band of ageBandYears, the last band holds the older ages
+}
+
+// newPairAges summarizes a list of ages with a histogram per age band, nil for an empty list.
+func newPairAges(ages []int) *PairAges {
+	quartiles := newTransitionGaps(ages)
+	if quartiles == nil {
+		return nil
+	}
+	pairAges := &PairAges{TransitionGaps: *quartiles, Histogram: make([]int, ageBands)}
+	for _, age := range ages {
+		pairAges.Histogram[utils.MaxInt(utils.MinInt(age/ageBandYears, ageBands-1), 0)]++
+	}
+	return pairAges
+}
+
+// InitPairAges computes the transition ages of the selected diagnosis pairs of the experiment, cf.
+// Experiment.PairAges. The diagnoses of the patients of a pair are matched within the given time frame, cf.
+// matchPatientTrajectory.
+func (exp *Experiment) InitPairAges(minTime, maxTime float64) {
+	exp.PairAges = make([]*PairAges, len(exp.Pairs))
+	parallel.Range(0, len(exp.Pairs), 0, func(low, high int) {
+		for i := low; i < high; i++ {
+			pair := exp.Pairs[i]
+			var ages []int
+			for _, p := range exp.DxDPatients[pair.First][pair.Second] {
+				if matches := matchPatientTrajectory(p, []int{pair.First, pair.Second}, minTime, maxTime); matches != nil {
+					ages = append(ages, AgeAt(p, matches[1].Date))
+				}
+			}
+			exp.PairAges[i] = newPairAges(ages)
+		}
+	})
+}
+
+// WritePairAges writes the transition ages of the selected diagnosis pairs to a tab file, cf. InitPairAges, and
+// returns the name of the file. For each diagnosis pair, it prints one line with the medical terms of the diagnoses,
+// the nr of patients, the minimum, first quartile, median, third quartile, interquartile range, and maximum of the
+// ages in years, the comma separated nr of patients per age band, and the codes of the diagnoses:
+// term1 tab term2 tab patients tab min tab Q1 tab median tab Q3 tab IQR tab max tab histogram tab code1 tab code2.
+func WritePairAges(exp *Experiment, path string) string {
+	name := filepath.Join(path, fmt.Sprintf("%s-pair-ages.tab", exp.Name))
+	file, err := os.Create(name)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	for i, pair := range exp.Pairs {
+		ages := exp.PairAges[i]
+		if ages == nil {
+			continue
+		}
+		patients := 0
+		histogram := make([]string, len(ages.Histogram))
+		for j, n := range ages.Histogram {
+			patients += n
+			histogram[j] = fmt.Sprint(exp.cellValue(float64(n), n))
+		}
+		fmt.Fprintf(file, "%s\t%s\t%v\t%d\t%d\t%d\t%d\t%d\t%d\t%s\t%s\t%s\n", exp.Icd10Map[pair.First].Name,
+			exp.Icd10Map[pair.Second].Name, exp.cellValue(float64(patients), patients), ages.Min, ages.Q1,
+			ages.Median, ages.Q3, ages.IQR(), ages.Max, strings.Join(histogram, ","), exp.IdMap[pair.First],
+			exp.IdMap[pair.Second])
+	}
+	return name
+}
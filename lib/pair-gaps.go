@@ -0,0 +1,113 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"fmt"
+	"github.com/exascience/pargo/parallel"
+	"github.com/imec-int/ptra/lib/utils"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Time gaps of the selected diagnosis pairs. As for the transitions of the trajectories, cf. transition-gaps.go, the
+// gaps between the dates of the two diagnoses of the patients diagnosed with a pair are summarized by their minimum,
+// quartiles, and maximum, in days, together with a histogram of the gaps per year. This allows annotating the pairs
+// with the time between the diagnoses, and checking whether the minimum and maximum years between the diagnoses cut
+// off a large part of the gaps.
+
+// daysPerYear is the mean nr of days in a year, for the buckets of the histograms of the time gaps.
+const daysPerYear = 365.25
+
+// PairGaps summarizes the time gaps in days between the diagnoses of the patients diagnosed with a diagnosis pair.
+type PairGaps struct {
+	TransitionGaps
+	Histogram []int // nr of patients per year of time gap, the first bucket holds the gaps of less than a year
+}
+
+// newPairGaps summarizes a list of time gaps with a histogram of the given nr of yearly buckets, nil for an empty
+// list. Gaps beyond the last bucket are counted in the last bucket.
+func newPairGaps(days []int, buckets int) *PairGaps {
+	transitionGaps := newTransitionGaps(days)
+	if transitionGaps == nil {
+		return nil
+	}
+	gaps := &PairGaps{TransitionGaps: *transitionGaps, Histogram: make([]int, buckets)}
+	for _, d := range days {
+		gaps.Histogram[utils.MinInt(int(math.Floor(float64(d)/daysPerYear)), buckets-1)]++
+	}
+	return gaps
+}
+
+// InitPairGaps computes the time gaps of the selected diagnosis pairs of the experiment, cf. Experiment.PairGaps. The
+// diagnoses of the patients of a pair are matched within the given time frame, cf. matchPatientTrajectory, and the
+// histograms have a bucket per year up to maxTime.
+func (exp *Experiment) InitPairGaps(minTime, maxTime float64) {
+	buckets := utils.MaxInt(int(math.Ceil(maxTime)), 1)
+	exp.PairGaps = make([]*PairGaps, len(exp.Pairs))
+	parallel.Range(0, len(exp.Pairs), 0, func(low, high int) {
+		for i := low; i < high; i++ {
+			pair := exp.Pairs[i]
+			var days []int
+			for _, p := range exp.DxDPatients[pair.First][pair.Second] {
+				if matches := matchPatientTrajectory(p, []int{pair.First, pair.Second}, minTime, maxTime); matches != nil {
+					days = append(days, DaysBetween(matches[0].Date, matches[1].Date))
+				}
+			}
+			exp.PairGaps[i] = newPairGaps(days, buckets)
+		}
+	})
+}
+
+// WritePairGaps writes the time gaps of the selected diagnosis pairs to a tab file, cf. InitPairGaps, and returns the
+// name of the file. For each diagnosis pair, it prints one line with the medical terms of the diagnoses, the nr of
+// patients with a time gap, the minimum, first quartile, median, third quartile, interquartile range, and maximum of
+// the gaps in days, the comma separated nr of patients per year of time gap, and the codes of the diagnoses:
+// term1 tab term2 tab patients tab min tab Q1 tab median tab Q3 tab IQR tab max tab histogram tab code1 tab code2.
+func WritePairGaps(exp *Experiment, path string) string {
+	name := filepath.Join(path, fmt.Sprintf("%s-pair-gaps.tab", exp.Name))
+	file, err := os.Create(name)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	for i, pair := range exp.Pairs {
+		gaps := exp.PairGaps[i]
+		if gaps == nil {
+			continue
+		}
+		patients := 0
+		histogram := make([]string, len(gaps.Histogram))
+		for j, n := range gaps.Histogram {
+			patients += n
+			histogram[j] = fmt.Sprint(exp.cellValue(float64(n), n))
+		}
+		fmt.Fprintf(file, "%s\t%s\t%v\t%d\t%d\t%d\t%d\t%d\t%d\t%s\t%s\t%s\n", exp.Icd10Map[pair.First].Name,
+			exp.Icd10Map[pair.Second].Name, exp.cellValue(float64(patients), patients), gaps.Min, gaps.Q1,
+			gaps.Median, gaps.Q3, gaps.IQR(), gaps.Max, strings.Join(histogram, ","), exp.IdMap[pair.First],
+			exp.IdMap[pair.Second])
+	}
+	return name
+}
@@ -0,0 +1,323 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+)
+
+// Writing of tables in the Apache Parquet format, so that the pairs, the trajectories, and the patients of the
+// trajectories can be loaded directly in e.g. pandas (pandas.read_parquet), R (arrow::read_parquet), or Spark. The
+// writer covers the subset of the format that these tables need: required int32, double, and utf8 columns, in one row
+// group with one uncompressed, plain encoded data page per column. The metadata of the file is serialized with the
+// thrift compact protocol, cf. https://github.com/apache/parquet-format.
+
+// Parquet physical types, encodings, and thrift compact types.
+const (
+	parquetInt32     = 1
+	parquetDouble    = 5
+	parquetByteArray = 6
+
+	parquetPlain = 0
+	parquetRLE   = 3
+
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// parquetColumn is a required column of a Parquet table, with its values in the plain encoding.
+type parquetColumn struct {
+	name         string
+	physicalType int32
+	utf8         bool
+	values       int
+	data         bytes.Buffer
+}
+
+func (column *parquetColumn) appendInt32(value int) {
+	column.data.Write(binary.LittleEndian.AppendUint32(nil, uint32(int32(value))))
+	column.values++
+}
+
+func (column *parquetColumn) appendDouble(value float64) {
+	column.data.Write(binary.LittleEndian.AppendUint64(nil, math.Float64bits(value)))
+	column.values++
+}
+
+func (column *parquetColumn) appendString(value string) {
+	column.data.Write(binary.LittleEndian.AppendUint32(nil, uint32(len(value))))
+	column.data.WriteString(value)
+	column.values++
+}
+
+// parquetTable is a table with the given columns, which are filled in row by row.
+type parquetTable struct {
+	columns []*parquetColumn
+}
+
+func newParquetTable() *parquetTable {
+	return &parquetTable{}
+}
+
+func (table *parquetTable) addColumn(name string, physicalType int32, utf8 bool) *parquetColumn {
+	column := &parquetColumn{name: name, physicalType: physicalType, utf8: utf8}
+	table.columns = append(table.columns, column)
+	return column
+}
+
+func (table *parquetTable) int32Column(name string) *parquetColumn {
+	return table.addColumn(name, parquetInt32, false)
+}
+
+func (table *parquetTable) doubleColumn(name string) *parquetColumn {
+	return table.addColumn(name, parquetDouble, false)
+}
+
+func (table *parquetTable) stringColumn(name string) *parquetColumn {
+	return table.addColumn(name, parquetByteArray, true)
+}
+
+// thriftWriter serializes thrift structs with the compact protocol. The field IDs are delta encoded relative to the
+// previous field of the same struct, so the writer keeps a stack with the previous field IDs of the enclosing structs.
+type thriftWriter struct {
+	bytes.Buffer
+	lastID  int16
+	lastIDs []int16
+}
+
+func (w *thriftWriter) uvarint(value uint64) {
+	w.Write(binary.AppendUvarint(nil, value))
+}
+
+func (w *thriftWriter) zigzag(value int64) {
+	w.uvarint(uint64(value<<1) ^ uint64(value>>63))
+}
+
+func (w *thriftWriter) field(id int16, thriftType byte) {
+	if delta := id - w.lastID; delta > 0 && delta <= 15 {
+		w.WriteByte(byte(delta)<<4 | thriftType)
+	} else {
+		w.WriteByte(thriftType)
+		w.zigzag(int64(id))
+	}
+	w.lastID = id
+}
+
+func (w *thriftWriter) i32(id int16, value int32) {
+	w.field(id, thriftI32)
+	w.zigzag(int64(value))
+}
+
+func (w *thriftWriter) i64(id int16, value int64) {
+	w.field(id, thriftI64)
+	w.zigzag(value)
+}
+
+func (w *thriftWriter) binary(id int16, value string) {
+	w.field(id, thriftBinary)
+	w.uvarint(uint64(len(value)))
+	w.WriteString(value)
+}
+
+// list writes the header of a list field with n elements of the given type, which are written next.
+func (w *thriftWriter) list(id int16, elementType byte, n int) {
+	w.field(id, thriftList)
+	if n < 15 {
+		w.WriteByte(byte(n)<<4 | elementType)
+	} else {
+		w.WriteByte(0xF0 | elementType)
+		w.uvarint(uint64(n))
+	}
+}
+
+// beginStruct begins a struct field, or a struct element of a list if the ID is 0.
+func (w *thriftWriter) beginStruct(id int16) {
+	if id != 0 {
+		w.field(id, thriftStruct)
+	}
+	w.lastIDs = append(w.lastIDs, w.lastID)
+	w.lastID = 0
+}
+
+func (w *thriftWriter) endStruct() {
+	w.WriteByte(0)
+	w.lastID = w.lastIDs[len(w.lastIDs)-1]
+	w.lastIDs = w.lastIDs[:len(w.lastIDs)-1]
+}
+
+// save writes the table to a Parquet file.
+func (table *parquetTable) save(fileName string) {
+	rows := 0
+	if len(table.columns) > 0 {
+		rows = table.columns[0].values
+	}
+	var file bytes.Buffer
+	file.WriteString("PAR1")
+	offsets := make([]int64, len(table.columns))
+	sizes := make([]int64, len(table.columns))
+	for i, column := range table.columns {
+		if column.values != rows {
+			panic(fmt.Sprint("Parquet column ", column.name, " has ", column.values, " values instead of ", rows))
+		}
+		header := &thriftWriter{}
+		header.i32(1, 0) // data page
+		header.i32(2, int32(column.data.Len()))
+		header.i32(3, int32(column.data.Len()))
+		header.beginStruct(5)
+		header.i32(1, int32(rows))
+		header.i32(2, parquetPlain)
+		header.i32(3, parquetRLE)
+		header.i32(4, parquetRLE)
+		header.endStruct()
+		header.WriteByte(0)
+		offsets[i] = int64(file.Len())
+		sizes[i] = int64(header.Len() + column.data.Len())
+		file.Write(header.Bytes())
+		file.Write(column.data.Bytes())
+	}
+	metadata := &thriftWriter{}
+	metadata.i32(1, 1) // version
+	metadata.list(2, thriftStruct, len(table.columns)+1)
+	metadata.beginStruct(0)
+	metadata.binary(4, "schema")
+	metadata.i32(5, int32(len(table.columns)))
+	metadata.endStruct()
+	for _, column := range table.columns {
+		metadata.beginStruct(0)
+		metadata.i32(1, column.physicalType)
+		metadata.i32(3, 0) // required
+		metadata.binary(4, column.name)
+		if column.utf8 {
+			metadata.i32(6, 0) // utf8
+		}
+		metadata.endStruct()
+	}
+	metadata.i64(3, int64(rows))
+	metadata.list(4, thriftStruct, 1)
+	metadata.beginStruct(0)
+	metadata.list(1, thriftStruct, len(table.columns))
+	var totalSize int64
+	for i, column := range table.columns {
+		metadata.beginStruct(0)
+		metadata.i64(2, offsets[i])
+		metadata.beginStruct(3)
+		metadata.i32(1, column.physicalType)
+		metadata.list(2, thriftI32, 1)
+		metadata.zigzag(parquetPlain)
+		metadata.list(3, thriftBinary, 1)
+		metadata.uvarint(uint64(len(column.name)))
+		metadata.WriteString(column.name)
+		metadata.i32(4, 0) // uncompressed
+		metadata.i64(5, int64(rows))
+		metadata.i64(6, sizes[i])
+		metadata.i64(7, sizes[i])
+		metadata.i64(9, offsets[i])
+		metadata.endStruct()
+		metadata.endStruct()
+		totalSize += sizes[i]
+	}
+	metadata.i64(2, totalSize)
+	metadata.i64(3, int64(rows))
+	metadata.endStruct()
+	metadata.binary(6, "ptra")
+	metadata.WriteByte(0)
+	file.Write(metadata.Bytes())
+	file.Write(binary.LittleEndian.AppendUint32(nil, uint32(metadata.Len())))
+	file.WriteString("PAR1")
+	if err := os.WriteFile(fileName, file.Bytes(), 0600); err != nil {
+		panic(err)
+	}
+}
+
+// WriteParquetTables writes the pairs, the trajectories, and the patients of the trajectories of an experiment as
+// Parquet files to the given output path:
+// - name-pairs.parquet: a row per diagnosis pair, with the DIDs, codes, and names of the diagnoses, the RR, and the
+// effect size of the metric of the experiment, cf. metric.go.
+// - name-trajectories.parquet: a row per transition of each trajectory, with the trajectory ID, the index of the
+// transition, the DIDs, codes, and names of the diagnoses, the nr of patients, and the RR of the diagnosis pair.
+// - name-patient-trajectories.parquet: a row per patient and trajectory that the patient matches, with the patient
+// id, or its pseudonym, and the trajectory ID.
+func WriteParquetTables(exp *Experiment, path string) {
+	pairs := newParquetTable()
+	first, firstCode, firstName := pairs.int32Column("first"), pairs.stringColumn("first_code"),
+		pairs.stringColumn("first_name")
+	second, secondCode, secondName := pairs.int32Column("second"), pairs.stringColumn("second_code"),
+		pairs.stringColumn("second_name")
+	rr, effect := pairs.doubleColumn("rr"), pairs.doubleColumn("effect")
+	for _, pair := range exp.Pairs {
+		first.appendInt32(pair.First)
+		firstCode.appendString(exp.IdMap[pair.First])
+		firstName.appendString(exp.Icd10Map[pair.First].Name)
+		second.appendInt32(pair.Second)
+		secondCode.appendString(exp.IdMap[pair.Second])
+		secondName.appendString(exp.Icd10Map[pair.Second].Name)
+		rr.appendDouble(exp.DxDRR[pair.First][pair.Second])
+		effect.appendDouble(exp.effect(pair.First, pair.Second))
+	}
+	trajectories := newParquetTable()
+	tid, hash := trajectories.int32Column("tid"), trajectories.stringColumn("hash")
+	index := trajectories.int32Column("index")
+	first, firstCode, firstName = trajectories.int32Column("first"), trajectories.stringColumn("first_code"),
+		trajectories.stringColumn("first_name")
+	second, secondCode, secondName = trajectories.int32Column("second"), trajectories.stringColumn("second_code"),
+		trajectories.stringColumn("second_name")
+	patients, rr := trajectories.int32Column("patients"), trajectories.doubleColumn("rr")
+	assignments := newParquetTable()
+	pid, assignmentTID := assignments.stringColumn("pid"), assignments.int32Column("tid")
+	for _, t := range exp.Trajectories {
+		for idx := 1; idx < len(t.Diagnoses); idx++ {
+			d1, d2 := t.Diagnoses[idx-1], t.Diagnoses[idx]
+			tid.appendInt32(t.ID)
+			hash.appendString(t.Hash)
+			index.appendInt32(idx - 1)
+			first.appendInt32(d1)
+			firstCode.appendString(exp.IdMap[d1])
+			firstName.appendString(exp.Icd10Map[d1].Name)
+			second.appendInt32(d2)
+			secondCode.appendString(exp.IdMap[d2])
+			secondName.appendString(exp.Icd10Map[d2].Name)
+			patients.appendInt32(t.PatientNumbers[idx-1])
+			rr.appendDouble(exp.DxDRR[d1][d2])
+		}
+		if len(t.Patients) == 0 {
+			continue
+		}
+		for _, p := range t.Patients[len(t.Patients)-1] {
+			pid.appendString(exp.Pseudonymizer.Pseudonym(p.PIDString))
+			assignmentTID.appendInt32(t.ID)
+		}
+	}
+	for _, table := range []struct {
+		table     *parquetTable
+		name      string
+		sensitive bool
+	}{{pairs, "pairs", false}, {trajectories, "trajectories", false}, {assignments, "patient-trajectories", true}} {
+		fileName := filepath.Join(path, fmt.Sprintf("%s-%s.parquet", exp.Name, table.name))
+		table.table.save(fileName)
+		exp.Audit.Wrote(fileName, table.sensitive)
+	}
+}
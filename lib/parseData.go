@@ -19,15 +19,14 @@
 package lib
 
 import (
-	"encoding/csv"
+	"cmp"
 	"encoding/json"
 	"encoding/xml"
 	"fmt"
-	"github.com/imec-int/ptra/lib/utils"
 	"io"
-	"math"
 	"os"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
@@ -44,9 +43,10 @@ import (
 //We have an additional file that maps ICD9 IDs -> ICD10 IDs.
 //We can download the ICD10 ID -> medical Name from https://www.cms.gov/medicare/icd-10/2022-icd-10-cm as an xml file.
 //TriNetX stores patient info as a csv file, as well as the diagnoses info.
-//For the medical Name mapping, we can also use the ICD10 -> CCSR Mapping which maps ICD10 onto 530 Categories with medical meaning. This
-//mapping can be downloaded from https://www.hcup-us.ahrq.gov/toolssoftware/ccsr/dxccsr.jsp#download as a CSV file. This
-//mapping performs a mapping ICD10 -> CCSR Categories -> medical Name.
+//For the medical Name mapping, we can also use the ICD10 -> CCSR Mapping which maps ICD10 onto 530 Categories with
+//medical meaning. This mapping can be downloaded from
+//https://www.hcup-us.ahrq.gov/toolssoftware/ccsr/dxccsr.jsp#download as a CSV file. This mapping performs a mapping
+//ICD10 -> CCSR Categories -> medical Name.
 
 // Parsing ICD10 hierarchy from xml
 // Structs for unmarshalling ICD10 xml data
@@ -86,7 +86,7 @@ type icd10Hierarchy struct {
 func parseIcd10HierarchyFromXml(file string) icd10Hierarchy {
 	fmt.Println("Parsing ICD10 code hierarchy from XML file: ", file)
 	//open file
-	xmlFile, err := os.Open(file)
+	xmlFile, err := openInput(file)
 	if err != nil {
 		panic(err)
 	}
@@ -280,31 +280,34 @@ func getIcd10CodesToExcludeFromAnalysis() map[string]bool {
 	return exclude
 }
 
-// getNonICD10CodesToAddToAnalysis returns a set of mockup ICD10 codes to be able to introduce non ICD codes to be
-// included for analysis. It returns a map from mockup ICD10 code (string) to description string. It introduces "C98" for
-// "Radical custectomy (bladder cancer)", "C99" for "MVAC Chemotherapy (bladder cancer)", and "C100" for "Intravesical
-// therapy (bladder cancer)".
-func getNonICD10CodesToAddToAnalysis() map[string]string {
-	return map[string]string{
-		"C98":  "Radical cystectomy (bladder cancer)",
-		"C99":  "MVAC Chemotherapy (bladder cancer)",
-		"C100": "Intravesical therapy (bladder cancer)",
+// sortedKeys returns the keys of a map in increasing order. Analysis IDs are handed out in this order, so that the same
+// input always results in the same analysis IDs.
+func sortedKeys[K cmp.Ordered, V any](m map[K]V) []K {
+	keys := make([]K, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
 	}
+	slices.Sort(keys)
+	return keys
 }
 
 // initializeIcd10AnalysisIDMap creates a map ICD10 DID -> analysis DID and a map analysis ID -> medical Name. This is
 // useful to remap diagnosis codes used in the input to a higher Level in the ICD10 hierarchy. E.g "typhoid fever" and
 // "cholera" are both "infectious intestinal diseases", so they could both be identified as such during the analysis.
-// This can be interesting to obtain more global patient trajectories/clusters.
-func initializeIcd10AnalysisMaps(icd10Map map[string]Icd10Entry, level int) (map[string]int, map[int]Icd10Entry, int) {
+// This can be interesting to obtain more global patient trajectories/clusters. The custom events are added after the
+// codes of the vocabulary, nil for the default bladder cancer events.
+func initializeIcd10AnalysisMaps(icd10Map map[string]Icd10Entry, level int, events []*CustomEvent) (map[string]int, map[int]Icd10Entry, int, map[string]bool) {
 	analysisIdMap := map[string]int{}                     // maps icd 10 code to analysis ID
 	analysisIcd10Map := map[int]Icd10Entry{}              // maps analysis ID to an Icd10Entry
 	nameToAnalysisIdMap := map[string]int{}               // maps medical Name to analysis ID
+	excluded := map[string]bool{}                         // icd 10 codes that are excluded from analysis
 	ctr := 0                                              //serves as analysis ID generator
 	icd10ToExclude := getIcd10DescToExcludeFromAnalysis() // a list of Level 0 Categories to exclude from analysis
-	for icd10Code, icd10Entry := range icd10Map {
+	for _, icd10Code := range sortedKeys(icd10Map) {
+		icd10Entry := icd10Map[icd10Code]
 		if _, ok := icd10ToExclude[icd10Entry.Categories[0]]; ok {
 			// code to exclude from analysis
+			excluded[icd10Code] = true
 			continue
 		}
 		var name string
@@ -323,15 +326,13 @@ func initializeIcd10AnalysisMaps(icd10Map map[string]Icd10Entry, level int) (map
 		}
 		analysisIdMap[icd10Code] = newID
 	}
-	extra := getNonICD10CodesToAddToAnalysis()
-	for code, name := range extra {
-		analysisIcd10Map[ctr] = Icd10Entry{Name: name}
-		nameToAnalysisIdMap[name] = ctr
-		analysisIdMap[code] = ctr
-		ctr++
-	}
+	ctr = addCustomEventCodes(events, ctr, func(code, name string, id int) {
+		analysisIcd10Map[id] = Icd10Entry{Name: name}
+		nameToAnalysisIdMap[name] = id
+		analysisIdMap[code] = id
+	})
 	fmt.Println("Mapped ", len(icd10Map), " ICD10 codes to ", ctr, " analysis IDs of Level ", level)
-	return analysisIdMap, analysisIcd10Map, ctr
+	return analysisIdMap, analysisIcd10Map, ctr, excluded
 }
 
 // ccsrCategory is a struct for containing CCSR categories, encoding medically meaningful names for a DID in ICD10
@@ -344,19 +345,13 @@ type ccsrCategory struct {
 
 type icd10ToCCSRTable map[string]ccsrCategory //maps ICD10 DID to its CCSR Categories
 
-// ccsrIcd10ToProperIcd10 transforms the ICD10 code from a ccsr file into a proper ICD10 code. The ICD10 codes in the
-// ccsr file are stored without the ".", so this needs to be added to be able to compare to any other data that uses
-// ICD10 codes. Also removes superfluous quotes stored in the ccsr file.
-func ccsrIcd10ToProperIcd10(code string) string {
-	return code[1:4] + "." + code[4:len(code)-1]
-}
-
-// initializeIcd10NameMapFromCCSR initializes a Name map for ICD10 DID -> CCSR Categories (medical names)
+// initializeIcd10NameMapFromCCSR initializes a Name map for ICD10 DID -> CCSR Categories (medical names). The layout of
+// the file is detected from its header, cf. detectCCSRLayout.
 func initializeIcd10ToCCSRMap(file string) map[string]ccsrCategory {
 	//map to collect data
 	icd10ToCCSRTable := map[string]ccsrCategory{}
 	//open file
-	csvFile, err := os.Open(file)
+	csvFile, err := openInput(file)
 	if err != nil {
 		panic(err)
 	}
@@ -366,14 +361,20 @@ func initializeIcd10ToCCSRMap(file string) map[string]ccsrCategory {
 		}
 	}()
 	//parse file
-	reader := csv.NewReader(csvFile)
-	//the header is 'ICD-10-CM CODE','ICD-10-CM CODE DESCRIPTION','Default CCSR CATEGORY IP','
+	reader := newCSVReader(csvFile)
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	//the header is e.g. 'ICD-10-CM CODE','ICD-10-CM CODE DESCRIPTION','Default CCSR CATEGORY IP','
 	//Default CCSR CATEGORY DESCRIPTION IP','Default CCSR CATEGORY OP','Default CCSR CATEGORY DESCRIPTION OP','
 	//CCSR CATEGORY 1','CCSR CATEGORY 1 DESCRIPTION','CCSR CATEGORY 2','CCSR CATEGORY 2 DESCRIPTION',
 	//'CCSR CATEGORY 3','CCSR CATEGORY 3 DESCRIPTION','CCSR CATEGORY 4','CCSR CATEGORY 4 DESCRIPTION',
 	//'CCSR CATEGORY 5','CCSR CATEGORY 5 DESCRIPTION','CCSR CATEGORY 6','CCSR CATEGORY 6 DESCRIPTION'
-	// skip header
-	reader.Read()
+	header, err := reader.Read()
+	if err != nil {
+		panic(fmt.Sprint("Invalid DiagnosisInfo file ", file, ": ", err))
+	}
+	layout := detectCCSRLayout(file, header)
+	fmt.Println("Parsing CCSR file of release ", layout.version, ": ", file)
 	for {
 		record, err := reader.Read()
 		if err == io.EOF {
@@ -382,16 +383,18 @@ func initializeIcd10ToCCSRMap(file string) map[string]ccsrCategory {
 		if err != nil {
 			panic(err)
 		}
+		code := layout.value(record, layout.code)
+		if code == "" {
+			continue
+		}
 		//create CSSR category, set default category
-		category := ccsrCategory{name: record[2], id: record[3], categories: map[string]string{}}
+		category := ccsrCategory{id: layout.value(record, layout.defaultCategory),
+			name: layout.value(record, layout.defaultName), categories: map[string]string{}}
 		//fill in unique CSSR alternative Categories, up to 6 possible
-		for i := 6; i <= 17; i = i + 2 {
-			if i >= len(record) {
-				panic("Invalid DiagnosisInfo file")
-			}
-			catID := record[i]
-			catName := record[i+1]
-			if catName == "" || catID == "' '" {
+		for _, columns := range layout.categories {
+			catID := layout.value(record, columns[0])
+			catName := layout.value(record, columns[1])
+			if catName == "" || catID == "" {
 				continue
 			}
 			if _, ok := category.categories[catID]; !ok {
@@ -399,8 +402,7 @@ func initializeIcd10ToCCSRMap(file string) map[string]ccsrCategory {
 			}
 		}
 		//add category to result
-		icd10Code := ccsrIcd10ToProperIcd10(record[0])
-		icd10ToCCSRTable[icd10Code] = category
+		icd10ToCCSRTable[normalizeICDCode(CodeSystemICD10, code)] = category
 	}
 	return icd10ToCCSRTable
 }
@@ -421,19 +423,24 @@ func printIcd10ToCCSRTable(tab map[string]ccsrCategory) {
 // initializeIcd10AnalysisMapsCCSR creates a map ICD10 DID -> [analysis DID] and a map analysis ID -> medical Name,
 // starting from a CCSR mapping, which maps ICD10 codes onto medical meaningful Categories.
 // Each icd10 code can be mapped to multiple ccsr Categories, and therefore to multiple analysis IDs.
+// The custom events are added after the CCSR categories, nil for the default bladder cancer events.
 // TO DO: exclude specific ICD10 codes from the analysis.
-func initializeIcd10AnalysisMapsCCSR(icd10ToCssrMap map[string]ccsrCategory) (map[string][]int, map[int]Icd10Entry, int) {
+func initializeIcd10AnalysisMapsCCSR(icd10ToCssrMap map[string]ccsrCategory, events []*CustomEvent) (map[string][]int, map[int]Icd10Entry, int, map[string]bool) {
 	analysisIdMap := map[string][]int{}      // maps icd 10 code to analysis IDs
 	analysisIcd10Map := map[int]Icd10Entry{} // maps analysis ID to a medical Name
+	excluded := map[string]bool{}            // icd 10 codes that are excluded from analysis
 	ccsrIDMap := map[string]int{}
 	ctr := 0 //serves as analysis ID generator
 	icd10ToExclude := getIcd10CodesToExcludeFromAnalysis()
-	for icd10Code, ccsr := range icd10ToCssrMap {
+	for _, icd10Code := range sortedKeys(icd10ToCssrMap) {
+		ccsr := icd10ToCssrMap[icd10Code]
 		if _, ok := icd10ToExclude[icd10Code[0:1]]; ok {
+			excluded[icd10Code] = true
 			continue
 		}
 		var ids []int
-		for id, name := range ccsr.categories {
+		for _, id := range sortedKeys(ccsr.categories) {
+			name := ccsr.categories[id]
 			var ccsrID int
 			var ok bool
 			if ccsrID, ok = ccsrIDMap[id]; !ok {
@@ -446,26 +453,34 @@ func initializeIcd10AnalysisMapsCCSR(icd10ToCssrMap map[string]ccsrCategory) (ma
 		}
 		analysisIdMap[icd10Code] = ids
 	}
-	extra := getNonICD10CodesToAddToAnalysis()
-	for code, name := range extra {
-		analysisIcd10Map[ctr] = Icd10Entry{Name: name}
-		analysisIdMap[code] = []int{ctr}
-		ctr++
-	}
+	ctr = addCustomEventCodes(events, ctr, func(code, name string, id int) {
+		analysisIcd10Map[id] = Icd10Entry{Name: name}
+		analysisIdMap[code] = []int{id}
+	})
 	fmt.Println("Mapped ", len(icd10ToCssrMap), " ICD10 codes to ", ctr, " analysis IDs")
-	return analysisIdMap, analysisIcd10Map, ctr
+	return analysisIdMap, analysisIcd10Map, ctr, excluded
 }
 
 type icd10AnalysisMapsFromCCSR struct {
 	Icd10Map          map[int]Icd10Entry // map analysis DID -> Icd10Entry
 	NofDiagnosisCodes int                // nr of different diagnosis codes
 	DIDMap            map[string][]int   // maps ICD10 Code onto multiple DIDs
+	Excluded          map[string]bool    // ICD10 codes that are excluded from analysis
 }
 
 type icd10AnalysisMapsFromXML struct {
 	Icd10Map          map[int]Icd10Entry // map analysis DID -> Icd10Entry
 	NofDiagnosisCodes int                // nr of different diagnosis codes
 	DIDMap            map[string]int     // map ICD10 Code -> DID
+	Excluded          map[string]bool    // ICD10 codes that are excluded from analysis
+}
+
+func (analysisMap icd10AnalysisMapsFromXML) isExcluded(icd10Code string) bool {
+	return analysisMap.Excluded[icd10Code]
+}
+
+func (analysisMap icd10AnalysisMapsFromCCSR) isExcluded(icd10Code string) bool {
+	return analysisMap.Excluded[icd10Code]
 }
 
 func (analysisMap icd10AnalysisMapsFromXML) getDID(icd10Name string) int {
@@ -503,33 +518,99 @@ func (analysisMap icd10AnalysisMapsFromCCSR) GetICDCode(did int) string {
 	return ""
 }
 
+// getIdMap maps each analysis DID onto the first of its ICD10 codes in increasing order, so that the same input always
+// results in the same map.
 func (analysisMap icd10AnalysisMapsFromXML) getIdMap() map[int]string {
 	res := map[int]string{}
-	for icd10Code, didCode := range analysisMap.DIDMap {
-		res[didCode] = icd10Code
+	for _, icd10Code := range sortedKeys(analysisMap.DIDMap) {
+		if _, ok := res[analysisMap.DIDMap[icd10Code]]; !ok {
+			res[analysisMap.DIDMap[icd10Code]] = icd10Code
+		}
 	}
 	return res
 }
 
 func (analysisMap icd10AnalysisMapsFromCCSR) getIdMap() map[int]string {
 	res := map[int]string{}
-	for icd10Code, didCodes := range analysisMap.DIDMap {
-		for _, didCode := range didCodes {
-			res[didCode] = icd10Code
+	for _, icd10Code := range sortedKeys(analysisMap.DIDMap) {
+		for _, didCode := range analysisMap.DIDMap[icd10Code] {
+			if _, ok := res[didCode]; !ok {
+				res[didCode] = icd10Code
+			}
 		}
 	}
 	return res
 }
 
+// remapIcd10Map renumbers the analysis DIDs of a map analysis DID -> Icd10Entry in place, DID -> dids[DID].
+func remapIcd10Map(icd10Map map[int]Icd10Entry, dids []int) {
+	entries := map[int]Icd10Entry{}
+	for did, entry := range icd10Map {
+		entries[dids[did]] = entry
+		delete(icd10Map, did)
+	}
+	for did, entry := range entries {
+		icd10Map[did] = entry
+	}
+}
+
+func (analysisMap icd10AnalysisMapsFromXML) remapDIDs(dids []int) {
+	for icd10Code, did := range analysisMap.DIDMap {
+		analysisMap.DIDMap[icd10Code] = dids[did]
+	}
+	remapIcd10Map(analysisMap.Icd10Map, dids)
+}
+
+func (analysisMap icd10AnalysisMapsFromCCSR) remapDIDs(dids []int) {
+	for _, didCodes := range analysisMap.DIDMap {
+		for i, did := range didCodes {
+			didCodes[i] = dids[did]
+		}
+	}
+	remapIcd10Map(analysisMap.Icd10Map, dids)
+}
+
 // AnalysisMaps represent maps extracted from the input that map analysis IDs onto medical terms and vice versa. This is
 // an interface that defines several methods. getICDCode returns for a did the original id in the input for the
 // diagnostic event. fillInPatientDiagnoses creates for a given diagnosis identifier from the input a Diagnosis object
-// and adds it to a patient's list of diagnoses.
+// and adds it to a patient's list of diagnoses. isExcluded checks if a code from the input is deliberately excluded from
+// the analysis, rather than unknown. codeSystem returns the code system of the codes from the input, and
+// isEventOfInterest checks if a code from the input is an event of interest. fromICD10 maps an ICD-10 code onto the code
+// system of the input. remapDIDs renumbers the analysis DIDs, cf. applyDIDMapping.
 type AnalysisMaps interface {
 	fillInPatientDiagnoses(patient *Patient, DidString string, date DiagnosisDate) int
+	isExcluded(icd10Code string) bool
 	fillInNonICDPatientDiagnoses(patient *Patient, infoMap map[string]*TreatmentInfo) int
 	GetICDCode(did int) string
 	getIdMap() map[int]string
+	codeSystem() string
+	isEventOfInterest(code string) bool
+	fromICD10(icd10Code string) (string, bool)
+	remapDIDs(dids []int)
+}
+
+func (analysisMap icd10AnalysisMapsFromXML) fromICD10(icd10Code string) (string, bool) {
+	return icd10Code, true
+}
+
+func (analysisMap icd10AnalysisMapsFromCCSR) fromICD10(icd10Code string) (string, bool) {
+	return icd10Code, true
+}
+
+func (analysisMap icd10AnalysisMapsFromXML) codeSystem() string {
+	return CodeSystemICD10
+}
+
+func (analysisMap icd10AnalysisMapsFromCCSR) codeSystem() string {
+	return CodeSystemICD10
+}
+
+func (analysisMap icd10AnalysisMapsFromXML) isEventOfInterest(code string) bool {
+	return TriNetXEventOfInterest(code)
+}
+
+func (analysisMap icd10AnalysisMapsFromCCSR) isEventOfInterest(code string) bool {
+	return TriNetXEventOfInterest(code)
 }
 
 func (analysisMap icd10AnalysisMapsFromXML) fillInPatientDiagnoses(patient *Patient, DIDString string, date DiagnosisDate) int {
@@ -557,20 +638,12 @@ func (analysisMap icd10AnalysisMapsFromCCSR) fillInPatientDiagnoses(patient *Pat
 func (analysisMap icd10AnalysisMapsFromXML) fillInNonICDPatientDiagnoses(patient *Patient, infoMap map[string]*TreatmentInfo) int {
 	nonIcd := 0
 	if info, ok := infoMap[patient.PIDString]; ok {
-		if info.RCDate != nil {
-			diagnosis := &Diagnosis{PID: patient.PID, DID: analysisMap.DIDMap["C98"], Date: *info.RCDate}
-			nonIcd = 1
-			patient.AddDiagnosis(diagnosis)
-		}
-		if info.MVACDate != nil {
-			nonIcd = 1
-			diagnosis := &Diagnosis{PID: patient.PID, DID: analysisMap.DIDMap["C99"], Date: *info.MVACDate}
-			patient.AddDiagnosis(diagnosis)
-		}
-		if info.IVTDate != nil {
-			nonIcd = 1
-			diagnosis := &Diagnosis{PID: patient.PID, DID: analysisMap.DIDMap["C100"], Date: *info.IVTDate}
-			patient.AddDiagnosis(diagnosis)
+		for _, event := range info.Events {
+			if DID, ok := analysisMap.DIDMap[event.Code]; ok {
+				diagnosis := &Diagnosis{PID: patient.PID, DID: DID, Date: event.Date}
+				nonIcd = 1
+				patient.AddDiagnosis(diagnosis)
+			}
 		}
 	}
 	return nonIcd
@@ -579,58 +652,96 @@ func (analysisMap icd10AnalysisMapsFromXML) fillInNonICDPatientDiagnoses(patient
 func (analysisMap icd10AnalysisMapsFromCCSR) fillInNonICDPatientDiagnoses(patient *Patient, infoMap map[string]*TreatmentInfo) int {
 	nonIcd := 0
 	if info, ok := infoMap[patient.PIDString]; ok {
-		if info.RCDate != nil {
-			dids := analysisMap.DIDMap["C98"]
-			for _, did := range dids {
-				diagnosis := &Diagnosis{PID: patient.PID, DID: did, Date: *info.RCDate}
+		for _, event := range info.Events {
+			for _, did := range analysisMap.DIDMap[event.Code] {
+				diagnosis := &Diagnosis{PID: patient.PID, DID: did, Date: event.Date}
 				nonIcd = 1
 				patient.AddDiagnosis(diagnosis)
 			}
 		}
-		if info.MVACDate != nil {
-			dids := analysisMap.DIDMap["C99"]
-			for _, did := range dids {
-				diagnosis := &Diagnosis{PID: patient.PID, DID: did, Date: *info.MVACDate}
-				nonIcd = 1
-				patient.AddDiagnosis(diagnosis)
+	}
+	return nonIcd
+}
+
+// icd10ReleaseFiles returns the xml files of an ICD-10-CM vocabulary that spans several yearly releases: a comma
+// separated list of files, in the given order, or the files that match a glob pattern, sorted by name. Other file names
+// are a single release.
+func icd10ReleaseFiles(fileName string) []string {
+	if strings.Contains(fileName, ",") {
+		return strings.Split(fileName, ",")
+	}
+	if !isRemoteInput(fileName) && strings.ContainsAny(fileName, "*?[") {
+		files, err := filepath.Glob(fileName)
+		if err != nil {
+			panic(err)
+		}
+		if len(files) == 0 {
+			panic(fmt.Sprint("No ICD10 files found for: ", fileName))
+		}
+		sort.Strings(files)
+		return files
+	}
+	return []string{fileName}
+}
+
+// mergeIcd10NameMaps merges the name maps of several ICD-10-CM releases, so that codes that are introduced or retired
+// in any of the releases resolve. The entries of the later releases replace those of the earlier ones, so that the
+// descriptions of the latest release are used.
+func mergeIcd10NameMaps(files []string) map[string]Icd10Entry {
+	if len(files) == 1 {
+		return initializeIcd10NameMap(files[0])
+	}
+	merged := map[string]Icd10Entry{}
+	for _, file := range files {
+		icd10Map := initializeIcd10NameMap(file)
+		retired := 0
+		for code := range merged {
+			if _, ok := icd10Map[code]; !ok {
+				retired++
 			}
 		}
-		if info.IVTDate != nil {
-			dids := analysisMap.DIDMap["C100"]
-			for _, did := range dids {
-				nonIcd = 1
-				diagnosis := &Diagnosis{PID: patient.PID, DID: did, Date: *info.IVTDate}
-				patient.AddDiagnosis(diagnosis)
+		added := 0
+		for code, entry := range icd10Map {
+			if _, ok := merged[code]; !ok {
+				added++
 			}
+			merged[code] = entry
 		}
+		fmt.Println("Merged ", len(icd10Map), " ICD10 codes of ", file, ": ", added, " codes added, ", retired,
+			" codes of earlier releases not in this release.")
 	}
-	return nonIcd
+	return merged
 }
 
 // initializeIcd10AnalysisMaps returns a map ICD10 DID -> internal analysis DID and a map analysis DID ->
-// medical Name for an ICD10 Hierarchy passed as xml file and a requested hierarchy Level.
-func initializeIcd10AnalysisMapsFromXML(file string, level int) icd10AnalysisMapsFromXML {
-	icd10MapFromXml := initializeIcd10NameMap(file) // map ICD10 DID -> ICD 10 Name (medical desc, Categories, Level)
-	analysisIdMap, icd10Map, ctr := initializeIcd10AnalysisMaps(icd10MapFromXml, level)
-	return icd10AnalysisMapsFromXML{DIDMap: analysisIdMap, Icd10Map: icd10Map, NofDiagnosisCodes: ctr}
+// medical Name for an ICD10 Hierarchy passed as xml file and a requested hierarchy Level. The file may also be several
+// releases of the hierarchy, cf. icd10ReleaseFiles, which are merged. The custom events are added after the codes, nil
+// for the default bladder cancer events.
+func initializeIcd10AnalysisMapsFromXML(file string, level int, events []*CustomEvent) icd10AnalysisMapsFromXML {
+	icd10MapFromXml := mergeIcd10NameMaps(icd10ReleaseFiles(file)) // map ICD10 DID -> ICD 10 Name (medical desc, Categories, Level)
+	analysisIdMap, icd10Map, ctr, excluded := initializeIcd10AnalysisMaps(icd10MapFromXml, level, events)
+	return icd10AnalysisMapsFromXML{DIDMap: analysisIdMap, Icd10Map: icd10Map, NofDiagnosisCodes: ctr, Excluded: excluded}
 }
 
 // initializeIcd10AnalysisMapsFromCCSR returns a map ICD10 -> []{internal analysis DID} and map analysis DID -> medical
-// Name for ICD10 CCSR categorization passed as a csv file.
-func initializeIcd10AnalysisMapsFromCCSR(file string) icd10AnalysisMapsFromCCSR {
+// Name for ICD10 CCSR categorization passed as a csv file. The custom events are added after the categories, nil for the
+// default bladder cancer events.
+func initializeIcd10AnalysisMapsFromCCSR(file string, events []*CustomEvent) icd10AnalysisMapsFromCCSR {
 	icd10ToCssrMap := initializeIcd10ToCCSRMap(file) // map ICD10 Code -> CCSR Name
-	analysisIdMap, icd10Map, ctr := initializeIcd10AnalysisMapsCCSR(icd10ToCssrMap)
-	return icd10AnalysisMapsFromCCSR{DIDMap: analysisIdMap, Icd10Map: icd10Map, NofDiagnosisCodes: ctr}
+	analysisIdMap, icd10Map, ctr, excluded := initializeIcd10AnalysisMapsCCSR(icd10ToCssrMap, events)
+	return icd10AnalysisMapsFromCCSR{DIDMap: analysisIdMap, Icd10Map: icd10Map, NofDiagnosisCodes: ctr, Excluded: excluded}
 }
 
 //Parsing patient information.
 
 // parseTriNetXPatientData parses a file with patient information from the TriNetX database. Input: a patient file in csv
 // format, a desired number of age groups to initialize cohorts. Diagnoses of the patient need to be filled in after
-// parsing the diagnoses file.
-func parseTriNetXPatientData(file string, nofCohortAges int) (*PatientMap, int) {
+// parsing the diagnoses file. Patients that occur more than once are counted in the duplicate report, and depending on
+// its policy, only their first row is kept.
+func parseTriNetXPatientData(file string, nofCohortAges int, duplicates *DuplicateReport,
+	report *ValidationReport) (*PatientMap, int) {
 	//open file
-	csvFile, err := os.Open(file)
+	csvFile, err := openInput(file)
 	if err != nil {
 		panic(err)
 	}
@@ -639,118 +750,72 @@ func parseTriNetXPatientData(file string, nofCohortAges int) (*PatientMap, int)
 			panic(err)
 		}
 	}()
-	patientMap := &PatientMap{PIDMap: map[int]*Patient{}, PIDStringMap: map[string]int{}}
-	maxYOB := 1850
-	minYOB := time.Now().Year() - 1
-	deathCr := 0
-	regions := map[string]int{} //counts per region
-	regionIds := map[string]int{}
+	loader := newPatientLoader(duplicates)
 	//parse file
-	reader := csv.NewReader(csvFile)
+	reader := newCSVReader(csvFile)
+	rows := newRowReader(reader, file, checkTriNetXPatientRow, report)
 	//the header is omitted from the TriNetX file, but is should be: patient_id, sex, race, ethnicity, year_of_birth,
 	//age_at_death, patient_regional_location, postal_code, marital_status, reason_yob_missing, month_year_death,
 	//source_id
 	for {
-		record, err := reader.Read()
+		record, err := rows.read()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
 			panic(err)
 		}
+		line, _ := reader.FieldPos(0)
 		var yob int
 		if yob, err = strconv.Atoi(record[4]); err != nil {
+			loader.patients.Warnings.add(file, line, WarningMissingYOB, record[4])
 			continue //skip patients without year of birth
 		}
-		pidString := record[0]
-		patientMap.Ctr++      // avoid using 0 as PID
-		pid := patientMap.Ctr //analysis ID
-		var sex int
-		if record[1] == "M" {
-			sex = Male
-			patientMap.MaleCtr++
-		}
-		if record[1] == "F" {
-			sex = Female
-			patientMap.FemaleCtr++
-		}
-		dateOfDeathString := record[10]
 		var dateOfDeath *DiagnosisDate
-		if len(dateOfDeathString) == 6 {
-			year, err := strconv.Atoi(dateOfDeathString[0:4])
-			if err == nil {
-				month, err := strconv.Atoi(dateOfDeathString[4:6])
-				if err == nil {
-					deathCr++
-					dateOfDeath = &DiagnosisDate{
-						Year:  year,
-						Month: month,
-						Day:   1, //unknown, default to 1
-					}
-				}
-			}
-		}
-		region := record[6]
-		if _, ok := regions[region]; !ok {
-			regions[region] = 0
-			regionIds[region] = len(regionIds)
-		} else {
-			regions[region]++
-		}
-		patient := Patient{
-			PID:       pid,
-			PIDString: pidString,
-			YOB:       yob,
-			CohortAge: 0,
-			Sex:       sex,
-			Diagnoses: []*Diagnosis{},
-			DeathDate: dateOfDeath,
-			Region:    regionIds[region],
-		}
-		patientMap.PIDMap[pid] = &patient
-		patientMap.PIDStringMap[pidString] = pid
-		maxYOB = utils.MaxInt(yob, maxYOB)
-		minYOB = utils.MinInt(yob, minYOB)
-	}
-	// initialize patient age groups
-	ageRange := float64(maxYOB-minYOB) / float64(nofCohortAges)
-	ageRange = math.Ceil(ageRange)
-	if nofCohortAges > 1 {
-		for _, p := range patientMap.PIDMap {
-			p.CohortAge = int(math.Floor(float64(p.YOB-minYOB) / float64(ageRange)))
+		if d, err := parseTriNetXMonthYear(record[10]); err == nil {
+			dateOfDeath = &d
 		}
+		loader.add(record[0], record[1], yob, dateOfDeath, record[6])
+		loader.addDemographics(record[0], record[2], record[3])
 	}
-	fmt.Println("Parsed patient data.")
-	fmt.Print("Parsed ", patientMap.Ctr, " patients with year of birth known ")
-	fmt.Print("of which ", patientMap.FemaleCtr, " females and ")
-	fmt.Println(patientMap.MaleCtr, "males; and of which ", deathCr, " have a known date of death.")
-	fmt.Println("Year of birth oldest patient:", minYOB)
-	fmt.Println("Year of birth youngest patient:", maxYOB)
-	fmt.Println("Patients are of ", len(regions), " regions: ")
-	for region, nr := range regions {
-		fmt.Print(region, ": ", nr, ", ")
-	}
-	fmt.Println("")
-	return patientMap, len(regions)
+	return loader.finish(nofCohortAges)
 }
 
 //Parsing patient diagnoses
 
-// parseTriNetXDiagnosisDate turns a TriNetX date string into DiagnosisDate object.
-func parseTriNetXDiagnosisDate(date string) DiagnosisDate {
-	year, err := strconv.Atoi(date[0:4])
+// parseTriNetXDate turns a TriNetX date string (YYYY-MM-DD) into a DiagnosisDate object. It returns an error if the
+// string does not represent a valid date.
+func parseTriNetXDate(date string) (DiagnosisDate, error) {
+	if len(date) < 10 {
+		return DiagnosisDate{}, fmt.Errorf("invalid date: %q", date)
+	}
+	t, err := time.Parse("2006-01-02", date[0:10])
 	if err != nil {
-		panic(err)
+		return DiagnosisDate{}, err
+	}
+	return DiagnosisDate{Year: t.Year(), Month: int(t.Month()), Day: t.Day()}, nil
+}
+
+// parseTriNetXMonthYear turns a TriNetX month-year string (YYYYMM) into a DiagnosisDate object. The day is unknown and
+// defaults to 1. It returns an error if the string does not represent a valid month.
+func parseTriNetXMonthYear(date string) (DiagnosisDate, error) {
+	if len(date) != 6 {
+		return DiagnosisDate{}, fmt.Errorf("invalid month-year: %q", date)
 	}
-	month, err := strconv.Atoi(date[5:7])
+	t, err := time.Parse("200601", date)
 	if err != nil {
-		panic(err)
+		return DiagnosisDate{}, err
 	}
-	day, err := strconv.Atoi(date[8:10])
+	return DiagnosisDate{Year: t.Year(), Month: int(t.Month()), Day: 1}, nil
+}
+
+// parseTriNetXDiagnosisDate turns a TriNetX date string into DiagnosisDate object.
+func parseTriNetXDiagnosisDate(date string) DiagnosisDate {
+	d, err := parseTriNetXDate(date)
 	if err != nil {
 		panic(err)
 	}
-	return DiagnosisDate{Year: year, Month: month, Day: day}
+	return d
 }
 
 // TriNetXEventOfInterest checks if the ICD10 code is related to bladder cancer
@@ -764,18 +829,41 @@ func TriNetXEventOfInterest(icd10ID string) bool {
 	return false
 }
 
-// TreatmentInfo implements a structure for storing the dates of certain bladder cancer treatments.
+// TreatmentInfo implements a structure for storing the dates of the custom events of a patient, e.g. bladder cancer
+// treatments.
 type TreatmentInfo struct {
-	RCDate   *DiagnosisDate //Date of radical cystectomy
-	MVACDate *DiagnosisDate //Date of MVAC chemotherapy
-	IVTDate  *DiagnosisDate //Date of intravesical therapy
+	Events []TreatmentEvent // the custom events with a known date, in the order of the custom events
+}
+
+// TreatmentEvent is a custom event of a patient with its date.
+type TreatmentEvent struct {
+	Code string        // code of the custom event
+	Date DiagnosisDate // date of the event
+}
+
+// firstDate returns the date of the first treatment, or nil if no treatment date is known.
+func (info *TreatmentInfo) firstDate() *DiagnosisDate {
+	var first *DiagnosisDate
+	for i := range info.Events {
+		date := &info.Events[i].Date
+		if first == nil || DiagnosisDateSmallerThan(*date, *first) {
+			first = date
+		}
+	}
+	return first
 }
 
 // parseTriNetXTreatmentFile parses a csv file that contains information of patient's treatments at different time stamps.
-// It returns a map from PID -> TreatmentInfo.
-func parseTriNetXTreatmentFile(fileName string) map[string]*TreatmentInfo {
+// The layout of the file is described by a schema, nil for the default TriNetX layout. The schema determines the custom
+// events whose dates are read. It returns a map from PID -> TreatmentInfo.
+func parseTriNetXTreatmentFile(fileName string, schema *TreatmentSchema,
+	report *ValidationReport) map[string]*TreatmentInfo {
+	if schema == nil {
+		schema = DefaultTreatmentSchema()
+	}
+	events := schema.customEvents()
 	result := map[string]*TreatmentInfo{}
-	file, err := os.Open(fileName)
+	file, err := openInput(fileName)
 	if err != nil {
 		panic(err)
 	}
@@ -784,159 +872,313 @@ func parseTriNetXTreatmentFile(fileName string) map[string]*TreatmentInfo {
 			panic(err)
 		}
 	}()
-	reader := csv.NewReader(file)
+	rows := newRowReader(newCSVReader(file), fileName, schema.checkRow, report)
 	for {
-		record, err := reader.Read()
+		record, err := rows.read()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
 			panic(err)
 		}
-		PIDString := record[0]
-		var rcDate, mvacDate, ivtDate *DiagnosisDate
-		if len(record[10]) == 10 { // valid date
-			d := parseTriNetXDiagnosisDate(record[10])
-			rcDate = &d
-		}
-		if len(record[11]) == 10 {
-			d := parseTriNetXDiagnosisDate(record[11])
-			mvacDate = &d
-		}
-		if len(record[13]) == 10 {
-			d := parseTriNetXDiagnosisDate(record[13])
-			rcDate = &d
+		PIDString := record[schema.PID]
+		info := &TreatmentInfo{}
+		for _, event := range events {
+			if date := schema.parseDateColumn(record, event); date != nil {
+				info.Events = append(info.Events, TreatmentEvent{Code: event.Code, Date: *date})
+			}
 		}
-		result[PIDString] = &TreatmentInfo{RCDate: rcDate, MVACDate: mvacDate, IVTDate: ivtDate}
+		result[PIDString] = info
 	}
 	return result
 }
 
 // parseTrinetXPatientDiagnoses parses a csv file containing patient diagnoses. It fills in those diagnoses for the given
-// patients. It uses the icd10AnalysisMap to assign internal analysis DID to the diagnoses.
+// patients. It uses the icd10AnalysisMap to assign internal analysis DID to the diagnoses. It returns a report of the
+// diagnosis codes that were dropped because they could not be mapped onto an analysis DID. Diagnosis rows that occur
+// more than once are counted in the duplicate report, and depending on its policy, removed. The layout of the treatment
+// file is described by the treatment schema, nil for the default TriNetX layout. The diagnoses may be split over
+// several shards, cf. shardFiles.
 // TO DO: Handle ICD09 diagnoses.
-func parseTrinetXPatientDiagnoses(diagnosesFile, treatmentInfoFile string, patients *PatientMap, icd10AnalysisMap AnalysisMaps, icd9ToIcd10Map map[string]string) {
-	file, err := os.Open(diagnosesFile)
-	if err != nil {
-		panic(err)
-	}
-	defer func() {
-		if err := file.Close(); err != nil {
-			panic(err)
-		}
-	}()
-	reader := csv.NewReader(file)
-	ctr := 0 //for counting the number of parsed diagnoses
-	ctrID09 := 0
-	ctrExcl := 0
-	EOICtr := 0
-	for {
-		record, err := reader.Read()
-		if err == io.EOF {
-			break
-		}
+func parseTrinetXPatientDiagnoses(diagnosesFile, treatmentInfoFile string, treatmentSchema *TreatmentSchema,
+	patients *PatientMap, icd10AnalysisMap AnalysisMaps, icd9ToIcd10Map map[string]string, duplicates *DuplicateReport,
+	report *ValidationReport) *UnmappedCodeReport {
+	loader := newDiagnosisLoader(patients, icd10AnalysisMap, icd9ToIcd10Map, duplicates)
+	shards := shardFiles(diagnosesFile)
+	report.addFiles(shards...)
+	readShards(shards, func(fileName string, emit func(row []string)) {
+		file, err := openInput(fileName)
 		if err != nil {
 			panic(err)
 		}
-		ctr++
-		PIDString := record[0]
-		patient, ok := GetPatient(PIDString, patients)
-		if !ok {
-			continue //skip unknown patients
-		}
-		DIDCodeSystem := record[2]
-		DIDString := record[3]
-		if DIDCodeSystem != "ICD-10-CM" {
-			// try to remap ICD9 code to ICD10 codes
-			if DIDString, ok = icd9ToIcd10Map[DIDString]; !ok {
-				continue // skip unkown ICD9 codes
+		defer func() {
+			if err := file.Close(); err != nil {
+				panic(err)
+			}
+		}()
+		reader := newCSVReader(file)
+		rows := newRowReader(reader, fileName, checkTriNetXDiagnosisRow, report)
+		for {
+			record, err := rows.read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				panic(err)
 			}
-			ctrID09++
+			emit(withRowRef(record, fileName, reader))
 		}
-		date := parseTriNetXDiagnosisDate(record[7])
+	}, func(row []string) {
+		record, fileName, line := splitRowRef(row)
+		loader.at(fileName, line)
+		loader.addInEncounter(record[0], record[1], record[2], record[3], isSecondaryDiagnosis(record[4]),
+			parseTriNetXDiagnosisDate(record[7]))
+	})
+	fillInTreatments(treatmentInfoFile, treatmentSchema, patients, icd10AnalysisMap, report)
+	return loader.finish()
+}
 
-		nr := icd10AnalysisMap.fillInPatientDiagnoses(patient, DIDString, date)
-		if nr > 0 {
-			ctrExcl++
-			continue
-		}
-		//Check if diagnosis is event of interest.
-		if patient.EOIDate == nil && TriNetXEventOfInterest(DIDString) {
-			EOICtr++
-			patient.EOIDate = &date // mark first event of interest (e.g. bladder cancers diagnosis)
-		}
+// fillInTreatments parses a treatment file, if given, and fills in the treatments as diagnoses of the patients. The
+// layout of the treatment file is described by the treatment schema, nil for the default TriNetX layout. The malformed
+// rows of the treatment file are added to the report.
+func fillInTreatments(treatmentInfoFile string, treatmentSchema *TreatmentSchema, patients *PatientMap,
+	icd10AnalysisMap AnalysisMaps, report *ValidationReport) {
+	if treatmentInfoFile == "" {
+		return
 	}
-	var nonICD10DiagnosesMap map[string]*TreatmentInfo
+	nonICD10DiagnosesMap := parseTriNetXTreatmentFile(treatmentInfoFile, treatmentSchema, report)
 	nonICDCtr := 0
-	if treatmentInfoFile != "" {
-		nonICD10DiagnosesMap = parseTriNetXTreatmentFile(treatmentInfoFile)
-		for _, patient := range patients.PIDMap {
-			//fill in non ICD10 diagnoses derived from procedure info
-			r := icd10AnalysisMap.fillInNonICDPatientDiagnoses(patient, nonICD10DiagnosesMap)
-			nonICDCtr = nonICDCtr + r
-		}
-	}
 	for _, patient := range patients.PIDMap {
-		SortDiagnoses(patient)
-		CompactDiagnoses(patient)
+		//fill in non ICD10 diagnoses derived from procedure info
+		r := icd10AnalysisMap.fillInNonICDPatientDiagnoses(patient, nonICD10DiagnosesMap)
+		nonICDCtr = nonICDCtr + r
+		if info, ok := nonICD10DiagnosesMap[patient.PIDString]; ok {
+			patient.TreatmentDate = info.firstDate()
+		}
 	}
-	fmt.Println("Parsed diagnosis data.")
-	fmt.Print("Parsed ", ctr, " diagnoses ")
-	fmt.Println("of which ", ctrID09, " ICD09 diagnoses and ", ctr-ctrID09, " ICD10 diagnoses, and ", ctrExcl, " diagnoses excluded from analysis")
-	fmt.Println("and of which ", EOICtr, " events of interest.")
 	fmt.Println("Parsed non ICD diagnoses for: ", nonICDCtr, " patients.")
 }
 
-func ParseTriNetXData(name, patientFile, diagnosisFile, diagnosisInfoFile, treatmentInfoFile string, nofCohortAges,
-	level int, minYears, maxYears float64, icd9ToIcd10File string, filters []PatientFilter) (*Experiment, *PatientMap) {
-	// parse data
-	// fill in patients
-	patients, nofRegions := parseTriNetXPatientData(patientFile, nofCohortAges)
-	// fill in icd10 to analysis map
+// initializeAnalysisMaps initializes the analysis maps of the vocabulary in the diagnosis info file: a directory with a
+// SNOMED CT release, a tab separated ICD-11 linearization or ICD-9-CM code file, the ICD-10-CM xml file or WHO ICD-10
+// ClaML file, a custom vocabulary in json or csv format, or the CCSR csv file. The custom events are added after the
+// codes of the vocabulary, nil for the default bladder cancer events. It returns the analysis maps, the nr of diagnosis
+// codes, and the maps of the analysis DIDs onto their entries and codes.
+func initializeAnalysisMaps(diagnosisInfoFile string, level int, icd10ToIcd11File string, events []*CustomEvent) (AnalysisMaps, int,
+	map[int]Icd10Entry, map[int]string) {
 	var analysisMaps AnalysisMaps
 	var nofDiagnosisCodes int
 	var icd10Map map[int]Icd10Entry
 	var idMap map[int]string
-	if filepath.Ext(diagnosisInfoFile) == ".xml" {
-		maps := initializeIcd10AnalysisMapsFromXML(diagnosisInfoFile, level)
+	if info, err := os.Stat(diagnosisInfoFile); err == nil && info.IsDir() {
+		maps := initializeSNOMEDAnalysisMaps(diagnosisInfoFile, level, events)
+		analysisMaps = maps
+		nofDiagnosisCodes = maps.NofDiagnosisCodes
+		icd10Map = maps.Icd10Map
+		idMap = maps.getIdMap()
+	}
+	if ext := inputExt(diagnosisInfoFile); ext == ".txt" || ext == ".tsv" {
+		if isICD11Linearization(diagnosisInfoFile) {
+			maps := initializeICD11AnalysisMaps(diagnosisInfoFile, level, icd10ToIcd11File, events)
+			analysisMaps = maps
+			nofDiagnosisCodes = maps.NofDiagnosisCodes
+			icd10Map = maps.Icd10Map
+			idMap = maps.getIdMap()
+		} else {
+			maps := initializeICD9AnalysisMaps(diagnosisInfoFile, level, events)
+			analysisMaps = maps
+			nofDiagnosisCodes = maps.NofDiagnosisCodes
+			icd10Map = maps.Icd10Map
+			idMap = maps.getIdMap()
+		}
+	}
+	if inputExt(diagnosisInfoFile) == ".xml" {
+		var maps icd10AnalysisMapsFromXML
+		if isClaML(icd10ReleaseFiles(diagnosisInfoFile)[0]) {
+			maps = initializeClaMLAnalysisMaps(diagnosisInfoFile, level, events)
+		} else {
+			maps = initializeIcd10AnalysisMapsFromXML(diagnosisInfoFile, level, events)
+		}
 		analysisMaps = maps
 		nofDiagnosisCodes = maps.NofDiagnosisCodes
 		icd10Map = maps.Icd10Map
 		idMap = maps.getIdMap()
 	}
-	if filepath.Ext(diagnosisInfoFile) == ".csv" || filepath.Ext(diagnosisInfoFile) == ".CSV" {
-		maps := initializeIcd10AnalysisMapsFromCCSR(diagnosisInfoFile)
+	if ext := inputExt(diagnosisInfoFile); ext == ".json" || (ext == ".csv" && isCustomVocabulary(diagnosisInfoFile)) {
+		maps := initializeCustomAnalysisMaps(diagnosisInfoFile, level, events)
+		analysisMaps = maps
+		nofDiagnosisCodes = maps.NofDiagnosisCodes
+		icd10Map = maps.Icd10Map
+		idMap = maps.getIdMap()
+	} else if ext == ".csv" {
+		maps := initializeIcd10AnalysisMapsFromCCSR(diagnosisInfoFile, events)
 		analysisMaps = maps
 		nofDiagnosisCodes = maps.NofDiagnosisCodes
 		icd10Map = maps.Icd10Map
 		idMap = maps.getIdMap()
 	}
+	return analysisMaps, nofDiagnosisCodes, icd10Map, idMap
+}
+
+// ParseOptions holds the inputs of ParseTriNetXData that are not experiment parameters, but are derived from them.
+type ParseOptions struct {
+	LabRules        []*LabRule        // rules of the lab file, cf. LoadLabRules
+	Filters         []PatientFilter   // filters applied to the parsed patients
+	ReferenceDate   DiagnosisDate     // reference date of the temporal checks, cf. CheckTemporalSanity
+	Report          *ValidationReport // report of the malformed rows of the csv input files
+	TreatmentSchema *TreatmentSchema  // schema of the treatment file
+	InputSchema     *InputSchema      // schema of the files of the csv input format
+	Database        *SQLSource        // source of the sql input format
+	Pseudonymizer   *Pseudonymizer    // pseudonymizer of the patient identifiers of a saved state
+	Telemetry       *Telemetry        // telemetry of the stages of the run
+}
+
+// ParseTriNetXData parses the input files of the given parameters into an experiment. Despite its name, it parses all
+// input formats, cf. the Input constants. OMOP tables are read from the given source, or from csv files if it is nil.
+// The files of the csv input format are described by the input schema, and the sql input format is read from the
+// database source. Procedures from the procedure file, if any, are added as events of their procedure groups, and lab
+// results from the lab file, if any, as events of the lab rules they match. With an enrollment file, only the diagnoses
+// inside the observation periods of the patients are kept, cf. ApplyObservationPeriods. The diagnoses of the same visit
+// are grouped as requested, cf. GroupVisits. With a state file to load, the diagnoses of a previous run are added to
+// the patients before the diagnosis files are parsed, and with a state file to save, all parsed diagnoses are saved for
+// a later run, with the patient identifiers replaced by their pseudonyms, cf. state.go. With a DID mapping file, the
+// analysis DIDs are kept stable across runs, cf. did-mapping.go. Duplicate patients are handled by the given strategy,
+// cf. DuplicateReport. In the streaming mode, the diagnoses are loaded with bounded memory, cf. diagnosisLoader. The
+// malformed rows of the csv input files are skipped and added to the validation report, cf. rowReader, and the dates
+// are checked with the reference date as today, cf. CheckTemporalSanity. It returns the experiment and the patients
+// that pass the filters.
+func ParseTriNetXData(args *ExperimentParams, options *ParseOptions) (*Experiment, *PatientMap) {
+	omop, report, treatmentSchema := args.OMOPSource, options.Report, options.TreatmentSchema
+	// parse data
+	// fill in patients
+	duplicates := NewDuplicateReport(args.Dedup)
+	duplicates.Streaming = args.Streaming
+	duplicates.SetPatientStrategy(args.DuplicatePatients)
+	var patients *PatientMap
+	var nofRegions int
+	var fhirReferences map[string]string
+	switch args.InputFormat {
+	case "", InputTriNetX:
+		patients, nofRegions = parseTriNetXPatientData(args.PatientInfo, args.NofAgeGroups, duplicates, report)
+	case InputFHIR:
+		patients, nofRegions, fhirReferences = parseFHIRPatients(args.PatientInfo, args.NofAgeGroups, duplicates)
+	case InputOMOP:
+		if omop == nil {
+			omop = NewOMOPCSVSource(args.PatientInfo, args.PatientDiagnoses)
+		}
+		patients, nofRegions = parseOMOPPatients(omop, args.NofAgeGroups, duplicates)
+	case InputMIMIC:
+		patients, nofRegions = parseMIMICPatients(args.PatientInfo, args.NofAgeGroups, duplicates)
+	case InputCSV:
+		patients, nofRegions = parseCSVPatientData(args.PatientInfo, options.InputSchema, args.NofAgeGroups, duplicates,
+			report)
+	case InputSQL:
+		patients, nofRegions = parseSQLPatients(options.Database, args.NofAgeGroups, duplicates)
+	default:
+		panic(fmt.Sprint("Unknown input format: ", args.InputFormat))
+	}
+	warnings := patients.Warnings // the patients are replaced by the filters
+	// fill in icd10 to analysis map
+	analysisMaps, nofDiagnosisCodes, icd10Map, idMap := initializeAnalysisMaps(args.DiagnosisInfo, args.Lvl,
+		args.ICD10ToICD11File, treatmentSchema.vocabularyEvents())
+	if args.DIDMap != "" {
+		nofDiagnosisCodes, idMap = applyDIDMapping(args.DIDMap, analysisMaps, icd10Map, nofDiagnosisCodes)
+	}
+	nofVocabularyCodes := nofDiagnosisCodes
 	icd9ToIcd10Map := map[string]string{}
-	if icd9ToIcd10File != "" {
-		icd9ToIcd10Map = parseIcd9ToIcd10Mapping(icd9ToIcd10File)
+	if args.ICD9ToICD10File != "" {
+		icd9ToIcd10Map = parseIcd9ToIcd10Mapping(args.ICD9ToICD10File)
+	}
+	if args.SNOMEDToICD10File != "" {
+		icd9ToIcd10Map = mergeToIcd10Mappings(icd9ToIcd10Map, parseSNOMEDToIcd10Mapping(args.SNOMEDToICD10File))
+	}
+	// fill in the diagnoses of a previous run, to which the new files are added
+	if args.LoadState != "" {
+		nofDiagnosisCodes = loadExperimentState(args.LoadState, patients, icd10Map, idMap, nofDiagnosisCodes,
+			options.Pseudonymizer)
 	}
 	// fill in diagnoses for patients
-	parseTrinetXPatientDiagnoses(diagnosisFile, treatmentInfoFile, patients, analysisMaps, icd9ToIcd10Map)
+	var unmapped *UnmappedCodeReport
+	switch args.InputFormat {
+	case InputFHIR:
+		unmapped = parseFHIRConditions(args.PatientDiagnoses, args.TreatmentInfo, treatmentSchema, patients,
+			fhirReferences, analysisMaps, icd9ToIcd10Map, duplicates, report)
+	case InputOMOP:
+		unmapped = parseOMOPConditions(omop, args.TreatmentInfo, treatmentSchema, patients, analysisMaps,
+			icd9ToIcd10Map, duplicates, report)
+	case InputMIMIC:
+		unmapped = parseMIMICDiagnoses(args.PatientDiagnoses, args.TreatmentInfo, treatmentSchema, patients,
+			analysisMaps, icd9ToIcd10Map, duplicates, report)
+	case InputCSV:
+		unmapped = parseCSVDiagnoses(args.PatientDiagnoses, args.TreatmentInfo, treatmentSchema, options.InputSchema,
+			patients, analysisMaps, icd9ToIcd10Map, duplicates, report)
+	case InputSQL:
+		unmapped = parseSQLDiagnoses(options.Database, args.TreatmentInfo, treatmentSchema, patients, analysisMaps,
+			icd9ToIcd10Map, duplicates, report)
+	default:
+		unmapped = parseTrinetXPatientDiagnoses(args.PatientDiagnoses, args.TreatmentInfo, treatmentSchema, patients,
+			analysisMaps, icd9ToIcd10Map, duplicates, report)
+	}
+	// fill in procedures as diagnoses of their procedure groups
+	if args.ProcedureInfo != "" {
+		nofDiagnosisCodes = parseTriNetXProcedures(args.ProcedureInfo, args.ProcedureGroups, patients, icd10Map, idMap,
+			nofDiagnosisCodes, report)
+	}
+	// fill in abnormal lab results as diagnoses of their lab events
+	if args.LabInfo != "" {
+		nofDiagnosisCodes = parseTriNetXLabResults(args.LabInfo, options.LabRules, patients, icd10Map, idMap,
+			nofDiagnosisCodes, report)
+	}
+	// persist the analysis DIDs for later runs
+	if args.DIDMap != "" {
+		saveDIDMapping(args.DIDMap, icd10Map, idMap, nofDiagnosisCodes)
+	}
+	// save the diagnoses for a later incremental run
+	if args.SaveState != "" {
+		saveExperimentState(args.SaveState, patients, icd10Map, idMap, nofVocabularyCodes, nofDiagnosisCodes,
+			options.Pseudonymizer)
+	}
+	// check dates of diagnoses against birth, death, and the reference date
+	isEventOfInterest := func(did int) bool {
+		return analysisMaps.isEventOfInterest(idMap[did])
+	}
+	CheckTemporalSanity(patients, args.TemporalChecks, options.ReferenceDate, isEventOfInterest, report)
+	// collapse the diagnoses of the same visit
+	GroupVisits(patients, args.SameVisit, args.VisitOrder)
+	// only count the diagnoses inside the observation periods of the patients
+	if args.EnrollmentInfo != "" {
+		patients = ApplyObservationPeriods(patients, parseEnrollmentFile(args.EnrollmentInfo), isEventOfInterest)
+	}
+	options.Telemetry.Begin(StageFilter)
+	// start the timelines of the patients at their index date
+	patients = AlignPatients(patients, args.IndexDate)
 	// Apply patient filter
-	patients = ApplyPatientFilters(filters, patients)
+	patients = ApplyPatientFilters(options.Filters, patients)
 	fmt.Println("Filtered down to: ", len(patients.PIDMap), " patients.")
-	// create cohorts
-	cohorts := InitCohorts(patients, nofCohortAges, nofRegions, nofDiagnosisCodes)
+	// create cohorts, per race/ethnicity stratum if requested
+	StratifyPatients(patients, args.Stratify)
+	cohorts := InitCohorts(patients, args.NofAgeGroups, nofRegions, nofDiagnosisCodes)
 	mergedCohort := MergeCohorts(cohorts)
 	exp := Experiment{
-		NofAgeGroups:      nofCohortAges,
-		Level:             level,
+		NofAgeGroups:      args.NofAgeGroups,
+		Level:             args.Lvl,
 		NofDiagnosisCodes: nofDiagnosisCodes,
 		DxDRR:             MakeDxDRR(nofDiagnosisCodes),
 		DxDPatients:       MakeDxDPatients(nofDiagnosisCodes),
 		DPatients:         mergedCohort.DPatients,
 		Cohorts:           cohorts,
-		Name:              name,
+		Periods:           patients.Periods,
+		Name:              args.Name,
 		Icd10Map:          icd10Map,
 		NofRegions:        nofRegions,
 		IdMap:             idMap,
 		FCtr:              patients.FemaleCtr,
 		MCtr:              patients.MaleCtr,
+		UnmappedCodes:     unmapped,
+		Warnings:          warnings,
+		Duplicates:        duplicates,
+		IndexDate:         args.IndexDate,
+		Stratification:    strings.Join(parseStratification(args.Stratify), ","),
 	}
 	return &exp, patients
 }
@@ -944,16 +1186,31 @@ func ParseTriNetXData(name, patientFile, diagnosisFile, diagnosisInfoFile, treat
 // opening json file with ICD09 -> ICD10 mapping
 
 func parseIcd9ToIcd10Mapping(file string) map[string]string {
-	jsonFile, err := os.Open(file)
+	mapping, err := readIcd9ToIcd10Mapping(file)
 	if err != nil {
 		panic(err)
 	}
+	return mapping
+}
+
+// readIcd9ToIcd10Mapping reads a json file with an object that maps ICD9 codes onto ICD10 codes, which are normalized,
+// cf. normalizeICDCode. It returns an error if the file cannot be read or is not such an object.
+func readIcd9ToIcd10Mapping(file string) (map[string]string, error) {
+	jsonFile, err := openInput(file)
+	if err != nil {
+		return nil, err
+	}
 	defer jsonFile.Close()
 	fmt.Println("Parsing ICD9 to ICD10 mapping from a json file.")
-	jsonBytes, _ := io.ReadAll(jsonFile)
 	var mapping map[string]string
-	json.Unmarshal(jsonBytes, &mapping)
-	return mapping
+	if err := json.NewDecoder(jsonFile).Decode(&mapping); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	normalized := make(map[string]string, len(mapping))
+	for icd9Code, icd10Code := range mapping {
+		normalized[normalizeICDCode(CodeSystemICD9, icd9Code)] = normalizeICDCode(CodeSystemICD10, icd10Code)
+	}
+	return normalized, nil
 }
 
 // TumorInfo is a struct for storing bladder cancer tumor information concerning: tumor size, tumor lymph nodes, tumor
@@ -961,57 +1218,27 @@ func parseIcd9ToIcd10Mapping(file string) map[string]string {
 type TumorInfo struct {
 	TStage, NStage, MStage, Stage string
 	Date                          DiagnosisDate
+	Site                          string // ICD-10 or ICD-O-3 site code, e.g. C67.9
+	Morphology                    string // ICD-O-3 morphology code, e.g. 8120/3, empty if unknown
+	Histology                     string // histology derived from the morphology code, cf. icdo3.go
 }
 
-// getTumorStage converts tumor size, number of lymph nodes, and metastatis Level into an overall cancer stage.
-// T stages: Ta,T1,Tis,T2,T3,T4
-// N stages: N0,N1,N2,N3
-// M stages: M0,M1
-// Stage 0a: Ta,N0,M0
-// Stage 0is:Tis,N0,M0 known as carcinoma in situ (CIS)
-// Stage I: T1,N0,M0
-// Stage II: T2,N0,M0
-// Stage IIIA: T3a,T3b, or T4a,N0,M0 --or-- T1 to T4a,N1,M0
-// Stage IIIB: T1 to T4a, N2 or N3, M0
-// Stage IVA: T4b,any N,M0 or any T, any N, M1a
-// Stage IVB: any T, any N, M1b
-func getTumorStage(tStage, nStage, mStage string) string {
-	if nStage == "N0" && mStage == "M0" {
-		switch tStage {
-		case "Ta":
-			return "0a"
-		case "Tis":
-			return "0is"
-		case "T1":
-			return "I"
-		case "T2":
-			return "II"
-		case "T3a", "T3b", "T4a":
-			return "IIIA"
-		}
-	}
-	if nStage == "N1" && mStage == "M0" {
-		switch tStage {
-		case "T1", "T1a", "T1b", "T2", "T2a", "T2b", "T3", "T3a", "T3b", "T4a":
-			return "IIIA"
-		}
-	}
-	if (nStage == "N2" || nStage == "N3") && mStage == "M0" {
-		switch tStage {
-		case "T1", "T1a", "T1b", "T2", "T2a", "T2b", "T3", "T3a", "T3b", "T4", "T4a":
-			return "IIIB"
-		}
-	}
-	if tStage == "T4b" && mStage == "M0" {
-		return "IVA"
-	}
-	if mStage == "M1a" {
-		return "IVA"
-	}
-	if mStage == "M1b" {
-		return "IVB"
+// Columns of the TriNetX tumor file.
+const (
+	triNetXTumorSite       = 4  // ICD-10 or ICD-O-3 site code
+	triNetXTumorMorphology = 6  // ICD-O-3 morphology code
+	triNetXTumorT          = 10 // TNM tumor size, e.g. TNM_T2
+	triNetXTumorN          = 11 // TNM lymph nodes, e.g. TNM_N0
+	triNetXTumorM          = 12 // TNM metastasis, e.g. TNM_M0
+)
+
+// parseTNMValue returns the stage of a TNM value, e.g. T2 for TNM_T2, or an empty string if the stage is missing.
+func parseTNMValue(value string) string {
+	info := strings.Split(value, "_")
+	if len(info) == 1 {
+		return ""
 	}
-	return tStage + nStage + mStage
+	return info[1]
 }
 
 // tumorIsCISStage checks if tumor is flat or carcinoma in situ (CIS).
@@ -1019,9 +1246,12 @@ func tumorIsCISStage(tumor *TumorInfo) bool {
 	return tumor.Stage == "0is"
 }
 
-// ParsetTriNetXTumorData parses the tumor data from a csv file and returns a map PIDString -> []*TumorInfo.
-func ParsetTriNetXTumorData(fileName string) map[string][]*TumorInfo {
-	file, err := os.Open(fileName)
+// ParsetTriNetXTumorData parses the tumor data from a csv file and returns a map PIDString -> []*TumorInfo. Only the
+// tumors of the given topography prefixes are recorded, nil for the default tumor sites. Their overall stages are
+// derived with the staging registry, nil for the default registry.
+func ParsetTriNetXTumorData(fileName string, sites []string, staging StagingRegistry,
+	report *ValidationReport) map[string][]*TumorInfo {
+	file, err := openInput(fileName)
 	if err != nil {
 		panic(err)
 	}
@@ -1031,47 +1261,60 @@ func ParsetTriNetXTumorData(fileName string) map[string][]*TumorInfo {
 		}
 	}()
 	result := map[string][]*TumorInfo{}
-	reader := csv.NewReader(file)
+	rows := newRowReader(newCSVReader(file), fileName, checkTriNetXTumorRow, report)
 	for {
-		record, err := reader.Read()
+		record, err := rows.read()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
 			panic(err)
 		}
-		tumorSite := strings.Split(record[4], ".")
-		if tumorSite[0] == "C67" { //only record bladder cancer information
-			PIDString := record[0]
-			date := parseTriNetXDiagnosisDate(record[1])
-			tumorSizeInfo := strings.Split(record[10], "_")
-			numberOfLymphNodesInfo := strings.Split(record[11], "_")
-			metastaticInfo := strings.Split(record[12], "_")
-			if len(tumorSizeInfo) == 1 || len(numberOfLymphNodesInfo) == 1 || len(metastaticInfo) == 1 {
-				continue
-			}
-			tumor := &TumorInfo{Date: date, TStage: tumorSizeInfo[1], NStage: numberOfLymphNodesInfo[1],
-				MStage: metastaticInfo[1]}
-			tumor.Stage = getTumorStage(tumorSizeInfo[1], numberOfLymphNodesInfo[1], metastaticInfo[1])
-			if ts, ok := result[PIDString]; ok {
-				result[PIDString] = append(ts, tumor)
-			} else {
-				result[PIDString] = []*TumorInfo{tumor}
-			}
-		}
+		addTumor(result, sites, staging, record[0], parseTriNetXDiagnosisDate(record[1]), record[triNetXTumorSite],
+			record[triNetXTumorMorphology], record[triNetXTumorT], record[triNetXTumorN], record[triNetXTumorM])
 	}
 	printTumorInfoSummary(result)
 	return result
 }
 
+// addTumor adds a tumor of a patient to the tumor info map. Only tumors of the given sites, nil for the default tumor
+// sites, with staging or morphology are recorded. The overall stage is derived with the staging registry, nil for the
+// default registry.
+func addTumor(result map[string][]*TumorInfo, sites []string, staging StagingRegistry, PIDString string,
+	date DiagnosisDate, site, morphology, t, n, m string) {
+	if !isTumorSite(site, sites) { //only record information of the studied cancers
+		return
+	}
+	tStage, nStage, mStage := parseTNMValue(t), parseTNMValue(n), parseTNMValue(m)
+	if isMissing(morphology) {
+		morphology = ""
+	}
+	staged := tStage != "" && nStage != "" && mStage != ""
+	if !staged && morphology == "" { // registry data may have a morphology without staging
+		return
+	}
+	tumor := &TumorInfo{Date: date, Site: site, Morphology: morphology, Histology: ICDO3Histology(morphology)}
+	if staged {
+		tumor.TStage, tumor.NStage, tumor.MStage = tStage, nStage, mStage
+		tumor.Stage = staging.stage(site, tStage, nStage, mStage)
+	}
+	result[PIDString] = append(result[PIDString], tumor)
+}
+
 func printTumorInfoSummary(tumorInfo map[string][]*TumorInfo) {
 	fmt.Println("Parsed tumor info. Found tumor info for: ", len(tumorInfo), " patients.")
 	ctr := map[string]int{}
+	histologies := map[string]int{}
 	for _, tumors := range tumorInfo {
 		for _, tumor := range tumors {
-			ctr[tumor.TStage]++
-			ctr[tumor.NStage]++
-			ctr[tumor.MStage]++
+			if tumor.TStage != "" {
+				ctr[tumor.TStage]++
+				ctr[tumor.NStage]++
+				ctr[tumor.MStage]++
+			}
+			if tumor.Histology != "" {
+				histologies[tumor.Histology]++
+			}
 		}
 	}
 	stages := []string{}
@@ -1082,6 +1325,9 @@ func printTumorInfoSummary(tumorInfo map[string][]*TumorInfo) {
 	for _, stage := range stages {
 		fmt.Println("For stage: ", stage, ": ", ctr[stage], " entries.")
 	}
+	for _, histology := range sortedKeys(histologies) {
+		fmt.Println("For histology: ", histology, ": ", histologies[histology], " entries.")
+	}
 }
 
 func printTumorInfo(tumorInfo map[int][]*TumorInfo) {
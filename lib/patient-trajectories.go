@@ -0,0 +1,93 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// Export of the trajectories per patient, for survival or utilization analyses that join the trajectories with other
+// data on patient level. For every patient, the export lists every trajectory the patient contributed to, with the
+// dates of the diagnoses of the patient that matched the diagnoses of the trajectory.
+
+// matchPatientTrajectory returns the diagnoses of a patient that match the diagnoses of a trajectory, in the same way
+// as the trajectories are built: the first occurrence of the first diagnosis, and for each next diagnosis its first
+// occurrence within the time frame of the previous match, cf. countPatientTrajectory. It returns nil if the patient
+// does not match the trajectory.
+func matchPatientTrajectory(p *Patient, diagnoses []int, minTime, maxTime float64) []*Diagnosis {
+	idx := -1
+	for i, d := range p.Diagnoses {
+		if d.DID == diagnoses[0] {
+			idx = i
+			break
+		}
+	}
+	if idx == -1 {
+		return nil
+	}
+	matches := []*Diagnosis{p.Diagnoses[idx]}
+	for _, did := range diagnoses[1:] {
+		if idx = countPatientTrajectory(p, idx, did, minTime, maxTime); idx == -1 {
+			return nil
+		}
+		matches = append(matches, p.Diagnoses[idx])
+	}
+	return matches
+}
+
+// WritePatientTrajectories writes a csv file with a row per matched diagnosis of each patient and each trajectory the
+// patient contributed to, i.e. the patients with all diagnoses of the trajectory. The header is:
+// PIDString,TID,Index,DID,Code,Name,Date. The TriNetX patient id is replaced by its pseudonym if the experiment has a
+// pseudonymizer. The diagnoses are matched within the given time frame, cf. matchPatientTrajectory. It returns the
+// file name.
+func WritePatientTrajectories(exp *Experiment, path string, minTime, maxTime float64) string {
+	fileName := filepath.Join(path, fmt.Sprintf("%s-patient-trajectories.csv", exp.Name))
+	file, err := os.Create(fileName)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	writer := csv.NewWriter(file)
+	writer.Write([]string{"PIDString", "TID", "Hash", "Index", "DID", "Code", "Name", "Date"})
+	for _, t := range exp.Trajectories {
+		if len(t.Patients) == 0 {
+			continue
+		}
+		for _, p := range t.Patients[len(t.Patients)-1] {
+			pid := exp.Pseudonymizer.Pseudonym(p.PIDString)
+			for idx, d := range matchPatientTrajectory(p, t.Diagnoses, minTime, maxTime) {
+				writer.Write([]string{pid, strconv.Itoa(t.ID), t.Hash, strconv.Itoa(idx), strconv.Itoa(d.DID),
+					exp.IdMap[d.DID], exp.Icd10Map[d.DID].Name, formatTriNetXDate(d.Date)})
+			}
+		}
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		panic(err)
+	}
+	return fileName
+}
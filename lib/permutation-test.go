@@ -0,0 +1,179 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Permutation test of the prevalence of the trajectories between two groups of patients, e.g. the male versus the
+// female patients, or the patients of 70 years and older versus the younger patients. The groups are defined by a
+// patient filter, cf. GetPatientFilter: the patients that pass the filter form the first group, and the other patients
+// the second group. For each trajectory, the difference between the fractions of patients of both groups that follow
+// the trajectory is compared with the differences obtained by randomly permuting the group labels of the patients,
+// which yields a two-sided p-value without assumptions on the distribution of the difference.
+
+// DefaultPermutations is the default nr of permutations of the permutation test.
+const DefaultPermutations = 1000
+
+// permutationGroups are the patient filters that can define the groups of the permutation test.
+var permutationGroups = []string{"age70+", "age70-", "male", "female", "Ta", "T1", "Tis", "T2", "T3", "T4", "N0", "N1",
+	"N2", "N3", "M0", "M1", "EOI-", "EOI+", "MIBC", "NMIBC", "mUC", HistologyUrothelial, HistologySquamous,
+	HistologyAdenocarcinoma, HistologyNeuroendocrine}
+
+// IsPermutationGroup returns whether the given patient filter can define the groups of the permutation test.
+func IsPermutationGroup(filter string) bool {
+	return slices.Contains(permutationGroups, filter)
+}
+
+// GroupDifference compares the patients of two groups that follow a trajectory.
+type GroupDifference struct {
+	Trajectory *Trajectory
+	Patients   [2]int  // nr of patients of each group that follow the trajectory
+	Totals     [2]int  // nr of patients of each group
+	PValue     float64 // two-sided permutation p-value of the difference
+}
+
+// Difference returns the difference between the fraction of patients of the first group that follow the trajectory and
+// the fraction of patients of the second group.
+func (d *GroupDifference) Difference() float64 {
+	return groupDifference(d.Patients[0], d.Patients[1], d.Totals[0], d.Totals[1])
+}
+
+// groupDifference returns the difference between the fractions of patients of two groups, or 0 if a group is empty.
+func groupDifference(n1, n2, total1, total2 int) float64 {
+	if total1 == 0 || total2 == 0 {
+		return 0
+	}
+	return float64(n1)/float64(total1) - float64(n2)/float64(total2)
+}
+
+// PermutationTest compares the fractions of the patients of the two groups defined by the given filter that follow the
+// trajectories of the experiment, with the given nr of permutations of the group labels. The patients following a
+// trajectory are the patients of its last transition. The p-value of a trajectory is the fraction of permutations of
+// which the absolute difference is at least the observed one, counting the observed labels as one of the permutations.
+func (exp *Experiment) PermutationTest(patients *PatientMap, group PatientFilter, permutations int) []*GroupDifference {
+	// index the patients in the order of their IDs, so that the permutations are reproducible
+	pids := make([]int, 0, len(patients.PIDMap))
+	for pid := range patients.PIDMap {
+		pids = append(pids, pid)
+	}
+	sort.Ints(pids)
+	index := make(map[int]int, len(pids))
+	labels := make([]bool, len(pids))
+	inGroup := 0
+	for i, pid := range pids {
+		index[pid] = i
+		p := *patients.PIDMap[pid] // some filters drop diagnoses of the patient they test
+		if labels[i] = group(&p); labels[i] {
+			inGroup++
+		}
+	}
+	total1, total2 := inGroup, len(pids)-inGroup
+	followers := make([][]int, len(exp.Trajectories))
+	differences := make([]*GroupDifference, len(exp.Trajectories))
+	for i, t := range exp.Trajectories {
+		if len(t.Patients) > 0 {
+			for _, p := range t.Patients[len(t.Patients)-1] {
+				if idx, ok := index[p.PID]; ok {
+					followers[i] = append(followers[i], idx)
+				}
+			}
+		}
+		n1 := countInGroup(followers[i], labels)
+		differences[i] = &GroupDifference{Trajectory: t, Patients: [2]int{n1, len(followers[i]) - n1},
+			Totals: [2]int{total1, total2}}
+	}
+	observed := make([]float64, len(differences))
+	for i, d := range differences {
+		observed[i] = math.Abs(d.Difference()) - 1e-12 // tolerates the rounding of mirrored differences
+	}
+	extreme := make([]int, len(differences))
+	rng := exp.Rand(permutationStream)
+	permuted := slices.Clone(labels)
+	for range permutations {
+		shuffleLabels(rng, permuted)
+		for i := range differences {
+			n1 := countInGroup(followers[i], permuted)
+			if math.Abs(groupDifference(n1, len(followers[i])-n1, total1, total2)) >= observed[i] {
+				extreme[i]++
+			}
+		}
+	}
+	for i, d := range differences {
+		d.PValue = float64(extreme[i]+1) / float64(permutations+1)
+	}
+	return differences
+}
+
+// countInGroup returns the nr of the given patient indexes that are labelled as the first group.
+func countInGroup(indexes []int, labels []bool) int {
+	n := 0
+	for _, idx := range indexes {
+		if labels[idx] {
+			n++
+		}
+	}
+	return n
+}
+
+// shuffleLabels randomly permutes the group labels in place.
+func shuffleLabels(rng *rand.Rand, labels []bool) {
+	rng.Shuffle(len(labels), func(i, j int) {
+		labels[i], labels[j] = labels[j], labels[i]
+	})
+}
+
+// WriteGroupDifferences writes the results of the permutation test to a file name-permutation-test.tab, with a line per
+// trajectory: the trajectory ID and hash, the terms and codes of the diagnoses, the nr of patients that follow the
+// trajectory and the nr of patients of the first and the second group, the difference of the fractions of patients of
+// the first and second group, and the p-value:
+// TID tab hash tab terms tab codes tab patients1 tab total1 tab patients2 tab total2 tab difference tab p-value. The
+// counts of patients that are small cells are binned, cf. exp. It returns the file name.
+func WriteGroupDifferences(exp *Experiment, differences []*GroupDifference, path string) string {
+	name := filepath.Join(path, fmt.Sprintf("%s-permutation-test.tab", exp.Name))
+	file, err := os.Create(name)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	for _, d := range differences {
+		t := d.Trajectory
+		terms, codes := make([]string, len(t.Diagnoses)), make([]string, len(t.Diagnoses))
+		for i, did := range t.Diagnoses {
+			terms[i], codes[i] = exp.Icd10Map[did].Name, exp.IdMap[did]
+		}
+		fmt.Fprintf(file, "%d\t%s\t%s\t%s\t%v\t%d\t%v\t%d\t%s\t%s\n", t.ID, t.Hash, strings.Join(terms, " -> "),
+			strings.Join(codes, " -> "), exp.cellValue(float64(d.Patients[0]), d.Patients[0]), d.Totals[0],
+			exp.cellValue(float64(d.Patients[1]), d.Patients[1]), d.Totals[1], formatRRFloat(d.Difference()),
+			formatRRFloat(d.PValue))
+	}
+	return name
+}
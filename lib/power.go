@@ -0,0 +1,146 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"github.com/imec-int/ptra/lib/utils"
+	"math"
+)
+
+// Power estimates of the sampling test of the diagnosis pairs, cf. InitRR, to choose the parameters of a run before
+// running it. A pair d1 -> d2 is selected if the nr of exposed patients with d2 exceeds the nr of patients with d2 in
+// all but a fraction of maxPValue of the iter sampled comparison groups. For a pair with a given RR and an expected nr
+// of exposed patients with d2, that nr is modelled as a Poisson variable, as are the nrs of patients with d2 in the
+// comparison groups, with the expected nr divided by the RR. This holds for diagnoses that are rare in the exposed
+// patients, and is conservative otherwise. The power of the test is the probability that the pair reaches minPatients
+// and that at most a fraction of maxPValue of the comparison groups has as many patients with d2. The minimum
+// prevalence of a detectable pair is the smallest expected nr of patients of the pair with the required power, as a
+// fraction of the patients of the cohort. The exact test of pairs with few diagnoses, cf. fisher.go, is not modelled.
+
+// powerPrecision is the relative precision of the minimum nr of patients of a power estimate.
+const powerPrecision = 1e-3
+
+// PowerParams are the parameters of a power estimate, cf. EstimatePower.
+type PowerParams struct {
+	Patients    int     // nr of patients of the cohort
+	RR          float64 // RR of the diagnosis pairs to detect
+	Iter        int     // nr of sampled comparison groups per diagnosis pair
+	MaxPValue   float64 // maximum p-value of the diagnosis pairs
+	Power       float64 // required probability of detecting a diagnosis pair
+	MinPatients int     // minimum nr of patients of a diagnosis pair
+}
+
+// PowerEstimate is the smallest diagnosis pair that is detected with the required power, cf. EstimatePower.
+type PowerEstimate struct {
+	Patients   int     // expected nr of patients with the pair
+	Prevalence float64 // expected nr of patients with the pair as a fraction of the patients of the cohort
+	Power      float64 // probability of detecting the pair
+}
+
+// logPoisson returns the log of the probability of k events of a Poisson variable with the given mean.
+func logPoisson(k int, mean float64) float64 {
+	lk, _ := math.Lgamma(float64(k + 1))
+	return float64(k)*math.Log(mean) - mean - lk
+}
+
+// binomialCDF returns the probability of at most m successes in n trials with success probability p.
+func binomialCDF(m, n int, p float64) float64 {
+	switch {
+	case m >= n || p <= 0:
+		return 1
+	case p >= 1:
+		return 0
+	}
+	ln, _ := math.Lgamma(float64(n + 1))
+	cdf := 0.0
+	for j := 0; j <= m; j++ {
+		lj, _ := math.Lgamma(float64(j + 1))
+		lnj, _ := math.Lgamma(float64(n - j + 1))
+		cdf += math.Exp(ln - lj - lnj + float64(j)*math.Log(p) + float64(n-j)*math.Log1p(-p))
+	}
+	return math.Min(cdf, 1)
+}
+
+// pairPower returns the probability that the sampling test selects a diagnosis pair with the given RR and expected nr
+// of patients, cf. EstimatePower.
+func pairPower(expected, rr float64, iter int, maxPValue float64, minPatients int) float64 {
+	if expected <= 0 {
+		return 0
+	}
+	spread := 10*math.Sqrt(expected) + 20
+	low, high := utils.MaxInt(minPatients, int(expected-spread)), int(math.Ceil(expected+spread))
+	if low > high {
+		return 0
+	}
+	// the probability that a comparison group has at least a patients with d2, for a from high down to low
+	comparisonMean := expected / rr
+	tail, tails := 0.0, make([]float64, high-low+1)
+	for a := high; a >= low; a-- {
+		tail += math.Exp(logPoisson(a, comparisonMean))
+		tails[a-low] = math.Min(tail, 1)
+	}
+	exceeding := int(math.Floor(maxPValue*float64(iter) + 1e-9)) // nr of comparison groups that may reach the pair
+	power := 0.0
+	for a := low; a <= high; a++ {
+		power += math.Exp(logPoisson(a, expected)) * binomialCDF(exceeding, iter, tails[a-low])
+	}
+	return math.Min(power, 1)
+}
+
+// EstimatePower estimates the minimum prevalence of the diagnosis pairs with a given RR that the sampling test of the
+// pairs detects with the required power, cf. PowerEstimate. It returns an error if the parameters are invalid, or if
+// even a pair of all the patients of the cohort is not detected with the required power.
+func EstimatePower(params *PowerParams) (*PowerEstimate, error) {
+	switch {
+	case params.Patients <= 0:
+		return nil, errors.New("the number of patients must be positive")
+	case params.RR <= 1:
+		return nil, errors.New("the RR of the pairs to detect must be greater than 1")
+	case params.Iter <= 0:
+		return nil, errors.New("the number of iterations must be positive")
+	case params.MaxPValue <= 0 || params.MaxPValue > 1:
+		return nil, errors.New("the maximum p-value must be greater than 0 and at most 1")
+	case params.Power <= 0 || params.Power >= 1:
+		return nil, errors.New("the power must be between 0 and 1")
+	case params.MinPatients < 0:
+		return nil, errors.New("the minimum number of patients must not be negative")
+	}
+	power := func(expected float64) float64 {
+		return pairPower(expected, params.RR, params.Iter, params.MaxPValue, params.MinPatients)
+	}
+	high := float64(params.Patients)
+	if power(high) < params.Power {
+		return nil, fmt.Errorf("pairs with an RR of %v cannot be detected with a power of %v in %d patients",
+			params.RR, params.Power, params.Patients)
+	}
+	// bisect the expected nr of patients between a pair that is not detected and one that is
+	low := 0.0
+	for high-low > math.Max(powerPrecision*high, 0.5) {
+		if middle := (low + high) / 2; power(middle) >= params.Power {
+			high = middle
+		} else {
+			low = middle
+		}
+	}
+	patients := int(math.Ceil(high))
+	return &PowerEstimate{Patients: patients, Prevalence: float64(patients) / float64(params.Patients),
+		Power: power(float64(patients))}, nil
+}
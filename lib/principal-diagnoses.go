@@ -0,0 +1,66 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"strings"
+)
+
+// Primary and secondary diagnoses. Diagnosis files may mark which diagnosis of an encounter is its principal, or
+// primary, diagnosis, e.g. the principal_diagnosis_indicator column of TriNetX, or the first sequence nr of MIMIC-IV.
+// Secondary diagnoses are comorbidities or complications that are coded along, and are less reliable as trajectory
+// events. Trajectories can either be restricted to primary diagnoses, or secondary diagnoses can be down-weighted in
+// the RR scores, cf. SecondaryWeight. Events from other sources than diagnosis files, e.g. treatments, are primary.
+
+// isSecondaryDiagnosis checks if the principal diagnosis indicator of a TriNetX diagnosis marks it as a secondary
+// diagnosis. Diagnoses without indicator are primary diagnoses.
+func isSecondaryDiagnosis(indicator string) bool {
+	switch strings.ToLower(strings.TrimSpace(indicator)) {
+	case "secondary", "s", "no", "n", "false", "0":
+		return true
+	default:
+		return false
+	}
+}
+
+// diagnosisWeight returns the weight with which a patient's diagnosis (did) is counted in the RR scores: 1 if the
+// patient has it as a primary diagnosis, or the weight of secondary diagnoses of the experiment otherwise.
+func (exp *Experiment) diagnosisWeight(p *Patient, did int) float64 {
+	if exp.SecondaryWeight == 1 {
+		return 1
+	}
+	for _, d := range p.Diagnoses {
+		if d.DID == did && !d.Secondary {
+			return 1
+		}
+	}
+	return exp.SecondaryWeight
+}
+
+// PrimaryDiagnosisFilter removes the secondary diagnoses of a patient. Patients without primary diagnoses are removed.
+func PrimaryDiagnosisFilter(p *Patient) bool {
+	var diagnoses []*Diagnosis
+	for _, d := range p.Diagnoses {
+		if !d.Secondary {
+			diagnoses = append(diagnoses, d)
+		}
+	}
+	p.Diagnoses = diagnoses
+	return len(diagnoses) > 0
+}
@@ -25,6 +25,7 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 )
 
 // Plotting of trajectories
@@ -44,10 +45,11 @@ func LogTrajectory(t *Trajectory, exp *Experiment) {
 }
 
 // printTrajectoriesToTabFile prints a human-readable representation of trajectories to a tab file. Per trajectory, it
-// prints two lines. A first line is a list of medical terms for diagnoses in the trajectory (in order of occurrence):
+// prints three lines. A first line is a list of medical terms for diagnoses in the trajectory (in order of occurrence):
 // term1 tab term2 tab ... termn. The second line lists the number of patients for each transition in the trajectory:
-// nr1->2 tab nr2->3 tab ... nrn-1->n.
-func printTrajectoriesToTabFile(trajectories []*Trajectory, icd10Map map[int]Icd10Entry, name string) {
+// nr1->2 tab nr2->3 tab ... nrn-1->n. The third line lists the codes of the diagnoses: code1 tab code2 tab ... coden.
+func printTrajectoriesToTabFile(trajectories []*Trajectory, icd10Map map[int]Icd10Entry, idMap map[int]string,
+	name string) {
 	file, err := os.Create(name)
 	if err != nil {
 		panic(err)
@@ -78,12 +80,29 @@ func printTrajectoriesToTabFile(trajectories []*Trajectory, icd10Map map[int]Icd
 			}
 		}
 		fmt.Fprintf(file, line)
+		codes := make([]string, len(nodes))
+		for i, node := range nodes {
+			codes[i] = idMap[node]
+		}
+		fmt.Fprintln(file, strings.Join(codes, "\t"))
 	}
 }
 
+// pairsHeader returns the names of the columns that the pairs files have in common, cf. printStratumPair.
+func pairsHeader() []string {
+	header := append([]string{"term1", "term2", "RR"}, statsHeader...)
+	return append(header, "patients", "code1", "code2")
+}
+
 // printPairsToTableFile prints the diagnosis pairs and the associated relative risks scores in a human-readable format
-// to a tab file. For each diagnosis pair, it prints one line that lists the medical terms for the diagnoses and the
-// relative risk score: term1 tab term2 tab RR.
+// to a tab file. For each diagnosis pair, it prints one line that lists the medical terms for the diagnoses, the
+// relative risk score, its statistics, the nr of patients diagnosed with the pair, the codes of the diagnoses, the
+// p-value of the directionality of the pair, the effect size of the metric of the experiment, 1 if the pair is rare, 0
+// otherwise, the population attributable fraction, and the excess incidence per 1000 patient-years:
+// term1 tab term2 tab RR tab p-value tab CI low tab CI high tab exposed tab exposed d2 tab comparison d2 tab patients
+// tab code1 tab code2 tab directionality tab effect tab rare tab PAF tab excess incidence, cf. RRStats,
+// directionality.go, metric.go, rare-pairs.go, and attributable-risk.go. The first line is a header that names the
+// columns, cf. pairsHeader.
 func printPairsToTabFile(exp *Experiment, name string) {
 	pairs := exp.Pairs
 	file, err := os.Create(name)
@@ -95,9 +114,22 @@ func printPairsToTabFile(exp *Experiment, name string) {
 			panic(err)
 		}
 	}()
+	header := append(pairsHeader(), "directionality", "effect", "rare", "paf", "excessIncidence")
+	fmt.Fprintln(file, strings.Join(header, "\t"))
 	for _, pair := range pairs {
-		fmt.Fprintf(file, "%s\t%s\t%s\n", exp.Icd10Map[pair.First].Name, exp.Icd10Map[pair.Second].Name,
-			strconv.FormatFloat(exp.DxDRR[pair.First][pair.Second], 'E', -1, 64))
+		patients := exp.pairPatientCount(pair.First, pair.Second)
+		rare := 0
+		if exp.rare(pair.First, pair.Second) {
+			rare = 1
+		}
+		fmt.Fprintf(file, "%s\t%s\t%s\t%s\t%v\t%s\t%s\t%s\t%s\t%d\t%s\t%s\n", exp.Icd10Map[pair.First].Name,
+			exp.Icd10Map[pair.Second].Name, strconv.FormatFloat(exp.DxDRR[pair.First][pair.Second], 'E', -1, 64),
+			strings.Join(exp.cellColumns(exp.rrStats(pair.First, pair.Second)), "\t"),
+			exp.cellValue(patients, formatCount(patients)), exp.IdMap[pair.First], exp.IdMap[pair.Second],
+			strconv.FormatFloat(exp.directionality(pair.First, pair.Second), 'E', -1, 64),
+			strconv.FormatFloat(exp.effect(pair.First, pair.Second), 'E', -1, 64), rare,
+			strconv.FormatFloat(exp.attributableFraction(pair.First, pair.Second), 'E', -1, 64),
+			strconv.FormatFloat(exp.excessIncidence(pair.First, pair.Second), 'E', -1, 64))
 	}
 }
 
@@ -137,7 +169,9 @@ func convertTrajectoriesToGraph(exp *Experiment) ([]int, [][][]int) {
 	return nodes, am
 }
 
-func printTrajectory(trajectory *Trajectory, exp *Experiment, w io.Writer) {
+// printTrajectory prints the nodes and edges of a trajectory in GML. If clustered, the edges carry the cluster of the
+// trajectory.
+func printTrajectory(trajectory *Trajectory, exp *Experiment, clustered bool, w io.Writer) {
 	TID := trajectory.ID
 	diagnoses := trajectory.Diagnoses
 	icd10Map := exp.Icd10Map
@@ -145,7 +179,8 @@ func printTrajectory(trajectory *Trajectory, exp *Experiment, w io.Writer) {
 	// print nodes
 	for _, node := range diagnoses {
 		icd10 := icd10Map[node]
-		fmt.Fprintf(w, "\tnode [\n\t\tid %d\n\t\tlabel \"%s\"\n\t", node, icd10.Name)
+		fmt.Fprintf(w, "\tnode [\n\t\tid %d\n\t\tlabel \"%s\"\n\t\tcode \"%s\"\n\t", node, icd10.Name,
+			exp.IdMap[node])
 		fmt.Fprintf(w, "\tlevel %d\n", icd10.Level)
 		for idx, cat := range icd10.Categories {
 			if cat == "NONE" {
@@ -163,14 +198,23 @@ func printTrajectory(trajectory *Trajectory, exp *Experiment, w io.Writer) {
 		target := diagnoses[idx+1]
 		patients := trajectory.PatientNumbers[idx]
 		RR := strconv.FormatFloat(exp.DxDRR[source][target], 'f', 2, 64)
-		fmt.Fprintf(w, fmt.Sprintf("\tedge [\n\t\ttid %d\n\t\ttlen %d\n\t\ttidx %d\n\t\tsource %d\n\t\ttarget %d\n\t\tpatients %d\n\t\tRR \"%s\"\n\t]\n", TID, tlen, idx, source, target, patients, RR))
+		fmt.Fprintf(w, fmt.Sprintf("\tedge [\n\t\ttid %d\n\t\tthash \"%s\"\n\t\ttlen %d\n\t\ttidx %d\n\t\tsource %d\n\t\ttarget %d\n\t\tpatients %d\n\t\tRR \"%s\"\n", TID, trajectory.Hash, tlen, idx, source, target, patients, RR))
+		if gaps := trajectory.transitionGaps(idx); gaps != nil {
+			for _, gap := range gaps.attributes() {
+				fmt.Fprintf(w, "\t\t%s %d\n", gap.name, gap.days)
+			}
+		}
+		if clustered {
+			fmt.Fprintf(w, "\t\tcluster %d\n", trajectory.Cluster)
+		}
+		fmt.Fprintf(w, "\t]\n")
 	}
 }
 
-// printTrajectories plots all of an experiment's trajectories as a single graph to a GML file. The nodes
+// printTrajectories plots the given trajectories of an experiment as a single graph to a GML file. The nodes
 // in the graph are the medical terms for the diagnoses that make up the trajectories. The edges are derived from the
-// transitions between diagnoses in the trajectories.
-func printTrajectories(exp *Experiment, name string) {
+// transitions between diagnoses in the trajectories. If clustered, the edges carry the clusters of the trajectories.
+func printTrajectories(exp *Experiment, trajectories []*Trajectory, clustered bool, name string) {
 	file, err := os.Create(name)
 	if err != nil {
 		panic(err)
@@ -183,8 +227,8 @@ func printTrajectories(exp *Experiment, name string) {
 
 	// open graph
 	fmt.Fprintf(file, "graph [\n\tdirected 1\n\tmultigraph 1\n")
-	for _, t := range exp.Trajectories {
-		printTrajectory(t, exp, file)
+	for _, t := range trajectories {
+		printTrajectory(t, exp, clustered, file)
 	}
 	// close graph
 	fmt.Fprintf(file, "]\n")
@@ -205,7 +249,7 @@ func printIndividualTrajectories(exp *Experiment, name string) {
 	for _, t := range exp.Trajectories {
 		// new graph per trajectory
 		fmt.Fprintf(file, "graph [\n\tdirected 1\n\tmultigraph 1\n")
-		printTrajectory(t, exp, file)
+		printTrajectory(t, exp, false, file)
 		// close graph
 		fmt.Fprintf(file, "]\n")
 	}
@@ -216,6 +260,11 @@ func printIndividualTrajectories(exp *Experiment, name string) {
 // - A tab file containing all disease pairs and their relative risk scores (medical terms + float for RR)
 // - A GML file with one graph representing all trajectories
 // - A GML file where each trajectory is represented as an individual subgraph
+// - GraphML files with the same graphs as the GML files
+// - A DOT file with the merged graph, for rendering with Graphviz
+// - A json file with a Plotly Sankey diagram of the flow of patients through the trajectories
+// - A json file and a text file with the trajectories merged into a prefix forest
+// - With an index date, a tab file containing trajectories with the mean years since the index date for each diagnosis
 func (exp *Experiment) PrintTrajectoriesToFile(path string) {
 	// print the trajectories to file
 	// create a file where all trajectories are separate graphs
@@ -223,13 +272,28 @@ func (exp *Experiment) PrintTrajectoriesToFile(path string) {
 	// create a file that just has each trajectory as a tab seperated list of disease codes
 	os.Mkdir(path, 0700)
 	tabFileName := filepath.Join(path, fmt.Sprintf("%s-trajectories.tab", exp.Name))
-	printTrajectoriesToTabFile(exp.Trajectories, exp.Icd10Map, tabFileName)
+	printTrajectoriesToTabFile(exp.Trajectories, exp.Icd10Map, exp.IdMap, tabFileName)
 	tabFileName2 := filepath.Join(path, fmt.Sprintf("%s-pairs.tab", exp.Name))
 	printPairsToTabFile(exp, tabFileName2)
 	graphFileName := filepath.Join(path, fmt.Sprintf("%s-trajectories-merged-graph.gml", exp.Name))
-	printTrajectories(exp, graphFileName)
+	printTrajectories(exp, exp.Trajectories, false, graphFileName)
 	graphsFileName := filepath.Join(path, fmt.Sprintf("%s-trajectories-individual-graphs.gml", exp.Name))
 	printIndividualTrajectories(exp, graphsFileName)
+	graphMLFileName := filepath.Join(path, fmt.Sprintf("%s-trajectories-merged-graph.graphml", exp.Name))
+	printTrajectoriesGraphML(exp, exp.Trajectories, false, graphMLFileName)
+	graphsMLFileName := filepath.Join(path, fmt.Sprintf("%s-trajectories-individual-graphs.graphml", exp.Name))
+	printIndividualTrajectoriesGraphML(exp, graphsMLFileName)
+	dotFileName := filepath.Join(path, fmt.Sprintf("%s-trajectories-merged-graph.dot", exp.Name))
+	printTrajectoriesDot(exp, exp.Trajectories, dotFileName)
+	sankeyFileName := filepath.Join(path, fmt.Sprintf("%s-trajectories-sankey.json", exp.Name))
+	printTrajectoriesSankey(exp, sankeyFileName)
+	treeFileName := filepath.Join(path, fmt.Sprintf("%s-trajectories-tree.json", exp.Name))
+	treeTextFileName := filepath.Join(path, fmt.Sprintf("%s-trajectories-tree.txt", exp.Name))
+	printTrajectoriesTree(exp, treeFileName, treeTextFileName)
+	for _, fileName := range []string{tabFileName, tabFileName2, graphFileName, graphsFileName, graphMLFileName,
+		graphsMLFileName, dotFileName, sankeyFileName, treeFileName, treeTextFileName} {
+		exp.Audit.Wrote(fileName, false)
+	}
 }
 
 // collectClusters returns a map from cluster ID to a set of trajectories that belong to that cluster
@@ -246,11 +310,16 @@ func collectClusters(exp *Experiment) map[int][]*Trajectory {
 }
 
 // PrintClusteredTrajectoriesToFile plots the trajectories of an experiment to a tab file, including for each trajectory
-// information about the cluster a trajectory belongs to. For each trajectory it prints 3 lines:
+// information about the cluster a trajectory belongs to. For each cluster it prints a line with the cluster ID, the nr
+// of patients, and the nr of trajectories: CID: \tab nr \tab Patients: \tab nr \tab Trajectories: \tab nr, followed by a
+// line per enriched feature of the cluster, cf. ClusterBackground.Enrichment: Enrichment: \tab feature \tab nr of
+// patients of the cluster with the feature \tab nr of patients of the cluster \tab nr of patients of the population with
+// the feature \tab nr of patients of the population \tab fold \tab p-value. There are no enrichment lines if the
+// background is nil. For each trajectory of the cluster it prints 3 lines:
 // - A line with the cluster ID and the trajectory ID: CID: \tab nr \tab TID: \tab nr.
 // - A list of medical terms for the diagnoses: term1 \tab term2 ...\tab termn.
 // - A list of patient numbers for the transitions between diagnosis pairs: nr1->2 \tab nr2->3 ...\tab nrn-1->n.
-func PrintClusteredTrajectoriesToFile(exp *Experiment, name string) {
+func PrintClusteredTrajectoriesToFile(exp *Experiment, background *ClusterBackground, name string) {
 	// plots a line with cluster ID, trajectory ID
 	// plots a line with trajectory
 	// plots a line with trajectory labels (= nr of patients)
@@ -266,16 +335,19 @@ func PrintClusteredTrajectoriesToFile(exp *Experiment, name string) {
 	clusters := collectClusters(exp)
 	for i := 0; i < len(clusters); i++ {
 		c := clusters[i]
-		// print out metrics of the c
-		ageMean, stdev, ageEOIMean, stdev2, mCtr, fCtr := MetricsFromTrajectories(c)
-		line := fmt.Sprintf("CID:\t%d\tMean Age:\t%s\tStdev:\t%s\tMean Age EOI:\t%s\tStdev:\t%s\tMales:\t%d\tFemales:\t%d\tTrajectories:\t%d\n",
-			i,
-			strconv.FormatFloat(ageMean, 'f', 2, 64),
-			strconv.FormatFloat(stdev, 'f', 2, 64),
-			strconv.FormatFloat(ageEOIMean, 'f', 2, 64),
-			strconv.FormatFloat(stdev2, 'f', 2, 64), mCtr, fCtr, len(c))
-		fmt.Fprintf(file, line)
-		line = ""
+		// print out the size and the enrichment of the cluster
+		nofPatients := len(clusterPatients(c))
+		fmt.Fprintf(file, "CID:\t%d\tPatients:\t%v\tTrajectories:\t%d\n", i,
+			exp.cellValue(float64(nofPatients), nofPatients), len(c))
+		if background != nil {
+			for _, e := range background.Enrichment(exp, c) {
+				fmt.Fprintf(file, "Enrichment:\t%s\t%v\t%v\t%v\t%d\t%s\t%s\n", e.Feature,
+					exp.cellValue(float64(e.Patients), e.Patients), exp.cellValue(float64(e.ClusterSize), e.ClusterSize),
+					exp.cellValue(float64(e.Background), e.Background), e.Population,
+					strconv.FormatFloat(e.Fold(), 'f', 2, 64), formatRRFloat(e.PValue))
+			}
+		}
+		line := ""
 		// print the trajectories to tab file
 		for _, trajectory := range c {
 			nodes := trajectory.Diagnoses
@@ -310,7 +382,8 @@ func PrintClusteredTrajectoriesToFile(exp *Experiment, name string) {
 
 // PrintClustersToCSVFiles prints the experiment clusters to a CSV file. It creates two output files:
 // - A CSV file with patient information. The header is: PID,AgeEOI,Sex,PIDString. This represents: patient analysis id,
-// age at which the event of interest occurred, sex, and the TriNetX patient id.
+// age at which the event of interest occurred, sex, and the TriNetX patient id. If the experiment has a pseudonymizer,
+// the TriNetX patient id is replaced by its pseudonym.
 // - A CSV file with cluster information. The header is: PID,CID,TID,Age. This represents: patient id, cluster id,
 // trajectory id, and age of the patient when matching the trajectory.
 func PrintClustersToCSVFiles(exp *Experiment, pName, cName string) {
@@ -335,7 +408,7 @@ func PrintClustersToCSVFiles(exp *Experiment, pName, cName string) {
 				} else {
 					sex = "F"
 				}
-				fmt.Fprintf(pFile, "%d,%d,%s,%s\n", p.PID, ageEOI, sex, p.PIDString)
+				fmt.Fprintf(pFile, "%d,%d,%s,%s\n", p.PID, ageEOI, sex, exp.Pseudonymizer.Pseudonym(p.PIDString))
 			}
 		}
 	}
@@ -343,6 +416,7 @@ func PrintClustersToCSVFiles(exp *Experiment, pName, cName string) {
 	if err := pFile.Close(); err != nil {
 		panic(err)
 	}
+	exp.Audit.Wrote(pName, true)
 	// print the cluster information to a CSV file containing:
 	// PID,CID,TID
 	cFile, err := os.Create(cName)
@@ -363,4 +437,5 @@ func PrintClustersToCSVFiles(exp *Experiment, pName, cName string) {
 			fmt.Fprintf(cFile, "%d,%d,%d,%d\n", p.PID, t.Cluster, t.ID, age)
 		}
 	}
+	exp.Audit.Wrote(cName, true)
 }
@@ -0,0 +1,175 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	crand "crypto/rand"
+	"fmt"
+	"math"
+	"math/rand/v2"
+)
+
+// Experimental differential privacy (DP) mode. When enabled, the statistics that leave the site (RR scores of diagnosis
+// pairs and patient counts of trajectory transitions) are perturbed with Laplace noise. The total privacy budget epsilon
+// is split evenly between the RR matrix and the trajectory patient counts, and each half is in turn split evenly over
+// the statistics it covers (sequential composition), so that epsilon is the sum of the epsilons spent on the noise of
+// the individual statistics. The noise is calibrated to a fixed sensitivity that does not depend on the data, since
+// noise that depends on a private count would itself reveal that count.
+//
+// This mode does not give a formal epsilon-DP guarantee for the run as a whole. Which RR scores and trajectories are
+// released still depends on exact counts: the diagnosis pairs are selected on their exact p-values, and the
+// trajectories are built from the exact patients of the pairs (DxDPatients) against minPatients, so that a single
+// patient can add or remove a pair or a trajectory from the outputs. The sensitivity of log(RR) is not bounded by a
+// constant either, cf. ApplyRRNoise. The epsilon reported in the run manifest therefore only accounts for the noise on
+// the released values. The mode makes it harder to recover exact counts from the outputs, and is best combined with a
+// minimum cell size, cf. small-cells.go.
+
+// PrivacyBudget records how the privacy budget of a DP run was spent. It is reported in the run manifest.
+type PrivacyBudget struct {
+	Mechanism        string  `json:"mechanism"`        // noise mechanism, e.g. laplace
+	Epsilon          float64 `json:"epsilon"`          // total privacy budget of the noise, not a bound for the run
+	RREpsilon        float64 `json:"rrEpsilon"`        // part of the budget spent on the RR matrix
+	CountEpsilon     float64 `json:"countEpsilon"`     // part of the budget spent on trajectory patient counts
+	RRSensitivity    float64 `json:"rrSensitivity"`    // sensitivity assumed for a single log(RR) score
+	CountSensitivity float64 `json:"countSensitivity"` // sensitivity assumed for a single patient count
+	RRStatEpsilon    float64 `json:"rrStatEpsilon"`    // part of the budget spent on each RR score
+	CountStatEpsilon float64 `json:"countStatEpsilon"` // part of the budget spent on each patient count
+	NoisedRRs        int     `json:"noisedRRs"`        // nr of RR scores that were perturbed
+	NoisedCounts     int     `json:"noisedCounts"`     // nr of patient counts that were perturbed
+}
+
+// NewPrivacyBudget creates a privacy budget for a given epsilon, split evenly between RR scores and patient counts.
+func NewPrivacyBudget(epsilon float64) *PrivacyBudget {
+	if epsilon <= 0 {
+		panic(fmt.Sprint("Differential privacy epsilon must be positive, but is: ", epsilon))
+	}
+	return &PrivacyBudget{
+		Mechanism:        "laplace",
+		Epsilon:          epsilon,
+		RREpsilon:        epsilon / 2.0,
+		CountEpsilon:     epsilon / 2.0,
+		RRSensitivity:    1.0,
+		CountSensitivity: 1.0,
+	}
+}
+
+// rrNoiseScale returns the scale of the Laplace noise added to each log(RR) score, once the budget of the RR matrix is
+// split over its scores.
+func (budget *PrivacyBudget) rrNoiseScale() float64 {
+	return budget.RRSensitivity / budget.RRStatEpsilon
+}
+
+// countNoiseScale returns the scale of the Laplace noise added to each patient count, once the budget of the patient
+// counts is split over the counts.
+func (budget *PrivacyBudget) countNoiseScale() float64 {
+	return budget.CountSensitivity / budget.CountStatEpsilon
+}
+
+// noiseRand returns a random generator for drawing noise. Unlike the generators of Experiment.Rand, it is seeded from
+// crypto/rand rather than from the seed of the experiment, since the seed is recorded in the run manifest, and anyone
+// who can regenerate the noise can subtract it from the outputs.
+func noiseRand() *rand.Rand {
+	var seed [32]byte
+	if _, err := crand.Read(seed[:]); err != nil {
+		panic(err)
+	}
+	return rand.New(rand.NewChaCha8(seed))
+}
+
+// laplaceNoise draws a sample from a Laplace distribution centered at 0 with the given scale.
+func laplaceNoise(rng *rand.Rand, scale float64) float64 {
+	return scale * (rng.ExpFloat64() - rng.ExpFloat64())
+}
+
+// noisyCount perturbs a patient count with Laplace noise of the given scale. The result is rounded and clamped at 0 so
+// that it remains a valid count.
+func noisyCount(rng *rand.Rand, n int, scale float64) int {
+	noisy := math.Round(float64(n) + laplaceNoise(rng, scale))
+	if noisy < 0 {
+		return 0
+	}
+	return int(noisy)
+}
+
+// released reports whether an RR score is released as a statistic. RR scores that were never computed (RR = 1.0) are
+// not.
+func released(RR float64) bool {
+	return RR != 1.0 && RR > 0.0
+}
+
+// ApplyRRNoise perturbs the RR scores of an experiment. The noise is added to log(RR). Adding an exposed patient
+// diagnosed with the pair changes log(RR) by about log(1+1/a) <= 1, with a >= 1 the number of patients diagnosed with
+// the pair, so the sensitivity is fixed at 1 rather than calibrated to a, so that the noise does not reveal a. This is
+// not a bound for every neighbouring dataset: removing the only patient diagnosed with a pair removes its RR score, and
+// a patient in the comparison groups changes the other cells of the 2x2 table, which are not bounded away from 0.
+func (exp *Experiment) ApplyRRNoise(budget *PrivacyBudget) {
+	nofRRs := 0
+	for _, js := range exp.DxDRR {
+		for _, RR := range js {
+			if released(RR) {
+				nofRRs++
+			}
+		}
+	}
+	budget.RRStatEpsilon = budget.RREpsilon / math.Max(1, float64(nofRRs))
+	fmt.Println("Adding differential privacy noise to ", nofRRs, " RR scores with epsilon: ", budget.RREpsilon,
+		" (", budget.RRStatEpsilon, " per score)")
+	rng := noiseRand()
+	scale := budget.rrNoiseScale()
+	for i, js := range exp.DxDRR {
+		for j, RR := range js {
+			if !released(RR) {
+				continue
+			}
+			exp.DxDRR[i][j] = RR * math.Exp(laplaceNoise(rng, scale))
+			budget.NoisedRRs++
+		}
+	}
+	exp.DxDStats = nil // the statistics are derived from the exact counts
+	exp.DxDHazardRatios = nil
+	exp.Privacy = budget
+}
+
+// pairPatientCount returns the nr of patients diagnosed with the pair d1 -> d2, or NaN in differential privacy mode, since
+// the exact count is not perturbed.
+func (exp *Experiment) pairPatientCount(d1, d2 int) float64 {
+	if exp.Privacy != nil {
+		return math.NaN()
+	}
+	return float64(len(exp.DxDPatients[d1][d2]))
+}
+
+// ApplyCountNoise perturbs the patient numbers of all trajectory transitions of an experiment.
+func (exp *Experiment) ApplyCountNoise(budget *PrivacyBudget) {
+	nofCounts := 0
+	for _, t := range exp.Trajectories {
+		nofCounts += len(t.PatientNumbers)
+	}
+	budget.CountStatEpsilon = budget.CountEpsilon / math.Max(1, float64(nofCounts))
+	fmt.Println("Adding differential privacy noise to ", nofCounts, " trajectory patient counts with epsilon: ",
+		budget.CountEpsilon, " (", budget.CountStatEpsilon, " per count)")
+	rng := noiseRand()
+	scale := budget.countNoiseScale()
+	for _, t := range exp.Trajectories {
+		for i, n := range t.PatientNumbers {
+			t.PatientNumbers[i] = noisyCount(rng, n, scale)
+			budget.NoisedCounts++
+		}
+	}
+}
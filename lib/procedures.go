@@ -0,0 +1,164 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Procedures as events. Procedures from a procedure file, coded in CPT or HCPCS, are grouped into medically meaningful
+// procedure groups with a grouping table, e.g. all CPT codes of cystectomies. Each procedure group gets its own analysis
+// DID, after the diagnosis codes, and the procedures are added as diagnoses of the patients, so that surgical and
+// imaging procedures are part of the trajectories as any other event. This generalizes the treatment file, which only
+// knows three bladder cancer treatments.
+
+// Code systems of procedure codes.
+const (
+	CodeSystemCPT   = "CPT"
+	CodeSystemHCPCS = "HCPCS"
+)
+
+// procedureGroupRule assigns procedure codes of a code system to a procedure group. The codes are a single code, or a
+// range of codes of the same length, e.g. 51550-51597.
+type procedureGroupRule struct {
+	codeSystem  string // empty for all code systems
+	first, last string
+	group       string
+}
+
+// matches checks if a procedure code is assigned to the group of the rule.
+func (rule procedureGroupRule) matches(codeSystem, code string) bool {
+	if rule.codeSystem != "" && !strings.EqualFold(rule.codeSystem, codeSystem) {
+		return false
+	}
+	return len(code) == len(rule.first) && code >= rule.first && code <= rule.last
+}
+
+// parseProcedureGroups reads a procedure grouping table: a csv file with a header, and the code_system, code, and group
+// columns. The code is a single code or a range of codes, e.g. 51550-51597. A code may belong to several groups.
+func parseProcedureGroups(file string) []procedureGroupRule {
+	var rules []procedureGroupRule
+	err := readCSVTable(file, []string{"code_system", "code", "group"}, func(values []string) {
+		if values[1] == "" || values[2] == "" {
+			return
+		}
+		first, last, ok := strings.Cut(values[1], "-")
+		if !ok {
+			last = first
+		}
+		rules = append(rules, procedureGroupRule{codeSystem: values[0], first: strings.TrimSpace(first),
+			last: strings.TrimSpace(last), group: values[2]})
+	})
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println("Parsed ", len(rules), " procedure grouping rules.")
+	return rules
+}
+
+// addEventCodes adds an analysis DID for each of the given events to the maps of the experiment, after the given number
+// of diagnosis codes. The events are sorted by name, so that the same input always results in the same analysis DIDs.
+// In the map of analysis DIDs onto input codes, the events are prefixed with the given prefix, e.g. PROC:. Events that
+// already have an analysis DID, e.g. from a saved experiment state, keep it. It returns a map event -> analysis DID, and
+// the new number of diagnosis codes.
+func addEventCodes(events map[string]bool, prefix string, icd10Map map[int]Icd10Entry, idMap map[int]string,
+	nofDiagnosisCodes int) (map[string]int, int) {
+	eventDIDs := map[string]int{}
+	for did, code := range idMap {
+		if event, ok := strings.CutPrefix(code, prefix); ok && events[event] {
+			eventDIDs[event] = did
+		}
+	}
+	for _, event := range sortedKeys(events) {
+		if _, ok := eventDIDs[event]; ok {
+			continue
+		}
+		did := nofDiagnosisCodes
+		nofDiagnosisCodes++
+		eventDIDs[event] = did
+		icd10Map[did] = Icd10Entry{Name: event}
+		idMap[did] = prefix + event
+	}
+	return eventDIDs, nofDiagnosisCodes
+}
+
+// parseTriNetXProcedures parses a TriNetX procedure file, and adds the procedures that belong to a procedure group as
+// diagnoses of the given patients. The header is omitted from the file, but it should be: patient_id, encounter_id,
+// code_system, code, principal_procedure_indicator, date, derived_by_TriNetX, source_id. The procedure groups are read
+// from the given grouping table. It returns the new number of diagnosis codes.
+func parseTriNetXProcedures(procedureFile, procedureGroupsFile string, patients *PatientMap,
+	icd10Map map[int]Icd10Entry, idMap map[int]string, nofDiagnosisCodes int, report *ValidationReport) int {
+	if procedureGroupsFile == "" {
+		panic("A procedure file requires a procedure grouping table")
+	}
+	rules := parseProcedureGroups(procedureGroupsFile)
+	groups := map[string]bool{}
+	for _, rule := range rules {
+		groups[rule.group] = true
+	}
+	groupDIDs, nofDiagnosisCodes := addEventCodes(groups, "PROC:", icd10Map, idMap, nofDiagnosisCodes)
+	file, err := openInput(procedureFile)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	rows := newRowReader(newCSVReader(file), procedureFile, checkTriNetXProcedureRow, report)
+	ctr, grouped, unknown := 0, 0, 0
+	changed := map[*Patient]bool{}
+	for {
+		record, err := rows.read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			panic(err)
+		}
+		ctr++
+		patient, ok := GetPatient(record[0], patients)
+		if !ok {
+			unknown++
+			continue //skip unknown patients
+		}
+		date := parseTriNetXDiagnosisDate(record[triNetXProcedureDate])
+		found := false
+		for _, rule := range rules {
+			if rule.matches(record[2], record[3]) {
+				patient.AddDiagnosis(&Diagnosis{PID: patient.PID, DID: groupDIDs[rule.group], Date: date})
+				found = true
+			}
+		}
+		if found {
+			grouped++
+			changed[patient] = true
+		}
+	}
+	for patient := range changed {
+		SortDiagnoses(patient)
+		CompactDiagnoses(patient)
+	}
+	fmt.Println("Parsed ", ctr, " procedures of which ", grouped, " in ", len(groupDIDs), " procedure groups, and ",
+		unknown, " of unknown patients.")
+	return nofDiagnosisCodes
+}
@@ -0,0 +1,290 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+)
+
+// Data quality profiling of the input files, for the ptra profile command. The profile summarizes the fitness of a
+// dataset before running a long experiment: the malformed rows and unparsable dates per input file, the patients
+// without year of birth, the diagnosis codes that do not map onto the vocabulary, the diagnoses before birth or after
+// death, and the distribution of the nr of distinct codes per patient. It is written as a csv file and an html page.
+
+// Names of the files written by the profile command.
+const (
+	ProfileCSVFile  = "profile.csv"
+	ProfileHTMLFile = "profile.html"
+)
+
+// profileTopCodes is the nr of most frequent unmapped codes listed in a profile.
+const profileTopCodes = 20
+
+// codesPerPatientBins are the upper bounds of the bins of the histogram of the nr of codes per patient.
+var codesPerPatientBins = []int{0, 1, 5, 10, 20, 50, 100}
+
+// ProfileMetric is a row of a data quality profile.
+type ProfileMetric struct {
+	Section string // the input file or the aspect of the data that is profiled
+	Metric  string
+	Value   string
+}
+
+// DataProfile is the data quality profile of a dataset.
+type DataProfile struct {
+	Integrity       *IntegrityReport // the problems found by the validation of the input
+	MissingYOB      int              // nr of patients without year of birth
+	BadDates        map[string]int   // nr of rows with unparsable dates per input file
+	CodesPerPatient []int            // nr of distinct diagnosis codes per patient, sorted
+}
+
+// countMissingYOB counts the well-formed rows of a TriNetX patient file without a year of birth. Such patients are
+// skipped by the parser.
+func countMissingYOB(file string) int {
+	csvFile, err := openInput(file)
+	if err != nil {
+		panic(err)
+	}
+	defer csvFile.Close()
+	rows := newRowReader(newCSVReader(csvFile), file, checkTriNetXPatientRow, nil)
+	count := 0
+	for {
+		record, err := rows.read()
+		if err == io.EOF {
+			return count
+		}
+		if err != nil {
+			panic(err)
+		}
+		if isMissing(record[4]) {
+			count++
+		}
+	}
+}
+
+// newDataProfile computes the profile of the patients and the report of the validation of their input files.
+func newDataProfile(report *IntegrityReport, patients *PatientMap, patientFile string) *DataProfile {
+	profile := &DataProfile{Integrity: report, MissingYOB: countMissingYOB(patientFile), BadDates: map[string]int{}}
+	for file, reasons := range report.Validation.FileReasons {
+		if rows := reasons[ReasonBadDate]; rows > 0 {
+			profile.BadDates[file] = rows
+		}
+	}
+	for _, p := range patients.PIDMap {
+		codes := map[int]bool{}
+		for _, d := range p.Diagnoses {
+			codes[d.DID] = true
+		}
+		profile.CodesPerPatient = append(profile.CodesPerPatient, len(codes))
+	}
+	sort.Ints(profile.CodesPerPatient)
+	return profile
+}
+
+// percentile returns the p-th percentile of a sorted list of counts, 0 for an empty list.
+func percentile(sorted []int, p float64) int {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[int(p*float64(len(sorted)-1))]
+}
+
+// Metrics returns the rows of the profile, grouped per section.
+func (profile *DataProfile) Metrics() []*ProfileMetric {
+	var metrics []*ProfileMetric
+	add := func(section, metric string, value interface{}) {
+		metrics = append(metrics, &ProfileMetric{Section: section, Metric: metric, Value: fmt.Sprint(value)})
+	}
+	report := profile.Integrity
+	for _, file := range report.Validation.Files {
+		add(file, "rows", report.Validation.Rows[file])
+		add(file, "malformed rows", report.Validation.BadRows[file])
+		add(file, "rows with unparsable dates", profile.BadDates[file])
+	}
+	add("patients", "patients with year of birth", report.Patients)
+	add("patients", "patients without year of birth", profile.MissingYOB)
+	for _, file := range sortedKeys(report.UnknownPatients) {
+		add("patients", "patients in "+file+" not in the patient file", report.UnknownPatients[file])
+	}
+	add("diagnoses", "rows parsed", report.Unmapped.Rows)
+	for _, codeSystem := range sortedKeys(report.Unmapped.CodeSystems) {
+		add("diagnoses", "rows of code system "+codeSystem, report.Unmapped.CodeSystems[codeSystem])
+	}
+	add("diagnoses", "rows dropped", report.Unmapped.Dropped)
+	for _, reason := range sortedKeys(report.Unmapped.Reasons) {
+		add("diagnoses", "rows dropped: "+reason, report.Unmapped.Reasons[reason])
+	}
+	for _, check := range temporalChecks {
+		if summary, ok := report.Validation.Checks[check]; ok {
+			add("diagnoses", check, summary.Flagged)
+		}
+	}
+	for i, code := range report.Unmapped.SortedCodes() {
+		if i == profileTopCodes {
+			break
+		}
+		add("unmapped codes", fmt.Sprint(code.CodeSystem, " ", code.Code, " (", code.Reason, ")"), code.Count)
+	}
+	counts := profile.CodesPerPatient
+	total := 0
+	for _, count := range counts {
+		total += count
+	}
+	mean := 0.0
+	if len(counts) > 0 {
+		mean = float64(total) / float64(len(counts))
+	}
+	add("codes per patient", "mean", fmt.Sprintf("%.2f", mean))
+	for _, p := range []struct {
+		name string
+		p    float64
+	}{{"min", 0}, {"25th percentile", 0.25}, {"median", 0.5}, {"75th percentile", 0.75}, {"95th percentile", 0.95},
+		{"max", 1}} {
+		add("codes per patient", p.name, percentile(counts, p.p))
+	}
+	lower := 0
+	for _, upper := range append(codesPerPatientBins, -1) {
+		bin := 0
+		for _, count := range counts {
+			if count >= lower && (upper == -1 || count <= upper) {
+				bin++
+			}
+		}
+		switch {
+		case upper == -1:
+			add("codes per patient", fmt.Sprint("patients with more than ", lower-1, " codes"), bin)
+		case lower == upper:
+			add("codes per patient", fmt.Sprint("patients with ", upper, " codes"), bin)
+		default:
+			add("codes per patient", fmt.Sprint("patients with ", lower, "-", upper, " codes"), bin)
+		}
+		lower = upper + 1
+	}
+	return metrics
+}
+
+// SaveCSV writes the profile to a csv file with the columns Section, Metric, and Value.
+func (profile *DataProfile) SaveCSV(path string) {
+	writeMetricsCSV(profile.Metrics(), path)
+}
+
+// writeMetricsCSV writes a list of metrics to a csv file with the columns Section, Metric, and Value.
+func writeMetricsCSV(metrics []*ProfileMetric, path string) {
+	file, err := os.Create(path)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	writer := csv.NewWriter(file)
+	writer.Write([]string{"Section", "Metric", "Value"})
+	for _, metric := range metrics {
+		writer.Write([]string{metric.Section, metric.Metric, metric.Value})
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		panic(err)
+	}
+}
+
+// profileTemplate is the html page of a profile, with a table per section.
+var profileTemplate = template.Must(template.New("profile").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>ptra data quality profile</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+td, th { border: 1px solid #ccc; padding: 0.2em 0.6em; text-align: left; }
+td.value { text-align: right; }
+</style>
+</head>
+<body>
+<h1>ptra data quality profile</h1>
+{{range .}}<h2>{{.Section}}</h2>
+<table>
+{{range .Metrics}}<tr><td>{{.Metric}}</td><td class="value">{{.Value}}</td></tr>
+{{end}}</table>
+{{end}}</body>
+</html>
+`))
+
+// SaveHTML writes the profile to an html page.
+func (profile *DataProfile) SaveHTML(path string) {
+	type section struct {
+		Section string
+		Metrics []*ProfileMetric
+	}
+	var sections []*section
+	for _, metric := range profile.Metrics() {
+		if len(sections) == 0 || sections[len(sections)-1].Section != metric.Section {
+			sections = append(sections, &section{Section: metric.Section})
+		}
+		sections[len(sections)-1].Metrics = append(sections[len(sections)-1].Metrics, metric)
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	if err := profileTemplate.Execute(file, sections); err != nil {
+		panic(err)
+	}
+}
+
+// ProfileInput validates the input files, cf. ValidateInput, and writes the data quality profile of the input to
+// profile.csv and profile.html in the output path.
+func ProfileInput(params *ValidateParams, outputPath string) (profile *DataProfile, err error) {
+	defer func() {
+		// converts any panics into errors, as for Run
+		if r := recover(); r != nil {
+			fmt.Println("Recovered from panic during profiling: ", r)
+			err = errors.New(fmt.Sprintf("%v", r))
+			fmt.Println(string(debug.Stack()))
+		}
+	}()
+	report, patients, err := validateInput(params)
+	if err != nil {
+		return nil, err
+	}
+	profile = newDataProfile(report, patients, params.PatientInfo)
+	if err := os.MkdirAll(outputPath, 0755); err != nil {
+		return nil, err
+	}
+	profile.SaveCSV(filepath.Join(outputPath, ProfileCSVFile))
+	profile.SaveHTML(filepath.Join(outputPath, ProfileHTMLFile))
+	fmt.Println("Wrote data quality profile to ", outputPath)
+	return profile, nil
+}
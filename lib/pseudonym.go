@@ -0,0 +1,150 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+)
+
+// Pseudonymization of patient identifiers. Output files that list patients normally contain the patient identifiers
+// from the input (PIDString). A Pseudonymizer replaces these by salted hashes or by study-specific pseudonyms, so that
+// the outputs can be shared outside the secure environment. The link between pseudonyms and the original identifiers
+// can optionally be saved to a separate mapping file that should stay inside the secure environment.
+
+const (
+	PseudonymizeNone   = "none"      // keep the original identifiers
+	PseudonymizeHash   = "hash"      // replace identifiers by a salted hash (HMAC-SHA256)
+	PseudonymizeStudy  = "pseudonym" // replace identifiers by sequential study-specific pseudonyms
+	pseudonymHashBytes = 16          // nr of bytes of the HMAC to keep for a hashed identifier
+)
+
+// Pseudonymizer maps patient identifiers from the input onto pseudonyms. The same identifier is always mapped onto the
+// same pseudonym within a run.
+type Pseudonymizer struct {
+	Method     string            // none, hash or pseudonym
+	Prefix     string            // prefix for study-specific pseudonyms, e.g. the experiment name
+	salt       []byte            // key for the salted hashes
+	pseudonyms map[string]string // maps PIDString onto its pseudonym
+	ctr        int               // generator for study-specific pseudonyms
+	lock       sync.Mutex
+}
+
+// NewPseudonymizer creates a pseudonymizer for the given method. For the hash method, the salt is used as key. If no
+// salt is given, a random salt is generated, in which case hashed identifiers can only be linked back to the original
+// identifiers via the mapping file.
+func NewPseudonymizer(method, salt, prefix string) *Pseudonymizer {
+	switch method {
+	case "", PseudonymizeNone:
+		method = PseudonymizeNone
+	case PseudonymizeHash, PseudonymizeStudy:
+	default:
+		panic(fmt.Sprint("Unknown pseudonymization method: ", method))
+	}
+	key := []byte(salt)
+	if method == PseudonymizeHash && salt == "" {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			panic(err)
+		}
+	}
+	return &Pseudonymizer{Method: method, Prefix: prefix, salt: key, pseudonyms: map[string]string{}}
+}
+
+// Pseudonym returns the pseudonym for a patient identifier from the input.
+func (ps *Pseudonymizer) Pseudonym(pidString string) string {
+	if ps == nil || ps.Method == PseudonymizeNone {
+		return pidString
+	}
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	if pseudonym, ok := ps.pseudonyms[pidString]; ok {
+		return pseudonym
+	}
+	var pseudonym string
+	if ps.Method == PseudonymizeHash {
+		pseudonym = ps.hash(pidString)
+	} else {
+		ps.ctr++
+		pseudonym = fmt.Sprintf("%s%08d", ps.Prefix, ps.ctr)
+	}
+	ps.pseudonyms[pidString] = pseudonym
+	return pseudonym
+}
+
+// hash returns the salted hash of a patient identifier from the input.
+func (ps *Pseudonymizer) hash(pidString string) string {
+	mac := hmac.New(sha256.New, ps.salt)
+	mac.Write([]byte(pidString))
+	return hex.EncodeToString(mac.Sum(nil)[:pseudonymHashBytes])
+}
+
+// patientLookup returns a function that finds patients by the identifiers that a previous run wrote to a file it saved
+// for later runs, e.g. a state file. Hashed identifiers are found by hashing the identifiers of all patients, so that
+// they are only found with the same salt. The original identifiers, as written without pseudonymization, are always
+// found.
+func (ps *Pseudonymizer) patientLookup(patients *PatientMap) func(id string) (*Patient, bool) {
+	if ps == nil || ps.Method != PseudonymizeHash {
+		return func(id string) (*Patient, bool) {
+			return GetPatient(id, patients)
+		}
+	}
+	hashed := make(map[string]*Patient, len(patients.PIDMap))
+	for _, p := range patients.PIDMap {
+		hashed[ps.hash(p.PIDString)] = p
+	}
+	return func(id string) (*Patient, bool) {
+		if p, ok := hashed[id]; ok {
+			return p, true
+		}
+		return GetPatient(id, patients)
+	}
+}
+
+// SaveMapping writes the mapping from patient identifiers onto pseudonyms that were handed out during the run to a csv
+// file. The header is: PIDString,Pseudonym. This file allows re-identification and should be kept separately from the
+// shared outputs.
+func (ps *Pseudonymizer) SaveMapping(path string) {
+	file, err := os.Create(path)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	pidStrings := make([]string, 0, len(ps.pseudonyms))
+	for pidString := range ps.pseudonyms {
+		pidStrings = append(pidStrings, pidString)
+	}
+	sort.Strings(pidStrings)
+	fmt.Fprintf(file, "PIDString,Pseudonym\n")
+	for _, pidString := range pidStrings {
+		fmt.Fprintf(file, "%s,%s\n", pidString, ps.pseudonyms[pidString])
+	}
+}
@@ -0,0 +1,55 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+// Rare diagnosis pairs. The RR of d1 -> d2 compares the nr of d2 diagnoses in the exposed group with the nr in the
+// comparison group. For pairs with few d2 diagnoses in either group, the RR and its confidence interval are unstable:
+// if the comparison group has no d2 diagnoses, the RR is infinite. A continuity correction adds a small count to each
+// cell of the 2x2 table of such pairs, as in the Haldane-Anscombe correction, which shrinks their RR towards 1 so that it
+// stays finite. Pairs with fewer d2 diagnoses than a minimum count in either group, or with a zero cell, are flagged
+// as rare in the outputs, rather than silently reporting their extreme values.
+
+// hasZeroCell checks if the 2x2 table of an RR score with the given nr of exposed patients, which is also the size of
+// the comparison group, and nr of d2 diagnoses in the exposed and comparison group, has a zero cell.
+func hasZeroCell(exposed int, exposedD2, comparisonD2 float64) bool {
+	n := float64(exposed)
+	return exposedD2 == 0 || comparisonD2 == 0 || exposedD2 == n || comparisonD2 == n
+}
+
+// continuityCorrected returns the size of the groups and the nr of d2 diagnoses in the exposed and comparison group of
+// the 2x2 table of an RR score, with the given correction added to each cell if the table has a zero cell.
+func continuityCorrected(exposed int, exposedD2, comparisonD2, correction float64) (n, a, c float64) {
+	n, a, c = float64(exposed), exposedD2, comparisonD2
+	if correction > 0 && hasZeroCell(exposed, exposedD2, comparisonD2) {
+		n, a, c = n+2*correction, a+correction, c+correction
+	}
+	return n, a, c
+}
+
+// rare checks if d1 -> d2 is a rare pair: a pair of which the RR score has a zero cell, or fewer d2 diagnoses in the
+// exposed or comparison group than the minimum count of the experiment. Pairs without statistics are not rare.
+func (exp *Experiment) rare(d1, d2 int) bool {
+	stats := exp.rrStats(d1, d2)
+	if stats == nil {
+		return false
+	}
+	minCount := float64(exp.MinCount)
+	return hasZeroCell(stats.Exposed, stats.ExposedD2, stats.ComparisonD2) || stats.ExposedD2 < minCount ||
+		stats.ComparisonD2 < minCount
+}
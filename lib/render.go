@@ -0,0 +1,102 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Rendering of trajectory graphs to images, so that runs on headless servers give figures that can be viewed directly.
+// As for the clustering with mcl, an external binary is called: the dot binary of Graphviz, which must be on the PATH.
+// The figures are rendered from DOT files as written by printTrajectoriesDot. Since a graph of thousands of
+// trajectories is unreadable, a figure only shows the trajectories with the most patients.
+
+// Image formats of the rendered figures.
+const (
+	RenderSVG = "svg"
+	RenderPNG = "png"
+)
+
+// renderTopTrajectories is the nr of trajectories with the most patients that are shown in a figure.
+const renderTopTrajectories = 50
+
+// renderDot calls the dot binary to render a DOT file to an image in the given format, next to the DOT file. It returns
+// the file name of the image.
+func renderDot(dotFile, format string) (string, error) {
+	figure := strings.TrimSuffix(dotFile, ".dot") + "." + format
+	cmd := exec.Command("dot", "-T"+format, "-o", figure, dotFile)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := stderr.String(); len(msg) > 0 {
+			return "", errors.New(fmt.Sprintf("rendering failed: %s", msg))
+		}
+		return "", errors.New(fmt.Sprintf("rendering failed: missing Graphviz binary \"dot\": %v", err))
+	}
+	return figure, nil
+}
+
+// RenderTrajectoryGraphs renders figures of the trajectories of an experiment in the given image format, in the folder
+// name-figures of the output path: trajectories.format with the merged graph of the top trajectories, and with
+// clustering, a figure with the top trajectories of each cluster per granularity, clusters-I<g>/cluster<CID>.format.
+// The DOT files of the figures are kept next to them. It returns the file names of the rendered figures.
+func RenderTrajectoryGraphs(exp *Experiment, path, format string) ([]string, error) {
+	folder := filepath.Join(path, fmt.Sprintf("%s-figures", exp.Name))
+	if err := os.MkdirAll(folder, 0777); err != nil {
+		return nil, err
+	}
+	graphs := map[string][]*Trajectory{ // maps the DOT files onto their trajectories
+		filepath.Join(folder, "trajectories.dot"): exp.selectTrajectories(exp.Trajectories, renderTopTrajectories, 0),
+	}
+	trajectories := map[int]*Trajectory{}
+	for _, t := range exp.Trajectories {
+		trajectories[t.ID] = t
+	}
+	for _, clustering := range exp.Clusterings {
+		clusterFolder := filepath.Join(folder, fmt.Sprint("clusters-I", clustering.Granularity))
+		if err := os.MkdirAll(clusterFolder, 0777); err != nil {
+			return nil, err
+		}
+		for _, cluster := range clustering.Clusters {
+			var ts []*Trajectory
+			for _, tid := range cluster.Trajectories {
+				ts = append(ts, trajectories[tid])
+			}
+			dotFile := filepath.Join(clusterFolder, fmt.Sprintf("cluster%d.dot", cluster.ID))
+			graphs[dotFile] = exp.selectTrajectories(ts, renderTopTrajectories, 0)
+		}
+	}
+	var figures []string
+	for _, dotFile := range sortedKeys(graphs) {
+		printTrajectoriesDot(exp, graphs[dotFile], dotFile)
+		figure, err := renderDot(dotFile, format)
+		if err != nil {
+			return figures, err
+		}
+		figures = append(figures, figure)
+	}
+	fmt.Println("Rendered ", len(figures), " figures in ", folder)
+	return figures, nil
+}
@@ -0,0 +1,203 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Export of the results of a run as a single json file, for web frontends and notebooks that would otherwise parse the
+// tab files. The file holds the run manifest, the parameters that influence the results, the diagnoses, the selected
+// diagnosis pairs, the trajectories, and the clusters of the trajectories per granularity. Diagnoses are referred to by
+// their analysis DID, and trajectories by their ID. The schema is versioned: fields may be added within a version,
+// incompatible changes increment ResultsVersion.
+
+// ResultsVersion is the version of the schema of the json results.
+const ResultsVersion = 1
+
+// Results are the results of a run, cf. WriteResults.
+type Results struct {
+	Version      int                  `json:"version"`               // version of the schema, cf. ResultsVersion
+	Manifest     *RunManifest         `json:"manifest"`              // metadata of the run
+	Parameters   *ResultParameters    `json:"parameters"`            // parameters that influence the results
+	Diagnoses    []*ResultDiagnosis   `json:"diagnoses"`             // the diagnoses of the pairs and trajectories, by DID
+	Pairs        []*ResultPair        `json:"pairs"`                 // the selected diagnosis pairs
+	Trajectories []*ResultTrajectory  `json:"trajectories"`          // the trajectories, by ID
+	Clusterings  []*ResultsClustering `json:"clusterings,omitempty"` // the clusters per granularity, with --cluster
+}
+
+// ResultParameters are the parameters of a run that influence its results.
+type ResultParameters struct {
+	Level               int     `json:"level"`
+	NofAgeGroups        int     `json:"nofAgeGroups"`
+	MinPatients         int     `json:"minPatients"`
+	MinYears            float64 `json:"minYears"`
+	MaxYears            float64 `json:"maxYears"`
+	MinRR               float64 `json:"minRR"`
+	MinTrajectoryLength int     `json:"minTrajectoryLength"`
+	MaxTrajectoryLength int     `json:"maxTrajectoryLength"`
+	PFilters            string  `json:"pfilters"`
+	TFilters            string  `json:"tfilters"`
+	Metric              string  `json:"metric"`    // metric of the effect sizes of the pairs, cf. metric.go
+	MaxPValue           float64 `json:"maxPValue"` // maximum p-value of the RR scores of the pairs
+	RRBound             string  `json:"rrBound"`   // bound of the RR scores compared with minRR, cf. significance.go
+}
+
+// ResultDiagnosis describes a diagnosis of the analysis.
+type ResultDiagnosis struct {
+	DID        int      `json:"did"`        // analysis DID
+	Code       string   `json:"code"`       // diagnosis code that represents the DID in the vocabulary
+	Name       string   `json:"name"`       // medical term
+	Level      int      `json:"level"`      // level in the hierarchy of the vocabulary
+	Categories []string `json:"categories"` // the ancestors in the hierarchy, from the top
+}
+
+// ResultPair is a selected diagnosis pair with its relative risk.
+type ResultPair struct {
+	First          int      `json:"first"`            // DID of the first diagnosis
+	Second         int      `json:"second"`           // DID of the second diagnosis
+	RR             float64  `json:"rr"`               // relative risk of the second diagnosis after the first
+	Directionality float64  `json:"directionality"`   // p-value of the directionality of the pair, cf. directionality.go
+	Effect         *float64 `json:"effect,omitempty"` // effect size of the metric of the experiment, if known, cf. metric.go
+	Rare           bool     `json:"rare,omitempty"`   // whether the pair is rare, cf. rare-pairs.go
+}
+
+// ResultTrajectory is a trajectory with the nr of patients of each of its transitions.
+type ResultTrajectory struct {
+	ID        int    `json:"id"`
+	Hash      string `json:"hash"`      // hash of the diagnosis codes, cf. TrajectoryHash
+	Diagnoses []int  `json:"diagnoses"` // DIDs of the diagnoses, in order
+	Patients  []int  `json:"patients"`  // nr of patients per transition, one less than the nr of diagnoses
+}
+
+// ResultsClustering are the clusters of the trajectories for a granularity of the clustering.
+type ResultsClustering struct {
+	Granularity int              `json:"granularity"`
+	Clusters    []*ResultCluster `json:"clusters"`
+}
+
+// ResultCluster is a cluster of trajectories.
+type ResultCluster struct {
+	ID           int   `json:"id"`
+	Trajectories []int `json:"trajectories"` // IDs of the trajectories in the cluster
+}
+
+// newResultsClustering returns the current clusters of the trajectories of an experiment, cf. collectClusters.
+func newResultsClustering(exp *Experiment, granularity int) *ResultsClustering {
+	clustering := &ResultsClustering{Granularity: granularity}
+	for id, trajectories := range collectClusters(exp) {
+		cluster := &ResultCluster{ID: id}
+		for _, t := range trajectories {
+			cluster.Trajectories = append(cluster.Trajectories, t.ID)
+		}
+		clustering.Clusters = append(clustering.Clusters, cluster)
+	}
+	sort.Slice(clustering.Clusters, func(i, j int) bool {
+		return clustering.Clusters[i].ID < clustering.Clusters[j].ID
+	})
+	return clustering
+}
+
+// finiteValue returns a pointer to the given value, or nil if it is NaN or infinite, which JSON cannot represent.
+func finiteValue(value float64) *float64 {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return nil
+	}
+	return &value
+}
+
+// newResults collects the results of an experiment.
+func newResults(exp *Experiment, manifest *RunManifest, parameters *ResultParameters) *Results {
+	results := &Results{Version: ResultsVersion, Manifest: manifest, Parameters: parameters,
+		Diagnoses: []*ResultDiagnosis{}, Pairs: []*ResultPair{}, Trajectories: []*ResultTrajectory{},
+		Clusterings: exp.Clusterings}
+	dids := map[int]bool{}
+	for _, pair := range exp.Pairs {
+		dids[pair.First], dids[pair.Second] = true, true
+		results.Pairs = append(results.Pairs, &ResultPair{First: pair.First, Second: pair.Second,
+			RR: exp.DxDRR[pair.First][pair.Second], Directionality: exp.directionality(pair.First, pair.Second),
+			Effect: finiteValue(exp.effect(pair.First, pair.Second)), Rare: exp.rare(pair.First, pair.Second)})
+	}
+	for _, t := range exp.Trajectories {
+		for _, did := range t.Diagnoses {
+			dids[did] = true
+		}
+		results.Trajectories = append(results.Trajectories, &ResultTrajectory{ID: t.ID, Hash: t.Hash,
+			Diagnoses: t.Diagnoses, Patients: t.PatientNumbers})
+	}
+	for did := range dids {
+		entry := exp.Icd10Map[did]
+		diagnosis := &ResultDiagnosis{DID: did, Code: exp.IdMap[did], Name: entry.Name, Level: entry.Level,
+			Categories: []string{}}
+		for _, cat := range entry.Categories {
+			if cat == "NONE" {
+				break
+			}
+			diagnosis.Categories = append(diagnosis.Categories, cat)
+		}
+		results.Diagnoses = append(results.Diagnoses, diagnosis)
+	}
+	sort.Slice(results.Diagnoses, func(i, j int) bool {
+		return results.Diagnoses[i].DID < results.Diagnoses[j].DID
+	})
+	return results
+}
+
+// WriteResults writes the results of an experiment as a json file to the given output path, and returns the file name.
+func WriteResults(exp *Experiment, manifest *RunManifest, parameters *ResultParameters, path string) string {
+	fileName := filepath.Join(path, fmt.Sprintf("%s-results.json", exp.Name))
+	file, err := os.Create(fileName)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(newResults(exp, manifest, parameters)); err != nil {
+		panic(err)
+	}
+	return fileName
+}
+
+// ReadResults reads the results of a previous run from a json file written by WriteResults. It returns an error if the
+// file cannot be read, or has a newer version of the schema.
+func ReadResults(fileName string) (*Results, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	results := &Results{}
+	if err := json.NewDecoder(file).Decode(results); err != nil {
+		return nil, fmt.Errorf("%s: %v", fileName, err)
+	}
+	if results.Version > ResultsVersion {
+		return nil, fmt.Errorf("%s: unsupported version of the results: %d", fileName, results.Version)
+	}
+	return results, nil
+}
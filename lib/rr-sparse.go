@@ -0,0 +1,156 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+)
+
+// Sparse RR matrices. The dense format of SaveRRMatrix has a line for each of the D x D diagnosis pairs, while InitRR
+// only computes the RR scores of a small fraction of the pairs: the other RR scores keep the default 1.0. The sparse
+// format only has lines for the RR scores that differ from the default or have statistics. It is a tab separated file
+// with a header line that describes the dimensions, a line per diagnosis that maps the DIDs of the file onto the
+// diagnosis codes, and a line per RR score:
+// - ptra-sparse-rr tab version tab nr of diagnoses tab nr of RR scores
+// - D tab DID tab code tab name
+// - R tab DID1 tab DID2 tab RR tab p-value tab CI low tab CI high tab exposed tab exposed d2 tab comparison d2 tab
+// iterations, where the statistics are left out if unknown, cf. RRStats.
+//
+// LoadRRMatrix recognizes the format by the first line, and matches the diagnoses of the file with the diagnoses of the
+// experiment by code, so that the DIDs of the file need not be the DIDs of the experiment.
+
+// RR matrix formats.
+const (
+	RRFormatDense  = "dense"
+	RRFormatSparse = "sparse"
+)
+
+const (
+	rrSparseMagic   = "ptra-sparse-rr"
+	rrSparseVersion = "1"
+)
+
+// SaveSparseRRMatrix stores the RR matrix of the given experiment in the sparse format.
+func (exp *Experiment) SaveSparseRRMatrix(path string) {
+	file, err := os.Create(path)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	var rows [][]string
+	for i, js := range exp.DxDRR {
+		for j, RR := range js {
+			stats := exp.rrStats(i, j)
+			if RR == 1.0 && stats == nil {
+				continue
+			}
+			row := []string{"R", strconv.Itoa(i), strconv.Itoa(j), formatRRFloat(RR)}
+			if stats != nil {
+				row = append(row, stats.fileColumns()...)
+			}
+			rows = append(rows, row)
+		}
+	}
+	writer := csv.NewWriter(file)
+	writer.Comma = '\t'
+	writer.Write([]string{rrSparseMagic, rrSparseVersion, strconv.Itoa(len(exp.DxDRR)), strconv.Itoa(len(rows))})
+	for did := range exp.DxDRR {
+		writer.Write([]string{"D", strconv.Itoa(did), exp.IdMap[did], exp.Icd10Map[did].Name})
+	}
+	writer.WriteAll(rows)
+	if err := writer.Error(); err != nil {
+		panic(err)
+	}
+}
+
+// isSparseRRMatrix checks if an RR matrix is in the sparse format, by the first line of the file.
+func isSparseRRMatrix(reader *bufio.Reader) bool {
+	magic, err := reader.Peek(len(rrSparseMagic) + 1)
+	return err == nil && string(magic) == rrSparseMagic+"\t"
+}
+
+// loadSparseRRMatrix loads an RR matrix in the sparse format from a reader and stores it in the given experiment.
+func (exp *Experiment) loadSparseRRMatrix(path string, r io.Reader) {
+	codeMap := map[string]int{}
+	for did, code := range exp.IdMap {
+		codeMap[code] = did
+	}
+	reader := csv.NewReader(r)
+	reader.Comma = '\t'
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		panic(err)
+	}
+	if len(header) < 4 || header[1] != rrSparseVersion {
+		panic(fmt.Sprint("RR matrix ", path, " has an unsupported sparse format: ", header))
+	}
+	didMap := map[string]int{} // maps the DIDs of the file onto the DIDs of the experiment
+	scores := 0
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			panic(err)
+		}
+		switch {
+		case record[0] == "D" && len(record) >= 4:
+			did, ok := codeMap[record[2]]
+			if !ok {
+				panic(fmt.Sprint("RR matrix ", path, " has a diagnosis that is not in the experiment: ", record[2],
+					" ", record[3]))
+			}
+			didMap[record[1]] = did
+		case record[0] == "R" && len(record) >= 4:
+			d1, ok1 := didMap[record[1]]
+			d2, ok2 := didMap[record[2]]
+			if !ok1 || !ok2 {
+				panic(fmt.Sprint("RR matrix ", path, " has an RR score of unknown diagnoses: ", record[1], ", ",
+					record[2]))
+			}
+			RR, err := strconv.ParseFloat(record[3], 64)
+			if err != nil {
+				panic(err)
+			}
+			exp.DxDRR[d1][d2] = RR
+			if len(record) >= 10 {
+				stats, err := parseRRStats(record[4:])
+				if err != nil {
+					panic(err)
+				}
+				exp.setRRStats(d1, d2, stats)
+			}
+			scores++
+		default:
+			panic(fmt.Sprint("RR matrix ", path, " has a malformed line: ", record))
+		}
+	}
+	fmt.Println("Loaded ", scores, " RR scores from sparse RR matrix ", path)
+}
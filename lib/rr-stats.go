@@ -0,0 +1,145 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"math"
+	"strconv"
+)
+
+// Statistics of the RR scores, so that the significance of the diagnosis pairs can be judged downstream. InitRR
+// compares the patients exposed to d1 with sampled comparison groups of the same size without d1, and estimates the
+// p-value of d1 -> d2 as the fraction of comparison groups with at least as many d2 diagnoses as the exposed group.
+// The confidence interval of the RR is the 95% interval of Katz's log method for the 2x2 table of the exposed group and
+// the mean comparison group.
+
+// rrZ is the z-score of the 95% confidence intervals of the RR scores.
+const rrZ = 1.959963984540054
+
+// RRStats holds the statistics of the RR score of a diagnosis pair d1 -> d2.
+type RRStats struct {
+	PValue       float64 // fraction of the comparison groups with at least as many d2 diagnoses as the exposed group
+	Low, High    float64 // 95% confidence interval of the RR
+	Exposed      int     // nr of patients diagnosed with d1, which is also the size of the comparison groups
+	ExposedD2    float64 // nr of exposed patients diagnosed with d2 after d1, weighted for secondary diagnoses
+	ComparisonD2 float64 // mean nr of patients diagnosed with d2 in the comparison groups, weighted likewise
+	Iterations   int     // nr of sampled comparison groups of the p-value, 0 if the p-value is exact or unknown
+	Correction   float64 // continuity correction added to the cells of the 2x2 table, cf. rare-pairs.go, 0 if none
+}
+
+// newRRStats returns the statistics of an RR score with the given p-value, nr of exposed patients, and nr of d2
+// diagnoses in the exposed group and the mean comparison group. If the 2x2 table has a zero cell, the given continuity
+// correction is added to its cells for the confidence interval, cf. continuityCorrected. If either nr of d2 diagnoses
+// is still 0, the confidence interval is [0, +Inf].
+func newRRStats(pValue float64, exposed int, exposedD2, comparisonD2, correction float64) *RRStats {
+	stats := &RRStats{PValue: pValue, Low: 0, High: math.Inf(1), Exposed: exposed, ExposedD2: exposedD2,
+		ComparisonD2: comparisonD2}
+	if correction > 0 && hasZeroCell(exposed, exposedD2, comparisonD2) {
+		stats.Correction = correction
+	}
+	n, a, c := stats.table()
+	if a > 0 && c > 0 {
+		logRR := math.Log((a / n) / (c / n))
+		se := math.Sqrt(1/a - 1/n + 1/c - 1/n)
+		stats.Low, stats.High = math.Exp(logRR-rrZ*se), math.Exp(logRR+rrZ*se)
+	}
+	return stats
+}
+
+// table returns the size of the groups and the nr of d2 diagnoses in the exposed and comparison group of the 2x2
+// table of the RR score, with the continuity correction of the statistics, if any.
+func (stats *RRStats) table() (n, a, c float64) {
+	return continuityCorrected(stats.Exposed, stats.ExposedD2, stats.ComparisonD2, stats.Correction)
+}
+
+// rrStats returns the statistics of the RR score of d1 -> d2, or nil if they are unknown, e.g. for RR scores that
+// were loaded from a file without statistics.
+func (exp *Experiment) rrStats(d1, d2 int) *RRStats {
+	if d1 >= len(exp.DxDStats) || exp.DxDStats[d1] == nil {
+		return nil
+	}
+	return exp.DxDStats[d1][d2]
+}
+
+// setRRStats sets the statistics of the RR score of d1 -> d2.
+func (exp *Experiment) setRRStats(d1, d2 int, stats *RRStats) {
+	if exp.DxDStats == nil {
+		exp.DxDStats = make([][]*RRStats, exp.NofDiagnosisCodes)
+	}
+	if exp.DxDStats[d1] == nil {
+		exp.DxDStats[d1] = make([]*RRStats, exp.NofDiagnosisCodes)
+	}
+	exp.DxDStats[d1][d2] = stats
+}
+
+// formatRRFloat formats a float of the RR files as the RR scores themselves.
+func formatRRFloat(f float64) string {
+	return strconv.FormatFloat(f, 'E', -1, 64)
+}
+
+// formatCount formats a nr of patients without exponent, e.g. 191, or 190.5 if it is weighted for secondary diagnoses.
+func formatCount(n float64) string {
+	return strconv.FormatFloat(n, 'f', -1, 64)
+}
+
+// statsHeader names the columns of the statistics in the headers of the pairs files, cf. columns.
+var statsHeader = []string{"pValue", "ciLow", "ciHigh", "exposed", "exposedD2", "comparisonD2"}
+
+// columns returns the statistics as columns of the pairs files: the p-value, the bounds of the confidence interval, the
+// nr of exposed patients, and the nr of d2 diagnoses in the exposed group and the mean comparison group. Unknown
+// statistics are NaN.
+func (stats *RRStats) columns() []string {
+	if stats == nil {
+		nan := formatRRFloat(math.NaN())
+		return []string{nan, nan, nan, nan, nan, nan}
+	}
+	return []string{formatRRFloat(stats.PValue), formatRRFloat(stats.Low), formatRRFloat(stats.High),
+		strconv.Itoa(stats.Exposed), formatCount(stats.ExposedD2), formatCount(stats.ComparisonD2)}
+}
+
+// fileColumns returns the statistics as columns of the RR files: the columns of the pairs files, cf. columns, and the
+// nr of iterations of the p-value, so that the resolution of the p-values is known when the RR files are loaded.
+func (stats *RRStats) fileColumns() []string {
+	return append(stats.columns(), strconv.Itoa(stats.Iterations))
+}
+
+// parseRRStats parses the statistics from the columns of an RR file, cf. fileColumns. The nr of iterations is
+// optional, since RR files of older versions do not have it.
+func parseRRStats(columns []string) (*RRStats, error) {
+	var floats [5]float64
+	for i, column := range []string{columns[0], columns[1], columns[2], columns[4], columns[5]} {
+		f, err := strconv.ParseFloat(column, 64)
+		if err != nil {
+			return nil, err
+		}
+		floats[i] = f
+	}
+	exposed, err := strconv.Atoi(columns[3])
+	if err != nil {
+		return nil, err
+	}
+	stats := &RRStats{PValue: floats[0], Low: floats[1], High: floats[2], Exposed: exposed, ExposedD2: floats[3],
+		ComparisonD2: floats[4]}
+	if len(columns) > 6 {
+		if stats.Iterations, err = strconv.Atoi(columns[6]); err != nil {
+			return nil, err
+		}
+	}
+	return stats, nil
+}
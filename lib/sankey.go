@@ -0,0 +1,122 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/imec-int/ptra/lib/utils"
+	"os"
+	"strconv"
+)
+
+// Plotting of trajectories as a Sankey diagram, which shows the flow of patients between the stages of the
+// trajectories. The diagram is a Plotly figure in json, which is rendered with e.g. Plotly.newPlot(div, figure) in
+// javascript, or plotly.io.read_json in python. The nodes of the diagram are the diagnoses per stage, i.e. per index in
+// the trajectories, so that the diagram flows from the first diagnoses of the trajectories on the left to their last
+// diagnoses on the right. A link that occurs in several trajectories carries its largest nr of patients, cf.
+// printTrajectoriesDot, because trajectories with a common prefix share their patients.
+
+// SankeyFigure is a Plotly figure with a single Sankey trace.
+type SankeyFigure struct {
+	Data   []*SankeyTrace         `json:"data"`
+	Layout map[string]interface{} `json:"layout"`
+}
+
+// SankeyTrace is a Plotly Sankey trace.
+type SankeyTrace struct {
+	Type        string      `json:"type"`
+	Arrangement string      `json:"arrangement"`
+	Node        *SankeyNode `json:"node"`
+	Link        *SankeyLink `json:"link"`
+}
+
+// SankeyNode holds the nodes of a Sankey trace: their labels, and the diagnosis and stage they represent.
+type SankeyNode struct {
+	Label      []string `json:"label"`
+	CustomData [][2]int `json:"customdata"` // DID and stage per node
+	Hover      string   `json:"hovertemplate"`
+}
+
+// SankeyLink holds the links of a Sankey trace, as parallel lists of source nodes, target nodes, nr of patients, and
+// labels with the RR of the diagnosis pair.
+type SankeyLink struct {
+	Source []int    `json:"source"`
+	Target []int    `json:"target"`
+	Value  []int    `json:"value"`
+	Label  []string `json:"label"`
+}
+
+// newSankeyFigure returns the trajectories of an experiment as a Plotly Sankey diagram.
+func newSankeyFigure(exp *Experiment) *SankeyFigure {
+	node := &SankeyNode{Label: []string{}, CustomData: [][2]int{},
+		Hover: "%{label}<br>stage %{customdata[1]}<br>%{value} patients<extra></extra>"}
+	link := &SankeyLink{Source: []int{}, Target: []int{}, Value: []int{}, Label: []string{}}
+	nodes := map[[2]int]int{} // maps DID and stage onto the index of the node
+	links := map[[2]int]int{} // maps source and target node onto the index of the link
+	nodeIndex := func(did, stage int) int {
+		key := [2]int{did, stage}
+		if index, ok := nodes[key]; ok {
+			return index
+		}
+		nodes[key] = len(node.Label)
+		node.Label = append(node.Label, exp.Icd10Map[did].Name)
+		node.CustomData = append(node.CustomData, key)
+		return nodes[key]
+	}
+	for _, t := range exp.Trajectories {
+		for idx := 1; idx < len(t.Diagnoses); idx++ {
+			source, target := nodeIndex(t.Diagnoses[idx-1], idx-1), nodeIndex(t.Diagnoses[idx], idx)
+			key := [2]int{source, target}
+			index, ok := links[key]
+			if !ok {
+				index = len(link.Source)
+				links[key] = index
+				rr := exp.DxDRR[t.Diagnoses[idx-1]][t.Diagnoses[idx]]
+				link.Source = append(link.Source, source)
+				link.Target = append(link.Target, target)
+				link.Value = append(link.Value, 0)
+				link.Label = append(link.Label, "RR "+strconv.FormatFloat(rr, 'f', 2, 64))
+			}
+			link.Value[index] = utils.MaxInt(link.Value[index], t.PatientNumbers[idx-1])
+		}
+	}
+	return &SankeyFigure{
+		Data:   []*SankeyTrace{{Type: "sankey", Arrangement: "snap", Node: node, Link: link}},
+		Layout: map[string]interface{}{"title": map[string]string{"text": fmt.Sprint("Trajectories of ", exp.Name)}},
+	}
+}
+
+// printTrajectoriesSankey plots all of an experiment's trajectories as a Plotly Sankey diagram to a json file.
+func printTrajectoriesSankey(exp *Experiment, name string) {
+	file, err := os.Create(name)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(newSankeyFigure(exp)); err != nil {
+		panic(err)
+	}
+}
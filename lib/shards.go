@@ -0,0 +1,134 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// Sharded diagnosis files. Exports of TriNetX and Spark split the diagnoses over many files, e.g. part-0000.csv,
+// part-0001.csv, ... The diagnosis file may therefore be a directory with the shards, or a glob pattern that matches
+// them. The shards are read and checked concurrently, but their rows are added to the patients in the order of the
+// shards, so that the result does not depend on the scheduling, e.g. which diagnosis is the first event of interest.
+
+// shardBatchSize is the nr of rows that a shard reader passes on at once.
+const shardBatchSize = 4096
+
+// shardFiles returns the shards of a diagnosis file, sorted by name: the files in a directory, or the files that match
+// a glob pattern. Files in a directory whose name starts with _ or . are skipped, e.g. the _SUCCESS and .crc files of
+// Spark. Other diagnosis files, including remote files, are a single shard.
+func shardFiles(fileName string) []string {
+	if isRemoteInput(fileName) {
+		return []string{fileName}
+	}
+	var files []string
+	if info, err := os.Stat(fileName); err == nil && info.IsDir() {
+		entries, err := os.ReadDir(fileName)
+		if err != nil {
+			panic(err)
+		}
+		for _, entry := range entries {
+			if name := entry.Name(); !entry.IsDir() && !strings.HasPrefix(name, "_") && !strings.HasPrefix(name, ".") {
+				files = append(files, filepath.Join(fileName, name))
+			}
+		}
+	} else if strings.ContainsAny(fileName, "*?[") {
+		if files, err = filepath.Glob(fileName); err != nil {
+			panic(err)
+		}
+	} else {
+		return []string{fileName}
+	}
+	if len(files) == 0 {
+		panic(fmt.Sprint("No diagnosis files found for: ", fileName))
+	}
+	sort.Strings(files)
+	return files
+}
+
+// shardBatch is a batch of rows read from a shard. If reading the shard failed, the batch holds the error.
+type shardBatch struct {
+	rows [][]string
+	err  interface{}
+}
+
+// readShards reads the given shards concurrently, with at most GOMAXPROCS shards at a time. The read function reads a
+// single shard and passes its rows to emit. The rows of all shards are passed to f in the order of the shards, from the
+// calling goroutine. A panic while reading a shard is passed on to the caller, and stops the other shard readers.
+func readShards(files []string, read func(fileName string, emit func(row []string)), f func(row []string)) {
+	channels := make([]chan shardBatch, len(files))
+	for i := range channels {
+		channels[i] = make(chan shardBatch, 2)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	// send passes a batch on, or stops the shard reader when the caller is done
+	send := func(batches chan<- shardBatch, batch shardBatch) {
+		select {
+		case batches <- batch:
+		case <-done:
+			runtime.Goexit()
+		}
+	}
+	// shards are started in order, so that the shard that f is waiting for is always running or finished
+	slots := make(chan struct{}, runtime.GOMAXPROCS(0))
+	go func() {
+		for i, file := range files {
+			select {
+			case slots <- struct{}{}:
+			case <-done:
+				return
+			}
+			go func(batches chan<- shardBatch, file string) {
+				defer func() { <-slots }()
+				defer close(batches)
+				defer func() {
+					if err := recover(); err != nil {
+						send(batches, shardBatch{err: err})
+					}
+				}()
+				rows := make([][]string, 0, shardBatchSize)
+				read(file, func(row []string) {
+					if rows = append(rows, row); len(rows) == shardBatchSize {
+						send(batches, shardBatch{rows: rows})
+						rows = make([][]string, 0, shardBatchSize)
+					}
+				})
+				if len(rows) > 0 {
+					send(batches, shardBatch{rows: rows})
+				}
+			}(channels[i], file)
+		}
+	}()
+	for _, batches := range channels {
+		for batch := range batches {
+			if batch.err != nil {
+				panic(batch.err)
+			}
+			for _, row := range batch.rows {
+				f(row)
+			}
+		}
+	}
+}
@@ -0,0 +1,61 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+// Significance of the diagnosis pairs. InitRR only keeps the RR scores of the pairs d1 -> d2 of which the p-value is at
+// most a maximum p-value, cf. RRStats, and selectDiagnosisPairs only builds trajectories from the pairs with an RR above
+// the minimum RR. The RR of a pair is either compared as a point estimate, or by the lower bound of its 95% confidence
+// interval, so that only the pairs that are above the minimum RR with confidence are selected.
+
+// DefaultMaxPValue is the maximum p-value of the RR scores of the diagnosis pairs, unless set otherwise.
+const DefaultMaxPValue = 0.001
+
+// Bounds of the RR scores that are compared with the minimum RR for selecting the diagnosis pairs.
+const (
+	RRBoundPoint = "point" // the RR score itself
+	RRBoundLow   = "low"   // the lower bound of the 95% confidence interval of the RR score
+)
+
+// maxPValue returns the maximum p-value of the RR scores of the diagnosis pairs.
+func (exp *Experiment) maxPValue() float64 {
+	if exp.MaxPValue == 0 {
+		return DefaultMaxPValue
+	}
+	return exp.MaxPValue
+}
+
+// significant checks if the RR score of d1 -> d2 passes the maximum p-value of the experiment. The computed RR scores
+// always pass, cf. InitRR, but RR scores loaded from a run with a larger maximum p-value may not, cf. LoadRRMatrix.
+// RR scores without statistics or with an unknown p-value pass.
+func (exp *Experiment) significant(d1, d2 int) bool {
+	stats := exp.rrStats(d1, d2)
+	return stats == nil || !(stats.PValue > exp.maxPValue())
+}
+
+// selectionRR returns the RR of d1 -> d2 that is compared with the minimum RR for selecting the pair, cf. the RRBound
+// constants. Pairs of which the RR score has no statistics, e.g. RR scores that are loaded from an older file, are
+// compared by their RR score.
+func (exp *Experiment) selectionRR(d1, d2 int) float64 {
+	if exp.RRBound == RRBoundLow {
+		if stats := exp.rrStats(d1, d2); stats != nil {
+			return stats.Low
+		}
+	}
+	return exp.DxDRR[d1][d2]
+}
@@ -0,0 +1,83 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import "fmt"
+
+// Small-cell suppression. Data-governance rules typically forbid sharing patient counts below a minimum cell size,
+// since small groups of patients may be re-identified. With a minimum cell size, the trajectories with a transition of
+// fewer patients are left out of the outputs, so that the edges of the graphs and the rows of the trajectory files
+// only carry counts of at least the minimum cell size. The other patient counts that are written (the patients of the
+// diagnosis pairs, the sexes of the clusters, and the cohorts and diagnoses of the summary) are binned as <k instead.
+
+// SmallCellSuppression records how small cells were suppressed. It is reported in the run manifest.
+type SmallCellSuppression struct {
+	MinCellSize            int `json:"minCellSize"`            // patient counts below this size are suppressed
+	SuppressedTrajectories int `json:"suppressedTrajectories"` // nr of trajectories with a transition below the size
+}
+
+// isSmallCell checks if a patient count is below the minimum cell size of an experiment. Counts of 0 are not small
+// cells, since they do not identify patients.
+func (exp *Experiment) isSmallCell(n float64) bool {
+	return n > 0 && n < float64(exp.MinCellSize)
+}
+
+// cellValue returns the value of a patient count n, or <k if n is a small cell, cf. isSmallCell.
+func (exp *Experiment) cellValue(n float64, value interface{}) interface{} {
+	if exp.isSmallCell(n) {
+		return fmt.Sprint("<", exp.MinCellSize)
+	}
+	return value
+}
+
+// cellColumns returns the statistics of an RR score as columns, cf. RRStats.columns, with the counts of patients that
+// are small cells binned.
+func (exp *Experiment) cellColumns(stats *RRStats) []string {
+	columns := stats.columns()
+	if stats != nil {
+		columns[3] = fmt.Sprint(exp.cellValue(float64(stats.Exposed), columns[3]))
+		columns[4] = fmt.Sprint(exp.cellValue(stats.ExposedD2, columns[4]))
+		columns[5] = fmt.Sprint(exp.cellValue(stats.ComparisonD2, columns[5]))
+	}
+	return columns
+}
+
+// SuppressSmallCells removes the trajectories of an experiment of which a transition has a small cell of patients.
+func (exp *Experiment) SuppressSmallCells() *SmallCellSuppression {
+	suppression := &SmallCellSuppression{MinCellSize: exp.MinCellSize}
+	var trajectories []*Trajectory
+	for _, t := range exp.Trajectories {
+		small := false
+		for _, n := range t.PatientNumbers {
+			if exp.isSmallCell(float64(n)) {
+				small = true
+				break
+			}
+		}
+		if small {
+			suppression.SuppressedTrajectories++
+			continue
+		}
+		trajectories = append(trajectories, t)
+	}
+	fmt.Println("Suppressed ", suppression.SuppressedTrajectories, " trajectories with fewer than ", exp.MinCellSize,
+		" patients in a transition.")
+	exp.Trajectories = trajectories
+	return suppression
+}
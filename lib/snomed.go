@@ -0,0 +1,278 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"fmt"
+	"github.com/imec-int/ptra/lib/utils"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Reading the SNOMED CT vocabulary. A SNOMED CT release in RF2 format is a directory with tab separated concept,
+// description, and relationship files. The IS-A relationships between the concepts form a hierarchy in which a concept
+// may have several parents. Each concept is placed in the hierarchy along its primary parents: the parents closest to
+// the root, so that diagnoses coded in SNOMED CT can be grouped on a level of the hierarchy, as for ICD-10. A subset of
+// the release, e.g. with only the concepts of interest, can be used as long as its files have the RF2 columns.
+
+// SNOMED CT concept and type IDs.
+const (
+	snomedRoot          = "138875005"          // SNOMED CT Concept
+	snomedIsA           = "116680003"          // Is a
+	snomedFSN           = "900000000000003001" // Fully specified name
+	snomedBladderCancer = "399326009"          // Malignant tumor of urinary bladder
+)
+
+// snomedDiagnosisHierarchies are the top level hierarchies of SNOMED CT that contain diagnoses. Concepts of the other
+// top level hierarchies, e.g. procedures or body structures, are excluded from analysis.
+var snomedDiagnosisHierarchies = map[string]bool{
+	"404684003": true, // Clinical finding
+	"243796009": true, // Situation with explicit context
+}
+
+// snomedAnalysisMaps maps SNOMED CT concept IDs onto analysis DIDs. Its Icd10Map describes SNOMED CT concepts rather
+// than ICD-10 codes.
+type snomedAnalysisMaps struct {
+	icd10AnalysisMapsFromXML
+	EventsOfInterest map[string]bool // concept IDs of the events of interest
+}
+
+func (analysisMap snomedAnalysisMaps) codeSystem() string {
+	return CodeSystemSNOMED
+}
+
+func (analysisMap snomedAnalysisMaps) fromICD10(string) (string, bool) {
+	return "", false
+}
+
+func (analysisMap snomedAnalysisMaps) isEventOfInterest(code string) bool {
+	return analysisMap.EventsOfInterest[code]
+}
+
+// snomedReleaseTable returns the table of a file from a SNOMED CT release: concept, description, or relationship, or
+// the empty string for other files. Files of full and delta releases are ignored in favour of the snapshot files.
+func snomedReleaseTable(file string) string {
+	name := strings.ToLower(filepath.Base(file))
+	if strings.Contains(name, "_full") || strings.Contains(name, "_delta") {
+		return ""
+	}
+	for _, table := range []string{"concept", "description", "relationship"} {
+		if strings.HasPrefix(name, table+".") || strings.Contains(name, "_"+table+"_") {
+			return table
+		}
+	}
+	return ""
+}
+
+// snomedRelease holds the active concepts of a SNOMED CT release with their names and IS-A parents.
+type snomedRelease struct {
+	names   map[string]string   // concept ID -> fully specified name, or another term if there is none
+	parents map[string][]string // concept ID -> IDs of its parents
+	depths  map[string]int      // concept ID -> length of the shortest path to a concept without parents
+}
+
+// parseSNOMEDRelease reads the concept, description, and relationship files from a directory with a SNOMED CT release.
+// Rows without an active column are active. Relationships without a type column are IS-A relationships. Without
+// concept file, the concepts are those of the relationships.
+func parseSNOMEDRelease(dir string) *snomedRelease {
+	files := map[string][]string{}
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if table := snomedReleaseTable(path); table != "" && !entry.IsDir() {
+			files[table] = append(files[table], path)
+		}
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+	if len(files["relationship"]) == 0 {
+		panic(fmt.Sprint("No SNOMED CT relationship file in ", dir))
+	}
+	active := func(value string) bool { return value == "" || value == "1" }
+	release := &snomedRelease{names: map[string]string{}, parents: map[string][]string{}, depths: map[string]int{}}
+	for _, file := range files["concept"] {
+		err := readCSVTable(file, []string{"id", "active"}, func(values []string) {
+			if active(values[1]) {
+				release.names[values[0]] = values[0]
+			}
+		})
+		if err != nil {
+			panic(err)
+		}
+	}
+	for _, file := range files["relationship"] {
+		err := readCSVTable(file, []string{"sourceId", "destinationId", "active", "typeId"}, func(values []string) {
+			if !active(values[2]) || (values[3] != "" && values[3] != snomedIsA) {
+				return
+			}
+			release.parents[values[0]] = append(release.parents[values[0]], values[1])
+			if len(files["concept"]) == 0 {
+				release.names[values[0]], release.names[values[1]] = values[0], values[1]
+			}
+		})
+		if err != nil {
+			panic(err)
+		}
+	}
+	fsn := map[string]bool{}
+	for _, file := range files["description"] {
+		err := readCSVTable(file, []string{"conceptId", "active", "typeId", "term"}, func(values []string) {
+			name, ok := release.names[values[0]]
+			if !active(values[1]) || !ok || fsn[values[0]] {
+				return
+			}
+			if values[2] == snomedFSN {
+				fsn[values[0]] = true
+				release.names[values[0]] = values[3]
+			} else if name == values[0] {
+				release.names[values[0]] = values[3]
+			}
+		})
+		if err != nil {
+			panic(err)
+		}
+	}
+	for concept, parents := range release.parents {
+		active := parents[:0]
+		for _, parent := range parents {
+			if _, ok := release.names[parent]; ok {
+				active = append(active, parent)
+			}
+		}
+		sort.Strings(active)
+		release.parents[concept] = active
+	}
+	fmt.Println("Parsed ", len(release.names), " SNOMED CT concepts.")
+	return release
+}
+
+// depth returns the length of the shortest path from a concept to a concept without parents.
+func (release *snomedRelease) depth(concept string) int {
+	if depth, ok := release.depths[concept]; ok {
+		return depth
+	}
+	release.depths[concept] = 0 // guards against cycles
+	depth := 0
+	for i, parent := range release.parents[concept] {
+		if d := release.depth(parent) + 1; i == 0 || d < depth {
+			depth = d
+		}
+	}
+	release.depths[concept] = depth
+	return depth
+}
+
+// path returns the ancestors of a concept along its primary parents, from the top level concept down to the parent of
+// the concept. The primary parent of a concept is the parent closest to the root, the smallest ID among equals. The
+// root concept of SNOMED CT is not part of the path.
+func (release *snomedRelease) path(concept string) []string {
+	var path []string
+	for {
+		parents := release.parents[concept]
+		if len(parents) == 0 {
+			break
+		}
+		primary := parents[0]
+		for _, parent := range parents[1:] {
+			if release.depth(parent) < release.depth(primary) {
+				primary = parent
+			}
+		}
+		if primary == snomedRoot {
+			break
+		}
+		path = append(path, primary)
+		concept = primary
+	}
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
+	}
+	return path
+}
+
+// isTopLevel checks if a concept is a top level concept, a child of the root concept of SNOMED CT.
+func (release *snomedRelease) isTopLevel(concept string) bool {
+	for _, parent := range release.parents[concept] {
+		if parent == snomedRoot {
+			return true
+		}
+	}
+	return false
+}
+
+// isDescendantOf checks if a concept is the given ancestor or one of its descendants, along all of its parents.
+func (release *snomedRelease) isDescendantOf(concept, ancestor string, memo map[string]bool) bool {
+	if concept == ancestor {
+		return true
+	}
+	if result, ok := memo[concept]; ok {
+		return result
+	}
+	memo[concept] = false // guards against cycles
+	for _, parent := range release.parents[concept] {
+		if release.isDescendantOf(parent, ancestor, memo) {
+			memo[concept] = true
+			return true
+		}
+	}
+	return false
+}
+
+// initializeSNOMEDAnalysisMaps returns a map SNOMED CT concept ID -> internal analysis DID and a map analysis DID ->
+// medical Name for a SNOMED CT release in the given directory and a requested hierarchy Level. Level 0 are the top level
+// concepts below the root, e.g. clinical finding. As for ICD-10, at most 6 levels are distinguished. The custom events
+// are added after the concepts, nil for the default bladder cancer events.
+func initializeSNOMEDAnalysisMaps(dir string, level int, events []*CustomEvent) snomedAnalysisMaps {
+	release := parseSNOMEDRelease(dir)
+	conceptMap := map[string]Icd10Entry{}
+	excluded := map[string]bool{}
+	eoi := map[string]bool{}
+	memo := map[string]bool{}
+	for concept, name := range release.names {
+		if concept == snomedRoot {
+			continue
+		}
+		path := release.path(concept)
+		top := concept
+		if len(path) > 0 {
+			top = path[0]
+		}
+		if release.isTopLevel(top) && !snomedDiagnosisHierarchies[top] {
+			excluded[concept] = true // not a diagnosis
+			continue
+		}
+		entry := Icd10Entry{Name: name, Categories: [6]string{"NONE", "NONE", "NONE", "NONE", "NONE", "NONE"}}
+		for i := 0; i < len(path) && i < len(entry.Categories); i++ {
+			entry.Categories[i] = release.names[path[i]]
+		}
+		entry.Level = utils.MinInt(len(path), len(entry.Categories))
+		conceptMap[concept] = entry
+		if release.isDescendantOf(concept, snomedBladderCancer, memo) {
+			eoi[concept] = true
+		}
+	}
+	analysisIdMap, icd10Map, ctr, _ := initializeIcd10AnalysisMaps(conceptMap, level, events)
+	return snomedAnalysisMaps{icd10AnalysisMapsFromXML: icd10AnalysisMapsFromXML{DIDMap: analysisIdMap,
+		Icd10Map: icd10Map, NofDiagnosisCodes: ctr, Excluded: excluded}, EventsOfInterest: eoi}
+}
@@ -0,0 +1,179 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Reading patients, diagnoses, and tumors from a database with SQL queries, so that ptra can read from a research
+// database directly instead of from csv exports. The caller opens the database with the driver of their choice, e.g.
+// PostgreSQL. The queries select their columns in a fixed order, as listed for SQLSource, the names of the columns do
+// not matter. Dates may be dates, timestamps, or strings such as 2010-05-01. The queries may also run elsewhere than on
+// a database/sql database, e.g. on BigQuery, with a QueryRunner.
+
+// QueryRunner runs queries, e.g. on BigQuery.
+type QueryRunner interface {
+	// ReadQuery runs a query and calls f for each row with the values of its columns. NULL values are empty strings. Each
+	// row has its own values, so that f may keep them. It returns an error if the query fails.
+	ReadQuery(query string, f func(values []string)) error
+}
+
+// SQLSource reads the patients, diagnoses, and tumors of the sql input format from a database.
+type SQLSource struct {
+	DB             *sql.DB
+	Runner         QueryRunner // runs the queries instead of DB if not nil
+	PatientQuery   string      // selects the patient id, sex (M or F), year of birth, date of death, and region
+	DiagnosisQuery string      // selects the patient id, code system (e.g. ICD-10-CM), diagnosis code, and date
+	TumorQuery     string      // selects the patient id, date, site, morphology, and TNM values (e.g. TNM_T2), none if empty
+}
+
+// LoadSQLSource creates a source that runs the queries in the given files on a database. The tumor query file is
+// optional.
+func LoadSQLSource(db *sql.DB, patientQueryFile, diagnosisQueryFile, tumorQueryFile string) (*SQLSource, error) {
+	source := &SQLSource{DB: db}
+	queries := []*string{&source.PatientQuery, &source.DiagnosisQuery, &source.TumorQuery}
+	for i, file := range []string{patientQueryFile, diagnosisQueryFile, tumorQueryFile} {
+		if file == "" {
+			continue
+		}
+		query, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if *queries[i] = strings.TrimSpace(string(query)); *queries[i] == "" {
+			return nil, fmt.Errorf("query file %s is empty", file)
+		}
+	}
+	if source.PatientQuery == "" || source.DiagnosisQuery == "" {
+		return nil, errors.New("the sql input format requires a patient and a diagnosis query")
+	}
+	return source, nil
+}
+
+// readSQLRows runs a query and calls f for each row with the values of its columns, cf. QueryRunner.
+func readSQLRows(db *sql.DB, query string, f func(values []string)) error {
+	rows, err := db.Query(query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	fields := make([]sql.NullString, len(columns))
+	pointers := make([]interface{}, len(columns))
+	for i := range fields {
+		pointers[i] = &fields[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(pointers...); err != nil {
+			return err
+		}
+		values := make([]string, len(columns)) // f may keep the values
+		for i, field := range fields {
+			values[i] = strings.TrimSpace(field.String)
+		}
+		f(values)
+	}
+	return rows.Err()
+}
+
+// readQuery runs a query that selects at least the given number of columns, and calls f for each row.
+func (source *SQLSource) readQuery(name, query string, columns int, f func(values []string)) {
+	check := func(values []string) {
+		if len(values) < columns {
+			panic(fmt.Sprint("the ", name, " query selects ", len(values), " columns, expected ", columns))
+		}
+		f(values)
+	}
+	var err error
+	if source.Runner != nil {
+		err = source.Runner.ReadQuery(query, check)
+	} else {
+		err = readSQLRows(source.DB, query, check)
+	}
+	if err != nil {
+		panic(fmt.Sprint("the ", name, " query failed: ", err))
+	}
+}
+
+// parseSQLPatients reads the patients with the patient query. Patients without id or year of birth are skipped.
+func parseSQLPatients(source *SQLSource, nofCohortAges int, duplicates *DuplicateReport) (*PatientMap, int) {
+	loader := newPatientLoader(duplicates)
+	skipped := 0
+	source.readQuery("patient", source.PatientQuery, 5, func(values []string) {
+		yob, err := strconv.Atoi(values[2])
+		if values[0] == "" || err != nil {
+			skipped++
+			return //skip patients without id or year of birth
+		}
+		var dateOfDeath *DiagnosisDate
+		if date, err := parseOMOPDate(values[3]); err == nil {
+			dateOfDeath = &date
+		}
+		loader.add(values[0], values[1], yob, dateOfDeath, values[4])
+	})
+	fmt.Println("Skipped ", skipped, " patients without id or year of birth.")
+	return loader.finish(nofCohortAges)
+}
+
+// parseSQLDiagnoses reads the diagnoses with the diagnosis query, and fills them in for the given patients. ICD codes
+// without dot are dotted. It returns a report of the diagnosis codes that could not be mapped.
+func parseSQLDiagnoses(source *SQLSource, treatmentInfoFile string, treatmentSchema *TreatmentSchema,
+	patients *PatientMap, icd10AnalysisMap AnalysisMaps, icd9ToIcd10Map map[string]string,
+	duplicates *DuplicateReport, report *ValidationReport) *UnmappedCodeReport {
+	loader := newDiagnosisLoader(patients, icd10AnalysisMap, icd9ToIcd10Map, duplicates)
+	skipped := 0
+	source.readQuery("diagnosis", source.DiagnosisQuery, 4, func(values []string) {
+		date, err := parseOMOPDate(values[3])
+		if values[0] == "" || values[2] == "" || err != nil {
+			skipped++
+			return //skip diagnoses without patient, code, or date
+		}
+		codeSystem, code := values[1], values[2]
+		if codeSystem == CodeSystemICD10 || codeSystem == CodeSystemICD9 {
+			code = dottedICDCode(codeSystem, code)
+		}
+		loader.add(values[0], codeSystem, code, date)
+	})
+	fmt.Println("Skipped ", skipped, " diagnoses without patient, code, or date.")
+	fillInTreatments(treatmentInfoFile, treatmentSchema, patients, icd10AnalysisMap, report)
+	return loader.finish()
+}
+
+// parseSQLTumors reads the tumors with the tumor query, as ParsetTriNetXTumorData does for a TriNetX tumor file.
+func parseSQLTumors(source *SQLSource, sites []string, staging StagingRegistry) map[string][]*TumorInfo {
+	result := map[string][]*TumorInfo{}
+	source.readQuery("tumor", source.TumorQuery, 7, func(values []string) {
+		date, err := parseOMOPDate(values[1])
+		if values[0] == "" || err != nil {
+			return //skip tumors without patient or date
+		}
+		addTumor(result, sites, staging, values[0], date, values[2], values[3], values[4], values[5], values[6])
+	})
+	printTumorInfoSummary(result)
+	return result
+}
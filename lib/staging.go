@@ -0,0 +1,177 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+)
+
+// Staging of tumors. The overall stage of a tumor is derived from its TNM classification by rules that differ per type
+// of cancer. A staging registry lists the rules per cancer, with the topography prefixes of its primary sites, cf.
+// tumorSites. The default registry contains the AJCC rules for bladder cancer. A staging rules file adds the rules of
+// other cancers, or replaces the rules of a cancer with the same name. Tumors of a site without rules get the
+// concatenation of their TNM values as stage, e.g. T2N0M0.
+
+// StagingRule maps a combination of TNM values onto an overall stage. A rule matches a tumor if its T, N and M values
+// occur in the respective lists. An empty list matches any value.
+type StagingRule struct {
+	T     []string `json:"t,omitempty"` // tumor size values, e.g. T1, T2a
+	N     []string `json:"n,omitempty"` // lymph node values, e.g. N0
+	M     []string `json:"m,omitempty"` // metastasis values, e.g. M0, M1a
+	Stage string   `json:"stage"`       // overall stage, e.g. IIIA
+}
+
+// matches checks if a rule applies to the given TNM values.
+func (rule *StagingRule) matches(tStage, nStage, mStage string) bool {
+	match := func(values []string, value string) bool {
+		return len(values) == 0 || slices.Contains(values, value)
+	}
+	return match(rule.T, tStage) && match(rule.N, nStage) && match(rule.M, mStage)
+}
+
+// CancerStaging lists the staging rules of a cancer. The first matching rule determines the stage.
+type CancerStaging struct {
+	Name  string         `json:"name"`  // name of the cancer, e.g. breast
+	Sites []string       `json:"sites"` // topography prefixes of the primary sites, e.g. C50
+	Rules []*StagingRule `json:"rules"`
+}
+
+// StagingRegistry lists the staging rules of several cancers.
+type StagingRegistry []*CancerStaging
+
+// DefaultStagingRegistry returns the staging rules of bladder cancer:
+// T stages: Ta,T1,Tis,T2,T3,T4
+// N stages: N0,N1,N2,N3
+// M stages: M0,M1
+// Stage 0a: Ta,N0,M0
+// Stage 0is:Tis,N0,M0 known as carcinoma in situ (CIS)
+// Stage I: T1,N0,M0
+// Stage II: T2,N0,M0
+// Stage IIIA: T3a,T3b, or T4a,N0,M0 --or-- T1 to T4a,N1,M0
+// Stage IIIB: T1 to T4a, N2 or N3, M0
+// Stage IVA: T4b,any N,M0 or any T, any N, M1a
+// Stage IVB: any T, any N, M1b
+func DefaultStagingRegistry() StagingRegistry {
+	n0, m0 := []string{"N0"}, []string{"M0"}
+	return StagingRegistry{{
+		Name:  "bladder",
+		Sites: DefaultTumorSites(),
+		Rules: []*StagingRule{
+			{T: []string{"Ta"}, N: n0, M: m0, Stage: "0a"},
+			{T: []string{"Tis"}, N: n0, M: m0, Stage: "0is"},
+			{T: []string{"T1"}, N: n0, M: m0, Stage: "I"},
+			{T: []string{"T2"}, N: n0, M: m0, Stage: "II"},
+			{T: []string{"T3a", "T3b", "T4a"}, N: n0, M: m0, Stage: "IIIA"},
+			{T: []string{"T1", "T1a", "T1b", "T2", "T2a", "T2b", "T3", "T3a", "T3b", "T4a"}, N: []string{"N1"}, M: m0,
+				Stage: "IIIA"},
+			{T: []string{"T1", "T1a", "T1b", "T2", "T2a", "T2b", "T3", "T3a", "T3b", "T4", "T4a"},
+				N: []string{"N2", "N3"}, M: m0, Stage: "IIIB"},
+			{T: []string{"T4b"}, M: m0, Stage: "IVA"},
+			{M: []string{"M1a"}, Stage: "IVA"},
+			{M: []string{"M1b"}, Stage: "IVB"},
+		},
+	}}
+}
+
+// LoadStagingRules loads the staging rules of one or more cancers from a json file and adds them to the default
+// registry. A cancer with the same name as a default one replaces it. The rules are validated.
+func LoadStagingRules(path string) (StagingRegistry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cancers StagingRegistry
+	if err := json.Unmarshal(data, &cancers); err != nil {
+		return nil, fmt.Errorf("staging rules %s: %v", path, err)
+	}
+	names := map[string]bool{}
+	for i, cancer := range cancers {
+		if cancer != nil {
+			sites := []string{}
+			for _, site := range cancer.Sites {
+				sites = append(sites, ParseTumorSites(site)...)
+			}
+			cancer.Sites = sites
+		}
+		if err := cancer.validate(); err != nil {
+			return nil, fmt.Errorf("staging rules %s: cancer %d: %v", path, i, err)
+		}
+		if names[cancer.Name] {
+			return nil, fmt.Errorf("staging rules %s: cancer %s occurs more than once", path, cancer.Name)
+		}
+		names[cancer.Name] = true
+	}
+	for _, cancer := range DefaultStagingRegistry() {
+		if !names[cancer.Name] {
+			cancers = append(cancers, cancer)
+		}
+	}
+	return cancers, nil
+}
+
+// validate checks that a cancer has a name, primary sites, and rules with a stage.
+func (cancer *CancerStaging) validate() error {
+	if cancer == nil || cancer.Name == "" {
+		return errors.New("missing name")
+	}
+	if len(cancer.Sites) == 0 {
+		return fmt.Errorf("%s has no sites", cancer.Name)
+	}
+	for i, rule := range cancer.Rules {
+		if rule == nil || rule.Stage == "" {
+			return fmt.Errorf("rule %d of %s has no stage", i, cancer.Name)
+		}
+	}
+	return nil
+}
+
+// cancerOf returns the staging rules for a site code, or nil if the site has no rules. If several cancers match, the
+// one with the longest topography prefix applies, so that e.g. rules for C34.1 take precedence over rules for C34.
+func (registry StagingRegistry) cancerOf(site string) *CancerStaging {
+	var result *CancerStaging
+	length := 0
+	for _, cancer := range registry {
+		for _, prefix := range cancer.Sites {
+			if len(prefix) > length && isTumorSite(site, []string{prefix}) {
+				result, length = cancer, len(prefix)
+			}
+		}
+	}
+	return result
+}
+
+// stage converts tumor size, number of lymph nodes, and metastasis Level of a tumor at the given site into an overall
+// cancer stage. The registry is nil for the default registry.
+func (registry StagingRegistry) stage(site, tStage, nStage, mStage string) string {
+	if registry == nil {
+		registry = DefaultStagingRegistry()
+	}
+	if cancer := registry.cancerOf(site); cancer != nil {
+		for _, rule := range cancer.Rules {
+			if rule.matches(tStage, nStage, mStage) {
+				return rule.Stage
+			}
+		}
+	}
+	return tStage + nStage + mStage
+}
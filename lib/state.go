@@ -0,0 +1,172 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Incremental ingestion. Refreshing an experiment with a new month of data should not require reparsing the entire
+// history of diagnoses. The diagnoses of the patients, as parsed from the diagnosis, treatment, procedure, and lab
+// files, are therefore saved in a state file. A later run loads that state, adds the diagnoses of the new files, and
+// saves the extended state for the next refresh. Patients are read from the patient file of each run, which is small
+// compared to the diagnosis files, so that new patients and updated dates of death are taken into account. The
+// temporal checks, visit grouping, observation periods, index dates, and patient filters are applied after the state is
+// loaded, and the cohorts, RR scores, and trajectories are computed from all diagnoses, as without a state.
+
+// stateVersion is the version of the state file format.
+const stateVersion = 1
+
+// experimentState is the parsed input of an experiment that is saved between incremental runs.
+type experimentState struct {
+	Version  int             `json:"version"`
+	Names    []string        `json:"names"`            // name of each analysis DID, to check the vocabulary of later runs
+	Events   map[int]string  `json:"events,omitempty"` // input codes of the procedure groups and lab events, cf. addEventCodes
+	Patients []*patientState `json:"patients"`
+}
+
+// patientState holds the diagnoses of a patient in an experiment state.
+type patientState struct {
+	ID            string           `json:"id"`
+	EOIDate       *DiagnosisDate   `json:"eoiDate,omitempty"`
+	TreatmentDate *DiagnosisDate   `json:"treatmentDate,omitempty"`
+	Diagnoses     []diagnosisState `json:"diagnoses"`
+}
+
+// diagnosisState holds a diagnosis in an experiment state.
+type diagnosisState struct {
+	DID       int           `json:"did"`
+	Date      DiagnosisDate `json:"date"`
+	Encounter string        `json:"encounter,omitempty"`
+	Secondary bool          `json:"secondary,omitempty"`
+}
+
+// saveExperimentState saves the diagnoses of the given patients to a json file, gzip compressed if the file name ends
+// in .gz. The analysis DIDs from the given number of vocabulary codes onwards are events, e.g. procedure groups. The
+// patient identifiers are replaced by their pseudonyms, if any.
+func saveExperimentState(file string, patients *PatientMap, icd10Map map[int]Icd10Entry, idMap map[int]string,
+	nofVocabularyCodes, nofDiagnosisCodes int, pseudonymizer *Pseudonymizer) {
+	state := &experimentState{Version: stateVersion, Names: make([]string, nofDiagnosisCodes), Events: map[int]string{}}
+	for did := 0; did < nofDiagnosisCodes; did++ {
+		state.Names[did] = icd10Map[did].Name
+		if did >= nofVocabularyCodes {
+			state.Events[did] = idMap[did]
+		}
+	}
+	nofDiagnoses := 0
+	for _, pid := range patients.sortedPIDs() {
+		p := patients.PIDMap[pid]
+		ps := &patientState{ID: pseudonymizer.Pseudonym(p.PIDString), EOIDate: p.EOIDate,
+			TreatmentDate: p.TreatmentDate, Diagnoses: make([]diagnosisState, 0, len(p.Diagnoses))}
+		for _, d := range p.Diagnoses {
+			ps.Diagnoses = append(ps.Diagnoses, diagnosisState{DID: d.DID, Date: d.Date, Encounter: d.Encounter,
+				Secondary: d.Secondary})
+		}
+		nofDiagnoses += len(ps.Diagnoses)
+		state.Patients = append(state.Patients, ps)
+	}
+	f, err := os.Create(file)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	var output io.Writer = f
+	if strings.ToLower(filepath.Ext(file)) == ".gz" {
+		compressor := gzip.NewWriter(f)
+		defer func() {
+			if err := compressor.Close(); err != nil {
+				panic(err)
+			}
+		}()
+		output = compressor
+	}
+	if err := json.NewEncoder(output).Encode(state); err != nil {
+		panic(err)
+	}
+	fmt.Println("Saved ", nofDiagnoses, " diagnoses of ", len(state.Patients), " patients to state file ", file)
+}
+
+// loadExperimentState adds the diagnoses of a state file to the given patients. The vocabulary of the state must be the
+// vocabulary of the experiment, which is checked by the names of the analysis DIDs. The events of the state, e.g.
+// procedure groups, are added to the maps of the experiment. The patients are found by their identifiers or by their
+// hashed pseudonyms, cf. Pseudonymizer.patientLookup. Diagnoses of patients that are not in the patient map are
+// skipped. It returns the new number of diagnosis codes.
+func loadExperimentState(file string, patients *PatientMap, icd10Map map[int]Icd10Entry, idMap map[int]string,
+	nofDiagnosisCodes int, pseudonymizer *Pseudonymizer) int {
+	f, err := openInput(file)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	state := &experimentState{}
+	if err := json.NewDecoder(f).Decode(state); err != nil {
+		panic(fmt.Sprint(file, ": ", err))
+	}
+	if state.Version != stateVersion {
+		panic(fmt.Sprint(file, ": unsupported state version ", state.Version))
+	}
+	if len(state.Names) < nofDiagnosisCodes {
+		panic(fmt.Sprint(file, ": the state has ", len(state.Names), " diagnosis codes rather than ", nofDiagnosisCodes))
+	}
+	for did, name := range state.Names[:nofDiagnosisCodes] {
+		if icd10Map[did].Name != name {
+			panic(fmt.Sprint(file, ": the state has a different vocabulary, diagnosis code ", did, " is ", name,
+				" rather than ", icd10Map[did].Name))
+		}
+	}
+	for did := nofDiagnosisCodes; did < len(state.Names); did++ {
+		icd10Map[did] = Icd10Entry{Name: state.Names[did]}
+		idMap[did] = state.Events[did]
+	}
+	lookup := pseudonymizer.patientLookup(patients)
+	nofDiagnoses, skipped := 0, 0
+	for _, ps := range state.Patients {
+		patient, ok := lookup(ps.ID)
+		if !ok {
+			skipped++
+			continue
+		}
+		for _, d := range ps.Diagnoses {
+			patient.AddDiagnosis(&Diagnosis{PID: patient.PID, DID: d.DID, Date: d.Date, Encounter: d.Encounter,
+				Secondary: d.Secondary})
+		}
+		nofDiagnoses += len(ps.Diagnoses)
+		if ps.EOIDate != nil && (patient.EOIDate == nil || DiagnosisDateSmallerThan(*ps.EOIDate, *patient.EOIDate)) {
+			patient.EOIDate = ps.EOIDate
+		}
+		if ps.TreatmentDate != nil && (patient.TreatmentDate == nil ||
+			DiagnosisDateSmallerThan(*ps.TreatmentDate, *patient.TreatmentDate)) {
+			patient.TreatmentDate = ps.TreatmentDate
+		}
+		compactPatientDiagnoses(patient)
+	}
+	fmt.Println("Loaded ", nofDiagnoses, " diagnoses of ", len(state.Patients)-skipped, " patients from state file ",
+		file, ", skipped ", skipped, " patients that are not in the patient file.")
+	return len(state.Names)
+}
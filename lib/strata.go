@@ -0,0 +1,194 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Stratification of cohorts on race, ethnicity, and calendar period. By default, cohorts match patients on age group
+// and sex, so that the RR scores are not biased by differences in age and sex between the patients with and without a
+// diagnosis. With stratification, each combination of the race and/or ethnicity of the patients is a stratum, and the
+// cohorts are split per stratum, so that the sampling for the RR scores is matched on race and ethnicity as well.
+// Patients with an unknown race or ethnicity form a stratum of their own. The cohorts can also be stratified on
+// calendar period, so that drift in coding practice over the years, e.g. the transition from ICD-9 to ICD-10, is not
+// mistaken for an association between diagnoses. Unlike race and ethnicity, the period is not a property of a patient
+// but of the diagnosis that is counted: a patient exposed to d1 is compared with the patients of the same cohort that
+// are observed in the period of the first d1 diagnosis, i.e. whose first diagnosis falls before the end of the period
+// and whose last diagnosis falls after its start. Each cohort is therefore split into the patients observed in each
+// period, cf. Cohort.Periods, and a patient belongs to the split of each period in which the patient is observed.
+
+// Dimensions of the stratification.
+const (
+	StratifyNone      = "none"      // no stratification
+	StratifyRace      = "race"      // stratify on the race of the patients
+	StratifyEthnicity = "ethnicity" // stratify on the ethnicity of the patients
+	StratifyPeriod    = "period"    // stratify on the calendar period of the exposure, period=years for the width
+)
+
+// DefaultPeriodYears is the default width in years of the calendar periods of the period stratification.
+const DefaultPeriodYears = 10
+
+// stratumUnknown is the value of a dimension for patients for whom it is unknown.
+const stratumUnknown = "unknown"
+
+// parseStratification parses a comma separated list of stratification dimensions, e.g. race,ethnicity or race,period=5.
+// It returns nil without stratification.
+func parseStratification(stratification string) []string {
+	var dimensions []string
+	for _, dimension := range strings.Split(stratification, ",") {
+		switch dimension = strings.TrimSpace(dimension); dimension {
+		case "", StratifyNone:
+		case StratifyRace, StratifyEthnicity, StratifyPeriod:
+			dimensions = append(dimensions, dimension)
+		default:
+			if periodYears(dimension) <= 0 {
+				panic(fmt.Sprint("Unknown stratification: ", dimension))
+			}
+			dimensions = append(dimensions, dimension)
+		}
+	}
+	return dimensions
+}
+
+// periodYears returns the width in years of the calendar periods of a period dimension, period or period=years, or 0
+// if the dimension is not a valid period dimension.
+func periodYears(dimension string) int {
+	if dimension == StratifyPeriod {
+		return DefaultPeriodYears
+	}
+	value, ok := strings.CutPrefix(dimension, StratifyPeriod+"=")
+	if !ok {
+		return 0
+	}
+	years, err := strconv.Atoi(value)
+	if err != nil || years <= 0 {
+		return 0
+	}
+	return years
+}
+
+// CalendarPeriods are the calendar periods of the period stratification, which span the diagnoses of the patients.
+type CalendarPeriods struct {
+	Years int // width of the periods in years
+	First int // first year of the first period, a multiple of Years
+	Count int // nr of periods
+}
+
+// newCalendarPeriods returns the calendar periods of the given width in years that span the diagnoses of the patients,
+// e.g. 2000-2009 and 2010-2019.
+func newCalendarPeriods(patients *PatientMap, years int) *CalendarPeriods {
+	first, last, found := 0, 0, false
+	for _, p := range patients.PIDMap {
+		if n := len(p.Diagnoses); n > 0 {
+			if !found || p.Diagnoses[0].Date.Year < first {
+				first = p.Diagnoses[0].Date.Year
+			}
+			if !found || p.Diagnoses[n-1].Date.Year > last {
+				last = p.Diagnoses[n-1].Date.Year
+			}
+			found = true
+		}
+	}
+	first -= first % years
+	return &CalendarPeriods{Years: years, First: first, Count: (last-first)/years + 1}
+}
+
+// index returns the period in which a date falls, or the first or last period for a date before or after the periods.
+func (periods *CalendarPeriods) index(date DiagnosisDate) int {
+	return max(0, min(periods.Count-1, (date.Year-periods.First)/periods.Years))
+}
+
+// name returns the name of the i-th period, e.g. 2010-2019.
+func (periods *CalendarPeriods) name(i int) string {
+	start := periods.First + i*periods.Years
+	return fmt.Sprintf("%d-%d", start, start+periods.Years-1)
+}
+
+// observed returns the first and the last period in which a patient is observed, i.e. the periods of the first and the
+// last diagnosis of the patient. A patient without diagnoses is observed in no period, and then last is below first.
+func (periods *CalendarPeriods) observed(p *Patient) (first, last int) {
+	if len(p.Diagnoses) == 0 {
+		return 0, -1
+	}
+	return periods.index(p.Diagnoses[0].Date), periods.index(p.Diagnoses[len(p.Diagnoses)-1].Date)
+}
+
+// stratumKey returns the values of the given race and ethnicity dimensions for a patient, e.g. White|Not Hispanic or
+// Latino. The period dimensions are ignored, cf. CalendarPeriods.
+func stratumKey(p *Patient, dimensions []string) string {
+	var values []string
+	for _, dimension := range dimensions {
+		var value string
+		switch dimension {
+		case StratifyRace:
+			value = p.Race
+		case StratifyEthnicity:
+			value = p.Ethnicity
+		default:
+			continue
+		}
+		if value == "" {
+			value = stratumUnknown
+		}
+		values = append(values, value)
+	}
+	return strings.Join(values, "|")
+}
+
+// StratifyPatients assigns the patients to the strata of the given comma separated stratification dimensions, cf. the
+// Stratify constants. The strata are numbered in the order of their values, so that the same input always results in
+// the same cohorts. It sets the nr of strata of the patient map, 1 without stratification, and with a period dimension,
+// the calendar periods in which the cohorts are split, cf. CalendarPeriods.
+func StratifyPatients(patients *PatientMap, stratification string) {
+	dimensions := parseStratification(stratification)
+	patients.Periods = nil
+	for _, dimension := range dimensions {
+		if years := periodYears(dimension); years > 0 {
+			patients.Periods = newCalendarPeriods(patients, years)
+		}
+	}
+	counts := map[string]int{}
+	for _, p := range patients.PIDMap {
+		counts[stratumKey(p, dimensions)]++
+	}
+	strata := map[string]int{}
+	for i, key := range sortedKeys(counts) {
+		strata[key] = i
+	}
+	for _, p := range patients.PIDMap {
+		p.Stratum = strata[stratumKey(p, dimensions)]
+	}
+	patients.NofStrata = len(strata)
+	if len(dimensions) == 0 {
+		patients.NofStrata = 1
+		return
+	}
+	fmt.Println("Stratified patients on ", strings.Join(dimensions, ", "), " into ", len(strata), " strata: ")
+	for _, key := range sortedKeys(counts) {
+		fmt.Print(key, ": ", counts[key], ", ")
+	}
+	fmt.Println("")
+	if periods := patients.Periods; periods != nil {
+		fmt.Println("Split the cohorts into ", periods.Count, " calendar periods from ", periods.name(0), " to ",
+			periods.name(periods.Count-1))
+	}
+}
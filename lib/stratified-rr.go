@@ -0,0 +1,181 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"fmt"
+	"github.com/exascience/pargo/parallel"
+	"io"
+	"math"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Stratified RR scores of the diagnosis pairs, per sex or per age group. The comparison groups of the RR scores are
+// drawn from the cohorts of the exposed patients, which are split by sex and age group, cf. cohortIndex, so the RR of a
+// pair within a stratum is computed in the same way as the RR of the pair, cf. relativeRisk, but with only the exposed
+// patients of that stratum. This allows inspecting sex-specific differences of the pairs in a single run, instead of
+// running the tool twice with the male and female patient filters, and detecting pairs of which the association is
+// driven by a single age group.
+
+// sexNames are the names of the sexes in the names of the output files.
+var sexNames = [2]string{Male: "male", Female: "female"}
+
+// StratumRR is the RR score of a diagnosis pair within the patients of one stratum, e.g. one sex.
+type StratumRR struct {
+	RR       float64
+	Stats    *RRStats // nil if d1 -> d2 is unlikely within the patients of the stratum
+	Patients int      // nr of patients of the stratum diagnosed with d1 -> d2
+}
+
+// stratumRR returns the RR score of d1 -> d2 within the given stratum of stratified RR scores, or nil if it is not
+// computed.
+func stratumRR(strata [][][]*StratumRR, stratum, d1, d2 int) *StratumRR {
+	if stratum >= len(strata) || strata[stratum] == nil || strata[stratum][d1] == nil {
+		return nil
+	}
+	return strata[stratum][d1][d2]
+}
+
+// initStratifiedRR computes the RR scores of the diagnosis pairs with an RR score, cf. InitRR, within each of the
+// given nr of strata of the patients, where stratum returns the stratum of a patient, and streams is the first stream
+// of random numbers for sampling the comparison groups. It returns the RR scores per stratum and diagnosis pair. This
+// requires the patients per diagnosis and the cohorts, cf. DPatients and Cohorts.
+func (exp *Experiment) initStratifiedRR(nofStrata int, stratum func(p *Patient) int, streams uint64, minTime,
+	maxTime float64, iter int) [][][]*StratumRR {
+	strata := make([][][]*StratumRR, nofStrata)
+	for s := range strata {
+		strata[s] = make([][]*StratumRR, exp.NofDiagnosisCodes)
+	}
+	parallel.Range(0, exp.NofDiagnosisCodes, 0, func(low, high int) {
+		for d1 := low; d1 < high; d1++ {
+			exposed := make([][]*Patient, nofStrata)
+			for _, p := range exp.DPatients[d1] {
+				exposed[stratum(p)] = append(exposed[stratum(p)], p)
+			}
+			for d2, patients := range exp.DxDPatients[d1] {
+				if len(patients) == 0 {
+					continue
+				}
+				for s := range exposed {
+					if strata[s][d1] == nil {
+						strata[s][d1] = make([]*StratumRR, exp.NofDiagnosisCodes)
+					}
+					result := &StratumRR{}
+					for _, p := range patients {
+						if stratum(p) == s {
+							result.Patients++
+						}
+					}
+					if len(exposed[s]) > 0 {
+						var rng *rand.Rand
+						if exp.Seed != 0 {
+							rng = exp.Rand(streams + uint64(nofStrata*(d1*exp.NofDiagnosisCodes+d2)+s))
+						}
+						result.RR, _, result.Stats = exp.relativeRisk(d1, d2, exposed[s], patientsToIdMap(exposed[s]),
+							minTime, maxTime, iter, rng)
+					}
+					strata[s][d1][d2] = result
+				}
+			}
+		}
+	})
+	return strata
+}
+
+// InitSexRR computes the RR scores within the male and female patients of the diagnosis pairs with an RR score.
+func (exp *Experiment) InitSexRR(minTime, maxTime float64, iter int) {
+	fmt.Println("Computing the RR scores of the diagnosis pairs per sex...")
+	exp.DxDSexRR = exp.initStratifiedRR(len(sexNames), func(p *Patient) int { return p.Sex }, sexStreams, minTime,
+		maxTime, iter)
+}
+
+// InitAgeRR computes the RR scores within the patients of each age group of the diagnosis pairs with an RR score.
+func (exp *Experiment) InitAgeRR(minTime, maxTime float64, iter int) {
+	fmt.Println("Computing the RR scores of the diagnosis pairs per age group...")
+	exp.DxDAgeRR = exp.initStratifiedRR(exp.NofAgeGroups, func(p *Patient) int { return p.CohortAge }, ageStreams,
+		minTime, maxTime, iter)
+}
+
+// printStratumPair prints the RR score of a diagnosis pair within a stratum in the format of the pairs file: term1 tab
+// term2 tab RR tab p-value tab CI low tab CI high tab exposed tab exposed d2 tab comparison d2 tab patients tab code1
+// tab code2, where the RR and its statistics are NaN if the pair is unlikely within the patients of the stratum. The
+// columns are named by pairsHeader.
+func printStratumPair(exp *Experiment, file io.Writer, pair *Pair, result *StratumRR) {
+	if result == nil {
+		result = &StratumRR{}
+	}
+	RR := math.NaN()
+	if result.Stats != nil {
+		RR = result.RR
+	}
+	fmt.Fprintf(file, "%s\t%s\t%s\t%s\t%v\t%s\t%s", exp.Icd10Map[pair.First].Name, exp.Icd10Map[pair.Second].Name,
+		strconv.FormatFloat(RR, 'E', -1, 64), strings.Join(exp.cellColumns(result.Stats), "\t"),
+		exp.cellValue(float64(result.Patients), result.Patients), exp.IdMap[pair.First], exp.IdMap[pair.Second])
+}
+
+// createStratifiedPairsFile creates a file for the stratified RR scores of the selected diagnosis pairs, and calls
+// print with it.
+func createStratifiedPairsFile(name string, print func(file io.Writer)) {
+	file, err := os.Create(name)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	print(file)
+}
+
+// WriteSexPairs writes the RR scores of the selected diagnosis pairs within the patients of the given sex to a tab
+// file, cf. InitSexRR and printStratumPair, and returns the name of the file. The first line is a header.
+func WriteSexPairs(exp *Experiment, path string, sex int) string {
+	name := filepath.Join(path, fmt.Sprintf("%s-pairs-%s.tab", exp.Name, sexNames[sex]))
+	createStratifiedPairsFile(name, func(file io.Writer) {
+		fmt.Fprintln(file, strings.Join(pairsHeader(), "\t"))
+		for _, pair := range exp.Pairs {
+			printStratumPair(exp, file, pair, stratumRR(exp.DxDSexRR, sex, pair.First, pair.Second))
+			fmt.Fprintln(file)
+		}
+	})
+	return name
+}
+
+// WriteAgePairs writes the RR scores of the selected diagnosis pairs within the patients of each age group to a tab
+// file, cf. InitAgeRR, and returns the name of the file. For each diagnosis pair, it prints one line per age group,
+// from the oldest to the youngest patients, in the format of printStratumPair followed by a tab and the age group. The
+// first line is a header.
+func WriteAgePairs(exp *Experiment, path string) string {
+	name := filepath.Join(path, fmt.Sprintf("%s-pairs-by-age.tab", exp.Name))
+	createStratifiedPairsFile(name, func(file io.Writer) {
+		fmt.Fprintln(file, strings.Join(append(pairsHeader(), "ageGroup"), "\t"))
+		for _, pair := range exp.Pairs {
+			for ageGroup := range exp.DxDAgeRR {
+				printStratumPair(exp, file, pair, stratumRR(exp.DxDAgeRR, ageGroup, pair.First, pair.Second))
+				fmt.Fprintf(file, "\t%d\n", ageGroup)
+			}
+		}
+	})
+	return name
+}
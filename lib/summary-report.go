@@ -0,0 +1,149 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+)
+
+// Summary report of an experiment. The sizes of the cohorts, the frequencies of the diagnoses, the nr of diagnosis
+// pairs per significance level, and the lengths of the trajectories are collected in a single table with the columns
+// Section, Metric, and Value, as for the data quality profile, cf. DataProfile. The report is written to a csv file
+// and printed at the end of a run, except for the diagnosis frequencies, which are only written to the file.
+
+// summaryPValues are the significance levels of the diagnosis pairs that are counted in the summary report.
+var summaryPValues = []float64{0.05, 0.01, 0.001}
+
+// SummaryReport is the summary report of an experiment.
+type SummaryReport struct {
+	Metrics []*ProfileMetric
+}
+
+// add adds a row to the summary report.
+func (report *SummaryReport) add(section, metric string, value interface{}) {
+	report.Metrics = append(report.Metrics, &ProfileMetric{Section: section, Metric: metric, Value: fmt.Sprint(value)})
+}
+
+// NewSummaryReport summarizes the cohorts, diagnoses, and RR scores of an experiment, before the cohorts are released.
+// With differential privacy, the exact patient counts of the cohorts and diagnoses are left out, and small cells of
+// patients are binned, cf. cellValue.
+func NewSummaryReport(exp *Experiment, private bool) *SummaryReport {
+	report := &SummaryReport{}
+	if !private {
+		ageGroups, sexes, regions := map[int]int{}, map[int]int{}, map[int]int{}
+		diagnoses := make([]int, exp.NofDiagnosisCodes)
+		for _, cohort := range exp.Cohorts {
+			ageGroups[cohort.AgeGroup] += cohort.NofPatients
+			sexes[cohort.Sex] += cohort.NofPatients
+			regions[cohort.Region] += cohort.NofPatients
+			for did, ctr := range cohort.DCtr {
+				diagnoses[did] += ctr
+			}
+		}
+		for _, ageGroup := range sortedKeys(ageGroups) {
+			report.add("cohorts", fmt.Sprint("patients in age group ", ageGroup),
+				exp.cellValue(float64(ageGroups[ageGroup]), ageGroups[ageGroup]))
+		}
+		report.add("cohorts", "male patients", exp.cellValue(float64(sexes[Male]), sexes[Male]))
+		report.add("cohorts", "female patients", exp.cellValue(float64(sexes[Female]), sexes[Female]))
+		for _, region := range sortedKeys(regions) {
+			report.add("cohorts", fmt.Sprint("patients in region ", region),
+				exp.cellValue(float64(regions[region]), regions[region]))
+		}
+		dids := make([]int, 0, len(diagnoses))
+		for did, ctr := range diagnoses {
+			if ctr > 0 {
+				dids = append(dids, did)
+			}
+		}
+		sort.SliceStable(dids, func(i, j int) bool { return diagnoses[dids[i]] > diagnoses[dids[j]] })
+		for _, did := range dids {
+			report.add("diagnoses", fmt.Sprint(exp.IdMap[did], " ", exp.Icd10Map[did].Name),
+				exp.cellValue(float64(diagnoses[did]), diagnoses[did]))
+		}
+	}
+	computed, increased := 0, 0
+	significant := make([]int, len(summaryPValues))
+	for d1, RRs := range exp.DxDRR {
+		for d2, RR := range RRs {
+			stats := exp.rrStats(d1, d2)
+			if RR == 1.0 && stats == nil {
+				continue
+			}
+			computed++
+			if RR > 1.0 {
+				increased++
+			}
+			for i, p := range summaryPValues {
+				if stats != nil && RR > 1.0 && stats.PValue < p {
+					significant[i]++
+				}
+			}
+		}
+	}
+	report.add("pairs", "pairs with an RR score", computed)
+	report.add("pairs", "pairs with RR > 1", increased)
+	if exp.DxDStats != nil {
+		for i, p := range summaryPValues {
+			report.add("pairs", fmt.Sprint("pairs with RR > 1 and p < ", p), significant[i])
+		}
+	}
+	return report
+}
+
+// AddTrajectories adds the selected pairs and a histogram of the lengths of the trajectories of an experiment to the
+// summary report.
+func (report *SummaryReport) AddTrajectories(exp *Experiment) {
+	report.add("pairs", "pairs selected for trajectories", len(exp.Pairs))
+	rare := 0
+	for _, pair := range exp.Pairs {
+		if exp.rare(pair.First, pair.Second) {
+			rare++
+		}
+	}
+	report.add("pairs", "rare pairs selected for trajectories", rare)
+	lengths := map[int]int{}
+	for _, t := range exp.Trajectories {
+		lengths[len(t.Diagnoses)]++
+	}
+	report.add("trajectories", "trajectories", len(exp.Trajectories))
+	for _, length := range sortedKeys(lengths) {
+		report.add("trajectories", fmt.Sprint("trajectories of length ", length), lengths[length])
+	}
+}
+
+// Log prints the summary report, except for the diagnosis frequencies.
+func (report *SummaryReport) Log() {
+	fmt.Println("Summary:")
+	for _, metric := range report.Metrics {
+		if metric.Section != "diagnoses" {
+			fmt.Println(metric.Section, ": ", metric.Metric, ": ", metric.Value)
+		}
+	}
+}
+
+// WriteSummaryReport writes the summary report of an experiment to a csv file with the columns Section, Metric, and
+// Value. It returns the file name.
+func WriteSummaryReport(exp *Experiment, report *SummaryReport, path string) string {
+	fileName := filepath.Join(path, fmt.Sprintf("%s-summary.csv", exp.Name))
+	writeMetricsCSV(report.Metrics, fileName)
+	return fileName
+}
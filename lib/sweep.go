@@ -0,0 +1,252 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Sensitivity analysis of the trajectories to the parameters with which they are built. The experiment is run once,
+// and the trajectories are then rebuilt from the same RR matrix for each setting of a grid of values of minYears,
+// maxYears, RR, and minPatients, cf. BuildTrajectories. The pairs of a setting are the patients diagnosed with the pair
+// within the time frame of the setting, which must lie within the time frame of the experiment, since the patients of
+// the pairs are only collected within that time frame, cf. InitRR. For each setting, the nr of pairs and trajectories is
+// reported, together with which of the top trajectories of the experiment persist, i.e. are rebuilt with the setting.
+
+// sweepTopTrajectories is the nr of trajectories with the most patients of the experiment of which the persistence
+// across the settings is reported.
+const sweepTopTrajectories = 10
+
+// SweepGrid holds the values of the parameters of a sensitivity analysis. Parameters that are not part of the grid have
+// the value of the experiment.
+type SweepGrid struct {
+	MinYears, MaxYears, RR []float64
+	MinPatients            []int
+}
+
+// SweepSetting is a setting of the parameters of a sensitivity analysis with the trajectories built with it.
+type SweepSetting struct {
+	MinYears, MaxYears, RR float64
+	MinPatients            int
+	Pairs                  int
+	Trajectories           int
+	Persists               []bool // whether each top trajectory of the experiment is rebuilt with the setting
+}
+
+// ParseSweepGrid parses a grid of parameter values of the form minYears=0,0.5;maxYears=5,10;RR=1,1.5;minPatients=50,100,
+// in which each parameter is optional and defaults to its value in the given parameters. The time frames must lie within
+// the time frame of the parameters.
+func ParseSweepGrid(s string, args *ExperimentParams) (*SweepGrid, error) {
+	grid := &SweepGrid{}
+	for _, entry := range strings.Split(s, ";") {
+		key, values, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid sweep parameter, expected name=values: %s", entry)
+		}
+		for _, value := range strings.Split(values, ",") {
+			value = strings.TrimSpace(value)
+			var err error
+			switch key {
+			case "minYears", "maxYears", "RR":
+				var f float64
+				if f, err = strconv.ParseFloat(value, 64); err == nil {
+					switch key {
+					case "minYears":
+						grid.MinYears = append(grid.MinYears, f)
+					case "maxYears":
+						grid.MaxYears = append(grid.MaxYears, f)
+					default:
+						grid.RR = append(grid.RR, f)
+					}
+				}
+			case "minPatients":
+				var n int
+				if n, err = strconv.Atoi(value); err == nil {
+					grid.MinPatients = append(grid.MinPatients, n)
+				}
+			default:
+				return nil, fmt.Errorf("unknown sweep parameter: %s", key)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid value of sweep parameter %s: %s", key, value)
+			}
+		}
+	}
+	if grid.MinYears == nil {
+		grid.MinYears = []float64{args.MinYears}
+	}
+	if grid.MaxYears == nil {
+		grid.MaxYears = []float64{args.MaxYears}
+	}
+	if grid.RR == nil {
+		grid.RR = []float64{args.RR}
+	}
+	if grid.MinPatients == nil {
+		grid.MinPatients = []int{args.MinPatients}
+	}
+	for _, minYears := range grid.MinYears {
+		if minYears < args.MinYears {
+			return nil, fmt.Errorf("the sweep value %v of minYears is below the minYears of the experiment", minYears)
+		}
+	}
+	for _, maxYears := range grid.MaxYears {
+		if maxYears > args.MaxYears {
+			return nil, fmt.Errorf("the sweep value %v of maxYears is above the maxYears of the experiment", maxYears)
+		}
+	}
+	return grid, nil
+}
+
+// settings returns the settings of the grid, with maxYears varying slowest and minPatients fastest, leaving out the
+// settings of which the time frame is empty.
+func (grid *SweepGrid) settings() []*SweepSetting {
+	var settings []*SweepSetting
+	for _, maxYears := range grid.MaxYears {
+		for _, minYears := range grid.MinYears {
+			if minYears > maxYears {
+				continue
+			}
+			for _, rr := range grid.RR {
+				for _, minPatients := range grid.MinPatients {
+					settings = append(settings, &SweepSetting{MinYears: minYears, MaxYears: maxYears, RR: rr,
+						MinPatients: minPatients})
+				}
+			}
+		}
+	}
+	return settings
+}
+
+// pairPatients returns the patients of the diagnosis pairs of the experiment restricted to the given time frame.
+func (exp *Experiment) pairPatients(minTime, maxTime float64) [][][]*Patient {
+	result := MakeDxDPatients(exp.NofDiagnosisCodes)
+	for d1, row := range exp.DxDPatients {
+		for d2, patients := range row {
+			for _, p := range patients {
+				if ctr, _ := countPatientDiagnosisPair(p, d1, d2, minTime, maxTime); ctr > 0 {
+					result[d1][d2] = append(result[d1][d2], p)
+				}
+			}
+		}
+	}
+	return result
+}
+
+// Sweep rebuilds the trajectories of the experiment for each setting of the grid, with the given trajectory lengths
+// and filters, and returns the settings and the top trajectories of the experiment of which the persistence is
+// reported. The experiment is built with the given time frame.
+func (exp *Experiment) Sweep(grid *SweepGrid, maxLength, minLength int, minTime, maxTime float64,
+	filters []TrajectoryFilter) ([]*SweepSetting, []*Trajectory) {
+	top := exp.selectTrajectories(exp.Trajectories, sweepTopTrajectories, 0)
+	pairPatients := map[[2]float64][][][]*Patient{{minTime, maxTime}: exp.DxDPatients}
+	settings := grid.settings()
+	for i, setting := range settings {
+		fmt.Println("Building the trajectories of sweep setting ", i+1, " of ", len(settings), "...")
+		window := [2]float64{setting.MinYears, setting.MaxYears}
+		if _, ok := pairPatients[window]; !ok {
+			pairPatients[window] = exp.pairPatients(setting.MinYears, setting.MaxYears)
+		}
+		sweep := *exp
+		sweep.DxDPatients = pairPatients[window]
+		hashes := map[string]bool{}
+		for _, t := range sweep.BuildTrajectories(setting.MinPatients, maxLength, minLength, setting.MinYears,
+			setting.MaxYears, setting.RR, filters) {
+			hashes[t.Hash] = true
+		}
+		setting.Pairs, setting.Trajectories = len(sweep.Pairs), len(sweep.Trajectories)
+		for _, t := range top {
+			setting.Persists = append(setting.Persists, hashes[t.Hash])
+		}
+	}
+	return settings, top
+}
+
+// WriteSweep writes the results of a sensitivity analysis to two files, and returns their names:
+//   - name-sweep.tab, with a line per setting: minYears tab maxYears tab RR tab minPatients tab nr of pairs tab nr of
+//     trajectories tab nr of top trajectories of the experiment that persist.
+//   - name-sweep-persistence.tab, with a line per top trajectory of the experiment: TID tab hash tab terms tab codes tab
+//     nr of settings in which the trajectory persists tab nr of settings.
+func WriteSweep(exp *Experiment, settings []*SweepSetting, top []*Trajectory, path string) (string, string) {
+	name := filepath.Join(path, fmt.Sprintf("%s-sweep.tab", exp.Name))
+	file, err := os.Create(name)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	persists := make([]int, len(top))
+	for _, setting := range settings {
+		n := 0
+		for i, ok := range setting.Persists {
+			if ok {
+				n++
+				persists[i]++
+			}
+		}
+		fmt.Fprintf(file, "%v\t%v\t%v\t%d\t%d\t%d\t%d\n", setting.MinYears, setting.MaxYears, setting.RR,
+			setting.MinPatients, setting.Pairs, setting.Trajectories, n)
+	}
+	persistenceName := filepath.Join(path, fmt.Sprintf("%s-sweep-persistence.tab", exp.Name))
+	persistenceFile, err := os.Create(persistenceName)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := persistenceFile.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	for i, t := range top {
+		terms, codes := make([]string, len(t.Diagnoses)), make([]string, len(t.Diagnoses))
+		for j, did := range t.Diagnoses {
+			terms[j], codes[j] = exp.Icd10Map[did].Name, exp.IdMap[did]
+		}
+		fmt.Fprintf(persistenceFile, "%d\t%s\t%s\t%s\t%d\t%d\n", t.ID, t.Hash, strings.Join(terms, " -> "),
+			strings.Join(codes, " -> "), persists[i], len(settings))
+	}
+	return name, persistenceName
+}
+
+// RunSweep runs a TriNetX experiment with the given parameters, and then a sensitivity analysis of its trajectories
+// on the grid of parameter values of args.Sweep, cf. ParseSweepGrid. The outputs of the experiment are written as for a
+// regular run, and the results of the sensitivity analysis to name-sweep.tab and name-sweep-persistence.tab.
+func RunSweep(args *ExperimentParams) error {
+	grid, err := ParseSweepGrid(args.Sweep, args)
+	if err != nil {
+		return err
+	}
+	if args.DPEpsilon > 0 {
+		return errors.New("a sensitivity analysis cannot be combined with differential privacy")
+	}
+	return runExperiment(args, func(exp *Experiment, patients *PatientMap) {
+		settings, top := exp.Sweep(grid, args.MaxTrajectoryLength, args.MinTrajectoryLength, args.MinYears,
+			args.MaxYears, GetTrajectoryFilters(args.TFilters, exp))
+		sweepFile, persistenceFile := WriteSweep(exp, settings, top, filepath.Join(args.OutputPath, args.Name))
+		exp.Audit.Wrote(sweepFile, false)
+		exp.Audit.Wrote(persistenceFile, false)
+	})
+}
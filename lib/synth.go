@@ -0,0 +1,343 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"encoding/csv"
+	"fmt"
+	"github.com/imec-int/ptra/lib/utils"
+	"math"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Generation of synthetic TriNetX data. The generator writes patient, diagnosis, tumor and treatment files in the same
+// csv format as the TriNetX exports parsed by ptra. Each patient gets a number of random background diagnoses, drawn
+// from a code vocabulary with a uniform, skewed (Zipf), or weighted distribution, e.g. with the frequencies of the codes
+// in a real dataset. On top of this, known trajectories are injected for a fraction of the patients, so that the output
+// of ptra on the synthetic data can be checked against a ground truth.
+
+// Code distributions for drawing background diagnoses.
+const (
+	SynthUniform  = "uniform"
+	SynthZipf     = "zipf"
+	SynthWeighted = "weighted" // codes are drawn proportionally to their weights, cf. LoadSynthCodes
+)
+
+// Names of the files written by the synthetic data generator.
+const (
+	SynthPatientFile     = "patient.csv"
+	SynthDiagnosisFile   = "diagnosis.csv"
+	SynthTumorFile       = "tumor.csv"
+	SynthTreatmentFile   = "treatments.csv"
+	SynthTrajectoryFile  = "injected-trajectories.tab"
+	synthLastYear        = 2022 // no events are generated after this year
+	synthBladderCancer   = "C67.9"
+	synthTrajectoryYears = 2.0 // maximum nr of years between subsequent diagnoses of an injected trajectory
+)
+
+// DefaultSynthCodes returns a vocabulary of common ICD10-CM codes used for background diagnoses when no vocabulary is
+// given. All codes occur in the 2022 ICD10-CM tabular file.
+func DefaultSynthCodes() []string {
+	return []string{
+		"I10", "E11.9", "E78.5", "J44.9", "I50.9", "F32.9", "K21.9", "M54.5", "M17.9", "J45.909", "G47.33", "E66.9",
+		"I25.10", "I48.91", "N39.0", "N18.30", "E03.9", "F41.9", "G43.909", "K57.30", "M81.0", "N40.0", "D64.9",
+		"I63.9", "J18.9", "L40.0", "E55.9", "H25.9", "K80.20", "N20.0", "I70.0", "C61", "C34.90", "C50.919",
+	}
+}
+
+// SynthParams contains the parameters for generating synthetic data.
+type SynthParams struct {
+	OutputPath        string     // directory where the generated files are written
+	NofPatients       int        // nr of patients to generate
+	MeanDiagnoses     float64    // mean nr of background diagnoses per patient
+	Codes             []string   // vocabulary of ICD10 codes for background diagnoses
+	Weights           []float64  // weight of each code for the weighted code distribution
+	CodeDistribution  string     // uniform, zipf, or weighted
+	Trajectories      [][]string // trajectories to inject, as lists of ICD10 codes
+	TrajectoryRate    float64    // fraction of patients that follows each injected trajectory
+	BladderCancerRate float64    // fraction of patients with bladder cancer, tumor info and treatments
+	MinYOB, MaxYOB    int        // range of years of birth
+	Seed              uint64     // seed for the random generator, the same seed generates the same data
+}
+
+// ParseSynthTrajectories parses a list of trajectories of the form "I10,E11.9,N18.30;J44.9,I50.9".
+func ParseSynthTrajectories(s string) [][]string {
+	var result [][]string
+	for _, t := range strings.Split(s, ";") {
+		var codes []string
+		for _, code := range strings.Split(t, ",") {
+			if trimmed := strings.TrimSpace(code); trimmed != "" {
+				codes = append(codes, trimmed)
+			}
+		}
+		if len(codes) > 0 {
+			result = append(result, codes)
+		}
+	}
+	return result
+}
+
+// LoadSynthCodes reads a vocabulary for background diagnoses from a csv file with a code column, and optionally a
+// weight column for the weighted code distribution, e.g. the nr of occurrences of the codes in a real dataset. Codes
+// without weight have weight 1.
+func LoadSynthCodes(file string) ([]string, []float64, error) {
+	var codes []string
+	var weights []float64
+	var weightErr error
+	err := readCSVTable(file, []string{"code", "weight"}, func(values []string) {
+		if values[0] == "" {
+			return
+		}
+		weight := 1.0
+		if values[1] != "" {
+			var err error
+			if weight, err = strconv.ParseFloat(values[1], 64); (err != nil || weight < 0) && weightErr == nil {
+				weightErr = fmt.Errorf("%s: invalid weight for code %s: %s", file, values[0], values[1])
+			}
+		}
+		codes = append(codes, values[0])
+		weights = append(weights, weight)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if weightErr != nil {
+		return nil, nil, weightErr
+	}
+	if len(codes) == 0 {
+		return nil, nil, fmt.Errorf("%s: no codes found in a code column", file)
+	}
+	return codes, weights, nil
+}
+
+// synthGenerator holds the state of the generator.
+type synthGenerator struct {
+	params     *SynthParams
+	rnd        *rand.Rand
+	zipf       *rand.Zipf
+	cumulative []float64 // cumulative weights of the codes for the weighted code distribution
+}
+
+// drawCode draws a code from the vocabulary, using the requested code distribution.
+func (g *synthGenerator) drawCode() string {
+	if g.zipf != nil {
+		return g.params.Codes[g.zipf.Uint64()]
+	}
+	if g.cumulative != nil {
+		r := g.rnd.Float64() * g.cumulative[len(g.cumulative)-1]
+		return g.params.Codes[sort.SearchFloat64s(g.cumulative, r)]
+	}
+	return g.params.Codes[g.rnd.IntN(len(g.params.Codes))]
+}
+
+// drawDate draws a random date between the given years (inclusive).
+func (g *synthGenerator) drawDate(fromYear, toYear int) DiagnosisDate {
+	year := fromYear
+	if toYear > fromYear {
+		year += g.rnd.IntN(toYear - fromYear + 1)
+	}
+	return DiagnosisDate{Year: year, Month: 1 + g.rnd.IntN(12), Day: 1 + g.rnd.IntN(28)}
+}
+
+// addYears returns a date that is a fractional number of years later than the given date.
+func addYears(d DiagnosisDate, years float64) DiagnosisDate {
+	days := int(math.Round(years * 365.25))
+	t := dateToTime(d).AddDate(0, 0, days)
+	return DiagnosisDate{Year: t.Year(), Month: int(t.Month()), Day: t.Day()}
+}
+
+// clampDate returns the given date, or the end date if the given date is later.
+func clampDate(date, end DiagnosisDate) DiagnosisDate {
+	if DiagnosisDateSmallerThan(end, date) {
+		return end
+	}
+	return date
+}
+
+// formatTriNetXDate formats a date as a TriNetX date string (YYYY-MM-DD).
+func formatTriNetXDate(d DiagnosisDate) string {
+	return fmt.Sprintf("%04d-%02d-%02d", d.Year, d.Month, d.Day)
+}
+
+// synthPatient is a generated patient.
+type synthPatient struct {
+	pid       string
+	sex       string
+	yob       int
+	death     *DiagnosisDate
+	end       DiagnosisDate // last date of the events, the end of the year before death or of synthLastYear
+	diagnoses []synthDiagnosis
+}
+
+type synthDiagnosis struct {
+	code string
+	date DiagnosisDate
+}
+
+// generatePatient generates a patient with background diagnoses and injected trajectories. The dates of the injected
+// trajectories are clamped to the end of the events of the patient, so that no diagnosis is dated after death or after
+// synthLastYear.
+func (g *synthGenerator) generatePatient(i int) *synthPatient {
+	p := &synthPatient{pid: fmt.Sprint(i + 1), sex: "M", yob: g.params.MinYOB}
+	if g.rnd.IntN(2) == 1 {
+		p.sex = "F"
+	}
+	if g.params.MaxYOB > g.params.MinYOB {
+		p.yob += g.rnd.IntN(g.params.MaxYOB - g.params.MinYOB + 1)
+	}
+	lastYear := synthLastYear
+	if g.rnd.Float64() < 0.2 {
+		death := g.drawDate(utils.MinInt(p.yob+40, synthLastYear), synthLastYear)
+		death.Day = 1 // TriNetX only stores month and year of death
+		p.death = &death
+		lastYear = death.Year - 1
+	}
+	p.end = DiagnosisDate{Year: lastYear, Month: 12, Day: 31}
+	firstYear := utils.MinInt(p.yob+1, lastYear)
+	// background diagnoses
+	n := int(math.Round(g.rnd.ExpFloat64() * g.params.MeanDiagnoses))
+	for j := 0; j < n; j++ {
+		p.diagnoses = append(p.diagnoses, synthDiagnosis{code: g.drawCode(), date: g.drawDate(firstYear, lastYear)})
+	}
+	// injected trajectories
+	for _, t := range g.params.Trajectories {
+		if g.rnd.Float64() >= g.params.TrajectoryRate {
+			continue
+		}
+		span := float64(len(t)-1) * synthTrajectoryYears
+		date := g.drawDate(firstYear, utils.MaxInt(firstYear, lastYear-int(math.Ceil(span))))
+		for _, code := range t {
+			p.diagnoses = append(p.diagnoses, synthDiagnosis{code: code, date: clampDate(date, p.end)})
+			date = addYears(date, 0.5+g.rnd.Float64()*(synthTrajectoryYears-0.5))
+		}
+	}
+	return p
+}
+
+// synthTNM draws a random TNM stage for a bladder cancer tumor.
+func (g *synthGenerator) synthTNM() (string, string, string) {
+	ts := []string{"Ta", "Tis", "T1", "T2", "T2a", "T3", "T3a", "T4", "T4a"}
+	ns := []string{"N0", "N0", "N0", "N1", "N2", "N3"}
+	ms := []string{"M0", "M0", "M0", "M1"}
+	return ts[g.rnd.IntN(len(ts))], ns[g.rnd.IntN(len(ns))], ms[g.rnd.IntN(len(ms))]
+}
+
+// GenerateSyntheticData generates synthetic TriNetX input files.
+func GenerateSyntheticData(params *SynthParams) error {
+	if params.NofPatients <= 0 {
+		return fmt.Errorf("number of patients must be positive, got %d", params.NofPatients)
+	}
+	if len(params.Codes) == 0 {
+		params.Codes = DefaultSynthCodes()
+	}
+	if err := os.MkdirAll(params.OutputPath, 0700); err != nil {
+		return err
+	}
+	g := &synthGenerator{params: params, rnd: rand.New(rand.NewPCG(params.Seed, synthStream))}
+	switch params.CodeDistribution {
+	case "", SynthUniform:
+	case SynthZipf:
+		g.zipf = rand.NewZipf(g.rnd, 1.1, 1.0, uint64(len(params.Codes)-1))
+	case SynthWeighted:
+		if len(params.Weights) != len(params.Codes) {
+			return fmt.Errorf("the weighted code distribution requires a weight for each of the %d codes",
+				len(params.Codes))
+		}
+		total := 0.0
+		for _, weight := range params.Weights {
+			total += weight
+			g.cumulative = append(g.cumulative, total)
+		}
+		if total <= 0 {
+			return fmt.Errorf("the weighted code distribution requires a positive total weight")
+		}
+	default:
+		return fmt.Errorf("unknown code distribution: %s", params.CodeDistribution)
+	}
+	files := map[string]*csv.Writer{}
+	for _, name := range []string{SynthPatientFile, SynthDiagnosisFile, SynthTumorFile, SynthTreatmentFile} {
+		file, err := os.Create(filepath.Join(params.OutputPath, name))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w := csv.NewWriter(file)
+		defer w.Flush()
+		files[name] = w
+	}
+	null := triNetXNull
+	nofDiagnoses, nofTumors := 0, 0
+	for i := 0; i < params.NofPatients; i++ {
+		p := g.generatePatient(i)
+		death := null
+		if p.death != nil {
+			death = fmt.Sprintf("%04d%02d", p.death.Year, p.death.Month)
+		}
+		files[SynthPatientFile].Write([]string{p.pid, p.sex, null, null, fmt.Sprint(p.yob), null, null, null, null, null,
+			death, null})
+		for _, d := range p.diagnoses {
+			files[SynthDiagnosisFile].Write([]string{p.pid, null, "ICD-10-CM", d.code, null, null, null,
+				formatTriNetXDate(d.date), null, null})
+			nofDiagnoses++
+		}
+		if g.rnd.Float64() >= params.BladderCancerRate {
+			continue
+		}
+		// bladder cancer diagnosis with tumor staging and treatments
+		date := g.drawDate(utils.MinInt(p.yob+40, p.end.Year), p.end.Year)
+		files[SynthDiagnosisFile].Write([]string{p.pid, null, "ICD-10-CM", synthBladderCancer, null, null, null,
+			formatTriNetXDate(date), null, null})
+		nofDiagnoses++
+		t, n, m := g.synthTNM()
+		files[SynthTumorFile].Write([]string{p.pid, formatTriNetXDate(date), null, null, synthBladderCancer, null, null,
+			null, null, null, "TNM_" + t, "TNM_" + n, "TNM_" + m})
+		nofTumors++
+		treatments := []string{null, null, null}
+		for j := range treatments {
+			if g.rnd.Float64() < 0.3 {
+				treatments[j] = formatTriNetXDate(clampDate(addYears(date, g.rnd.Float64()), p.end))
+			}
+		}
+		files[SynthTreatmentFile].Write([]string{p.pid, null, p.sex, null, null, null, fmt.Sprint(p.yob), null, death,
+			null, treatments[0], treatments[1], null, treatments[2], null})
+	}
+	for _, w := range files {
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return err
+		}
+	}
+	// write the ground truth
+	file, err := os.Create(filepath.Join(params.OutputPath, SynthTrajectoryFile))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	for _, t := range params.Trajectories {
+		fmt.Fprintf(file, "%s\n", strings.Join(t, "\t"))
+	}
+	fmt.Println("Generated ", params.NofPatients, " patients with ", nofDiagnoses, " diagnoses and ", nofTumors,
+		" tumors in: ", params.OutputPath)
+	return nil
+}
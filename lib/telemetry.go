@@ -0,0 +1,138 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Per-stage resource telemetry. To help size HPC allocations, the wall time, peak memory, heap allocations, and number
+// of goroutines are recorded for each stage of the pipeline and reported in the run manifest.
+
+// Pipeline stages.
+const (
+	StageParse        = "parse"
+	StageFilter       = "filter"
+	StageRR           = "rr"
+	StageTrajectories = "trajectories"
+	StageExport       = "export"
+	StageCluster      = "cluster"
+)
+
+// goroutineSampleInterval is the interval at which the number of goroutines is sampled during a stage.
+const goroutineSampleInterval = 10 * time.Millisecond
+
+// StageTelemetry records the resources used by a stage of the pipeline.
+type StageTelemetry struct {
+	Stage          string  `json:"stage"`
+	WallSeconds    float64 `json:"wallSeconds"`    // elapsed wall-clock time
+	PeakRSSBytes   uint64  `json:"peakRSSBytes"`   // peak resident set size of the process at the end of the stage
+	Allocations    uint64  `json:"allocations"`    // number of heap objects allocated during the stage
+	AllocatedBytes uint64  `json:"allocatedBytes"` // number of bytes allocated on the heap during the stage
+	PeakGoroutines int     `json:"peakGoroutines"` // maximum number of goroutines sampled during the stage
+}
+
+// Telemetry records the resources used by the stages of a run. Stages run one after the other. A nil Telemetry ignores
+// all stages.
+type Telemetry struct {
+	Stages     []*StageTelemetry
+	current    *StageTelemetry
+	start      time.Time
+	mallocs    uint64
+	totalAlloc uint64
+	peak       atomic.Int64
+	stop       chan struct{}
+	sampler    sync.WaitGroup
+}
+
+// NewTelemetry creates an empty telemetry record.
+func NewTelemetry() *Telemetry {
+	return &Telemetry{}
+}
+
+// Begin ends the current stage, if any, and starts recording the given stage.
+func (t *Telemetry) Begin(stage string) {
+	if t == nil {
+		return
+	}
+	t.End()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	t.current = &StageTelemetry{Stage: stage}
+	t.start = time.Now()
+	t.mallocs, t.totalAlloc = stats.Mallocs, stats.TotalAlloc
+	t.peak.Store(int64(runtime.NumGoroutine()))
+	t.stop = make(chan struct{})
+	t.sampler.Add(1)
+	go t.sampleGoroutines()
+}
+
+// sampleGoroutines keeps track of the maximum number of goroutines until the current stage ends. The sampler itself
+// is not counted.
+func (t *Telemetry) sampleGoroutines() {
+	defer t.sampler.Done()
+	ticker := time.NewTicker(goroutineSampleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.stop:
+			return
+		case <-ticker.C:
+			if n := int64(runtime.NumGoroutine() - 1); n > t.peak.Load() {
+				t.peak.Store(n)
+			}
+		}
+	}
+}
+
+// End ends the current stage, if any, and adds it to the recorded stages.
+func (t *Telemetry) End() {
+	if t == nil || t.current == nil {
+		return
+	}
+	close(t.stop)
+	t.sampler.Wait()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	stage := t.current
+	stage.WallSeconds = time.Since(t.start).Seconds()
+	stage.PeakRSSBytes = peakRSS()
+	stage.Allocations = stats.Mallocs - t.mallocs
+	stage.AllocatedBytes = stats.TotalAlloc - t.totalAlloc
+	stage.PeakGoroutines = int(t.peak.Load())
+	t.Stages = append(t.Stages, stage)
+	t.current = nil
+}
+
+// Log prints the recorded stages.
+func (t *Telemetry) Log() {
+	if t == nil {
+		return
+	}
+	fmt.Println("Resources per stage:")
+	for _, stage := range t.Stages {
+		fmt.Printf("%-12s wall: %8.2fs, peak RSS: %6d MiB, allocations: %10d (%d MiB), peak goroutines: %d\n",
+			stage.Stage, stage.WallSeconds, stage.PeakRSSBytes>>20, stage.Allocations, stage.AllocatedBytes>>20,
+			stage.PeakGoroutines)
+	}
+}
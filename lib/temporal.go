@@ -0,0 +1,183 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"fmt"
+	"time"
+)
+
+// Temporal sanity checks. After parsing, the dates of the patients are checked for consistency: diagnoses should not be
+// dated before birth, after death, or in the future, and patients should not die before their event of interest. Rows
+// that pass the validation of the input files can still fail these checks, since they combine information of multiple
+// files. Depending on the policy, offending dates are only flagged, dropped, or clamped to the nearest valid date.
+
+// Policies for handling dates that fail a temporal check.
+const (
+	TemporalFlag  = "flag"  // only count the offending dates
+	TemporalDrop  = "drop"  // drop offending diagnoses and death dates
+	TemporalClamp = "clamp" // move offending dates to the nearest valid date
+)
+
+// Temporal checks.
+const (
+	CheckBeforeBirth    = "diagnosis before birth"
+	CheckAfterDeath     = "diagnosis after death"
+	CheckDeathBeforeEOI = "death before event of interest"
+	CheckFutureDate     = "future date"
+)
+
+// temporalChecks lists the temporal checks in the order in which they are applied and reported.
+var temporalChecks = []string{CheckDeathBeforeEOI, CheckFutureDate, CheckBeforeBirth, CheckAfterDeath}
+
+// CheckSummary counts how often a check failed, and how the failures were handled.
+type CheckSummary struct {
+	Flagged, Dropped, Clamped int
+}
+
+// add counts a failed check that was handled according to the given policy.
+func (summary *CheckSummary) add(policy string) {
+	summary.Flagged++
+	switch policy {
+	case TemporalDrop:
+		summary.Dropped++
+	case TemporalClamp:
+		summary.Clamped++
+	}
+}
+
+// ParseReferenceDate parses the date that the temporal checks use as today, formatted as YYYY-MM-DD. It returns the
+// current date if the date is empty.
+func ParseReferenceDate(date string) (DiagnosisDate, error) {
+	if date == "" {
+		now := time.Now()
+		return DiagnosisDate{Year: now.Year(), Month: int(now.Month()), Day: now.Day()}, nil
+	}
+	reference, err := parseTriNetXDate(date)
+	if err != nil || len(date) != 10 {
+		return DiagnosisDate{}, fmt.Errorf("invalid reference date: %s", date)
+	}
+	return reference, nil
+}
+
+// monthAfter checks if date d1 falls in a later month than date d2. Death dates are only known up to the month.
+func monthAfter(d1, d2 DiagnosisDate) bool {
+	return d1.Year > d2.Year || (d1.Year == d2.Year && d1.Month > d2.Month)
+}
+
+// checkPatientDates applies the temporal checks to a single patient. If the diagnosis of the event of interest is
+// dropped or clamped, the event of interest becomes the first remaining diagnosis for which isEventOfInterest holds, if
+// any. It returns true if any date of the patient was dropped or changed.
+func checkPatientDates(p *Patient, policy string, today DiagnosisDate, isEventOfInterest func(did int) bool,
+	report *ValidationReport) bool {
+	changed, eoiChanged := false, false
+	// death dates: before the event of interest, or in the future
+	if p.DeathDate != nil && p.EOIDate != nil && monthAfter(*p.EOIDate, *p.DeathDate) {
+		report.Checks[CheckDeathBeforeEOI].add(policy)
+		switch policy {
+		case TemporalDrop:
+			p.DeathDate, changed = nil, true
+		case TemporalClamp:
+			p.DeathDate, changed = &DiagnosisDate{Year: p.EOIDate.Year, Month: p.EOIDate.Month, Day: 1}, true
+		}
+	}
+	if p.DeathDate != nil && monthAfter(*p.DeathDate, today) {
+		report.Checks[CheckFutureDate].add(policy)
+		switch policy {
+		case TemporalDrop:
+			p.DeathDate, changed = nil, true
+		case TemporalClamp:
+			p.DeathDate, changed = &DiagnosisDate{Year: today.Year, Month: today.Month, Day: 1}, true
+		}
+	}
+	// diagnosis dates: in the future, before birth, or after death
+	birth := DiagnosisDate{Year: p.YOB, Month: 1, Day: 1}
+	diagnoses := p.Diagnoses[:0]
+	for _, d := range p.Diagnoses {
+		failed, date := false, d.Date
+		if DiagnosisDateSmallerThan(today, d.Date) {
+			report.Checks[CheckFutureDate].add(policy)
+			failed = true
+			if policy == TemporalClamp {
+				d.Date = today
+			}
+		}
+		if d.Date.Year < p.YOB {
+			report.Checks[CheckBeforeBirth].add(policy)
+			failed = true
+			if policy == TemporalClamp {
+				d.Date = birth
+			}
+		}
+		if p.DeathDate != nil && monthAfter(d.Date, *p.DeathDate) {
+			report.Checks[CheckAfterDeath].add(policy)
+			failed = true
+			if policy == TemporalClamp {
+				d.Date = *p.DeathDate
+			}
+		}
+		if failed && policy != TemporalFlag {
+			changed = true
+			if p.EOIDate != nil && date == *p.EOIDate && isEventOfInterest(d.DID) {
+				eoiChanged = true
+			}
+		}
+		if !failed || policy != TemporalDrop {
+			diagnoses = append(diagnoses, d)
+		}
+	}
+	p.Diagnoses = diagnoses
+	if eoiChanged {
+		p.EOIDate = nil
+		for _, d := range p.Diagnoses {
+			if isEventOfInterest(d.DID) && (p.EOIDate == nil || DiagnosisDateSmallerThan(d.Date, *p.EOIDate)) {
+				date := d.Date
+				p.EOIDate = &date
+			}
+		}
+	}
+	return changed
+}
+
+// CheckTemporalSanity applies the temporal checks to all patients, using the given date as today, and handles offending
+// dates according to the policy. The events of interest are the diagnoses for which isEventOfInterest holds, cf.
+// checkPatientDates. The failed checks are summarized in the validation report.
+func CheckTemporalSanity(patients *PatientMap, policy string, today DiagnosisDate, isEventOfInterest func(did int) bool,
+	report *ValidationReport) {
+	switch policy {
+	case "":
+		policy = TemporalFlag
+	case TemporalFlag, TemporalDrop, TemporalClamp:
+	default:
+		panic(fmt.Sprint("Unknown temporal check policy: ", policy))
+	}
+	fmt.Println("Checking dates of diagnoses, deaths, and events of interest...")
+	for _, check := range temporalChecks {
+		report.Checks[check] = &CheckSummary{}
+	}
+	for _, pid := range patients.sortedPIDs() {
+		p := patients.PIDMap[pid]
+		if checkPatientDates(p, policy, today, isEventOfInterest, report) {
+			// clamped dates may change the order of the diagnoses
+			SortDiagnoses(p)
+			CompactDiagnoses(p)
+		}
+	}
+	report.LogChecks()
+}
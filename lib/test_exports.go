@@ -23,7 +23,67 @@ var ParseTriNetXPatientData = parseTriNetXPatientData
 var InitializeIcd10AnalysisMaps = initializeIcd10AnalysisMaps
 var InitializeIcd10NameMap = initializeIcd10NameMap
 var InitializeIcd10AnalysisMapsFromXML = initializeIcd10AnalysisMapsFromXML
+var InitializeIcd10AnalysisMapsFromCCSR = initializeIcd10AnalysisMapsFromCCSR
 var ParseTrinetXPatientDiagnoses = parseTrinetXPatientDiagnoses
 var ParseIcd10HierarchyFromXml = parseIcd10HierarchyFromXml
 var PrintIcd10Hierarchy = printIcd10Hierarchy
 var PrintIcd10NameMap = printIcd10NameMap
+var WithinYears = withinYears
+var IsBladderSite = isBladderSite
+var ParseFHIRPatients = parseFHIRPatients
+var ParseFHIRConditions = parseFHIRConditions
+var ParseOMOPPatients = parseOMOPPatients
+var ParseOMOPConditions = parseOMOPConditions
+var ParseMIMICPatients = parseMIMICPatients
+var ParseMIMICDiagnoses = parseMIMICDiagnoses
+var InitializeSNOMEDAnalysisMaps = initializeSNOMEDAnalysisMaps
+var InitializeICD11AnalysisMaps = initializeICD11AnalysisMaps
+var InitializeClaMLAnalysisMaps = initializeClaMLAnalysisMaps
+var InitializeCustomAnalysisMaps = initializeCustomAnalysisMaps
+var InitializeICD9AnalysisMaps = initializeICD9AnalysisMaps
+var ParseTriNetXProcedures = parseTriNetXProcedures
+var ParseTriNetXLabResults = parseTriNetXLabResults
+var ParseEnrollmentFile = parseEnrollmentFile
+var CountPatientDiagnosisPair = countPatientDiagnosisPair
+var SaveExperimentState = saveExperimentState
+var LoadExperimentState = loadExperimentState
+var ApplyDIDMapping = applyDIDMapping
+var SaveDIDMapping = saveDIDMapping
+var ParseCSVPatientData = parseCSVPatientData
+var ParseCSVDiagnoses = parseCSVDiagnoses
+var SignS3Request = signS3Request
+var ParseSNOMEDToIcd10Mapping = parseSNOMEDToIcd10Mapping
+var PrintClusterGraphs = printClusterGraphs
+var FisherExactGreater = fisherExactGreater
+var DirectionalityPValue = directionalityPValue
+var SelectMatchedControls = selectMatchedControls
+var CoxHazardRatio = coxHazardRatio
+var SelectionRR = (*Experiment).selectionRR
+var NewRRStats = newRRStats
+var Rare = (*Experiment).rare
+var Censored = (*Experiment).censored
+var BenjaminiHochberg = benjaminiHochberg
+var ResamplePatients = resamplePatients
+var PairPower = pairPower
+var PatientYearsAtRisk = patientYearsAtRisk
+var RRNoiseScale = (*PrivacyBudget).rrNoiseScale
+var CountNoiseScale = (*PrivacyBudget).countNoiseScale
+var PrintPairsToTabFile = printPairsToTabFile
+var MaxRowIssues = maxRowIssues
+var CheckTriNetXPatientRow = checkTriNetXPatientRow
+var CheckTriNetXDiagnosisRow = checkTriNetXDiagnosisRow
+var CheckTriNetXProcedureRow = checkTriNetXProcedureRow
+var CheckTriNetXLabRow = checkTriNetXLabRow
+var CheckTriNetXTumorRow = checkTriNetXTumorRow
+var CheckTreatmentRow = (*TreatmentSchema).checkRow
+var ValidateDuplicateOptions = validateDuplicateOptions
+var CountDeaths = countDeaths
+var AttributableFraction = (*Experiment).attributableFraction
+var ExcessIncidence = (*Experiment).excessIncidence
+var ParseTriNetXTreatmentFile = parseTriNetXTreatmentFile
+var ComparisonCohort = (*Experiment).comparisonCohort
+var ManifestParameters = manifestParameters
+var InputChecksums = inputChecksums
+var SelectDiagnosisPairs = (*Experiment).selectDiagnosisPairs
+var MeanYearsSinceIndex = meanYearsSinceIndex
+var DiagnosisWeight = (*Experiment).diagnosisWeight
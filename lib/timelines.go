@@ -0,0 +1,195 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"html/template"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Patient timelines, for validating trajectories against the histories of individual patients. For a list of requested
+// patients, the timeline lists all mapped diagnoses of a patient in the order of their dates, and marks the diagnoses
+// that match a trajectory the patient contributed to, cf. matchPatientTrajectory. The timelines are written as a csv
+// file, and as an html page with a table per patient in which the matched diagnoses are highlighted.
+
+// TimelineEntry is a diagnosis on the timeline of a patient.
+type TimelineEntry struct {
+	Date         string
+	DID          int
+	Code         string
+	Name         string
+	Secondary    bool
+	Trajectories []int // IDs of the trajectories of which the diagnosis is a match
+}
+
+// Timeline is the timeline of a patient.
+type Timeline struct {
+	PIDString string // pseudonymized if the experiment has a pseudonymizer
+	Entries   []*TimelineEntry
+}
+
+// Matched returns whether the diagnosis matches a trajectory.
+func (entry *TimelineEntry) Matched() bool {
+	return len(entry.Trajectories) > 0
+}
+
+// TrajectoryIDs returns the IDs of the trajectories of which the diagnosis is a match, separated by spaces.
+func (entry *TimelineEntry) TrajectoryIDs() string {
+	ids := make([]string, len(entry.Trajectories))
+	for i, tid := range entry.Trajectories {
+		ids[i] = strconv.Itoa(tid)
+	}
+	return strings.Join(ids, " ")
+}
+
+// ParseTimelinePatients returns the patient ids of a comma separated list, or of a file with a patient id per line.
+func ParseTimelinePatients(patients string) []string {
+	if _, err := os.Stat(patients); err != nil {
+		return strings.Split(patients, ",")
+	}
+	file, err := os.Open(patients)
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+	var pids []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if pid := strings.TrimSpace(scanner.Text()); pid != "" {
+			pids = append(pids, pid)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		panic(err)
+	}
+	return pids
+}
+
+// newTimelines returns the timelines of the requested patients. The diagnoses of the trajectories are matched within
+// the given time frame. Patients that are not in the experiment are skipped.
+func newTimelines(exp *Experiment, patients *PatientMap, pids []string, minTime, maxTime float64) []*Timeline {
+	var timelines []*Timeline
+	entries := map[*Diagnosis]*TimelineEntry{}
+	requested := map[*Patient]bool{}
+	for _, pidString := range pids {
+		p, ok := GetPatient(strings.TrimSpace(pidString), patients)
+		if !ok {
+			fmt.Println("Timeline patient ", pidString, " not found.")
+			continue
+		}
+		requested[p] = true
+		timeline := &Timeline{PIDString: exp.Pseudonymizer.Pseudonym(p.PIDString)}
+		for _, d := range p.Diagnoses {
+			entry := &TimelineEntry{Date: formatTriNetXDate(d.Date), DID: d.DID, Code: exp.IdMap[d.DID],
+				Name: exp.Icd10Map[d.DID].Name, Secondary: d.Secondary}
+			entries[d] = entry
+			timeline.Entries = append(timeline.Entries, entry)
+		}
+		timelines = append(timelines, timeline)
+	}
+	for _, t := range exp.Trajectories {
+		if len(t.Patients) == 0 {
+			continue
+		}
+		for _, p := range t.Patients[len(t.Patients)-1] {
+			if !requested[p] {
+				continue
+			}
+			for _, d := range matchPatientTrajectory(p, t.Diagnoses, minTime, maxTime) {
+				entries[d].Trajectories = append(entries[d].Trajectories, t.ID)
+			}
+		}
+	}
+	return timelines
+}
+
+// timelinesTemplate is the html page of the timelines, with a table per patient.
+var timelinesTemplate = template.Must(template.New("timelines").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>ptra patient timelines</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+td, th { border: 1px solid #ccc; padding: 0.2em 0.6em; text-align: left; }
+tr.matched { background-color: #fdd; font-weight: bold; }
+</style>
+</head>
+<body>
+<h1>ptra patient timelines</h1>
+{{range .}}<h2>{{.PIDString}}</h2>
+<table>
+<tr><th>Date</th><th>Code</th><th>Diagnosis</th><th>Trajectories</th></tr>
+{{range .Entries}}<tr{{if .Matched}} class="matched"{{end}}><td>{{.Date}}</td><td>{{.Code}}</td>
+<td>{{.Name}}{{if .Secondary}} (secondary){{end}}</td><td>{{.TrajectoryIDs}}</td></tr>
+{{end}}</table>
+{{end}}</body>
+</html>
+`))
+
+// WriteTimelines writes the timelines of the requested patients to a csv file, with the header
+// PIDString,Date,DID,Code,Name,Secondary,Trajectories, and to an html page. It returns the file names.
+func WriteTimelines(exp *Experiment, patients *PatientMap, pids []string, path string, minTime,
+	maxTime float64) (string, string) {
+	timelines := newTimelines(exp, patients, pids, minTime, maxTime)
+	csvFileName := filepath.Join(path, fmt.Sprintf("%s-timelines.csv", exp.Name))
+	csvFile, err := os.Create(csvFileName)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := csvFile.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	writer := csv.NewWriter(csvFile)
+	writer.Write([]string{"PIDString", "Date", "DID", "Code", "Name", "Secondary", "Trajectories"})
+	for _, timeline := range timelines {
+		for _, entry := range timeline.Entries {
+			writer.Write([]string{timeline.PIDString, entry.Date, strconv.Itoa(entry.DID), entry.Code, entry.Name,
+				strconv.FormatBool(entry.Secondary), entry.TrajectoryIDs()})
+		}
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		panic(err)
+	}
+	htmlFileName := filepath.Join(path, fmt.Sprintf("%s-timelines.html", exp.Name))
+	htmlFile, err := os.Create(htmlFileName)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := htmlFile.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	if err := timelinesTemplate.Execute(htmlFile, timelines); err != nil {
+		panic(err)
+	}
+	fmt.Println("Wrote the timelines of ", len(timelines), " patients.")
+	return csvFileName, htmlFileName
+}
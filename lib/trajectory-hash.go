@@ -0,0 +1,48 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// Stable trajectory IDs. The analysis IDs of trajectories are assigned in the order in which they are discovered, so
+// that the same trajectory gets a different ID in runs with different parameters, or even in reruns with the same
+// parameters. The hash of a trajectory is derived from the sequence of its diagnosis codes instead, so that the
+// trajectories of different runs can be diffed and joined on their hashes.
+
+// trajectoryHashLength is the number of bytes of the SHA-256 digest that are kept in a trajectory hash.
+const trajectoryHashLength = 8
+
+// TrajectoryHash returns the hash of a sequence of diagnosis codes, as a hexadecimal string.
+func TrajectoryHash(codes []string) string {
+	digest := sha256.Sum256([]byte(strings.Join(codes, "\n")))
+	return hex.EncodeToString(digest[:trajectoryHashLength])
+}
+
+// trajectoryHash returns the hash of a trajectory, from the codes of its diagnoses, cf. TrajectoryHash.
+func (exp *Experiment) trajectoryHash(t *Trajectory) string {
+	codes := make([]string, len(t.Diagnoses))
+	for i, did := range t.Diagnoses {
+		codes[i] = exp.IdMap[did]
+	}
+	return TrajectoryHash(codes)
+}
@@ -0,0 +1,91 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Selecting the trajectories for output. Large cohorts produce hundreds of thousands of trajectories, too many to review
+// in the tab and graph files. The selection keeps the trajectories whose transitions all have a minimum RR score, and of
+// those the trajectories with the most patients. The selected trajectories keep their IDs and their order, so that the
+// outputs of a run with and without selection can be compared.
+
+// trajectorySupport returns the number of patients that follow a trajectory up to its last diagnosis.
+func trajectorySupport(t *Trajectory) int {
+	if len(t.PatientNumbers) == 0 {
+		return 0
+	}
+	return t.PatientNumbers[len(t.PatientNumbers)-1]
+}
+
+// minTrajectoryRR returns the lowest RR score of the transitions of a trajectory.
+func (exp *Experiment) minTrajectoryRR(t *Trajectory) float64 {
+	minRR := 0.0
+	for i := 0; i+1 < len(t.Diagnoses); i++ {
+		if RR := exp.DxDRR[t.Diagnoses[i]][t.Diagnoses[i+1]]; i == 0 || RR < minRR {
+			minRR = RR
+		}
+	}
+	return minRR
+}
+
+// SelectTrajectories restricts the trajectories of the experiment to the trajectories whose transitions all have an RR
+// score of at least minEdgeRR, and of those to the top trajectories with the most patients. A top of 0 keeps all
+// trajectories, a minEdgeRR of 0 does not filter on RR.
+func (exp *Experiment) SelectTrajectories(top int, minEdgeRR float64) {
+	if top <= 0 && minEdgeRR <= 0 {
+		return
+	}
+	selected := exp.selectTrajectories(exp.Trajectories, top, minEdgeRR)
+	fmt.Println("Selected ", len(selected), " of ", len(exp.Trajectories), " trajectories for output.")
+	exp.Trajectories = selected
+}
+
+// selectTrajectories returns the given trajectories whose transitions all have an RR score of at least minEdgeRR, and
+// of those the top trajectories with the most patients, in their original order, cf. SelectTrajectories.
+func (exp *Experiment) selectTrajectories(trajectories []*Trajectory, top int, minEdgeRR float64) []*Trajectory {
+	var selected []*Trajectory
+	for _, t := range trajectories {
+		if minEdgeRR <= 0 || exp.minTrajectoryRR(t) >= minEdgeRR {
+			selected = append(selected, t)
+		}
+	}
+	if top > 0 && len(selected) > top {
+		ranked := make([]*Trajectory, len(selected))
+		copy(ranked, selected)
+		sort.Slice(ranked, func(i, j int) bool {
+			si, sj := trajectorySupport(ranked[i]), trajectorySupport(ranked[j])
+			return si > sj || si == sj && ranked[i].ID < ranked[j].ID
+		})
+		keep := map[*Trajectory]bool{}
+		for _, t := range ranked[:top] {
+			keep[t] = true
+		}
+		var topSelected []*Trajectory
+		for _, t := range selected {
+			if keep[t] {
+				topSelected = append(topSelected, t)
+			}
+		}
+		selected = topSelected
+	}
+	return selected
+}
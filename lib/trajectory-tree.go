@@ -0,0 +1,139 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/imec-int/ptra/lib/utils"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Condensed output of trajectories as a prefix forest. Many trajectories share a prefix, e.g. A -> B -> C and
+// A -> B -> D, and repeat it in the tab and graph files. The forest merges the common prefixes: it has a tree per first
+// diagnosis, and a path from a root to a node for each prefix of the trajectories. A node carries the nr of patients of
+// the transition into it, the largest over the trajectories with that prefix, cf. printTrajectoriesSankey, and the IDs
+// of the trajectories that end in it. The children of a node are sorted on their nr of patients, most first.
+
+// TrajectoryTreeNode is a node of the prefix forest of the trajectories.
+type TrajectoryTreeNode struct {
+	DID          int                   `json:"did"`
+	Code         string                `json:"code"`
+	Name         string                `json:"name"`
+	Patients     int                   `json:"patients,omitempty"`     // nr of patients of the transition into the node
+	RR           string                `json:"RR,omitempty"`           // RR of the transition into the node, as in GML
+	Trajectories []int                 `json:"trajectories,omitempty"` // IDs of the trajectories that end in the node
+	Children     []*TrajectoryTreeNode `json:"children,omitempty"`
+}
+
+// child returns the child of a node for a diagnosis, and adds it if the node has no such child.
+func (node *TrajectoryTreeNode) child(did int, exp *Experiment) *TrajectoryTreeNode {
+	for _, c := range node.Children {
+		if c.DID == did {
+			return c
+		}
+	}
+	c := &TrajectoryTreeNode{DID: did, Code: exp.IdMap[did], Name: exp.Icd10Map[did].Name}
+	node.Children = append(node.Children, c)
+	return c
+}
+
+// sortChildren sorts the children of a node and its descendants on their nr of patients, most first, and then on DID.
+func (node *TrajectoryTreeNode) sortChildren() {
+	sort.Slice(node.Children, func(i, j int) bool {
+		ci, cj := node.Children[i], node.Children[j]
+		return ci.Patients > cj.Patients || ci.Patients == cj.Patients && ci.DID < cj.DID
+	})
+	for _, c := range node.Children {
+		sort.Ints(c.Trajectories)
+		c.sortChildren()
+	}
+}
+
+// newTrajectoryForest merges the trajectories of an experiment into a prefix forest, and returns its roots.
+func newTrajectoryForest(exp *Experiment) []*TrajectoryTreeNode {
+	forest := &TrajectoryTreeNode{} // the roots are the children of a sentinel node
+	for _, t := range exp.Trajectories {
+		node := forest
+		for idx, did := range t.Diagnoses {
+			node = node.child(did, exp)
+			if idx > 0 {
+				node.Patients = utils.MaxInt(node.Patients, t.PatientNumbers[idx-1])
+				node.RR = strconv.FormatFloat(exp.DxDRR[t.Diagnoses[idx-1]][did], 'f', 2, 64)
+			}
+		}
+		node.Trajectories = append(node.Trajectories, t.ID)
+	}
+	forest.sortChildren()
+	sort.Slice(forest.Children, func(i, j int) bool { return forest.Children[i].DID < forest.Children[j].DID })
+	return forest.Children
+}
+
+// printTrajectoryTreeNode prints a node of the prefix forest and its descendants as indented lines.
+func printTrajectoryTreeNode(node *TrajectoryTreeNode, depth int, w io.Writer) {
+	line := fmt.Sprintf("%s%s (%s)", strings.Repeat("  ", depth), node.Name, node.Code)
+	if depth > 0 {
+		line = fmt.Sprintf("%s: %d patients, RR %s", line, node.Patients, node.RR)
+	}
+	if len(node.Trajectories) > 0 {
+		line = fmt.Sprint(line, " ", node.Trajectories)
+	}
+	fmt.Fprintln(w, line)
+	for _, c := range node.Children {
+		printTrajectoryTreeNode(c, depth+1, w)
+	}
+}
+
+// printTrajectoriesTree prints the prefix forest of an experiment's trajectories to a json file and to a text file.
+// The text file has a line per node, indented by its depth in the forest, with the name and the code of the diagnosis,
+// the nr of patients and the RR of the transition into the node, and the IDs of the trajectories that end in it
+// between brackets.
+func printTrajectoriesTree(exp *Experiment, jsonName, textName string) {
+	forest := newTrajectoryForest(exp)
+	jsonFile, err := os.Create(jsonName)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := jsonFile.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	encoder := json.NewEncoder(jsonFile)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(forest); err != nil {
+		panic(err)
+	}
+	textFile, err := os.Create(textName)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := textFile.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	for _, root := range forest {
+		printTrajectoryTreeNode(root, 0, textFile)
+	}
+}
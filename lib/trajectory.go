@@ -19,6 +19,7 @@
 package lib
 
 import (
+	"bufio"
 	"encoding/csv"
 	"fmt"
 	"github.com/exascience/pargo/parallel"
@@ -26,20 +27,24 @@ import (
 	"github.com/valyala/fastrand"
 	"io"
 	"math"
+	"math/rand/v2"
 	"os"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // Trajectory holds all data relevant to a disease trajectory.
 type Trajectory struct {
-	Diagnoses      []int            // A list of diagnosis codes that represent the trajectory
-	PatientNumbers []int            // A list with nr of patients for each transition in the trajectory
-	Patients       [][]*Patient     // A list of patients with the given trajectory
-	TrajMap        map[*Patient]int // Maps patient IDs onto a diagnosis index for trajectory tracking
-	ID             int              // An analysis id
-	Cluster        int              // A cluster ID to which this trajectory is assigned to
+	Diagnoses      []int             // A list of diagnosis codes that represent the trajectory
+	PatientNumbers []int             // A list with nr of patients for each transition in the trajectory
+	Patients       [][]*Patient      // A list of patients with the given trajectory
+	TrajMap        map[*Patient]int  // Maps patient IDs onto a diagnosis index for trajectory tracking
+	ID             int               // An analysis id
+	Hash           string            // A hash of the diagnosis codes that is stable across runs, cf. TrajectoryHash
+	Cluster        int               // A cluster ID to which this trajectory is assigned to
+	Gaps           []*TransitionGaps // The time gaps of the transitions, cf. InitTransitionGaps
 }
 
 const (
@@ -49,15 +54,22 @@ const (
 
 // Patient represents patient information.
 type Patient struct {
-	PID       int            // analysis ID
-	PIDString string         // ID from TriNetX
-	YOB       int            // year of birth
-	CohortAge int            // age range a patient belongs to
-	Sex       int            // 0 = male, 1 = female
-	Diagnoses []*Diagnosis   // list of patient's diagnoses, sorted by date <, unique diagnosis per date
-	EOIDate   *DiagnosisDate // Event of interest date, e.g. day of cancer diagnosis
-	DeathDate *DiagnosisDate // Date of death
-	Region    int            // Region where the patient lives
+	PID            int            // analysis ID
+	PIDString      string         // ID from TriNetX
+	YOB            int            // year of birth
+	CohortAge      int            // age range a patient belongs to
+	Sex            int            // 0 = male, 1 = female
+	Diagnoses      []*Diagnosis   // list of patient's diagnoses, sorted by date <, unique diagnosis per date
+	EOIDate        *DiagnosisDate // Event of interest date, e.g. day of cancer diagnosis
+	DeathDate      *DiagnosisDate // Date of death
+	TreatmentDate  *DiagnosisDate // Date of the first treatment from the treatment file
+	EnrollmentDate *DiagnosisDate // Start of the first observation period, nil without one, cf. enrollment.go
+	IndexDate      *DiagnosisDate // Index date from which the timeline starts, nil without index date, cf. alignment.go
+	Region         int            // Region where the patient lives
+	Race           string         // race as in the input, empty if unknown
+	Ethnicity      string         // ethnicity as in the input, empty if unknown
+	Stratum        int            // race/ethnicity stratum of the cohorts the patient belongs to, cf. StratifyPatients
+	Comorbidities  int            // nr of distinct diagnoses, only set for matching, cf. InitComorbidityMatching
 }
 
 // AppendPatient appends a patient to a slice of patients, unless that patient is already a member of that slice.
@@ -113,16 +125,25 @@ func DiagnosisDateSmallerThan(d1, d2 DiagnosisDate) bool {
 	return false
 }
 
-// DiagnosisDateToFloat converts a diagnosis date to a floating point number.
+// DiagnosisDateToFloat converts a diagnosis date to a floating point number. The result is only an approximation, use
+// the functions in dates.go for date arithmetic.
 func DiagnosisDateToFloat(d DiagnosisDate) float64 {
 	return float64(d.Year) + float64(d.Month)/12.0 + float64(d.Day)/365.0
 }
 
+// dateToTime converts a diagnosis date to a time value, for date arithmetic.
+func dateToTime(d DiagnosisDate) time.Time {
+	return time.Date(d.Year, time.Month(d.Month), d.Day, 0, 0, 0, 0, time.UTC)
+}
+
 // Diagnosis represents a diagnosis for a patient.
 type Diagnosis struct {
-	PID, DID int
-	Date     DiagnosisDate
-	Icd10    Icd10Entry
+	PID, DID  int
+	Date      DiagnosisDate
+	Icd10     Icd10Entry
+	Encounter string // encounter ID from the input, empty if unknown
+	Visit     int    // visit of the diagnosis when the diagnoses of a visit are unordered, cf. GroupVisits, 0 otherwise
+	Secondary bool   // whether the input marks the diagnosis as a secondary diagnosis, cf. principal diagnoses
 }
 
 // AddDiagnosis appends a diagnosis to a patient's list of diagnoses.
@@ -148,7 +169,8 @@ func diagnosisEqual(d1, d2 *Diagnosis) bool {
 	return d1.DID == d2.DID && d1.PID == d2.PID && diagnosisDateEqual(d1.Date, d2.Date)
 }
 
-// CompactDiagnoses makes a sorted diagnosis list contain unique diagnoses for a patient. Want to avoid over counting diagnoses.
+// CompactDiagnoses makes a sorted diagnosis list contain unique diagnoses for a patient. Want to avoid over counting
+// diagnoses. A diagnosis that is both a primary and a secondary diagnosis is kept as a primary diagnosis.
 func CompactDiagnoses(p *Patient) {
 	if len(p.Diagnoses) > 1 {
 		diagnoses := p.Diagnoses
@@ -159,6 +181,8 @@ func CompactDiagnoses(p *Patient) {
 			if !diagnosisEqual(curDiagnosis, diagnosis) {
 				curDiagnosis = diagnosis
 				newDiagnoses = append(newDiagnoses, curDiagnosis)
+			} else if !diagnosis.Secondary {
+				curDiagnosis.Secondary = false
 			}
 		}
 		p.Diagnoses = newDiagnoses
@@ -173,6 +197,9 @@ type PatientMap struct {
 	// optional info for logging
 	MaleCtr   int
 	FemaleCtr int
+	NofStrata int              // nr of race/ethnicity strata of the cohorts, 0 or 1 without stratification
+	Periods   *CalendarPeriods // calendar periods of the cohorts, cf. strata.go, nil without period stratification
+	Warnings  *WarningLog      // rows of the input that were skipped while parsing, cf. warnings.go
 }
 
 // GetPatient retrieves from a patient map the patient object associated with a given patient ID. The patient ID is
@@ -186,6 +213,16 @@ func GetPatient(pidString string, patients *PatientMap) (*Patient, bool) {
 	return patient, ok
 }
 
+// sortedPIDs returns the PIDs of the patients in increasing order, for iterating over the patients in a stable order.
+func (patients *PatientMap) sortedPIDs() []int {
+	pids := make([]int, 0, len(patients.PIDMap))
+	for pid := range patients.PIDMap {
+		pids = append(pids, pid)
+	}
+	sort.Ints(pids)
+	return pids
+}
+
 //Experiment representation
 
 // Cohort represents a specific group of patients from the population stratified by age, sex, and region. The population
@@ -193,9 +230,12 @@ func GetPatient(pidString string, patients *PatientMap) (*Patient, bool) {
 // this could be one for each possible age range apart by 10 years: [0-10], [10-20],[20-30]...[100-120].
 type Cohort struct {
 	AgeGroup, Sex, Region, NofPatients, NofDiagnoses int
-	DCtr                                             []int        //counts nr of patients per DID
-	DPatients                                        [][]*Patient //contains a list of patients per DID
-	Patients                                         []*Patient   //the patients in this cohort
+	Stratum                                          int                //race/ethnicity stratum, cf. StratifyPatients
+	DCtr                                             []int              //counts nr of patients per DID
+	DPatients                                        [][]*Patient       //contains a list of patients per DID
+	Patients                                         []*Patient         //the patients in this cohort
+	Comorbidities                                    map[int][]*Patient //the patients per nr of distinct diagnoses, cf. InitComorbidityMatching
+	Periods                                          []*Cohort          //the patients observed in each calendar period, cf. strata.go, nil without period stratification
 }
 
 // MakeDxDRR makes a diagnosis by diagnosis-sized matrix for storing the relative risk score for each possible diagnosis
@@ -225,65 +265,127 @@ func MakeDxDPatients(size int) [][][]*Patient {
 // Experiment contains the inputs and outputs for calculating diagnosis trajectories for a specific patient population.
 type Experiment struct {
 	NofAgeGroups, NofRegions, Level, NofDiagnosisCodes int
-	DxDRR                                              [][]float64        // per disease pair, relative risk score (RR)
-	DxDPatients                                        [][][]*Patient     // per disease pair, all patients diagnosed
-	DPatients                                          [][]*Patient       // per disease, all patients diagnosed
-	Cohorts                                            []*Cohort          // cohorts in the experiment
-	Name                                               string             // Name of the experiment, for printing
-	Icd10Map                                           map[int]Icd10Entry // maps diagnosis ID to Icd10Entry
-	Trajectories                                       []*Trajectory      // a list of computed trajectories
-	Pairs                                              []*Pair            // a list of all selected pairs that are used to compute trajectories
-	IdMap                                              map[int]string     // maps the analysis DID to the original diagnostic ID used in the input data
-	MCtr, FCtr                                         int                // counters for counting nr of males,females,patients
-}
-
-// selectCohort returns from a list of cohorts a cohort that matches a specific age group, sex, and region.
-func selectCohort(cohorts []*Cohort, nofAgeGroups, nofRegions, sex, ageGroup, region int) *Cohort {
-	cIndex := cohortIndex(nofAgeGroups, nofRegions, sex, ageGroup, region)
+	DxDRR                                              [][]float64          // per disease pair, relative risk score (RR)
+	DxDPatients                                        [][][]*Patient       // per disease pair, all patients diagnosed
+	DxDStats                                           [][]*RRStats         // per disease pair, statistics of the RR score, cf. RRStats
+	DxDHazardRatios                                    [][]float64          // per disease pair, hazard ratio of the pair, cf. hazard-ratio.go, nil unless computed
+	DxDDirectionality                                  [][]float64          // per disease pair, p-value of the directionality of the pair, cf. directionality.go
+	DxDSexRR                                           [][][]*StratumRR     // per sex and disease pair, RR score within the patients of the sex, cf. stratified-rr.go, nil unless computed
+	DxDAgeRR                                           [][][]*StratumRR     // per age group and disease pair, RR score within the patients of the age group, nil unless computed
+	DPatients                                          [][]*Patient         // per disease, all patients diagnosed
+	Cohorts                                            []*Cohort            // cohorts in the experiment
+	Periods                                            *CalendarPeriods     // calendar periods of the cohorts, cf. strata.go, nil without period stratification
+	Name                                               string               // Name of the experiment, for printing
+	Icd10Map                                           map[int]Icd10Entry   // maps diagnosis ID to Icd10Entry
+	Trajectories                                       []*Trajectory        // a list of computed trajectories
+	Pairs                                              []*Pair              // a list of all selected pairs that are used to compute trajectories
+	PairGaps                                           []*PairGaps          // time gaps of the selected pairs, in the order of Pairs, cf. pair-gaps.go, nil unless computed
+	PairAges                                           []*PairAges          // transition ages of the selected pairs, in the order of Pairs, cf. pair-ages.go, nil unless computed
+	DPatientYears                                      []float64            // patient-years at risk of the patients with each diagnosis, cf. attributable-risk.go, nil unless computed
+	IdMap                                              map[int]string       // maps the analysis DID to the original diagnostic ID used in the input data
+	MCtr, FCtr                                         int                  // counters for counting nr of males,females,patients
+	Pseudonymizer                                      *Pseudonymizer       // replaces patient IDs in outputs, nil keeps the input IDs
+	Seed                                               uint64               // seed for random sampling, 0 for non-reproducible sampling
+	UnmappedCodes                                      *UnmappedCodeReport  // diagnosis codes dropped while parsing the input
+	Warnings                                           *WarningLog          // rows of the input skipped while parsing, cf. warnings.go
+	Duplicates                                         *DuplicateReport     // duplicate records found while parsing the input
+	Audit                                              *AuditLog            // records the outputs written, nil if audit logging is disabled
+	IndexDate                                          string               // index date from which the patient timelines start, cf. alignment.go
+	Stratification                                     string               // race, ethnicity, and calendar-period dimensions of the cohorts, e.g. race,period=5, cf. strata.go
+	SecondaryWeight                                    float64              // weight of secondary diagnoses in the RR scores, between 0 and 1
+	MinCellSize                                        int                  // patient counts below this size are suppressed in the outputs, cf. small-cells.go
+	MatchedControls                                    int                  // nr of controls matched to each exposed patient, cf. matching.go, 0 for sampling from similar cohorts
+	ComorbidityFallbacks                               int64                // nr of matched controls drawn without the same nr of comorbidities, updated atomically
+	PairTest                                           string               // test of the significance of the diagnosis pairs, cf. the PairTest constants
+	MaxPValue                                          float64              // maximum p-value of the RR scores of the diagnosis pairs, 0 for DefaultMaxPValue
+	ContinuityCorrection                               float64              // added to the cells of the 2x2 tables of the RR scores with a zero cell, cf. rare-pairs.go
+	MinCount                                           int                  // nr of d2 diagnoses in the exposed or comparison group below which pairs are rare
+	Censoring                                          bool                 // censor the exposed patients at death or the end of the data, cf. censoring.go
+	EndDate                                            DiagnosisDate        // end of the data for censoring
+	RRBound                                            string               // bound of the RR scores that is compared with the minimum RR, cf. significance.go
+	Metric                                             string               // effect size of the pairs that is reported besides the RR, cf. the Metric constants
+	MaxDirectionalityP                                 float64              // maximum directionality p-value of the pairs that trajectories are built from, 0 for no filter
+	Clusterings                                        []*ResultsClustering // clusters of the trajectories per granularity, cf. ClusterTrajectories
+	Privacy                                            *PrivacyBudget       // budget of the differential privacy mode, cf. privacy.go, nil if disabled
+}
+
+// Rand returns a random generator for a given stream of random numbers. If the experiment has a seed, the generator is
+// derived from the seed and the stream, so that results are reproducible, also when the streams are consumed in parallel.
+// Otherwise, the generator is randomly seeded.
+func (exp *Experiment) Rand(stream uint64) *rand.Rand {
+	if exp.Seed == 0 {
+		return rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64()))
+	}
+	return rand.New(rand.NewPCG(exp.Seed, stream))
+}
+
+// The streams of random numbers, cf. Experiment.Rand. The comparison groups of a diagnosis pair d1 -> d2 are sampled
+// from stream d1 * NofDiagnosisCodes + d2. The other uses of random numbers start at a power of two above that, with a
+// stream per replicate, per trajectory, or per diagnosis pair and stratum, so that no two uses share a stream. The
+// synthetic input data is drawn from its own stream, with the seed of the synthetic data. The noise of differential
+// privacy is not drawn from a stream, cf. noiseRand.
+const (
+	synthStream       = 1 << 56 // synthetic input data, cf. synth.go
+	mortalityStreams  = 1 << 57 // non-followers of each trajectory, cf. mortality.go
+	bootstrapStreams  = 1 << 58 // resampled patients of each bootstrap replicate, cf. bootstrap.go
+	permutationStream = 1 << 59 // permuted group labels of the permutation test, cf. permutation-test.go
+	ageStreams        = 1 << 60 // comparison groups of each age stratum of a pair, cf. stratified-rr.go
+	sexStreams        = 1 << 61 // comparison groups of each sex stratum of a pair, cf. stratified-rr.go
+	hazardStreams     = 1 << 62 // controls of each diagnosis pair, cf. hazard-ratio.go
+)
+
+// selectCohort returns from a list of cohorts a cohort that matches a specific age group, sex, region, and stratum.
+func selectCohort(cohorts []*Cohort, nofAgeGroups, nofRegions, sex, ageGroup, region, stratum int) *Cohort {
+	cIndex := cohortIndex(nofAgeGroups, nofRegions, sex, ageGroup, region, stratum)
 	return cohorts[cIndex]
 }
 
-// cohortIndex computes the index of a specific cohort in a cohort array. This index is derived from the sex and age
-// group:
+// cohortIndex computes the index of a specific cohort in a cohort array. This index is derived from the stratum, sex and
+// age group:
 // cohorts: [Males: [age: 10-20] [age: 20-30] ... [age: 100-120] Females: [age: 10-20], [age: 20-30] ... [age: 100-120]]
-func cohortIndex(nofAgegroups, nofRegions, sex, ageGroup, region int) int {
-	return sex*nofAgegroups + ageGroup
+// repeated for each race/ethnicity stratum.
+func cohortIndex(nofAgegroups, nofRegions, sex, ageGroup, region, stratum int) int {
+	return (stratum*2+sex)*nofAgegroups + ageGroup
 }
 
-// makeCohorts creates cohorts for a requested nr of age groups, nr of regions, and nr of diagnosis codes used in patient
-// records. Creates empty cohorts for both male and females, for every age group, one for each possible age range.
-func makeCohorts(nofAgeGroups, nofRegions, nofDiagnoses int) []*Cohort {
+// makeCohorts creates cohorts for a requested nr of age groups, nr of regions, nr of strata, and nr of diagnosis codes
+// used in patient records. Creates empty cohorts for both male and females, for every age group, one for each possible
+// age range, and this for every stratum.
+func makeCohorts(nofAgeGroups, nofRegions, nofStrata, nofDiagnoses int) []*Cohort {
 	// Create empty cohorts
 	nofCohorts := nofAgeGroups * 2 //#age groups x #sexes
-	cohorts := make([]*Cohort, nofCohorts)
-	sex := Male
-	ageGroup := 0
-	region := 0
-	femaleCohortIndex := int(math.Floor(float64(nofCohorts / 2)))
-	for i := 0; i < nofCohorts; i++ {
-		// first fill in male cohorts, then female cohorts
-		// check if need to switch to filling in female cohorts
-		if i >= femaleCohortIndex && sex != Female {
-			sex = Female
-			ageGroup = 0
-			region = 0
-		}
-		cohort := &Cohort{
-			AgeGroup:     ageGroup,
-			Sex:          sex,
-			NofPatients:  0,
-			NofDiagnoses: 0,
-			Region:       region,
-			DCtr:         make([]int, nofDiagnoses),
-			DPatients:    make([][]*Patient, nofDiagnoses),
-			Patients:     []*Patient{},
-		}
-		cohorts[i] = cohort
-		if ageGroup == nofAgeGroups-1 { //switch to next region
-			ageGroup = 0
-			region++
-		} else {
-			ageGroup++ //next age group
+	cohorts := make([]*Cohort, 0, nofCohorts*nofStrata)
+	for stratum := 0; stratum < nofStrata; stratum++ {
+		sex := Male
+		ageGroup := 0
+		region := 0
+		femaleCohortIndex := int(math.Floor(float64(nofCohorts / 2)))
+		for i := 0; i < nofCohorts; i++ {
+			// first fill in male cohorts, then female cohorts
+			// check if need to switch to filling in female cohorts
+			if i >= femaleCohortIndex && sex != Female {
+				sex = Female
+				ageGroup = 0
+				region = 0
+			}
+			cohort := &Cohort{
+				AgeGroup:     ageGroup,
+				Sex:          sex,
+				NofPatients:  0,
+				NofDiagnoses: 0,
+				Region:       region,
+				Stratum:      stratum,
+				DCtr:         make([]int, nofDiagnoses),
+				DPatients:    make([][]*Patient, nofDiagnoses),
+				Patients:     []*Patient{},
+			}
+			cohorts = append(cohorts, cohort)
+			if ageGroup == nofAgeGroups-1 { //switch to next region
+				ageGroup = 0
+				region++
+			} else {
+				ageGroup++ //next age group
+			}
 		}
 	}
 	return cohorts
@@ -295,32 +397,53 @@ func InitCohorts(patients *PatientMap, nofAgegroups, nofRegions, nofDiagnosisCod
 		"Females: ", patients.FemaleCtr, ") "+
 		" nr of diagnosis codes: ", nofDiagnosisCodes, "nr of age groups: ", nofAgegroups)
 	fmt.Println("Making cohort vectors...")
-	cohorts := makeCohorts(nofAgegroups, nofRegions, nofDiagnosisCodes)
+	cohorts := makeCohorts(nofAgegroups, nofRegions, utils.MaxInt(1, patients.NofStrata), nofDiagnosisCodes)
 	// count occurrence of diagnoses, collect patients in the cohort
 	fmt.Println("Counting diagnosis occurrences...")
-	for _, patient := range patients.PIDMap {
-		diagnoses := patient.Diagnoses
-		cohort := selectCohort(cohorts, nofAgegroups, nofRegions, patient.Sex, patient.CohortAge, patient.Region)
-		cohort.NofPatients++
-		cohort.Patients = append(cohort.Patients, patient)
-		diagnosisCountedForPatient := map[int]bool{} // can count exposure of a disease only once per patient DID->bool
-		for _, d1 := range diagnoses {
-			// count diagnosis unless already counted (one exposure per patient)
-			if _, ok := diagnosisCountedForPatient[d1.DID]; !ok {
-				cohort.DCtr[d1.DID]++
-				cohort.NofDiagnoses = cohort.NofDiagnoses + 1
-				cohort.DPatients[d1.DID] = append(cohort.DPatients[d1.DID], patient)
-				diagnosisCountedForPatient[d1.DID] = true
+	for _, pid := range patients.sortedPIDs() {
+		patient := patients.PIDMap[pid]
+		cohort := selectCohort(cohorts, nofAgegroups, nofRegions, patient.Sex, patient.CohortAge, patient.Region,
+			patient.Stratum)
+		cohort.add(patient)
+		if periods := patients.Periods; periods != nil {
+			if cohort.Periods == nil {
+				cohort.Periods = make([]*Cohort, periods.Count)
+				for i := range cohort.Periods {
+					cohort.Periods[i] = &Cohort{AgeGroup: cohort.AgeGroup, Sex: cohort.Sex, Region: cohort.Region,
+						Stratum: cohort.Stratum, DCtr: make([]int, nofDiagnosisCodes),
+						DPatients: make([][]*Patient, nofDiagnosisCodes), Patients: []*Patient{}}
+				}
+			}
+			first, last := periods.observed(patient)
+			for i := first; i <= last; i++ {
+				cohort.Periods[i].add(patient)
 			}
 		}
 	}
 	return cohorts
 }
 
+// add adds a patient to a cohort, and counts the diagnoses of the patient.
+func (cohort *Cohort) add(patient *Patient) {
+	cohort.NofPatients++
+	cohort.Patients = append(cohort.Patients, patient)
+	diagnosisCountedForPatient := map[int]bool{} // can count exposure of a disease only once per patient DID->bool
+	for _, d1 := range patient.Diagnoses {
+		// count diagnosis unless already counted (one exposure per patient)
+		if _, ok := diagnosisCountedForPatient[d1.DID]; !ok {
+			cohort.DCtr[d1.DID]++
+			cohort.NofDiagnoses = cohort.NofDiagnoses + 1
+			cohort.DPatients[d1.DID] = append(cohort.DPatients[d1.DID], patient)
+			diagnosisCountedForPatient[d1.DID] = true
+		}
+	}
+}
+
 // selectRandomPatientsWithoutShuffle randomly selects number of patients (ctr) from a given list of patients (patients),
 // while avoiding patients from a list to be excluded from selection (patientsToExclude). It performs this random selection
-// without shuffling the input patients, which would be computationally too costly.
-func selectRandomPatientsWithoutShuffle(patients []*Patient, ctr int, patientsToExclude map[int]bool) []*Patient {
+// without shuffling the input patients, which would be computationally too costly. If a random generator (rng) is given,
+// it is used for the selection, otherwise a fast non-deterministic generator is used.
+func selectRandomPatientsWithoutShuffle(patients []*Patient, ctr int, patientsToExclude map[int]bool, rng *rand.Rand) []*Patient {
 	var collectedPatients []*Patient
 	maxRandSkips := utils.MaxInt(0, len(patients)-len(patientsToExclude)-ctr)
 	for _, p := range patients {
@@ -329,7 +452,7 @@ func selectRandomPatientsWithoutShuffle(patients []*Patient, ctr int, patientsTo
 		}
 		if _, ok := patientsToExclude[p.PID]; !ok { // not a member of patients to exclude
 			if maxRandSkips > 0 {
-				if fastrand.Uint32n(2) > 0 {
+				if randomBit(rng) {
 					collectedPatients = append(collectedPatients, p)
 				} else {
 					maxRandSkips--
@@ -342,23 +465,36 @@ func selectRandomPatientsWithoutShuffle(patients []*Patient, ctr int, patientsTo
 	return collectedPatients
 }
 
-// selectRandomPatientsFromSimilarCohorts collects for a given list of patients a random list of patients that is
-// comparable in terms of cohorts. This means, for each patient, randomly select another patient that belongs to the same
-// sex and age groups.
-func selectRandomPatientsFromSimilarCohorts(exp *Experiment, patients []*Patient, pids map[int]bool) []*Patient {
+// randomBit returns a random boolean, drawn from the given generator, or from a fast non-deterministic generator if rng
+// is nil.
+func randomBit(rng *rand.Rand) bool {
+	if rng == nil {
+		return fastrand.Uint32n(2) > 0
+	}
+	return rng.Uint32N(2) > 0
+}
+
+// selectRandomPatientsFromSimilarCohorts collects for a given list of patients exposed to d1 a random list of patients
+// that is comparable in terms of cohorts. This means, for each patient, randomly select another patient that belongs to
+// the same sex, age group and race/ethnicity stratum, and calendar period, cf. comparisonCohort.
+func selectRandomPatientsFromSimilarCohorts(exp *Experiment, patients []*Patient, pids map[int]bool, d1 int,
+	rng *rand.Rand) []*Patient {
 	// for each cohort, see how many patients you need to select from it
-	cohortSimilar := make([][]*Patient, len(exp.Cohorts))
+	cohortSimilar := make([][]*Patient, len(exp.Cohorts)*exp.nofPeriods())
 	for i := range cohortSimilar {
 		cohortSimilar[i] = []*Patient{}
 	}
 	for _, p := range patients {
-		cohortIndex := cohortIndex(exp.NofAgeGroups, exp.NofRegions, p.Sex, p.CohortAge, p.Region)
+		cohortIndex := exp.comparisonIndex(p, d1)
 		cohortSimilar[cohortIndex] = append(cohortSimilar[cohortIndex], p)
 	}
 	// select Random patients from the cohorts
 	var collectedPatients []*Patient
 	for i, ps := range cohortSimilar {
-		similarPatients := selectRandomPatientsWithoutShuffle(exp.Cohorts[i].Patients, len(ps), pids)
+		if len(ps) == 0 {
+			continue
+		}
+		similarPatients := selectRandomPatientsWithoutShuffle(exp.comparisonCohortAt(i).Patients, len(ps), pids, rng)
 		for _, p := range similarPatients {
 			collectedPatients = append(collectedPatients, p)
 		}
@@ -368,11 +504,10 @@ func selectRandomPatientsFromSimilarCohorts(exp *Experiment, patients []*Patient
 
 // probNotExposed calculates for a list of patients exposed to a disease d1, the chance to select a patient exposed to d2
 // that is not exposed to d1.
-func probNotExposed(exp *Experiment, d1Patients []*Patient, d1IDs map[int]bool, d2 int) float64 {
+func probNotExposed(exp *Experiment, d1Patients []*Patient, d1IDs map[int]bool, d1, d2 int) float64 {
 	d2Ctr := 0.0
 	for _, p := range d1Patients {
-		idx := cohortIndex(exp.NofAgeGroups, exp.NofRegions, p.Sex, p.CohortAge, p.Region)
-		cohort := exp.Cohorts[idx]
+		cohort := exp.comparisonCohort(p, d1)
 		d2Patients := cohort.DPatients[d2]
 		ctr := 0
 		for _, p2 := range d2Patients { //d2 patients without d1 that could potentially be sampled from
@@ -396,7 +531,7 @@ func countPatientDiagnosis(p *Patient, did int) int {
 }
 
 // countPatientDiagnosisPair returns 1 when a patient was diagnosed with a specific diagnosis pair (d1->d2) and 0 when
-// not diagnosed.
+// not diagnosed. Diagnoses of the same unordered visit are not counted as pairs.
 func countPatientDiagnosisPair(p *Patient, d1, d2 int, minTime, maxTime float64) (int, int) {
 	var d1Date DiagnosisDate
 	var d1Index int
@@ -412,10 +547,14 @@ func countPatientDiagnosisPair(p *Patient, d1, d2 int, minTime, maxTime float64)
 	if d1ok != true {
 		panic(fmt.Sprint("Disease d1: ", d1, " not present in patient when checking for d1->d2"))
 	}
+	var window *dateWindow // computed once, for the first d2 diagnosis
 	for i, d := range p.Diagnoses[d1Index+1:] {
-		if d.DID == d2 {
-			timeBetween := DiagnosisDateToFloat(d.Date) - DiagnosisDateToFloat(d1Date)
-			if timeBetween <= maxTime && timeBetween >= minTime {
+		if d.DID == d2 && !sameVisit(p.Diagnoses[d1Index], d) {
+			if window == nil {
+				w := newDateWindow(d1Date, minTime, maxTime)
+				window = &w
+			}
+			if window.contains(d.Date) {
 				return 1, i
 			}
 		}
@@ -427,12 +566,15 @@ func countPatientDiagnosisPair(p *Patient, d1, d2 int, minTime, maxTime float64)
 // (d) with ond this diagnosis occurs within a specific time frame (cf. minTime and maxTime) of a previous diagnosis
 // occuring at index idx in the patient's diagnosis list.
 func countPatientTrajectory(p *Patient, idx, d2 int, minTime, maxTime float64) int {
-	d1Date := p.Diagnoses[idx].Date
+	var window *dateWindow // computed once, for the first d2 diagnosis
 	for i := idx; i < len(p.Diagnoses); i++ {
 		diag := p.Diagnoses[i]
-		if diag.DID == d2 {
-			timeBetween := DiagnosisDateToFloat(diag.Date) - DiagnosisDateToFloat(d1Date)
-			if timeBetween <= maxTime && timeBetween >= minTime {
+		if diag.DID == d2 && !sameVisit(p.Diagnoses[idx], diag) {
+			if window == nil {
+				w := newDateWindow(p.Diagnoses[idx].Date, minTime, maxTime)
+				window = &w
+			}
+			if window.contains(diag.Date) {
 				return i
 			}
 		}
@@ -454,7 +596,12 @@ func patientsToIdMap(patients []*Patient) map[int]bool {
 // experiment. It takes into account the minimum and maximum time between diagnoses (minTime and maxTime). It is an
 // iterative algorithm that runs for a given number of iterations (iter). With iter = 400, the calculated p-values are
 // within 0.05 of the true p-values and with iter = 10000 they are within 0.01 of the true p-values.
-// The relative risk ratios are calculated in parallel for all possible diagnosis pairs.
+// The relative risk ratios are calculated in parallel for all possible diagnosis pairs. Patients that only have d2 as
+// a secondary diagnosis are counted with the weight of secondary diagnoses, cf. diagnosisWeight. If the experiment has
+// a seed, each diagnosis pair is sampled with its own seeded random generator, so that the result does not depend on
+// the order in which the pairs are processed. Depending on the pair test of the experiment, the p-values of some or all
+// pairs are computed with Fisher's exact test instead of sampling, cf. fisher.go. With matched controls, the comparison
+// groups hold a given nr of controls per exposed patient, cf. matching.go.
 func (exp *Experiment) InitRR(minTime, maxTime float64, iter int) {
 	fmt.Println("Initializing relative risk ratios...")
 	fmt.Println("Sampling ", iter, " comparison groups for each diagnosis pair...")
@@ -462,66 +609,26 @@ func (exp *Experiment) InitRR(minTime, maxTime float64, iter int) {
 	for i := 0; i < exp.NofDiagnosisCodes; i++ {
 		indexVector = append(indexVector, i)
 	}
+	exp.DxDStats = make([][]*RRStats, exp.NofDiagnosisCodes)
 	parallel.Range(0, len(indexVector), 0, func(low, high int) {
 		for _, d1 := range indexVector[low:high] {
 			d1ExposedPatients := exp.DPatients[d1]
 			d1ExposedPatientsIDMap := patientsToIdMap(d1ExposedPatients)
 			if len(d1ExposedPatients) > 0 {
+				exp.DxDStats[d1] = make([]*RRStats, exp.NofDiagnosisCodes)
 				parallel.Range(0, len(indexVector), 0, func(low, high int) {
 					for _, d2 := range indexVector[low:high] {
-						// select randomly patients without d1 as a control group of same size as group 1
-						notd1ExposedPatients := selectRandomPatientsFromSimilarCohorts(exp, d1ExposedPatients, d1ExposedPatientsIDMap)
-						if len(d1ExposedPatients) == len(notd1ExposedPatients) {
-							// count nr of patients with d2 in the exposed group, taking into account time constraints
-							// between exposure and diagnosis d1
-							d2CtrInExposedGroup := 0
-							d1FollowedByd2Patients := []*Patient{}
-							for _, p := range d1ExposedPatients {
-								ctr, _ := countPatientDiagnosisPair(p, d1, d2, minTime, maxTime)
-								if ctr > 0 {
-									d1FollowedByd2Patients = AppendPatient(d1FollowedByd2Patients, p)
-								}
-								d2CtrInExposedGroup = d2CtrInExposedGroup + ctr
-							}
-							// count nr of patients with d2 in the not exposed group
-							// take the average of this of 400 iterations; 400 iterations to get within 0.05 of the
-							// true p-value.
-							// first filter out pairs (d1, d2) with a high chance that #d2 in non exposed >= #d1->d2 in exposed
-							probd2Notd1Exposed := probNotExposed(exp, d1ExposedPatients, d1ExposedPatientsIDMap, d2)
-							probd2d1Exposed := float64(d2CtrInExposedGroup) / float64(len(d1ExposedPatients))
-							if probd2Notd1Exposed >= probd2d1Exposed {
-								continue // skip sampling for testing d1->d2 pair because it is unlikely
-							}
-							var pval float64
-							d2CtrInNotExposedGroup := 0 // will be average if N iterations
-							for i := 0; i < iter; i++ {
-								d2Ctr := 0
-								for _, p := range notd1ExposedPatients {
-									ctr := countPatientDiagnosis(p, d2)
-									d2Ctr = d2Ctr + ctr
-									d2CtrInNotExposedGroup = d2CtrInNotExposedGroup + ctr
-								}
-								if d2Ctr >= d2CtrInExposedGroup { // if #D2 in comparison group >= #D1->D2 in exposed group, unlikely that D1->D2
-									pval++
-								}
-								notd1ExposedPatients = selectRandomPatientsFromSimilarCohorts(exp, d1ExposedPatients, d1ExposedPatientsIDMap)
-							}
-							pval = pval / float64(iter)
-							d2CtrInNotExposedGroup = d2CtrInNotExposedGroup / iter // take the average of d2s counted in all sampled non exposed groups
-							if pval > 0.001 {
-								continue // seems that #D2 in non-exposed > #D1->D2 in exposed, so unlikely D1->D2
-							}
-							// compute RR
-							a := float64(d2CtrInExposedGroup)
-							b := float64(len(d1ExposedPatients) - d2CtrInExposedGroup)
-							c := float64(d2CtrInNotExposedGroup)
-							d := float64(len(d1ExposedPatients) - d2CtrInNotExposedGroup) //take len(d1ExposedPatients) cause we want same length randomly selected groups
-							p1 := a / (a + b)
-							p2 := c / (c + d)
-							RR := p1 / p2
+						var rng *rand.Rand
+						if exp.Seed != 0 {
+							rng = exp.Rand(uint64(d1*exp.NofDiagnosisCodes + d2))
+						}
+						RR, d1FollowedByd2Patients, stats := exp.relativeRisk(d1, d2, d1ExposedPatients, d1ExposedPatientsIDMap,
+							minTime, maxTime, iter, rng)
+						if stats != nil {
 							// initialize RR, d1->d2 ctrs etc
 							exp.DxDRR[d1][d2] = RR
 							exp.DxDPatients[d1][d2] = d1FollowedByd2Patients
+							exp.DxDStats[d1][d2] = stats
 						}
 					}
 				})
@@ -530,15 +637,115 @@ func (exp *Experiment) InitRR(minTime, maxTime float64, iter int) {
 	})
 }
 
+// relativeRisk computes the RR of the diagnosis pair d1->d2 for the given patients exposed to d1, by comparing them
+// to sampled comparison groups of patients without d1. It returns the RR, the exposed patients diagnosed with d1->d2
+// and the statistics of the RR, or nil statistics when d1->d2 is unlikely.
+func (exp *Experiment) relativeRisk(d1, d2 int, d1ExposedPatients []*Patient, d1ExposedPatientsIDMap map[int]bool,
+	minTime, maxTime float64, iter int, rng *rand.Rand) (float64, []*Patient, *RRStats) {
+	ratio := exp.controlRatio()
+	// select randomly patients without d1 as a control group of same size as group 1
+	notd1ExposedPatients := exp.selectComparisonGroup(d1ExposedPatients, d1ExposedPatientsIDMap, d1, rng)
+	if len(d1ExposedPatients)*ratio != len(notd1ExposedPatients) {
+		return 0, nil, nil
+	}
+	// count nr of patients with d2 in the exposed group, taking into account time constraints
+	// between exposure and diagnosis d1
+	d2CtrInExposedGroup := 0.0
+	d1FollowedByd2Patients := []*Patient{}
+	censored := 0
+	for _, p := range d1ExposedPatients {
+		ctr, _ := countPatientDiagnosisPair(p, d1, d2, minTime, maxTime)
+		if ctr > 0 {
+			d1FollowedByd2Patients = AppendPatient(d1FollowedByd2Patients, p)
+			d2CtrInExposedGroup = d2CtrInExposedGroup + exp.diagnosisWeight(p, d2)
+		} else if exp.Censoring && exp.censored(p, d1, maxTime) {
+			censored++
+		}
+	}
+	if censored > 0 {
+		if censored == len(d1ExposedPatients) {
+			return 0, nil, nil // no exposed patient is followed long enough
+		}
+		// scale the nr of d2 diagnoses of the patients that are not censored to the whole exposed group, cf.
+		// censoring.go
+		d2CtrInExposedGroup = d2CtrInExposedGroup * float64(len(d1ExposedPatients)) /
+			float64(len(d1ExposedPatients)-censored)
+	}
+	// count nr of patients with d2 in the not exposed group
+	// take the average of this of 400 iterations; 400 iterations to get within 0.05 of the
+	// true p-value.
+	// first filter out pairs (d1, d2) with a high chance that #d2 in non exposed >= #d1->d2 in exposed
+	probd2Notd1Exposed := probNotExposed(exp, d1ExposedPatients, d1ExposedPatientsIDMap, d1, d2)
+	probd2d1Exposed := d2CtrInExposedGroup / float64(len(d1ExposedPatients))
+	if probd2Notd1Exposed >= probd2d1Exposed {
+		return 0, nil, nil // skip sampling for testing d1->d2 pair because it is unlikely
+	}
+	var pval float64
+	iterations := iter            // nr of sampled comparison groups, 0 for the exact test
+	d2CtrInNotExposedGroup := 0.0 // will be average if N iterations
+	exposed := len(d1ExposedPatients)
+	if expected := math.Floor(probd2Notd1Exposed * float64(exposed)); exp.useFisherTest(d2CtrInExposedGroup, expected) {
+		// exact test against the cases and non-cases of the sampled comparison group
+		d2CtrInComparisonGroup := 0.0
+		for _, p := range notd1ExposedPatients {
+			if countPatientDiagnosis(p, d2) > 0 {
+				d2CtrInComparisonGroup = d2CtrInComparisonGroup + exp.diagnosisWeight(p, d2)
+			}
+		}
+		d2Exposed := int(math.Round(d2CtrInExposedGroup))
+		d2Comparison := int(math.Round(d2CtrInComparisonGroup))
+		pval = fisherExactGreater(d2Exposed, exposed-d2Exposed, d2Comparison, len(notd1ExposedPatients)-d2Comparison)
+		// scaled to the size of the exposed group
+		d2CtrInNotExposedGroup = math.Floor(d2CtrInComparisonGroup / float64(ratio))
+		iterations = 0
+	} else {
+		for i := 0; i < iter; i++ {
+			if len(d1ExposedPatients)*ratio != len(notd1ExposedPatients) {
+				return 0, nil, nil // a short comparison group would bias the sampled p-value and RR
+			}
+			d2Ctr := 0.0
+			for _, p := range notd1ExposedPatients {
+				if countPatientDiagnosis(p, d2) > 0 {
+					weight := exp.diagnosisWeight(p, d2) / float64(ratio) // scaled to the size of the exposed group
+					d2Ctr = d2Ctr + weight
+					d2CtrInNotExposedGroup = d2CtrInNotExposedGroup + weight
+				}
+			}
+			if d2Ctr >= d2CtrInExposedGroup { // if #D2 in comparison group >= #D1->D2 in exposed group, unlikely that D1->D2
+				pval++
+			}
+			notd1ExposedPatients = exp.selectComparisonGroup(d1ExposedPatients, d1ExposedPatientsIDMap, d1, rng)
+		}
+		pval = pval / float64(iter)
+		d2CtrInNotExposedGroup = math.Floor(d2CtrInNotExposedGroup / float64(iter)) // take the average of d2s counted in all sampled non exposed groups
+	}
+	if pval > exp.maxPValue() {
+		return 0, nil, nil // seems that #D2 in non-exposed > #D1->D2 in exposed, so unlikely D1->D2
+	}
+	// compute RR, with the continuity correction of the experiment if the 2x2 table has a zero cell
+	stats := newRRStats(pval, len(d1ExposedPatients), d2CtrInExposedGroup, d2CtrInNotExposedGroup,
+		exp.ContinuityCorrection)
+	n, a, c := stats.table() // take len(d1ExposedPatients) cause we want same length randomly selected groups
+	b := n - a
+	d := n - c
+	p1 := a / (a + b)
+	p2 := c / (c + d)
+	stats.Iterations = iterations
+	return p1 / p2, d1FollowedByd2Patients, stats
+}
+
 // LoadRRMatrix loads an RR matrix from file and stores it in the given experiment. This file was created from a
-// previous run. This can be used instead of initializeRelativeRiskRatiosParallel
+// previous run. This can be used instead of initializeRelativeRiskRatiosParallel. The diagnoses of the matrix are
+// matched by name, and must all be diagnoses of the experiment, e.g. by using the same DID mapping file as the run that
+// saved the matrix, cf. applyDIDMapping. The statistics of the RR scores are loaded if the matrix has them, cf.
+// SaveRRMatrix. A matrix in the sparse format is recognized by its first line, cf. SaveSparseRRMatrix.
 func (exp *Experiment) LoadRRMatrix(path string) {
 	// map icd10 names to DIDs
 	nameMap := map[string]int{}
 	for did, icd10 := range exp.Icd10Map {
 		nameMap[icd10.Name] = did
 	}
-	file, err := os.Open(path)
+	file, err := openInput(path)
 	if err != nil {
 		panic(err)
 	}
@@ -547,8 +754,14 @@ func (exp *Experiment) LoadRRMatrix(path string) {
 			panic(err)
 		}
 	}()
-	reader := csv.NewReader(file)
+	buffered := bufio.NewReader(file)
+	if isSparseRRMatrix(buffered) {
+		exp.loadSparseRRMatrix(path, buffered)
+		return
+	}
+	reader := csv.NewReader(buffered)
 	reader.Comma = '\t'
+	reader.FieldsPerRecord = -1 // only the computed RR scores have statistics
 	for {
 		record, err := reader.Read()
 		if err == io.EOF {
@@ -557,20 +770,32 @@ func (exp *Experiment) LoadRRMatrix(path string) {
 		if err != nil {
 			panic(err)
 		}
-		d1 := nameMap[record[0]]
-		d2 := nameMap[record[1]]
+		d1, ok1 := nameMap[record[0]]
+		d2, ok2 := nameMap[record[1]]
+		if !ok1 || !ok2 {
+			panic(fmt.Sprint("RR matrix ", path, " has diagnoses that are not in the experiment: ", record[0], ", ",
+				record[1]))
+		}
 		RR, err := strconv.ParseFloat(record[2], 64)
 		if err != nil {
 			panic(err)
 		}
 		exp.DxDRR[d1][d2] = RR
+		if len(record) >= 9 {
+			stats, err := parseRRStats(record[3:])
+			if err != nil {
+				panic(err)
+			}
+			exp.setRRStats(d1, d2, stats)
+		}
 	}
 }
 
 // LoadDxDPatients loads the DxD patients from a file created during a previous run. It takes as parameters the experiment
 // (exp), the patient map where to look up patient objects parsed from the input (pMap), and the file Name (path). The
 // function side effects the experiment's DxDPatients slice. It uses the pMap to match concrete patient objects with IDs
-// stored in the file to be able to fill the patients for each pair of diagnoses.
+// stored in the file to be able to fill the patients for each pair of diagnoses. The IDs may be hashed pseudonyms, cf.
+// Pseudonymizer.patientLookup, and IDs of patients that are not in the pMap are skipped.
 func (exp *Experiment) LoadDxDPatients(pMap *PatientMap, path string) {
 	// map icd10 names to DIDs
 	nameMap := map[string]int{}
@@ -583,7 +808,7 @@ func (exp *Experiment) LoadDxDPatients(pMap *PatientMap, path string) {
 			exp.DxDPatients[i][j] = []*Patient{}
 		}
 	}
-	file, err := os.Open(path)
+	file, err := openInput(path)
 	if err != nil {
 		panic(err)
 	}
@@ -592,6 +817,7 @@ func (exp *Experiment) LoadDxDPatients(pMap *PatientMap, path string) {
 			panic(err)
 		}
 	}()
+	lookup := exp.Pseudonymizer.patientLookup(pMap)
 	reader := csv.NewReader(file)
 	reader.Comma = '\t'
 	for {
@@ -602,19 +828,24 @@ func (exp *Experiment) LoadDxDPatients(pMap *PatientMap, path string) {
 		if err != nil {
 			panic(err)
 		}
-		d1 := nameMap[record[0]]
-		d2 := nameMap[record[1]]
+		d1, ok1 := nameMap[record[0]]
+		d2, ok2 := nameMap[record[1]]
+		if !ok1 || !ok2 {
+			panic(fmt.Sprint("Patient file ", path, " has diagnoses that are not in the experiment: ", record[0], ", ",
+				record[1]))
+		}
 		pidStrings := strings.Split(record[2], ",")
 		for _, pidString := range pidStrings {
-			pid := pMap.PIDStringMap[pidString]
-			p := pMap.PIDMap[pid]
-			exp.DxDPatients[d1][d2] = append(exp.DxDPatients[d1][d2], p)
+			if p, ok := lookup(pidString); ok {
+				exp.DxDPatients[d1][d2] = append(exp.DxDPatients[d1][d2], p)
+			}
 		}
 	}
 }
 
 // SaveRRMatrix stores the RR matrix calculated for the given experiment. The diagnosis pairs from the matrix are
-// stored line per line as follows: medical Name 1, medical Name 2, RR.
+// stored line per line as follows: medical Name 1, medical Name 2, RR, and for the computed RR scores their statistics:
+// p-value, CI low, CI high, exposed, exposed d2, comparison d2, iterations, cf. RRStats.
 func (exp *Experiment) SaveRRMatrix(path string) {
 	file, err := os.Create(path)
 	if err != nil {
@@ -627,13 +858,18 @@ func (exp *Experiment) SaveRRMatrix(path string) {
 	}()
 	for i, js := range exp.DxDRR {
 		for j, RR := range js {
-			fmt.Fprintf(file, "%s\t%s\t%s\n", exp.Icd10Map[i].Name, exp.Icd10Map[j].Name,
+			fmt.Fprintf(file, "%s\t%s\t%s", exp.Icd10Map[i].Name, exp.Icd10Map[j].Name,
 				strconv.FormatFloat(RR, 'E', -1, 64))
+			if stats := exp.rrStats(i, j); stats != nil {
+				fmt.Fprintf(file, "\t%s", strings.Join(stats.fileColumns(), "\t"))
+			}
+			fmt.Fprintln(file)
 		}
 	}
 }
 
-// SaveDxDPatients saves per disease the PIDs that are diagnosed with this disease
+// SaveDxDPatients saves per disease the PIDs that are diagnosed with this disease, replaced by their pseudonyms if the
+// experiment has a pseudonymizer.
 func (exp *Experiment) SaveDxDPatients(path string) {
 	file, err := os.Create(path)
 	if err != nil {
@@ -649,7 +885,7 @@ func (exp *Experiment) SaveDxDPatients(path string) {
 			if len(patientPairs) > 0 {
 				patients := ""
 				for patientIdx, patient := range pair {
-					patients = patients + patient.PIDString
+					patients = patients + exp.Pseudonymizer.Pseudonym(patient.PIDString)
 					if patientIdx != len(pair)-1 {
 						patients = patients + ","
 					}
@@ -690,6 +926,7 @@ func (cohort Cohort) Log(max int) {
 	fmt.Print("Age group: ", cohort.AgeGroup)
 	fmt.Print(" Sex: ", cohort.Sex)
 	fmt.Print(" Region: ", cohort.Region)
+	fmt.Print(" Stratum: ", cohort.Stratum)
 	fmt.Print(" Nr of patients: ", cohort.NofPatients)
 	fmt.Println(" Nr of diagnoses: ", cohort.NofDiagnoses)
 	fmt.Print("DCtr: [")
@@ -712,7 +949,8 @@ type Pair struct {
 }
 
 // selectDiagnosisPairs selects diagnosis pairs from which to calculate trajectories. These pairs are constrained by
-// requiring a minimum number of patients that is diagnosed with the disease pair, and a minimum RR score.
+// requiring a minimum number of patients that is diagnosed with the disease pair, a minimum RR score, a maximum
+// p-value, cf. significant, and optionally a maximum directionality p-value, cf. directional.
 func (exp *Experiment) selectDiagnosisPairs(minPatients int, minRR float64) []*Pair {
 	fmt.Println("Selecting diagnosis pairs for building trajectories...")
 	var pairs []*Pair
@@ -722,10 +960,13 @@ func (exp *Experiment) selectDiagnosisPairs(minPatients int, minRR float64) []*P
 		for j := i; j < nofDiagnosisCodes; j++ {
 			occurs := len(exp.DxDPatients[i][j])
 			occursReverse := len(exp.DxDPatients[j][i])
-			RR := exp.DxDRR[i][j]
-			RRReverse := exp.DxDRR[j][i]
+			RR := exp.selectionRR(i, j)
+			RRReverse := exp.selectionRR(j, i)
+			forward := occurs >= minPatients && RR > minRR && exp.significant(i, j) && exp.directional(i, j)
+			backward := occursReverse >= minPatients && RRReverse > minRR && exp.significant(j, i) &&
+				exp.directional(j, i)
 			if i != j {
-				if occurs >= minPatients && RR > minRR && occursReverse >= minPatients && RRReverse > minRR {
+				if forward && backward {
 					var maxOccurs int
 					var maxIndices *Pair
 					if occurs > occursReverse {
@@ -741,11 +982,11 @@ func (exp *Experiment) selectDiagnosisPairs(minPatients int, minRR float64) []*P
 					}
 					continue
 				}
-				if occurs >= minPatients && RR > minRR {
+				if forward {
 					pairs = append(pairs, &Pair{First: i, Second: j})
 					continue
 				}
-				if occursReverse >= minPatients && RRReverse > minRR {
+				if backward {
 					pairs = append(pairs, &Pair{First: j, Second: i})
 				}
 			}
@@ -822,6 +1063,7 @@ func (exp *Experiment) BuildTrajectories(minPatients, maxLength, minLength int,
 						for p := range extendedTrajMap {
 							patients = append(patients, p)
 						}
+						sort.Slice(patients, func(i, j int) bool { return patients[i].PID < patients[j].PID })
 						newT := &Trajectory{
 							Diagnoses:      append(diagnoses, pair.Second), // should copy slice, could be updated many times...
 							PatientNumbers: append(patientNumbers, len(patients)),
@@ -866,6 +1108,7 @@ func (exp *Experiment) BuildTrajectories(minPatients, maxLength, minLength int,
 		}
 		if keep {
 			traj.ID = idx
+			traj.Hash = exp.trajectoryHash(traj)
 			filteredTrajectories = append(filteredTrajectories, traj)
 		}
 	}
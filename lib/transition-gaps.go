@@ -0,0 +1,88 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"github.com/exascience/pargo/parallel"
+	"sort"
+)
+
+// Time gaps of the transitions of trajectories. An RR score says that a second diagnosis follows a first diagnosis more
+// often than expected, but not how long after it. For each transition of a trajectory, the gaps between the dates of
+// the two diagnoses of the patients that contributed to the transition are summarized by their minimum, quartiles,
+// and maximum, in days.
+
+// TransitionGaps summarizes the time gaps in days between the diagnoses of a transition of a trajectory.
+type TransitionGaps struct {
+	Min, Q1, Median, Q3, Max int
+}
+
+// IQR returns the interquartile range of the time gaps.
+func (gaps *TransitionGaps) IQR() int {
+	return gaps.Q3 - gaps.Q1
+}
+
+// transitionGapAttribute is a named time gap, for the edge attributes of the graph outputs.
+type transitionGapAttribute struct {
+	name string
+	days int
+}
+
+// attributes returns the time gaps as edge attributes: gapMin, gapQ1, gapMedian, gapQ3, gapIQR, and gapMax.
+func (gaps *TransitionGaps) attributes() []transitionGapAttribute {
+	return []transitionGapAttribute{{"gapMin", gaps.Min}, {"gapQ1", gaps.Q1}, {"gapMedian", gaps.Median},
+		{"gapQ3", gaps.Q3}, {"gapIQR", gaps.IQR()}, {"gapMax", gaps.Max}}
+}
+
+// newTransitionGaps summarizes a list of time gaps, nil for an empty list.
+func newTransitionGaps(days []int) *TransitionGaps {
+	if len(days) == 0 {
+		return nil
+	}
+	sort.Ints(days)
+	return &TransitionGaps{Min: days[0], Q1: percentile(days, 0.25), Median: percentile(days, 0.5),
+		Q3: percentile(days, 0.75), Max: days[len(days)-1]}
+}
+
+// transitionGaps returns the time gaps of a transition of a trajectory, nil if unknown.
+func (t *Trajectory) transitionGaps(idx int) *TransitionGaps {
+	if idx >= len(t.Gaps) {
+		return nil
+	}
+	return t.Gaps[idx]
+}
+
+// InitTransitionGaps computes the time gaps of the transitions of the trajectories of the experiment. The diagnoses of
+// the patients of a transition are matched within the given time frame, cf. matchPatientTrajectory.
+func (exp *Experiment) InitTransitionGaps(minTime, maxTime float64) {
+	parallel.Range(0, len(exp.Trajectories), 0, func(low, high int) {
+		for _, t := range exp.Trajectories[low:high] {
+			t.Gaps = make([]*TransitionGaps, len(t.Patients))
+			for idx, patients := range t.Patients {
+				var days []int
+				for _, p := range patients {
+					if matches := matchPatientTrajectory(p, t.Diagnoses[:idx+2], minTime, maxTime); matches != nil {
+						days = append(days, DaysBetween(matches[idx].Date, matches[idx+1].Date))
+					}
+				}
+				t.Gaps[idx] = newTransitionGaps(days)
+			}
+		}
+	})
+}
@@ -0,0 +1,201 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Configuration of the treatment file layout. Treatment extracts differ in shape between sites, so the columns that hold
+// the patient id and the treatment dates, and the format of the dates, are described by a TreatmentSchema. The default
+// schema matches the TriNetX treatment extract used for the bladder cancer study. The treatment dates are the dates of
+// custom events, cf. CustomEvent. A schema declares any number of treatments, each a column with the code of its event
+// and the format of its dates. Without treatments, the schema reads the bladder cancer treatments from the columns of
+// radical cystectomy, MVAC chemotherapy and intravesical therapy.
+
+// TreatmentSchema describes which columns of a treatment file hold the patient id and the treatment dates, and how the
+// dates are formatted. Columns are counted from 0. Date formats are Go time layouts, e.g. 2006-01-02 or 02/01/2006.
+type TreatmentSchema struct {
+	PID                 int    `json:"pid"`                 // column with the patient id
+	RadicalCystectomy   int    `json:"radicalCystectomy"`   // column with the date of radical cystectomy
+	MVAC                int    `json:"mvac"`                // column with the date of MVAC chemotherapy
+	IntravesicalTherapy int    `json:"intravesicalTherapy"` // column with the date of intravesical therapy
+	DateFormat          string `json:"dateFormat"`          // layout of the dates
+	// custom events with the columns of their dates, nil for the bladder cancer treatments in the columns above
+	Events []*CustomEvent `json:"treatments,omitempty"`
+}
+
+// DefaultTreatmentSchema returns the schema of the TriNetX treatment extract.
+func DefaultTreatmentSchema() *TreatmentSchema {
+	return &TreatmentSchema{PID: 0, RadicalCystectomy: 10, MVAC: 11, IntravesicalTherapy: 13, DateFormat: "2006-01-02"}
+}
+
+// LoadTreatmentSchema loads a treatment schema from a json file. Fields that are omitted keep their default value. The
+// schema is validated.
+func LoadTreatmentSchema(path string) (*TreatmentSchema, error) {
+	schema := DefaultTreatmentSchema()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, schema); err != nil {
+		return nil, fmt.Errorf("treatment schema %s: %v", path, err)
+	}
+	if err := schema.Validate(); err != nil {
+		return nil, fmt.Errorf("treatment schema %s: %v", path, err)
+	}
+	return schema, nil
+}
+
+// customEvents returns the custom events whose dates are read from the treatment file.
+func (schema *TreatmentSchema) customEvents() []*CustomEvent {
+	if schema.Events == nil {
+		return DefaultCustomEvents(schema)
+	}
+	return schema.Events
+}
+
+// vocabularyEvents returns the custom events to add to the analysis maps, nil for the default bladder cancer events. The
+// schema may be nil.
+func (schema *TreatmentSchema) vocabularyEvents() []*CustomEvent {
+	if schema == nil {
+		return nil
+	}
+	return schema.Events
+}
+
+// columns returns the named columns of the schema. Custom events are named by their code.
+func (schema *TreatmentSchema) columns() ([]string, []int) {
+	if schema.Events == nil {
+		return []string{"pid", "radicalCystectomy", "mvac", "intravesicalTherapy"},
+			[]int{schema.PID, schema.RadicalCystectomy, schema.MVAC, schema.IntravesicalTherapy}
+	}
+	names, columns := []string{"pid"}, []int{schema.PID}
+	for _, event := range schema.Events {
+		names, columns = append(names, event.Code), append(columns, event.Column)
+	}
+	return names, columns
+}
+
+// Validate checks that the columns of the schema are valid and distinct, and that the date format describes a year, month
+// and day.
+func (schema *TreatmentSchema) Validate() error {
+	names, columns := schema.columns()
+	used := map[int]string{}
+	for i, column := range columns {
+		if column < 0 {
+			return fmt.Errorf("column for %s must not be negative, got %d", names[i], column)
+		}
+		if other, ok := used[column]; ok {
+			return fmt.Errorf("column %d is used for both %s and %s", column, other, names[i])
+		}
+		used[column] = names[i]
+	}
+	if err := validateCustomEvents(schema.Events); err != nil {
+		return err
+	}
+	return checkDateFormat(schema.DateFormat, true)
+}
+
+// checkDateFormat checks that a date format describes a year, month and day, or only a year and month if withDay is
+// false.
+func checkDateFormat(format string, withDay bool) error {
+	if format == "" {
+		return errors.New("date format is empty")
+	}
+	reference := time.Date(2006, 1, 2, 0, 0, 0, 0, time.UTC)
+	t, err := time.Parse(format, reference.Format(format))
+	if withDay && (err != nil || !t.Equal(reference)) {
+		return fmt.Errorf("date format %q does not describe a year, month and day", format)
+	}
+	if err != nil || t.Year() != reference.Year() || t.Month() != reference.Month() {
+		return fmt.Errorf("date format %q does not describe a year and month", format)
+	}
+	return nil
+}
+
+// minColumns returns the number of columns a row needs to contain all columns of the schema.
+func (schema *TreatmentSchema) minColumns() int {
+	_, columns := schema.columns()
+	max := 0
+	for _, column := range columns {
+		if column > max {
+			max = column
+		}
+	}
+	return max + 1
+}
+
+// parseDate parses the date of a custom event from the treatment file. Values longer than the date format, e.g. with a
+// time, are truncated.
+func (schema *TreatmentSchema) parseDate(event *CustomEvent, value string) (DiagnosisDate, error) {
+	if event.DateFormat != "" {
+		return parseDateLayout(event.DateFormat, value)
+	}
+	return parseDateLayout(schema.DateFormat, value)
+}
+
+// parseDateLayout parses a date with the given layout. Values longer than the layout, e.g. with a time, are truncated.
+// The day defaults to 1 if the layout has no day.
+func parseDateLayout(layout, value string) (DiagnosisDate, error) {
+	if len(value) > len(layout) {
+		value = value[:len(layout)]
+	}
+	t, err := time.Parse(layout, value)
+	if err != nil {
+		return DiagnosisDate{}, err
+	}
+	return DiagnosisDate{Year: t.Year(), Month: int(t.Month()), Day: t.Day()}, nil
+}
+
+// checkRow checks a row of a treatment file, cf. rowCheck.
+func (schema *TreatmentSchema) checkRow(record []string) (reasons, details []string) {
+	if detail, ok := checkColumns(record, schema.minColumns(), false); !ok {
+		return []string{ReasonColumnCount}, []string{detail}
+	}
+	if isMissing(record[schema.PID]) {
+		reasons, details = append(reasons, ReasonMissingPID), append(details, "patient_id is empty")
+	}
+	names, _ := schema.columns()
+	for i, event := range schema.customEvents() {
+		if value := record[event.Column]; !isMissing(value) {
+			if _, err := schema.parseDate(event, value); err != nil {
+				reasons = append(reasons, ReasonBadDate)
+				details = append(details, fmt.Sprint(names[i+1], " (column ", event.Column, "): ", value))
+			}
+		}
+	}
+	return reasons, details
+}
+
+// parseDateColumn returns the date of a custom event in a row, or nil if it is missing.
+func (schema *TreatmentSchema) parseDateColumn(record []string, event *CustomEvent) *DiagnosisDate {
+	if isMissing(record[event.Column]) {
+		return nil
+	}
+	d, err := schema.parseDate(event, record[event.Column])
+	if err != nil {
+		panic(err)
+	}
+	return &d
+}
@@ -0,0 +1,144 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"fmt"
+	"os"
+	"sort"
+)
+
+// Reporting of dropped diagnosis codes. Diagnoses from the input that cannot be mapped onto an analysis DID are skipped
+// while parsing. The UnmappedCodeReport counts these codes per reason, so that it is visible how many records are lost
+// and which codes are responsible.
+
+// Reasons for dropping a diagnosis from the input.
+const (
+	UnmappedICD9            = "not in ICD9 to ICD10 map"
+	UnmappedSNOMED          = "not in SNOMED CT to ICD10 map"
+	UnmappedICD10           = "not in ICD10 to ICD11 map"
+	UnmappedICD10Custom     = "not in ICD10 to custom vocabulary map"
+	UnmappedNotInVocabulary = "not in vocabulary"
+	UnmappedExcluded        = "excluded from analysis"
+	UnmappedUnknownPatient  = "unknown patient"
+	UnmappedNoICDConcept    = "no ICD concept"
+	UnmappedOtherCodeSystem = "other code system than vocabulary"
+)
+
+// UnmappedCode counts how often a diagnosis code was dropped for a given reason.
+type UnmappedCode struct {
+	CodeSystem string // code system from the input, e.g. ICD-10-CM
+	Code       string // diagnosis code from the input
+	Reason     string // why the code was dropped, cf. the Unmapped constants
+	Count      int    // nr of diagnoses with this code that were dropped
+}
+
+// UnmappedCodeReport collects the diagnosis codes that were dropped while parsing the diagnoses.
+type UnmappedCodeReport struct {
+	Rows        int                      // nr of diagnosis rows parsed
+	Dropped     int                      // nr of diagnosis rows dropped
+	Reasons     map[string]int           // nr of diagnosis rows dropped per reason
+	Codes       map[string]*UnmappedCode // maps code system, code and reason onto their count
+	CodeSystems map[string]int           // nr of diagnosis rows parsed per code system, cf. detectCodeSystem
+}
+
+// NewUnmappedCodeReport creates an empty report.
+func NewUnmappedCodeReport() *UnmappedCodeReport {
+	return &UnmappedCodeReport{Reasons: map[string]int{}, Codes: map[string]*UnmappedCode{},
+		CodeSystems: map[string]int{}}
+}
+
+// add counts a dropped diagnosis.
+func (report *UnmappedCodeReport) add(codeSystem, code, reason string) {
+	report.Dropped++
+	report.Reasons[reason]++
+	key := codeSystem + "\t" + code + "\t" + reason
+	if entry, ok := report.Codes[key]; ok {
+		entry.Count++
+		return
+	}
+	report.Codes[key] = &UnmappedCode{CodeSystem: codeSystem, Code: code, Reason: reason, Count: 1}
+}
+
+// SortedCodes returns the dropped codes, the most frequent ones first.
+func (report *UnmappedCodeReport) SortedCodes() []*UnmappedCode {
+	codes := make([]*UnmappedCode, 0, len(report.Codes))
+	for _, code := range report.Codes {
+		codes = append(codes, code)
+	}
+	sort.Slice(codes, func(i, j int) bool {
+		if codes[i].Count != codes[j].Count {
+			return codes[i].Count > codes[j].Count
+		}
+		if codes[i].Code != codes[j].Code {
+			return codes[i].Code < codes[j].Code
+		}
+		if codes[i].CodeSystem != codes[j].CodeSystem {
+			return codes[i].CodeSystem < codes[j].CodeSystem
+		}
+		return codes[i].Reason < codes[j].Reason
+	})
+	return codes
+}
+
+// Log prints the totals per reason and the max most frequent dropped codes to standard output.
+func (report *UnmappedCodeReport) Log(max int) {
+	percentage := 0.0
+	if report.Rows > 0 {
+		percentage = 100.0 * float64(report.Dropped) / float64(report.Rows)
+	}
+	fmt.Printf("Dropped %d of %d diagnoses (%.2f%%) that could not be mapped for analysis.\n", report.Dropped,
+		report.Rows, percentage)
+	for _, codeSystem := range sortedKeys(report.CodeSystems) {
+		fmt.Println("Code system: ", codeSystem, ": ", report.CodeSystems[codeSystem], " diagnoses.")
+	}
+	reasons := []string{}
+	for reason := range report.Reasons {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		fmt.Println("Reason: ", reason, ": ", report.Reasons[reason], " diagnoses.")
+	}
+	for i, code := range report.SortedCodes() {
+		if i == max {
+			fmt.Println("...")
+			break
+		}
+		fmt.Println(code.CodeSystem, " ", code.Code, ": ", code.Count, " diagnoses, ", code.Reason)
+	}
+}
+
+// Save writes the dropped codes to a tab file, the most frequent ones first. The header is: CodeSystem, Code, Reason,
+// Count.
+func (report *UnmappedCodeReport) Save(path string) {
+	file, err := os.Create(path)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	fmt.Fprintf(file, "CodeSystem\tCode\tReason\tCount\n")
+	for _, code := range report.SortedCodes() {
+		fmt.Fprintf(file, "%s\t%s\t%s\t%d\n", code.CodeSystem, code.Code, code.Reason, code.Count)
+	}
+}
@@ -0,0 +1,455 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// Validation of the TriNetX input files. The parsers check every row of the input files while they read them, cf.
+// rowReader, and report the malformed rows with file name, line number and reason, together with summary statistics
+// per file. This avoids that a run crashes on the first bad record somewhere deep in the parsing code, and that the
+// input is read a second time to validate it. Runs may tolerate a budget of malformed rows: the parsers skip them. Only
+// the first malformed rows of each file are kept in the report, the others are only counted, so that the report stays
+// small for a bad input.
+
+// Reasons for rejecting a row of an input file.
+const (
+	ReasonMalformedCSV  = "malformed csv"
+	ReasonColumnCount   = "wrong column count"
+	ReasonMissingPID    = "missing PID"
+	ReasonMissingCode   = "missing diagnosis code"
+	ReasonUnknownSex    = "unknown sex code"
+	ReasonBadDate       = "bad date"
+	ReasonBadMorphology = "bad morphology code"
+	ReasonBadValue      = "bad numeric value"
+	ReasonCodeSystem    = "unknown code system"
+)
+
+// triNetXNull is the value TriNetX uses for missing fields.
+const triNetXNull = `\\000`
+
+// Expected number of columns in the TriNetX input files. The patient, diagnosis, and procedure files have a fixed
+// number of columns, the tumor file needs at least the given number of columns. The columns of the treatment file are
+// described by a TreatmentSchema.
+const (
+	triNetXPatientColumns   = 12
+	triNetXDiagnosisColumns = 10
+	triNetXTumorColumns     = 13
+	triNetXProcedureColumns = 8
+	triNetXLabColumns       = 10
+)
+
+// Columns of the dates, values, and units in the TriNetX procedure and lab files.
+const (
+	triNetXProcedureDate = 5
+	triNetXLabDate       = 4
+	triNetXLabValue      = 5
+	triNetXLabUnit       = 7
+)
+
+// RowIssue describes a malformed row in an input file.
+type RowIssue struct {
+	File   string   // name of the input file
+	Line   int      // line number of the row in the input file
+	Reason string   // why the row is malformed, cf. the Reason constants, separated by ; if multiple
+	Detail string   // more information, e.g. the offending column and value
+	Record []string // the rejected row, nil if it could not be parsed as csv
+}
+
+func (issue *RowIssue) String() string {
+	return fmt.Sprintf("%s:%d: %s: %s", issue.File, issue.Line, issue.Reason, issue.Detail)
+}
+
+// maxRowIssues is the nr of malformed rows per file that are kept in a validation report. Further malformed rows are
+// only counted.
+const maxRowIssues = 1000
+
+// ValidationReport collects the malformed rows found in the input files, together with summary statistics. The input
+// files may be validated concurrently, e.g. the shards of a diagnosis file.
+type ValidationReport struct {
+	Files       []string                  // the validated files, in order of validation
+	Rows        map[string]int            // nr of rows checked per file
+	BadRows     map[string]int            // nr of malformed rows per file
+	Reasons     map[string]int            // nr of issues per reason, a row can have multiple issues
+	FileReasons map[string]map[string]int // nr of malformed rows per file and reason
+	Checks      map[string]*CheckSummary  // summary per temporal check, cf. CheckTemporalSanity
+	issues      map[string][]*RowIssue    // the first maxRowIssues malformed rows per file, in order of occurrence
+	mutex       sync.Mutex
+}
+
+// NewValidationReport creates an empty validation report.
+func NewValidationReport() *ValidationReport {
+	return &ValidationReport{Rows: map[string]int{}, BadRows: map[string]int{}, Reasons: map[string]int{},
+		FileReasons: map[string]map[string]int{}, Checks: map[string]*CheckSummary{}, issues: map[string][]*RowIssue{}}
+}
+
+// addFiles adds files to the validated files, unless they were added before. The shards of a file are added before
+// they are read concurrently, so that they are reported in order.
+func (report *ValidationReport) addFiles(files ...string) {
+	if report == nil {
+		return
+	}
+	report.mutex.Lock()
+	defer report.mutex.Unlock()
+	for _, file := range files {
+		if _, ok := report.FileReasons[file]; !ok {
+			report.Files = append(report.Files, file)
+			report.FileReasons[file] = map[string]int{}
+		}
+	}
+}
+
+// addRows counts the rows checked in a file.
+func (report *ValidationReport) addRows(file string, rows int) {
+	if report == nil {
+		return
+	}
+	report.mutex.Lock()
+	defer report.mutex.Unlock()
+	report.Rows[file] += rows
+}
+
+// addIssue records a malformed row in the report.
+func (report *ValidationReport) addIssue(file string, line int, reasons, details []string, record []string) {
+	if report == nil {
+		return
+	}
+	report.mutex.Lock()
+	defer report.mutex.Unlock()
+	report.BadRows[file]++
+	if len(report.issues[file]) < maxRowIssues {
+		report.issues[file] = append(report.issues[file], &RowIssue{File: file, Line: line,
+			Reason: strings.Join(reasons, "; "), Detail: strings.Join(details, "; "), Record: record})
+	}
+	counted := map[string]bool{}
+	for _, reason := range reasons {
+		report.Reasons[reason]++
+		if !counted[reason] {
+			report.FileReasons[file][reason]++
+			counted[reason] = true
+		}
+	}
+}
+
+// Issues returns the malformed rows that are kept in the report, cf. maxRowIssues, per file in order of validation.
+func (report *ValidationReport) Issues() []*RowIssue {
+	var issues []*RowIssue
+	for _, file := range report.Files {
+		issues = append(issues, report.issues[file]...)
+	}
+	return issues
+}
+
+// OK returns true if no malformed rows were found.
+func (report *ValidationReport) OK() bool {
+	return report.NofBadRows() == 0
+}
+
+// NofBadRows returns the total nr of malformed rows in all files.
+func (report *ValidationReport) NofBadRows() int {
+	count := 0
+	for _, rows := range report.BadRows {
+		count += rows
+	}
+	return count
+}
+
+// Error returns an error summarizing the report, or nil if no malformed rows were found.
+func (report *ValidationReport) Error() error {
+	if report.OK() {
+		return nil
+	}
+	return errors.New(fmt.Sprint("input validation failed: found ", report.NofBadRows(), " malformed rows, first: ",
+		report.Issues()[0]))
+}
+
+// Log prints the summary statistics of the report and at most max issues to standard output.
+func (report *ValidationReport) Log(max int) {
+	fmt.Println("Input validation:")
+	for _, file := range report.Files {
+		fmt.Println(file, ": checked ", report.Rows[file], " rows, of which ", report.BadRows[file], " malformed.")
+	}
+	reasons := []string{}
+	for reason := range report.Reasons {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		fmt.Println("Reason: ", reason, ": ", report.Reasons[reason], " issues.")
+	}
+	for i, issue := range report.Issues() {
+		if i == max {
+			fmt.Println("...")
+			break
+		}
+		fmt.Println(issue)
+	}
+}
+
+// LogChecks prints the summary of the temporal checks to standard output.
+func (report *ValidationReport) LogChecks() {
+	for _, check := range temporalChecks {
+		if summary, ok := report.Checks[check]; ok {
+			fmt.Println("Check: ", check, ": ", summary.Flagged, " flagged, ", summary.Dropped, " dropped, ",
+				summary.Clamped, " clamped.")
+		}
+	}
+}
+
+// Save writes the malformed rows that are kept in the report to a tab file, so they can be inspected. The header is:
+// File, Line, Reason, Detail, Row. The Row column contains the original row, with its fields separated by commas. The
+// file ends with a comment line per file of which not all malformed rows are kept, cf. maxRowIssues.
+func (report *ValidationReport) Save(path string) {
+	file, err := os.Create(path)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	fmt.Fprintf(file, "File\tLine\tReason\tDetail\tRow\n")
+	for _, issue := range report.Issues() {
+		fmt.Fprintf(file, "%s\t%d\t%s\t%s\t%s\n", issue.File, issue.Line, issue.Reason, issue.Detail,
+			strings.Join(issue.Record, ","))
+	}
+	for _, name := range report.Files {
+		if omitted := report.BadRows[name] - len(report.issues[name]); omitted > 0 {
+			fmt.Fprintf(file, "# %s: %d more malformed rows\n", name, omitted)
+		}
+	}
+}
+
+// rowCheck checks a single row of an input file. It returns the reasons why the row is malformed, with details, or
+// nil if the row is fine.
+type rowCheck func(record []string) (reasons, details []string)
+
+// isMissing checks if a field of a TriNetX file is empty.
+func isMissing(field string) bool {
+	return field == "" || field == triNetXNull
+}
+
+// checkColumns checks the number of columns in a row. If exact is false, the row needs at least the given number of
+// columns.
+func checkColumns(record []string, columns int, exact bool) (string, bool) {
+	if len(record) == columns || (!exact && len(record) > columns) {
+		return "", true
+	}
+	return fmt.Sprint("expected ", columns, " columns, got ", len(record)), false
+}
+
+// checkCodeSystem checks that a diagnosis code is in one of the supported code systems. Codes of other code systems
+// would otherwise be taken for ICD-9-CM codes.
+func checkCodeSystem(codeSystem string) (string, bool) {
+	switch detectCodeSystem(codeSystem) {
+	case CodeSystemICD10, CodeSystemICD9, CodeSystemSNOMED, CodeSystemICD11, CodeSystemCustom:
+		return "", true
+	}
+	return fmt.Sprint("code_system: ", codeSystem), false
+}
+
+// isHeaderRow checks if a row that fails the row check is a header row instead: all its fields are names that start
+// with a letter, whereas data rows have dates or numbers.
+func isHeaderRow(record []string) bool {
+	for _, field := range record {
+		if field == "" || !unicode.IsLetter([]rune(field)[0]) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkTriNetXPatientRow checks a row of a TriNetX patient file.
+func checkTriNetXPatientRow(record []string) (reasons, details []string) {
+	if detail, ok := checkColumns(record, triNetXPatientColumns, true); !ok {
+		return []string{ReasonColumnCount}, []string{detail}
+	}
+	if isMissing(record[0]) {
+		reasons, details = append(reasons, ReasonMissingPID), append(details, "patient_id is empty")
+	}
+	if record[1] != "M" && record[1] != "F" {
+		reasons, details = append(reasons, ReasonUnknownSex), append(details, fmt.Sprint("sex: ", record[1]))
+	}
+	if !isMissing(record[4]) {
+		if _, err := strconv.Atoi(record[4]); err != nil {
+			reasons, details = append(reasons, ReasonBadDate), append(details, fmt.Sprint("year_of_birth: ", record[4]))
+		}
+	}
+	if !isMissing(record[10]) {
+		if _, err := parseTriNetXMonthYear(record[10]); err != nil {
+			reasons = append(reasons, ReasonBadDate)
+			details = append(details, fmt.Sprint("month_year_death: ", record[10]))
+		}
+	}
+	return reasons, details
+}
+
+// checkTriNetXDiagnosisRow checks a row of a TriNetX diagnosis file.
+func checkTriNetXDiagnosisRow(record []string) (reasons, details []string) {
+	if detail, ok := checkColumns(record, triNetXDiagnosisColumns, true); !ok {
+		return []string{ReasonColumnCount}, []string{detail}
+	}
+	if isMissing(record[0]) {
+		reasons, details = append(reasons, ReasonMissingPID), append(details, "patient_id is empty")
+	}
+	if isMissing(record[3]) {
+		reasons, details = append(reasons, ReasonMissingCode), append(details, "code is empty")
+	}
+	if detail, ok := checkCodeSystem(record[2]); !ok {
+		reasons, details = append(reasons, ReasonCodeSystem), append(details, detail)
+	}
+	if _, err := parseTriNetXDate(record[7]); err != nil {
+		reasons, details = append(reasons, ReasonBadDate), append(details, fmt.Sprint("date: ", record[7]))
+	}
+	return reasons, details
+}
+
+// checkTriNetXProcedureRow checks a row of a TriNetX procedure file.
+func checkTriNetXProcedureRow(record []string) (reasons, details []string) {
+	if detail, ok := checkColumns(record, triNetXProcedureColumns, true); !ok {
+		return []string{ReasonColumnCount}, []string{detail}
+	}
+	if isMissing(record[0]) {
+		reasons, details = append(reasons, ReasonMissingPID), append(details, "patient_id is empty")
+	}
+	if isMissing(record[3]) {
+		reasons, details = append(reasons, ReasonMissingCode), append(details, "code is empty")
+	}
+	if _, err := parseTriNetXDate(record[triNetXProcedureDate]); err != nil {
+		reasons = append(reasons, ReasonBadDate)
+		details = append(details, fmt.Sprint("date: ", record[triNetXProcedureDate]))
+	}
+	return reasons, details
+}
+
+// checkTriNetXLabRow checks a row of a TriNetX lab result file. The numeric value may be missing, e.g. for text
+// results.
+func checkTriNetXLabRow(record []string) (reasons, details []string) {
+	if detail, ok := checkColumns(record, triNetXLabColumns, true); !ok {
+		return []string{ReasonColumnCount}, []string{detail}
+	}
+	if isMissing(record[0]) {
+		reasons, details = append(reasons, ReasonMissingPID), append(details, "patient_id is empty")
+	}
+	if isMissing(record[3]) {
+		reasons, details = append(reasons, ReasonMissingCode), append(details, "code is empty")
+	}
+	if _, err := parseTriNetXDate(record[triNetXLabDate]); err != nil {
+		reasons, details = append(reasons, ReasonBadDate), append(details, fmt.Sprint("date: ", record[triNetXLabDate]))
+	}
+	if value := record[triNetXLabValue]; !isMissing(value) {
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			reasons = append(reasons, ReasonBadValue)
+			details = append(details, fmt.Sprint("lab_result_num_val: ", value))
+		}
+	}
+	return reasons, details
+}
+
+// checkTriNetXTumorRow checks a row of a TriNetX tumor file.
+func checkTriNetXTumorRow(record []string) (reasons, details []string) {
+	if detail, ok := checkColumns(record, triNetXTumorColumns, false); !ok {
+		return []string{ReasonColumnCount}, []string{detail}
+	}
+	if isMissing(record[0]) {
+		reasons, details = append(reasons, ReasonMissingPID), append(details, "patient_id is empty")
+	}
+	if _, err := parseTriNetXDate(record[1]); err != nil {
+		reasons, details = append(reasons, ReasonBadDate), append(details, fmt.Sprint("date: ", record[1]))
+	}
+	if morphology := record[triNetXTumorMorphology]; !isMissing(morphology) {
+		if _, _, err := parseICDO3Morphology(morphology); err != nil {
+			reasons = append(reasons, ReasonBadMorphology)
+			details = append(details, fmt.Sprint("morphology: ", morphology))
+		}
+	}
+	return reasons, details
+}
+
+// rowReader reads the rows of a csv file that pass a row check. The malformed rows are skipped and added to a
+// validation report, so that the input files are validated while they are parsed.
+type rowReader struct {
+	reader  *csv.Reader
+	file    string
+	check   rowCheck
+	report  *ValidationReport // nil if the malformed rows are not reported
+	rows    int               // nr of rows read so far, without a skipped header
+	started bool              // true once the first row is read
+}
+
+// newRowReader creates a reader for the rows of a csv file that pass the given check. The malformed rows are added to
+// the report, nil if they are not reported.
+func newRowReader(reader *csv.Reader, fileName string, check rowCheck, report *ValidationReport) *rowReader {
+	reader.FieldsPerRecord = -1
+	report.addFiles(fileName)
+	return &rowReader{reader: reader, file: fileName, check: check, report: report}
+}
+
+// read returns the next row that passes the check. A first row that fails the check but looks like a header is skipped
+// without being reported. It returns io.EOF when there are no more rows.
+func (r *rowReader) read() ([]string, error) {
+	for {
+		record, err := r.reader.Read()
+		if err == io.EOF {
+			r.report.addRows(r.file, r.rows)
+			r.rows = 0
+			return nil, err
+		}
+		if !r.started {
+			r.started = true
+			if err == nil && isHeaderRow(record) {
+				if reasons, _ := r.check(record); len(reasons) > 0 {
+					if r.report != nil {
+						fmt.Println("Skipping header row of ", r.file, ": ", strings.Join(record, ", "))
+					}
+					continue
+				}
+			}
+		}
+		r.rows++
+		if err != nil {
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				r.report.addIssue(r.file, parseErr.Line, []string{ReasonMalformedCSV}, []string{parseErr.Err.Error()},
+					nil)
+				continue
+			}
+			return nil, err
+		}
+		reasons, details := r.check(record)
+		if len(reasons) == 0 {
+			return record, nil
+		}
+		if r.report != nil {
+			line, _ := r.reader.FieldPos(0)
+			r.report.addIssue(r.file, line, reasons, details, record)
+		}
+	}
+}
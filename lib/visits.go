@@ -0,0 +1,117 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"fmt"
+)
+
+// Same-visit grouping. Diagnoses that are coded during the same hospital visit are recorded in an arbitrary order, or
+// on the successive days of a stay, so that ordering them by date creates transitions between them that do not exist.
+// With grouping, the diagnoses of a visit, i.e. of the same encounter or of the same date, are collapsed onto the first
+// date of that visit. The tie-breaking policy then decides how the diagnoses of a visit are ordered: not at all, so
+// that they form an unordered set without transitions between them, or by their diagnosis codes.
+
+// Groupings of the diagnoses of a visit.
+const (
+	VisitNone      = "none"      // no grouping, diagnoses are ordered by date
+	VisitDate      = "date"      // the diagnoses of the same date form a visit
+	VisitEncounter = "encounter" // the diagnoses of the same encounter form a visit, or of the same date without encounter
+)
+
+// Tie-breaking policies for the diagnoses of a visit.
+const (
+	VisitUnordered = "unordered" // no transitions between the diagnoses of a visit
+	VisitByCode    = "code"      // the diagnoses of a visit are ordered by their analysis DIDs
+)
+
+// sameVisit checks if two diagnoses belong to the same unordered visit, cf. GroupVisits.
+func sameVisit(d1, d2 *Diagnosis) bool {
+	return d1.Visit != 0 && d1.Visit == d2.Visit
+}
+
+// collapseEncounters moves the diagnoses of each encounter of a patient onto the first date of that encounter. It
+// returns the nr of diagnoses that were moved.
+func collapseEncounters(p *Patient) int {
+	firstDates := map[string]DiagnosisDate{}
+	for _, d := range p.Diagnoses {
+		if d.Encounter == "" {
+			continue
+		}
+		if date, ok := firstDates[d.Encounter]; !ok || DiagnosisDateSmallerThan(d.Date, date) {
+			firstDates[d.Encounter] = d.Date
+		}
+	}
+	moved := 0
+	for _, d := range p.Diagnoses {
+		if d.Encounter == "" {
+			continue
+		}
+		if date := firstDates[d.Encounter]; !diagnosisDateEqual(d.Date, date) {
+			d.Date = date
+			moved++
+		}
+	}
+	return moved
+}
+
+// numberVisits numbers the visits of a patient, whose diagnoses are sorted by date, starting from 1.
+func numberVisits(p *Patient) {
+	visit := 0
+	for i, d := range p.Diagnoses {
+		if i == 0 || !diagnosisDateEqual(p.Diagnoses[i-1].Date, d.Date) {
+			visit++
+		}
+		d.Visit = visit
+	}
+}
+
+// GroupVisits groups the diagnoses of all patients into visits, cf. the Visit constants, and orders the diagnoses of
+// each visit according to the tie-breaking policy, cf. VisitUnordered and VisitByCode.
+func GroupVisits(patients *PatientMap, grouping, order string) {
+	switch grouping {
+	case "", VisitNone:
+		return
+	case VisitDate, VisitEncounter:
+	default:
+		panic(fmt.Sprint("Unknown same-visit grouping: ", grouping))
+	}
+	switch order {
+	case "":
+		order = VisitUnordered
+	case VisitUnordered, VisitByCode:
+	default:
+		panic(fmt.Sprint("Unknown same-visit order: ", order))
+	}
+	fmt.Println("Grouping diagnoses of the same visit by ", grouping, ", ordered: ", order)
+	moved := 0
+	for _, pid := range patients.sortedPIDs() {
+		p := patients.PIDMap[pid]
+		if grouping == VisitEncounter {
+			moved += collapseEncounters(p)
+		}
+		compactPatientDiagnoses(p)
+		if order == VisitUnordered {
+			numberVisits(p)
+		}
+	}
+	if grouping == VisitEncounter {
+		fmt.Println("Moved ", moved, " diagnoses onto the first date of their encounter.")
+	}
+}
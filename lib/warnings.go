@@ -0,0 +1,138 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// Machine-readable warnings. The parsers skip the rows of the input that cannot be used, e.g. diagnoses of unknown
+// patients or with unmapped codes, and patients without year of birth. Rows with bad dates are rejected before they
+// are parsed, cf. rowReader, and are reported in the rejects file. The warning log records each skipped row with
+// a reference to its file and line, if known, so that the skipped rows can be traced back to the input. The warnings
+// are written as a json lines file, and their counts per reason are reported in the run manifest. Diagnoses that are
+// excluded from analysis by design, cf. UnmappedExcluded, are not warnings.
+
+// Reasons for skipping a patient, in addition to the reasons for dropping a diagnosis, cf. the Unmapped constants.
+const (
+	WarningMissingYOB       = "missing year of birth"
+	WarningMissingAdmission = "no admission time"
+)
+
+// maxWarnings is the nr of warnings that are kept in a warning log. Further warnings are only counted.
+const maxWarnings = 100000
+
+// Warning describes a skipped row of an input file.
+type Warning struct {
+	File   string `json:"file,omitempty"`   // name of the input file, if known
+	Line   int    `json:"line,omitempty"`   // line number of the row in the input file, if known
+	Reason string `json:"reason"`           // why the row was skipped, cf. the Warning and Unmapped constants
+	Detail string `json:"detail,omitempty"` // more information, e.g. the code system and code of a diagnosis
+}
+
+// WarningLog collects the warnings of the parsers.
+type WarningLog struct {
+	Warnings []*Warning     // the warnings, in order of occurrence, at most maxWarnings
+	Reasons  map[string]int // nr of warnings per reason, including the warnings that were not kept
+}
+
+// NewWarningLog creates an empty warning log.
+func NewWarningLog() *WarningLog {
+	return &WarningLog{Reasons: map[string]int{}}
+}
+
+// add records a warning. A line of 0 means that the line is unknown.
+func (log *WarningLog) add(file string, line int, reason, detail string) {
+	if log == nil {
+		return
+	}
+	log.Reasons[reason]++
+	if len(log.Warnings) < maxWarnings {
+		log.Warnings = append(log.Warnings, &Warning{File: file, Line: line, Reason: reason, Detail: detail})
+	}
+}
+
+// Count returns the total nr of warnings.
+func (log *WarningLog) Count() int {
+	if log == nil {
+		return 0
+	}
+	count := 0
+	for _, n := range log.Reasons {
+		count += n
+	}
+	return count
+}
+
+// Log prints the nr of warnings per reason to standard output.
+func (log *WarningLog) Log() {
+	fmt.Println("Skipped ", log.Count(), " rows of the input with warnings.")
+	if log == nil {
+		return
+	}
+	reasons := make([]string, 0, len(log.Reasons))
+	for reason := range log.Reasons {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		fmt.Println("Warning: ", reason, ": ", log.Reasons[reason], " rows.")
+	}
+}
+
+// Save writes the warnings to a json lines file, with a json object per warning.
+func (log *WarningLog) Save(path string) {
+	file, err := os.Create(path)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	if log == nil {
+		return
+	}
+	encoder := json.NewEncoder(file)
+	for _, warning := range log.Warnings {
+		if err := encoder.Encode(warning); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// withRowRef appends the file name and line number of the last row read by a csv reader to the row, so that the
+// reference is passed on with the row, e.g. through readShards. The row itself is not modified.
+func withRowRef(row []string, file string, reader *csv.Reader) []string {
+	line, _ := reader.FieldPos(0)
+	return append(row[:len(row):len(row)], file, strconv.Itoa(line))
+}
+
+// splitRowRef splits the file name and line number off a row, cf. withRowRef.
+func splitRowRef(row []string) ([]string, string, int) {
+	n := len(row) - 2
+	line, _ := strconv.Atoi(row[n+1])
+	return row[:n], row[n], line
+}
@@ -0,0 +1,262 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package lib
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Export of the results as an Excel workbook, with a sheet for the trajectories, the diagnosis pairs, the clusters,
+// and the summary report, cf. SummaryReport. An xlsx file is a zip archive of xml parts in the SpreadsheetML format of
+// Office Open XML. Only the parts that Excel requires are written: the content types, the relationships, the workbook,
+// a minimal stylesheet with a bold font for the header rows, and the worksheets. Strings are stored inline rather than
+// in a shared string table.
+
+// xlsxSheet is a worksheet of a workbook. The values of the cells are strings, ints, or float64s.
+type xlsxSheet struct {
+	name string
+	rows [][]interface{}
+}
+
+// addRow adds a row to a worksheet.
+func (sheet *xlsxSheet) addRow(values ...interface{}) {
+	sheet.rows = append(sheet.rows, values)
+}
+
+const xlsxContentTypes = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">
+<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>
+<Default Extension="xml" ContentType="application/xml"/>
+<Override PartName="/xl/workbook.xml"
+	ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>
+<Override PartName="/xl/styles.xml"
+	ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/>
+%s</Types>
+`
+
+const xlsxSheetContentType = `<Override PartName="/xl/worksheets/sheet%d.xml" ` +
+	`ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>
+`
+
+const xlsxRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId1" Target="xl/workbook.xml"
+	Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument"/>
+</Relationships>
+`
+
+const xlsxStyles = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">
+<fonts count="2">
+<font><sz val="11"/><name val="Calibri"/></font>
+<font><b/><sz val="11"/><name val="Calibri"/></font>
+</fonts>
+<fills count="2"><fill><patternFill patternType="none"/></fill><fill><patternFill patternType="gray125"/></fill></fills>
+<borders count="1"><border><left/><right/><top/><bottom/><diagonal/></border></borders>
+<cellStyleXfs count="1"><xf numFmtId="0" fontId="0" fillId="0" borderId="0"/></cellStyleXfs>
+<cellXfs count="2">
+<xf numFmtId="0" fontId="0" fillId="0" borderId="0" xfId="0"/>
+<xf numFmtId="0" fontId="1" fillId="0" borderId="0" xfId="0" applyFont="1"/>
+</cellXfs>
+</styleSheet>
+`
+
+// xlsxText escapes a string for use in an xml part of a workbook.
+func xlsxText(s string) string {
+	var escaped strings.Builder
+	xml.EscapeText(&escaped, []byte(s))
+	return escaped.String()
+}
+
+// xlsxColumn returns the name of a column of a worksheet, e.g. A for 0, Z for 25, and AA for 26.
+func xlsxColumn(column int) string {
+	name := ""
+	for column++; column > 0; column = (column - 1) / 26 {
+		name = string(rune('A'+(column-1)%26)) + name
+	}
+	return name
+}
+
+// writeXlsxCell writes a cell of a worksheet. Numbers that are not finite, such as unknown statistics, are written as
+// strings, since a workbook cannot hold them as numbers.
+func writeXlsxCell(w io.Writer, ref string, style int, value interface{}) {
+	switch v := value.(type) {
+	case int:
+		fmt.Fprintf(w, `<c r="%s" s="%d"><v>%d</v></c>`, ref, style, v)
+	case bool:
+		value := 0
+		if v {
+			value = 1
+		}
+		fmt.Fprintf(w, `<c r="%s" s="%d" t="b"><v>%d</v></c>`, ref, style, value)
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			writeXlsxCell(w, ref, style, strconv.FormatFloat(v, 'g', -1, 64))
+		} else {
+			fmt.Fprintf(w, `<c r="%s" s="%d"><v>%s</v></c>`, ref, style, strconv.FormatFloat(v, 'g', -1, 64))
+		}
+	default:
+		fmt.Fprintf(w, `<c r="%s" s="%d" t="inlineStr"><is><t xml:space="preserve">%s</t></is></c>`, ref, style,
+			xlsxText(fmt.Sprint(v)))
+	}
+}
+
+// writeXlsxSheet writes a worksheet. The first row is the header row, in bold and frozen.
+func writeXlsxSheet(w io.Writer, sheet *xlsxSheet) {
+	fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>`+"\n")
+	fmt.Fprint(w, `<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">`)
+	fmt.Fprint(w, `<sheetViews><sheetView workbookViewId="0"><pane ySplit="1" topLeftCell="A2" activePane="bottomLeft" `+
+		`state="frozen"/></sheetView></sheetViews><sheetData>`)
+	for i, row := range sheet.rows {
+		fmt.Fprintf(w, `<row r="%d">`, i+1)
+		style := 0
+		if i == 0 {
+			style = 1
+		}
+		for j, value := range row {
+			writeXlsxCell(w, fmt.Sprint(xlsxColumn(j), i+1), style, value)
+		}
+		fmt.Fprint(w, "</row>")
+	}
+	fmt.Fprint(w, "</sheetData></worksheet>\n")
+}
+
+// writeXlsx writes the given worksheets as a workbook to a file.
+func writeXlsx(sheets []*xlsxSheet, fileName string) {
+	file, err := os.Create(fileName)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	archive := zip.NewWriter(file)
+	part := func(name string) io.Writer {
+		w, err := archive.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate})
+		if err != nil {
+			panic(err)
+		}
+		return w
+	}
+	var contentTypes, workbookSheets, workbookRels strings.Builder
+	for i, sheet := range sheets {
+		fmt.Fprintf(&contentTypes, xlsxSheetContentType, i+1)
+		fmt.Fprintf(&workbookSheets, `<sheet name="%s" sheetId="%d" r:id="rId%d"/>`, xlsxText(sheet.name), i+1, i+1)
+		fmt.Fprintf(&workbookRels, `<Relationship Id="rId%d" `+
+			`Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" `+
+			`Target="worksheets/sheet%d.xml"/>`+"\n", i+1, i+1)
+	}
+	fmt.Fprintf(&workbookRels, `<Relationship Id="rId%d" `+
+		`Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>`+"\n",
+		len(sheets)+1)
+	fmt.Fprintf(part("[Content_Types].xml"), xlsxContentTypes, contentTypes.String())
+	fmt.Fprint(part("_rels/.rels"), xlsxRels)
+	fmt.Fprintf(part("xl/workbook.xml"), `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" `+
+		`xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets>%s</sheets></workbook>
+`, workbookSheets.String())
+	fmt.Fprintf(part("xl/_rels/workbook.xml.rels"), `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+%s</Relationships>
+`, workbookRels.String())
+	fmt.Fprint(part("xl/styles.xml"), xlsxStyles)
+	for i, sheet := range sheets {
+		writeXlsxSheet(part(fmt.Sprintf("xl/worksheets/sheet%d.xml", i+1)), sheet)
+	}
+	if err := archive.Close(); err != nil {
+		panic(err)
+	}
+}
+
+// newWorkbookSheets returns the worksheets of the results of an experiment: the trajectories, the diagnosis pairs, the
+// clusters, and the summary report.
+func newWorkbookSheets(exp *Experiment, summary *SummaryReport) []*xlsxSheet {
+	trajectories := &xlsxSheet{name: "Trajectories"}
+	trajectories.addRow("TID", "Hash", "Length", "Patients", "Diagnoses", "Codes", "Patients per transition")
+	for _, t := range exp.Trajectories {
+		names := make([]string, len(t.Diagnoses))
+		codes := make([]string, len(t.Diagnoses))
+		for i, did := range t.Diagnoses {
+			names[i] = exp.Icd10Map[did].Name
+			codes[i] = exp.IdMap[did]
+		}
+		numbers := make([]string, len(t.PatientNumbers))
+		for i, n := range t.PatientNumbers {
+			numbers[i] = strconv.Itoa(n)
+		}
+		trajectories.addRow(t.ID, t.Hash, len(t.Diagnoses), trajectorySupport(t), strings.Join(names, " -> "),
+			strings.Join(codes, " -> "), strings.Join(numbers, ", "))
+	}
+	pairs := &xlsxSheet{name: "Pairs"}
+	pairs.addRow("Diagnosis 1", "Code 1", "Diagnosis 2", "Code 2", "RR", "p-value", "CI low", "CI high", "Exposed",
+		"Exposed D2", "Comparison D2", "Patients", "Directionality", exp.metricName(), "Rare", "PAF",
+		"Excess per 1000 PY")
+	for _, pair := range exp.Pairs {
+		stats := exp.rrStats(pair.First, pair.Second)
+		if stats == nil {
+			stats = &RRStats{PValue: math.NaN(), Low: math.NaN(), High: math.NaN(), ExposedD2: math.NaN(),
+				ComparisonD2: math.NaN()}
+		}
+		patients := exp.pairPatientCount(pair.First, pair.Second)
+		pairs.addRow(exp.Icd10Map[pair.First].Name, exp.IdMap[pair.First], exp.Icd10Map[pair.Second].Name,
+			exp.IdMap[pair.Second], exp.DxDRR[pair.First][pair.Second], stats.PValue, stats.Low, stats.High,
+			exp.cellValue(float64(stats.Exposed), stats.Exposed), exp.cellValue(stats.ExposedD2, stats.ExposedD2),
+			exp.cellValue(stats.ComparisonD2, stats.ComparisonD2), exp.cellValue(patients, patients),
+			exp.directionality(pair.First, pair.Second), exp.effect(pair.First, pair.Second),
+			exp.rare(pair.First, pair.Second), exp.attributableFraction(pair.First, pair.Second),
+			exp.excessIncidence(pair.First, pair.Second))
+	}
+	clusters := &xlsxSheet{name: "Clusters"}
+	clusters.addRow("Granularity", "CID", "TID")
+	for _, clustering := range exp.Clusterings {
+		for _, cluster := range clustering.Clusters {
+			for _, tid := range cluster.Trajectories {
+				clusters.addRow(clustering.Granularity, cluster.ID, tid)
+			}
+		}
+	}
+	summarySheet := &xlsxSheet{name: "Summary"}
+	summarySheet.addRow("Section", "Metric", "Value")
+	for _, metric := range summary.Metrics {
+		if value, err := strconv.Atoi(metric.Value); err == nil {
+			summarySheet.addRow(metric.Section, metric.Metric, value)
+		} else {
+			summarySheet.addRow(metric.Section, metric.Metric, metric.Value)
+		}
+	}
+	return []*xlsxSheet{trajectories, pairs, clusters, summarySheet}
+}
+
+// WriteWorkbook writes the results of an experiment to an Excel workbook, with a sheet for the trajectories, the
+// diagnosis pairs, the clusters, and the summary report. It returns the file name.
+func WriteWorkbook(exp *Experiment, summary *SummaryReport, path string) string {
+	fileName := filepath.Join(path, fmt.Sprintf("%s-results.xlsx", exp.Name))
+	writeXlsx(newWorkbookSheets(exp, summary), fileName)
+	return fileName
+}
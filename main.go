@@ -1,14 +1,16 @@
 package main
 
 import (
-	"bytes"
+	"database/sql"
 	"flag"
 	"fmt"
 	"github.com/imec-int/ptra/lib"
+	_ "github.com/lib/pq"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 )
 
 /*
@@ -16,6 +18,10 @@ Ptra is a tool for patient trajectory analysis.
 
 Usage:
 	ptra pfile ifile dfile path [flags]
+	ptra synth path [flags]
+	ptra validate pfile ifile dfile [flags]
+	ptra profile pfile ifile dfile path [flags]
+	ptra power [flags]
 
 Example:
 	ptra ICD10 patient.csv icd10cm_tabular_2022.xml diagnosis.csv ./MIBC_tfiltered/ --nofAgeGroups 10 --lvl 2
@@ -24,6 +30,13 @@ Example:
 	--mclPath /home/caherzee/tools/mcl/ --clusterGranularities 40,60,80,100 --pfilters "MIBC" --tumorInfo tumor.csv
 	--tfilters "bc" --treatmentInfo treatments.csv
 
+Input files may be compressed (.gz or .zst), and may be s3:// or https:// URLs, which are downloaded while they are
+read. S3 requests are signed with the credentials of the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, and AWS_REGION
+environment variables.
+
+The diagnosis file may be a directory, or a quoted glob pattern, with the shards of a split diagnosis export, e.g.
+part-0000.csv, part-0001.csv, ..., which are read concurrently.
+
 The flags are:
 
 --nofAgeGroups nr
@@ -36,7 +49,10 @@ The flags are:
 	this chosen level. ICD10 codes of lower levels may be combined into the same code of a higher level. E.g. A00.0
 	Cholera due to Vibrio cholerae 01, biovar cholerae and A00.1 Cholera due to Vibrio cholerae 01, biovar eltor are lvl
 	3 codes and may be collapsed to A00 Cholera in lvl 2, or A00-A09 Intestinal infectious diseases in lvl 1, or A00-B99
-	Certain infectious and parasitic diseases in lvl 0.
+	Certain infectious and parasitic diseases in lvl 0. For ICD-9-CM, lvl 0 are the chapters, lvl 1 the 3 digit
+	categories, and each next digit is one level deeper. For ICD-11, lvl 0 are the chapters, and each next level is one
+	block or category deeper. For a SNOMED CT release, lvl 0 are the top level concepts, e.g. Clinical finding, and each
+	next level is one IS-A relationship deeper.
 --minPatients nr
 	Sets the minimum required number of patients in a trajectory.
 --maxYears nr
@@ -56,6 +72,14 @@ The flags are:
 --ICD9ToICD10File file
 	A json file that provides a mapping from ICD9 to ICD10 codes. The input may be mixed ICD9 and ICD10 codes. With this
 	mapping, the tool can automatically convert all diagnosis codes to ICD10 codes for analysis.
+--ICD10ToICD11File file
+	A mapping from ICD10 to ICD11 codes, used when the diagnosis information is the ICD-11 linearization. This is
+	either a json file, or the tab separated 10To11MapToOneCategory file of the WHO. The input may be mixed ICD10 and
+	ICD11 codes, ICD9 codes are first mapped to ICD10 codes.
+--SNOMEDToICD10File file
+	A mapping from SNOMED CT concepts to ICD10 codes, either a json file, or the extended map of a SNOMED CT
+	release. The input may then mix SNOMED CT, ICD9, and ICD10 codes: the code system of each diagnosis is detected
+	from its code_system column, e.g. ICD-10-CM, ICD10, or SNOMED, and its code is mapped onto the vocabulary.
 --cluster
 	If this flag is passed, the computed trajectories are clustered and the clusters are outputted to file.
 --mclPath
@@ -64,26 +88,322 @@ The flags are:
 	Sets the number of iterations to be used in the sampling experiments for calculating relative risk ratios. If iter
 	is 400, the calculated p-values are within 0.05 of the true p-values. For iter = 10000, the true p-values are within
 	0.01 of the true p-values. The higher the number of iterations, the higher the runtime.
+--matchedControls nr
+	Matches each exposed patient to the given number of controls of the same sex, age group, region, and
+	race/ethnicity stratum, drawn uniformly at random, instead of sampling comparison groups of the same size from the
+	cohorts of the exposed patients. 0 (the default) samples from the cohorts.
+--matchComorbidities
+	If this flag is passed, the matched controls also have the same number of distinct diagnoses as the exposed
+	patient. Requires --matchedControls.
+--pairTest sampling | fisher | auto
+	Sets the test of the significance of the diagnosis pairs. sampling (the default) estimates the p-values by
+	sampling comparison groups, fisher computes them with Fisher's exact test, which is exact for rare pairs, and auto
+	uses Fisher's exact test for pairs with fewer than 10 patients with the second diagnosis in the exposed or
+	comparison group, and sampling otherwise.
+--maxPValue nr
+	The maximum p-value of the diagnosis pairs d1 -> d2 that get an RR score, as estimated by --pairTest. The
+	default is 0.001. With sampling, p-values below 1/iter cannot be distinguished, so the number of iterations should
+	be large enough for the given p-value.
+--rrBound point | low
+	Sets the bound of the RR scores that is compared with --RR for selecting the diagnosis pairs that trajectories
+	are built from: the RR score itself (point, the default), or the lower bound of its 95% confidence interval
+	(low). low cannot be combined with --dpEpsilon.
+--continuityCorrection nr
+	The continuity correction that is added to each cell of the 2x2 table of the diagnosis pairs with a zero cell,
+	e.g. 0.5, so that their RR scores and confidence intervals stay finite. 0 (the default) disables the correction.
+--minCount nr
+	Flags the diagnosis pairs with fewer second diagnoses than the given count in the exposed or comparison group
+	as rare in the outputs. Pairs with a zero cell in their 2x2 table are always rare. The default is 0.
+--censoring
+	If this flag is passed, the exposed patients without the second diagnosis of a pair that die or reach the end of
+	the data before the end of the --maxYears time frame after the first diagnosis are censored: they are left out
+	of the exposed group when computing the RR, rather than counted as never diagnosed with the second diagnosis.
+--endDate date
+	The end of the data for --censoring, formatted as YYYY-MM-DD. The default is the date of the last diagnosis in the
+	input.
+--maxDirectionalityP nr
+	Only builds trajectories from the diagnosis pairs d1 -> d2 that occur significantly more often in this order
+	than in the reverse order d2 -> d1, i.e. of which the p-value of the binomial test of the directionality is at
+	most the given value. 0 (the default) disables the filter.
+--metric rr | or | rd | hr
+	Sets the effect size that is reported for the diagnosis pairs next to the RR: the relative risk (rr, the
+	default), the odds ratio (or), the absolute risk difference (rd), or the hazard ratio (hr) of a Cox model of the
+	time from the first to the second diagnosis, censored at death or the end of observation. The pairs are still
+	selected on their RR.
+--pairsBySex
+	If this flag is passed, the RR scores of the selected diagnosis pairs are also computed within the male and
+	female patients, and written to name-pairs-male.tab and name-pairs-female.tab. Cannot be combined with
+	--dpEpsilon.
+--pairsByAge
+	If this flag is passed, the RR scores of the selected diagnosis pairs are also computed within the patients of
+	each age group, and written to name-pairs-by-age.tab. Cannot be combined with --dpEpsilon.
 --saveRR file
 	Save the RR matrix, a matrix that represents the RR calculated from the population for each possible combination of
 	ICD10 diagnosis pairs. This matrix can be loaded in other ptra runs to avoid recalculating the RR scores. This can
 	be useful if parameters want to be explored that do not impact the RR calculation itself. Only iter, maxYears and
 	minYears, and filters influence RR calculation. Variations of other parameters for constructing trajectories from RR
 	scores, such as maxTrajectoryLenght, minTrajectoryLength, minPatients, RR etc might be explored in other runs.
+--rrFormat dense | sparse
+	The format of the RR matrix saved with --saveRR. dense (default) has a line for each diagnosis pair, sparse only
+	has lines for the computed RR scores, with a header that maps the diagnoses onto their codes. --loadRR accepts
+	both formats.
 --loadRR file
 	Load the RR matrix from file. Such a file must be created by a previous run of ptra with the --saveRR flag.
---pfilters age70+ | age70- | male | female | Ta | T0 | Tis | T1 | T2 | T3 | T4 | N0 | N1 | N2 | N3 | M0 | M1 |NMIBC | MIBC | mUC
+--pfilters age70+ | age70- | male | female | Ta | T0 | Tis | T1 | T2 | T3 | T4 | N0 | N1 | N2 | N3 | M0 | M1 |NMIBC | MIBC | mUC | urothelial | squamous | adenocarcinoma | neuroendocrine
 	A list of filters for selecting patients from whitch to derive trajectories.
+--comparePFilters filters
+	Runs a differential analysis of two cohorts: the patients selected by --pfilters, and the patients selected by
+	the given filters, e.g. --pfilters MIBC --comparePFilters NMIBC. The outputs of each cohort are written as for
+	separate runs named name-cohort1 and name-cohort2, and the trajectories of both cohorts are compared in
+	name-differential.tab.
+--permutationTest filter
+	Compares the prevalence of the trajectories between the patients that pass the given patient filter, e.g. male,
+	age70+, or T2, and the other patients, with a permutation test of the group labels. The results are written to
+	name-permutation-test.tab.
+--permutations nr
+	The number of permutations of the group labels of --permutationTest. Defaults to 1000.
 --tumorInfo file
 	A file with information about patients and their tumors. This file contains annotations about the stage of the
-	bladder cancer at a specific time. Cf. TriNetX tumor table. This information is used by filters.
+	bladder cancer at a specific time. Cf. TriNetX tumor table. This information is used by filters. Sites may be ICD-10
+	or ICD-O-3 topography codes, and an ICD-O-3 morphology code determines the histology of the tumor.
+--tumorSites list
+	A comma separated list of ICD-10 or ICD-O-3 topography prefixes, e.g. C50,C34, of the tumors that are
+	recorded from the tumor file. Defaults to the bladder (C67). This way, other cohorts, e.g. breast, lung or
+	prostate cancer, can use the tumor stage filters.
+--stagingRules file
+	A json file with the TNM staging rules of other cancers than bladder cancer. Each cancer has a name, the
+	topography prefixes of its sites, and rules that map combinations of T, N and M values onto an overall stage.
 --tfilters neoplasm | bc
 	A list of filters for reducing the output of trajectories. E.g. neoplasm only outputs trajectories where there is at
 	least one diagnosis related to cancer. bc only outputs trajectories where one diagnosis is (assuming) related to
 	bladder cancer.
+--topTrajectories nr
+	Only output the given number of trajectories with the most patients, i.e. the patients that follow the whole
+	trajectory. The selected trajectories keep their IDs. 0 (default) outputs all trajectories.
+--minEdgeRR nr
+	Only output the trajectories of which each transition has at least the given RR score. Unlike --RR, this does
+	not change how trajectories are built. 0 (default) does not filter on RR. Combined with --topTrajectories, the
+	top trajectories are selected among the trajectories with the minimum RR.
+--bootstrap nr
+	The number of bootstrap replicates of the patients from which the trajectories are rebuilt, to report for each
+	trajectory the fraction of the replicates in which it reappears in name-bootstrap.tab. 0 (the default) for none.
+--validateTrajectories file
+	The json results (name-results.json) of a previous run, e.g. on the data of another site, of which the
+	trajectories are validated on the input: the RR scores and the numbers of patients of their transitions are
+	recomputed, and they are written to name-validation.tab.
+--sweep grid
+	Runs a sensitivity analysis: after the run, the trajectories are rebuilt from the same RR matrix for each setting
+	of a grid of values of minYears, maxYears, RR, and minPatients, e.g. minYears=0.5,1;RR=1,1.5;minPatients=50,100.
+	The settings are summarized in name-sweep.tab, and the persistence of the top trajectories in
+	name-sweep-persistence.tab.
+--mortality windows
+	Comma separated windows in years, e.g. 1,5, within which the proportion of the patients following a trajectory
+	that die after its last diagnosis is compared with that of matched non-followers, in name-mortality.tab.
+--render svg | png
+	Render figures of the trajectories with the dot binary of Graphviz, which must be on the PATH, in the given image
+	format: a figure of the merged graph of the 50 trajectories with the most patients, and with --cluster, a figure
+	per cluster. The figures are written to the name-figures folder of the output path.
 --treatmentInfo file
 	A file with information about patients and their treatments, e.g. MVAC,radical cystectomy, etc. If this file is
 	passed, the treatments will be used as diagnostic codes to calculated trajectories.
+--treatmentSchema file
+	A json file describing the layout of the treatment file: the columns with the patient id and the dates of radical
+	cystectomy, MVAC chemotherapy and intravesical therapy, and the date format. Defaults to the TriNetX layout.
+	Alternatively, the schema lists any number of treatments, each a column with an event code, a description and
+	a date format.
+--customEvents file
+	A json file with the custom events that are read from the treatment file: a list of events with a code, a
+	description, and the column of the treatment file with the date of the event. The codes are added to the
+	diagnostic codes. Defaults to the bladder cancer treatments C98, C99 and C100.
+--procedureInfo file
+	A TriNetX procedure file with CPT or HCPCS coded procedures. The procedures are grouped with the
+	--procedureGroups table, and each procedure group is used as a diagnostic code to calculate trajectories.
+--procedureGroups file
+	A csv file that groups procedure codes into procedure groups, with code_system, code, and group columns. The code
+	is a single code or a range of codes, e.g. 51550-51597. Required with --procedureInfo.
+--labInfo file
+	A TriNetX lab result file with LOINC coded lab results. The lab results that match a --labRules rule are used as
+	diagnostic codes of the events of the rules to calculate trajectories.
+--labRules file
+	A json file with the rules that turn lab results into events: a list of objects with a LOINC code (loinc), a
+	comparator (<, <=, >, >=, or =), a threshold, an optional unit, and the name of the event. Required with --labInfo.
+--enrollmentInfo file
+	A csv file with the observation periods of the patients, e.g. their enrollment in an insurance plan, with
+	patient_id, start_date, and end_date columns. Only the diagnoses inside the observation periods are counted,
+	and patients without observation period are left out.
+--dpEpsilon nr
+	Enables the experimental differential privacy mode with the given privacy budget epsilon. Laplace noise is added to
+	the RR scores and to the patient counts of the trajectories, and the spent privacy budget is reported in the run
+	manifest. Smaller values give more noise. The released pairs and trajectories still depend on exact counts, so
+	this is not a formal differential privacy guarantee for the run, see the README. The noise is drawn from a
+	cryptographic random source, not from --seed, so that it cannot be regenerated. Cannot be combined with
+	--deterministic.
+--minCellSize nr
+	Suppresses the patient counts below the given size in the outputs, as required by small-cell rules. The
+	trajectories with a transition of fewer patients are left out, and the other patient counts are binned as <nr.
+--pseudonymize none | hash | pseudonym
+	Replaces the TriNetX patient ids in the output files. hash replaces them by salted hashes, pseudonym replaces them by
+	study-specific pseudonyms derived from the experiment name.
+--pseudonymSalt string
+	The salt (key) used for hashing patient ids. Required by --pseudonymize hash.
+--pseudonymMapFile file
+	Writes the mapping from patient ids onto pseudonyms to a csv file. This file allows re-identification and should be
+	kept separately from the shared outputs.
+--neo4j
+	Writes the trajectories as csv files for the bulk importer of Neo4j to a neo4j folder in the output folder,
+	so that they can be queried with Cypher. The files hold the diagnoses, trajectories, and patients as nodes, and
+	PROGRESSES_TO and MATCHES relationships. The patients are identified by their pseudonyms.
+--parquet
+	Writes the pairs, the trajectories, and the patients of the trajectories as Parquet files to the output
+	folder, so that they can be loaded directly in e.g. pandas, R, or Spark. The patients are identified by their
+	pseudonyms.
+--patientTrajectories
+	Writes a csv file that lists, for every patient, every trajectory the patient contributed to, with the dates
+	of the diagnoses of the patient that matched the trajectory. The patients are identified by their pseudonyms.
+--timelinePatients list | file
+	Writes the timelines of the given patients, a comma separated list of patient ids or a file with a patient id
+	per line: all their mapped diagnoses in the order of their dates, with the diagnoses that match a trajectory
+	highlighted, as a csv file and an html page. The patients are identified by their pseudonyms.
+--xlsx
+	Writes an Excel workbook with a sheet for the trajectories, the diagnosis pairs, the clusters, and the summary
+	of the experiment.
+--maxBadRows nr
+	The maximum number of malformed rows in the input files that are tolerated. Malformed rows are skipped and written to
+	a rejects file. If there are more malformed rows, the run stops. By default, no malformed rows are tolerated.
+--rejectsFile file
+	The file to which malformed input rows are written. Defaults to name-rejects.tab in the output path.
+--deterministic
+	Runs in deterministic mode: random sampling uses a fixed seed and timestamps in the outputs are fixed, so that the
+	same input always results in the same output files.
+--seed nr
+	The seed for the random sampling of comparison groups, but not the noise of --dpEpsilon. Two runs with the same
+	input and seed compute the same RR matrix, also when the diagnosis pairs are sampled in parallel. 0 (the
+	default) uses a random seed, or a fixed seed with --deterministic.
+--dedup all | patients | diagnoses | none
+	Which duplicate records are removed from the input: duplicate patients (same patient id), duplicate diagnoses (same
+	patient, code and date), both (all), or none (none, the default). Duplicates are always counted and reported in the
+	run manifest.
+--duplicatePatients first | merge | fail | keep
+	How to handle patients that occur more than once in the patient file (same patient id): keep the first
+	occurrence (first), merge the occurrences into one patient with the diagnoses of all of them (merge), stop the run
+	(fail), or keep all occurrences as separate patients (keep). Defaults to first, or keep if --dedup does not remove
+	duplicate patients. A strategy that contradicts --dedup is rejected. Occurrences with a different sex, year of
+	birth or date of death are counted as conflicts.
+--temporalChecks flag | drop | clamp
+	How to handle diagnoses dated before birth, after death, or in the future, and deaths before the event of interest.
+	flag (the default) only reports them, drop removes the offending diagnoses and death dates, and clamp moves them to
+	the nearest valid date.
+--referenceDate date
+	The date that the temporal checks use as today, formatted as YYYY-MM-DD, e.g. the date on which the data was
+	extracted. The default is the current date.
+--auditLog file
+	Appends a data-access audit log to the given file, with one json object per event: which input files were read, which
+	output files were written (and whether they contain patient-level data), by which user and run ID.
+--auditUser string
+	The user recorded in the audit log. Defaults to the user running ptra.
+--runID string
+	The run ID recorded in the audit log and the run manifest. Defaults to a random ID.
+--indexDate none | eoi | treatment | enrollment
+	Starts the timeline of each patient at an index date: the event of interest, the first treatment, or the start of
+	the first observation period of --enrollmentInfo, which enrollment requires. Diagnoses before the index date are
+	removed, as are patients without an index date. The dates of the diagnoses are kept, so time frames and ages are
+	still computed on the calendar. The mean years since the index date for each diagnosis of the trajectories, matched
+	within --minYears and --maxYears, are written to a separate tab file.
+--stratify none | race | ethnicity | race,ethnicity | period[=years]
+	Stratifies the cohorts on the race and/or ethnicity of the patients in the patient file, so that the sampling
+	for the RR scores is matched on race and ethnicity as well as on age group and sex. Defaults to none. With
+	period, the patients exposed to a diagnosis are compared with patients observed in the calendar period of that
+	diagnosis, of 10 years or the given nr of years, e.g. race,period=5, so that drift in coding practice is not
+	mistaken for an association.
+--sameVisit none | date | encounter
+	Groups the diagnoses of the same visit: of the same date, or of the same encounter, in which case they are
+	moved onto the first date of their encounter. How the diagnoses of a visit are ordered is set by --visitOrder.
+	Defaults to none.
+--visitOrder unordered | code
+	How the diagnoses of the same visit are ordered, cf. --sameVisit: unordered (the default) treats them as an
+	unordered set, so that no transitions between them are counted, code orders them by their diagnosis codes.
+--primaryDiagnoses
+	Only primary diagnoses are trajectory events: diagnoses that the principal_diagnosis_indicator of the
+	diagnosis file marks as secondary are removed. Diagnoses without indicator are primary.
+--secondaryWeight w
+	The weight, between 0 and 1, with which secondary diagnoses are counted as outcomes in the RR scores, cf.
+	--primaryDiagnoses. 0 ignores them as outcomes. Defaults to 1.
+--loadState file
+	A state file saved by a previous run with --saveState. The diagnoses of the state are added to the patients
+	of the patient file before the diagnosis files of this run, e.g. a new month of data, are parsed.
+--saveState file
+	Saves the parsed diagnoses of the patients to a state file, gzip compressed if the file name ends in .gz,
+	so that a later run can add new data to them with --loadState.
+--didMap file
+	A tab separated file that persists the analysis DIDs across runs. If it exists, the DIDs of its diagnosis
+	names are reused and new diagnoses get new DIDs, otherwise it is created. It is updated at the end of parsing.
+--inputFormat trinetx | fhir | omop | mimic | csv | sql
+	The format of the patient and diagnosis files. trinetx (the default) reads the TriNetX csv files. fhir reads
+	FHIR R4 json bundles or ndjson bulk exports: Patient resources from the patient file, and Condition resources with
+	ICD-10 or ICD-9 codings from the diagnosis file. Both may be the same file. omop reads OMOP Common Data Model csv
+	tables: the person table from the patient file, the condition_occurrence table from the diagnosis file, and the
+	optional death and concept tables from the directory of the patient file. mimic reads MIMIC-IV hosp tables: the
+	patients table from the patient file, the diagnoses_icd table from the diagnosis file, and the admissions table
+	from the directory of the diagnosis file. The tables may be compressed. csv reads csv files of another layout, whose
+	columns are described by --inputSchema. sql reads from the database of --database, with the SQL queries in the
+	patient, diagnosis, and tumor files.
+--inputSchema file
+	A json file that describes the columns of the patient and diagnosis files of the csv input format, by index
+	or by header name, and the format of their dates. Required with --inputFormat csv.
+--database connstring
+	A PostgreSQL connection string, e.g. postgres://user@host/ehr?sslmode=disable, of the database that the sql
+	input format reads from. The patient, diagnosis, and tumor files then hold the SQL queries that select the
+	patients, diagnoses, and tumors. With --inputFormat omop, the OMOP tables are read from the database instead.
+--bigQuery project[.dataset]
+	A BigQuery project, and optionally its default dataset, that the sql input format runs its queries on, instead
+	of --database. With --inputFormat omop, the OMOP tables are read from the dataset. The access token is read
+	from GOOGLE_OAUTH_ACCESS_TOKEN, or else from the metadata server on Google Cloud.
+--streaming
+	Loads the diagnoses in streaming mode, with memory bounded by the compacted diagnoses of the patients rather
+	than the nr of diagnosis rows, for extracts with hundreds of millions of diagnoses. Duplicate diagnosis rows are not
+	counted in this mode, cf. --dedup, but they are still removed by compaction.
+
+The synth command generates synthetic patient, diagnosis, tumor and treatment files in TriNetX format in the given path.
+Its flags are:
+
+--nofPatients nr
+	The number of patients to generate.
+--meanDiagnoses nr
+	The mean number of random background diagnoses per patient.
+--codes list | file
+	A comma-separated list of ICD10 codes to draw background diagnoses from, or a csv file with a code column and an
+	optional weight column, e.g. the nr of occurrences of the codes in a real dataset. Defaults to a list of common codes.
+--codeDistribution uniform | zipf | weighted
+	The distribution used to draw background diagnoses from the codes. The weighted distribution draws the codes
+	proportionally to the weights in the codes file.
+--trajectories list
+	Trajectories to inject, e.g. "I10,E11.9,N18.30;J44.9,I50.9". The trajectories are also written to
+	injected-trajectories.tab as a ground truth.
+--trajectoryRate nr
+	The fraction of patients that follows each injected trajectory.
+--bladderCancerRate nr
+	The fraction of patients with a bladder cancer diagnosis, tumor info and treatments.
+--minYOB nr, --maxYOB nr
+	The range of years of birth.
+--seed nr
+	The seed for the random generator. The same seed generates the same data.
+
+The profile command checks the input files as the validate command does, with the same flags, and writes a data
+quality profile to profile.csv and profile.html in the given path: the malformed rows and unparsable dates per file, the
+patients without year of birth, the unknown codes, the diagnoses before birth or after death, and the distribution of
+the nr of codes per patient.
+
+The power command estimates the minimum prevalence of the diagnosis pairs with a given RR that a run detects, to choose
+the parameters of a run before running it. Its flags are:
+
+--patients nr
+	The number of patients of the cohort.
+--RR nr
+	The RR of the diagnosis pairs to detect.
+--iter nr, --maxPValue nr, --minPatients nr
+	The parameters of the run, as for the ptra command.
+--power nr
+	The required probability of detecting a diagnosis pair, 0.8 by default.
 */
 
 const (
@@ -106,17 +426,136 @@ const ptraHelp = "\nptra parameters:\n" +
 	"[--minTrajectoryLength nr]\n" +
 	"[--name string]\n" +
 	"[--ICD9ToICD10File file]\n" +
+	"[--ICD10ToICD11File file]\n" +
+	"[--SNOMEDToICD10File file]\n" +
 	"[--cluster]\n" +
 	"[--mclPath string]\n" +
 	"[--iter nr]\n" +
+	"[--matchedControls nr]\n" +
+	"[--matchComorbidities]\n" +
+	"[--pairTest sampling | fisher | auto]\n" +
+	"[--maxPValue nr]\n" +
+	"[--rrBound point | low]\n" +
+	"[--continuityCorrection nr]\n" +
+	"[--minCount nr]\n" +
+	"[--censoring]\n" +
+	"[--endDate date]\n" +
+	"[--maxDirectionalityP nr]\n" +
+	"[--metric rr | or | rd | hr]\n" +
+	"[--pairsBySex]\n" +
+	"[--pairsByAge]\n" +
 	"[--saveRR file]\n" +
+	"[--rrFormat dense | sparse]\n" +
 	"[--loadRR file]\n" +
 	"[--pfilters age70+ | age70- | male | female | Ta | T0 | Tis | T1 | T2 | T3 | T4 | N0 | N1 | N2 | N3 | M0 | M1 |" +
-	"NMIBC | MIBC | mUC ]\n" +
+	"NMIBC | MIBC | mUC | urothelial | squamous | adenocarcinoma | neuroendocrine]\n" +
+	"[--comparePFilters filters]\n" +
+	"[--permutationTest filter]\n" +
+	"[--permutations nr]\n" +
 	"[--tumorInfo file]\n" +
+	"[--tumorSites list]\n" +
+	"[--stagingRules file]\n" +
 	"[--tfilters neoplasm | bc]\n" +
+	"[--topTrajectories nr]\n" +
+	"[--minEdgeRR nr]\n" +
+	"[--bootstrap nr]\n" +
+	"[--validateTrajectories file]\n" +
+	"[--sweep grid]\n" +
+	"[--mortality windows]\n" +
+	"[--render svg | png]\n" +
 	"[--treatmentInfo file]\n" +
-	"[--nrOfThreads nr]\n"
+	"[--treatmentSchema file]\n" +
+	"[--customEvents file]\n" +
+	"[--procedureInfo file]\n" +
+	"[--procedureGroups file]\n" +
+	"[--labInfo file]\n" +
+	"[--labRules file]\n" +
+	"[--enrollmentInfo file]\n" +
+	"[--nrOfThreads nr]\n" +
+	"[--dpEpsilon nr]\n" +
+	"[--minCellSize nr]\n" +
+	"[--pseudonymize none | hash | pseudonym]\n" +
+	"[--pseudonymSalt string]\n" +
+	"[--pseudonymMapFile file]\n" +
+	"[--neo4j]\n" +
+	"[--parquet]\n" +
+	"[--patientTrajectories]\n" +
+	"[--timelinePatients list | file]\n" +
+	"[--xlsx]\n" +
+	"[--maxBadRows nr]\n" +
+	"[--rejectsFile file]\n" +
+	"[--deterministic]\n" +
+	"[--seed nr]\n" +
+	"[--dedup all | patients | diagnoses | none]\n" +
+	"[--duplicatePatients first | merge | fail | keep]\n" +
+	"[--temporalChecks flag | drop | clamp]\n" +
+	"[--referenceDate date]\n" +
+	"[--auditLog file]\n" +
+	"[--auditUser string]\n" +
+	"[--runID string]\n" +
+	"[--indexDate none | eoi | treatment | enrollment]\n" +
+	"[--stratify none | race | ethnicity | race,ethnicity | period[=years]]\n" +
+	"[--sameVisit none | date | encounter]\n" +
+	"[--visitOrder unordered | code]\n" +
+	"[--primaryDiagnoses]\n" +
+	"[--secondaryWeight w]\n" +
+	"[--loadState file]\n" +
+	"[--saveState file]\n" +
+	"[--didMap file]\n" +
+	"[--inputFormat trinetx | fhir | omop | mimic | csv | sql]\n" +
+	"[--inputSchema file]\n" +
+	"[--database connstring]\n" +
+	"[--bigQuery project[.dataset]]\n" +
+	"[--streaming]\n"
+
+const synthHelp = "\nptra synth parameters:\n" +
+	"ptra synth outputPath\n" +
+	"[--nofPatients nr]\n" +
+	"[--meanDiagnoses nr]\n" +
+	"[--codes list | file]\n" +
+	"[--codeDistribution uniform | zipf | weighted]\n" +
+	"[--trajectories list]\n" +
+	"[--trajectoryRate nr]\n" +
+	"[--bladderCancerRate nr]\n" +
+	"[--minYOB nr]\n" +
+	"[--maxYOB nr]\n" +
+	"[--seed nr]\n"
+
+const validateHelp = "\nptra validate parameters:\n" +
+	"ptra validate patientInfoFile diagnosisInfoFile diagnosesFile\n" +
+	"[--lvl nr]\n" +
+	"[--ICD9ToICD10File file]\n" +
+	"[--ICD10ToICD11File file]\n" +
+	"[--SNOMEDToICD10File file]\n" +
+	"[--tumorInfo file]\n" +
+	"[--tumorSites list]\n" +
+	"[--treatmentInfo file]\n" +
+	"[--treatmentSchema file]\n" +
+	"[--customEvents file]\n" +
+	"[--maxBadRows nr]\n" +
+	"[--rejectsFile file]\n"
+
+const profileHelp = "\nptra profile parameters:\n" +
+	"ptra profile patientInfoFile diagnosisInfoFile diagnosesFile outputPath\n" +
+	"[--lvl nr]\n" +
+	"[--ICD9ToICD10File file]\n" +
+	"[--ICD10ToICD11File file]\n" +
+	"[--SNOMEDToICD10File file]\n" +
+	"[--tumorInfo file]\n" +
+	"[--tumorSites list]\n" +
+	"[--treatmentInfo file]\n" +
+	"[--treatmentSchema file]\n" +
+	"[--customEvents file]\n" +
+	"[--rejectsFile file]\n"
+
+const powerHelp = "\nptra power parameters:\n" +
+	"ptra power\n" +
+	"[--patients nr]\n" +
+	"[--RR nr]\n" +
+	"[--iter nr]\n" +
+	"[--maxPValue nr]\n" +
+	"[--minPatients nr]\n" +
+	"[--power nr]\n"
 
 func parseFlags(flags flag.FlagSet, requiredArgs int, help string) {
 	if len(os.Args) < requiredArgs {
@@ -149,9 +588,158 @@ func getFileName(s, help string) string {
 	return s
 }
 
+// synth generates synthetic input data.
+func synth() {
+	var params = lib.SynthParams{}
+	var flags flag.FlagSet
+	var codes, trajectories string
+	flags.IntVar(&params.NofPatients, "nofPatients", 10000, "The number of patients to generate.")
+	flags.Float64Var(&params.MeanDiagnoses, "meanDiagnoses", 10, "The mean number of background diagnoses "+
+		"per patient.")
+	flags.StringVar(&codes, "codes", "", "A list of ICD10 codes to draw background diagnoses from, "+
+		"or a csv file with code and weight columns.")
+	flags.StringVar(&params.CodeDistribution, "codeDistribution", lib.SynthUniform, "The distribution for "+
+		"drawing background diagnoses: uniform, zipf, or weighted.")
+	flags.StringVar(&trajectories, "trajectories", "I10,E11.9,N18.30;J44.9,I50.9,I48.91", "Trajectories to "+
+		"inject, as lists of ICD10 codes separated by ;.")
+	flags.Float64Var(&params.TrajectoryRate, "trajectoryRate", 0.05, "The fraction of patients that follows "+
+		"each injected trajectory.")
+	flags.Float64Var(&params.BladderCancerRate, "bladderCancerRate", 0.02, "The fraction of patients with "+
+		"bladder cancer.")
+	flags.IntVar(&params.MinYOB, "minYOB", 1920, "The minimum year of birth.")
+	flags.IntVar(&params.MaxYOB, "maxYOB", 2000, "The maximum year of birth.")
+	flags.Uint64Var(&params.Seed, "seed", 1, "The seed for the random generator.")
+
+	parseFlags(flags, 3, synthHelp)
+
+	params.OutputPath = getFileName(os.Args[2], synthHelp)
+	if _, err := os.Stat(codes); codes != "" && err == nil {
+		if params.Codes, params.Weights, err = lib.LoadSynthCodes(codes); err != nil {
+			panic(err)
+		}
+	} else if codes != "" {
+		params.Codes = strings.Split(codes, ",")
+	}
+	params.Trajectories = lib.ParseSynthTrajectories(trajectories)
+	if err := lib.GenerateSyntheticData(&params); err != nil {
+		panic(err)
+	}
+}
+
+// validateFlags defines the flags of the validate and profile commands.
+func validateFlags(flags *flag.FlagSet, params *lib.ValidateParams) {
+	flags.IntVar(&params.Lvl, "lvl", 3, "The level of the diagnosis codes in the hierarchy of the vocabulary.")
+	flags.StringVar(&params.ICD9ToICD10File, "ICD9ToICD10File", "", "A json file that maps ICD9 to "+
+		"ICD10 codes.")
+	flags.StringVar(&params.ICD10ToICD11File, "ICD10ToICD11File", "", "A json file or a WHO mapping table "+
+		"that maps ICD10 to ICD11 codes.")
+	flags.StringVar(&params.SNOMEDToICD10File, "SNOMEDToICD10File", "", "A json file or an RF2 extended map "+
+		"that maps SNOMED CT concepts to ICD10 codes.")
+	flags.StringVar(&params.TumorInfo, "tumorInfo", "", "A csv file with tumor information.")
+	flags.StringVar(&params.TumorSites, "tumorSites", "", "A comma separated list of topography "+
+		"prefixes of the tumors to check.")
+	flags.StringVar(&params.TreatmentInfo, "treatmentInfo", "", "A csv file with treatment information.")
+	flags.StringVar(&params.TreatmentSchema, "treatmentSchema", "", "A json file describing the columns of "+
+		"the treatment file.")
+	flags.StringVar(&params.CustomEvents, "customEvents", "", "A json file with the custom events of "+
+		"the treatment file.")
+	flags.IntVar(&params.MaxBadRows, "maxBadRows", 0, "The maximum number of malformed input rows that is "+
+		"not fatal.")
+	flags.StringVar(&params.RejectsFile, "rejectsFile", "", "The tab file to which malformed input rows are "+
+		"written.")
+}
+
+// validate checks the input files without running an experiment. It exits with status 1 on fatal problems.
+func validate() {
+	var params = lib.ValidateParams{}
+	var flags flag.FlagSet
+	validateFlags(&flags, &params)
+
+	parseFlags(flags, 5, validateHelp)
+
+	params.PatientInfo = getFileName(os.Args[2], validateHelp)
+	params.DiagnosisInfo = getFileName(os.Args[3], validateHelp)
+	params.PatientDiagnoses = getFileName(os.Args[4], validateHelp)
+	report, err := lib.ValidateInput(&params)
+	if err == nil {
+		report.Log(20)
+		err = report.Fatal()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Validation failed: ", err)
+		os.Exit(1)
+	}
+	fmt.Println("Validation passed.")
+}
+
+// profile writes a data quality profile of the input files.
+func profile() {
+	var params = lib.ValidateParams{}
+	var flags flag.FlagSet
+	validateFlags(&flags, &params)
+
+	parseFlags(flags, 6, profileHelp)
+
+	params.PatientInfo = getFileName(os.Args[2], profileHelp)
+	params.DiagnosisInfo = getFileName(os.Args[3], profileHelp)
+	params.PatientDiagnoses = getFileName(os.Args[4], profileHelp)
+	profile, err := lib.ProfileInput(&params, getFileName(os.Args[5], profileHelp))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Profiling failed: ", err)
+		os.Exit(1)
+	}
+	profile.Integrity.Log(20)
+}
+
+// power estimates the minimum prevalence of the diagnosis pairs that a run detects.
+func power() {
+	var params = lib.PowerParams{}
+	var flags flag.FlagSet
+	flags.IntVar(&params.Patients, "patients", 100000, "The number of patients of the cohort.")
+	flags.Float64Var(&params.RR, "RR", 1.5, "The RR of the diagnosis pairs to detect.")
+	flags.IntVar(&params.Iter, "iter", 10000, "The number of sampling iterations of the diagnosis pairs.")
+	flags.Float64Var(&params.MaxPValue, "maxPValue", lib.DefaultMaxPValue, "The maximum p-value of the "+
+		"diagnosis pairs.")
+	flags.IntVar(&params.MinPatients, "minPatients", 1000, "The minimum number of patients of a diagnosis pair.")
+	flags.Float64Var(&params.Power, "power", 0.8, "The required probability of detecting a diagnosis pair.")
+
+	parseFlags(flags, 2, powerHelp)
+
+	estimate, err := lib.EstimatePower(&params)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Power estimate failed: ", err)
+		os.Exit(1)
+	}
+	fmt.Println("Minimum nr of patients with a diagnosis pair: ", estimate.Patients)
+	fmt.Println("Minimum prevalence of a diagnosis pair: ", estimate.Prevalence)
+	fmt.Println("Power: ", estimate.Power)
+	if resolution := 1 / float64(params.Iter); params.MaxPValue < resolution {
+		fmt.Println("The sampled p-values are multiples of ", resolution, ", so only pairs that exceed all comparison "+
+			"groups are selected.")
+	}
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "synth" {
+		synth()
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		validate()
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "profile" {
+		profile()
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "power" {
+		power()
+		return
+	}
+
 	var params = lib.ExperimentParams{}
 	var flags flag.FlagSet
+	var database, bigQuery string
 
 	// extract ExperimentParams from command line params
 	flags.IntVar(&params.NofAgeGroups, "nofAgeGroups", 6, "The population data is divided in cohorts in"+
@@ -174,22 +762,155 @@ func main() {
 		"names of the output files.")
 	flags.StringVar(&params.ICD9ToICD10File, "ICD9ToICD10File", "", "A json file that maps ICD9 to "+
 		"ICD10 codes.")
+	flags.StringVar(&params.ICD10ToICD11File, "ICD10ToICD11File", "", "A json file or a WHO mapping table "+
+		"that maps ICD10 to ICD11 codes.")
+	flags.StringVar(&params.SNOMEDToICD10File, "SNOMEDToICD10File", "", "A json file or an RF2 extended map "+
+		"that maps SNOMED CT concepts to ICD10 codes.")
 	flags.BoolVar(&params.Cluster, "cluster", false, "Cluster the trajectories using MCL and output "+
 		"the results")
 	flags.StringVar(&params.ClusterGranularities, "clusterGranularities", "40,60,80,100", "The "+
 		"granularities used for the mcl clustering step.") // recommended 14,20,40,60
 	flags.IntVar(&params.Iter, "iter", 10000, "The minimum number of sampling iterations "+
 		"diagnosis in a trajectory")
+	flags.IntVar(&params.MatchedControls, "matchedControls", 0, "The number of controls matched to each "+
+		"exposed patient, 0 for sampling from similar cohorts.")
+	flags.BoolVar(&params.MatchComorbidities, "matchComorbidities", false, "Match the controls on their "+
+		"number of comorbidities.")
+	flags.StringVar(&params.PairTest, "pairTest", lib.PairTestSampling, "The test of the significance of the "+
+		"diagnosis pairs: sampling, fisher, or auto.")
+	flags.Float64Var(&params.MaxPValue, "maxPValue", lib.DefaultMaxPValue, "The maximum p-value of the "+
+		"diagnosis pairs.")
+	flags.StringVar(&params.RRBound, "rrBound", lib.RRBoundPoint, "The bound of the RR scores compared "+
+		"with --RR: point or low.")
+	flags.Float64Var(&params.ContinuityCorrection, "continuityCorrection", 0, "The continuity correction "+
+		"of the pairs with a zero cell, 0 for none.")
+	flags.IntVar(&params.MinCount, "minCount", 0, "The number of second diagnoses in either group below "+
+		"which pairs are flagged as rare.")
+	flags.BoolVar(&params.Censoring, "censoring", false, "Censor the exposed patients at their death or the "+
+		"end of the data.")
+	flags.StringVar(&params.EndDate, "endDate", "", "The end of the data for censoring, YYYY-MM-DD.")
+	flags.Float64Var(&params.MaxDirectionalityP, "maxDirectionalityP", 0, "The maximum p-value of the "+
+		"binomial test of the directionality of the pairs, 0 for no filter.")
+	flags.StringVar(&params.Metric, "metric", lib.MetricRR, "The effect size reported for the diagnosis "+
+		"pairs: rr, or, rd, or hr.")
+	flags.BoolVar(&params.PairsBySex, "pairsBySex", false, "Also compute the RR scores of the pairs "+
+		"within the male and female patients.")
+	flags.BoolVar(&params.PairsByAge, "pairsByAge", false, "Also compute the RR scores of the pairs "+
+		"within the patients of each age group.")
 	flags.Float64Var(&params.RR, "RR", 1.0, "The minimum RR score for considering pairs.")
 	flags.StringVar(&params.SaveRR, "saveRR", "", "Save the RR matrix to a file so it can be loaded for "+
 		"later runs")
+	flags.StringVar(&params.RRFormat, "rrFormat", lib.RRFormatDense, "The format of the saved RR matrix: "+
+		"dense or sparse.")
 	flags.StringVar(&params.LoadRR, "loadRR", "", "Load the RR matrix from a given file instead of "+
 		"calculating it from scratch.")
 	flags.StringVar(&params.PFilters, "pfilters", "id", "A list of pfilters to restrict analysis on specific "+
 		"patients.")
+	flags.StringVar(&params.ComparePFilters, "comparePFilters", "", "A list of pfilters that selects the "+
+		"second cohort of a differential analysis.")
+	flags.StringVar(&params.PermutationGroup, "permutationTest", "", "A pfilter that defines the groups "+
+		"of the permutation test of the prevalence of the trajectories.")
+	flags.IntVar(&params.Permutations, "permutations", 0, "The nr of permutations of the permutation test, "+
+		"1000 if 0.")
 	flags.StringVar(&params.TumorInfo, "tumorInfo", "", "A file with information about the tumor stages.")
+	flags.StringVar(&params.TumorSites, "tumorSites", "", "A comma separated list of topography prefixes of "+
+		"the tumors that are recorded from the tumor file.")
+	flags.StringVar(&params.StagingRules, "stagingRules", "", "A json file with the TNM staging rules of "+
+		"other cancers than bladder cancer.")
 	flags.StringVar(&params.TreatmentInfo, "treatmentInfo", "", "A file with information about patient cancer stages.")
+	flags.StringVar(&params.TreatmentSchema, "treatmentSchema", "", "A json file describing the columns and date "+
+		"format of the treatment file.")
+	flags.StringVar(&params.CustomEvents, "customEvents", "", "A json file with the custom events that are "+
+		"read from the treatment file.")
+	flags.StringVar(&params.ProcedureInfo, "procedureInfo", "", "A file with the procedures of the "+
+		"patients, to be used as events in the trajectories.")
+	flags.StringVar(&params.ProcedureGroups, "procedureGroups", "", "A csv file that groups the "+
+		"procedure codes into events.")
+	flags.StringVar(&params.LabInfo, "labInfo", "", "A file with the lab results of the patients, "+
+		"of which the abnormal values are used as events in the trajectories.")
+	flags.StringVar(&params.LabRules, "labRules", "", "A json file with the rules that turn lab "+
+		"results into events.")
+	flags.StringVar(&params.EnrollmentInfo, "enrollmentInfo", "", "A csv file with the observation "+
+		"periods of the patients.")
 	flags.StringVar(&params.TFilters, "tfilters", "id", "A list of pfilters to restrict output of trajectories")
+	flags.IntVar(&params.TopTrajectories, "topTrajectories", 0, "The number of trajectories with the most "+
+		"patients to output, 0 for all trajectories.")
+	flags.Float64Var(&params.MinEdgeRR, "minEdgeRR", 0, "The minimum RR score of each transition of the "+
+		"trajectories to output.")
+	flags.IntVar(&params.Bootstrap, "bootstrap", 0, "The nr of bootstrap replicates of the stability of "+
+		"the trajectories, 0 for none.")
+	flags.StringVar(&params.ValidateTrajectories, "validateTrajectories", "", "The json results of a "+
+		"previous run of which the trajectories are validated on the input.")
+	flags.StringVar(&params.Sweep, "sweep", "", "A grid of values of minYears, maxYears, RR, and "+
+		"minPatients for a sensitivity analysis of the trajectories.")
+	flags.StringVar(&params.Mortality, "mortality", "", "Comma separated windows in years of the "+
+		"mortality of the followers of the trajectories versus matched non-followers.")
+	flags.StringVar(&params.Render, "render", "", "Render figures of the trajectories in the given image "+
+		"format: svg or png. Requires Graphviz.")
+	flags.Float64Var(&params.DPEpsilon, "dpEpsilon", 0, "Enable differential privacy with the given epsilon. "+
+		"Noise is added to RR scores and patient counts before output.")
+	flags.IntVar(&params.MinCellSize, "minCellSize", 0, "Suppress the patient counts below the given size in "+
+		"the outputs, 0 for none.")
+	flags.StringVar(&params.Pseudonymize, "pseudonymize", "none", "Replace patient ids in the outputs by "+
+		"salted hashes (hash) or study-specific pseudonyms (pseudonym).")
+	flags.StringVar(&params.PseudonymSalt, "pseudonymSalt", "", "The salt used for hashing patient ids.")
+	flags.StringVar(&params.PseudonymMapFile, "pseudonymMapFile", "", "A file to write the mapping from "+
+		"patient ids to pseudonyms to.")
+	flags.BoolVar(&params.Neo4j, "neo4j", false, "Write the trajectories as csv files for the bulk "+
+		"importer of Neo4j.")
+	flags.BoolVar(&params.Parquet, "parquet", false, "Write the pairs, trajectories, and patients of the "+
+		"trajectories as Parquet files.")
+	flags.BoolVar(&params.PatientTrajectories, "patientTrajectories", false, "Write the trajectories of "+
+		"each patient, with the dates of the matched diagnoses.")
+	flags.StringVar(&params.TimelinePatients, "timelinePatients", "", "Write the timelines of the given "+
+		"patients, a comma separated list of patient ids or a file with a patient id per line.")
+	flags.BoolVar(&params.Xlsx, "xlsx", false, "Write the trajectories, pairs, clusters, and summary as an "+
+		"Excel workbook.")
+	flags.IntVar(&params.MaxBadRows, "maxBadRows", 0, "The maximum number of malformed input rows to skip "+
+		"before stopping the run.")
+	flags.StringVar(&params.RejectsFile, "rejectsFile", "", "A file to write malformed input rows to.")
+	flags.BoolVar(&params.Deterministic, "deterministic", false, "Use a fixed seed and fixed timestamps, so that "+
+		"the same input always results in the same output.")
+	flags.Uint64Var(&params.Seed, "seed", 0, "The seed for random sampling, 0 for a random seed.")
+	flags.StringVar(&params.Dedup, "dedup", "", "Which duplicate records to remove from the input: "+
+		"all, patients, diagnoses, or none.")
+	flags.StringVar(&params.DuplicatePatients, "duplicatePatients", "", "How to handle duplicate "+
+		"patients: first, merge, fail, or keep.")
+	flags.StringVar(&params.TemporalChecks, "temporalChecks", lib.TemporalFlag, "How to handle dates that fail "+
+		"the temporal checks: flag, drop, or clamp.")
+	flags.StringVar(&params.ReferenceDate, "referenceDate", "", "The date that the temporal checks use as today, "+
+		"YYYY-MM-DD.")
+	flags.StringVar(&params.AuditLog, "auditLog", "", "A file to append data-access audit events to.")
+	flags.StringVar(&params.AuditUser, "auditUser", "", "The user recorded in the audit log.")
+	flags.StringVar(&params.RunID, "runID", "", "The run ID recorded in the audit log.")
+	flags.StringVar(&params.IndexDate, "indexDate", lib.IndexNone, "Start the patient timelines at an index date: "+
+		"none, eoi, treatment, or enrollment.")
+	flags.StringVar(&params.Stratify, "stratify", lib.StratifyNone, "Stratify the cohorts on race and/or "+
+		"ethnicity and/or calendar period: none, race, ethnicity, period[=years], or a list, e.g. race,period.")
+	flags.StringVar(&params.SameVisit, "sameVisit", lib.VisitNone, "Group the diagnoses of the same "+
+		"visit: none, date, or encounter.")
+	flags.StringVar(&params.VisitOrder, "visitOrder", lib.VisitUnordered, "Order the diagnoses of the "+
+		"same visit: unordered or code.")
+	flags.BoolVar(&params.PrimaryDiagnoses, "primaryDiagnoses", false, "Only use the primary diagnoses "+
+		"as trajectory events.")
+	flags.Float64Var(&params.SecondaryWeight, "secondaryWeight", 1, "The weight of secondary diagnoses "+
+		"in the RR scores, between 0 and 1.")
+	flags.StringVar(&params.LoadState, "loadState", "", "A state file of a previous run to which the "+
+		"diagnosis files are added.")
+	flags.StringVar(&params.SaveState, "saveState", "", "A state file to which the parsed diagnoses "+
+		"are saved.")
+	flags.StringVar(&params.DIDMap, "didMap", "", "A file that persists the analysis DIDs across "+
+		"runs.")
+	flags.StringVar(&params.InputFormat, "inputFormat", lib.InputTriNetX, "The format of the patient and "+
+		"diagnosis files: trinetx, fhir, omop, mimic, csv, or sql.")
+	flags.StringVar(&params.InputSchema, "inputSchema", "", "A json file describing the columns of the "+
+		"csv input format.")
+	flags.StringVar(&database, "database", "", "A PostgreSQL connection string of the database of the sql "+
+		"input format.")
+	flags.StringVar(&bigQuery, "bigQuery", "", "A BigQuery project, and optionally its default "+
+		"dataset, to run the queries of the sql input format on.")
+	flags.BoolVar(&params.Streaming, "streaming", false, "Load the diagnoses with bounded memory, without "+
+		"tracking duplicate diagnosis rows.")
 
 	// parse optional arguments
 	parseFlags(flags, 5, ptraHelp)
@@ -200,46 +921,34 @@ func main() {
 	params.PatientDiagnoses = getFileName(os.Args[3], ptraHelp)
 	params.OutputPath, _ = filepath.Abs(getFileName(os.Args[4], ptraHelp))
 	fmt.Println("Output path: ", params.OutputPath)
+	params.Version = fmt.Sprint(programVersion) // the parameters and version are recorded in the run manifest
 
-	// build an output command line
-	var command bytes.Buffer
-	fmt.Fprint(&command, os.Args[0], " ", params.PatientInfo, " ", params.DiagnosisInfo, " ", params.PatientDiagnoses,
-		" ", params.OutputPath)
-	fmt.Fprint(&command, " --nofAgeGroups ", params.NofAgeGroups)
-	fmt.Fprint(&command, " --lvl ", params.Lvl)
-	fmt.Fprint(&command, " --maxYears ", params.MaxYears)
-	fmt.Fprint(&command, " --minYears ", params.MinYears)
-	fmt.Fprint(&command, " --minPatients ", params.MinPatients)
-	fmt.Fprint(&command, " --maxTrajectoryLength ", params.MaxTrajectoryLength)
-	fmt.Fprint(&command, " --minTrajectoryLength ", params.MinTrajectoryLength)
-	fmt.Fprint(&command, " --name ", params.Name)
-	fmt.Fprint(&command, " --ICD9ToICD10File ", params.ICD9ToICD10File)
-	fmt.Fprint(&command, " --iter ", params.Iter)
-	fmt.Fprint(&command, " --RR ", params.RR)
-	fmt.Fprint(&command, " --tumorInfo ", params.TumorInfo)
-	fmt.Fprint(&command, " --treatmentInfo ", params.TreatmentInfo)
-
-	if params.SaveRR != "" {
-		fmt.Fprint(&command, " --saveRR ", params.SaveRR)
-	}
-
-	if params.LoadRR != "" {
-		fmt.Fprint(&command, " --loadRR ", params.LoadRR)
+	if database != "" {
+		db, err := sql.Open("postgres", database)
+		if err != nil {
+			panic(err)
+		}
+		defer db.Close()
+		params.Database = db
+		if params.InputFormat == lib.InputOMOP {
+			params.OMOPSource = &lib.OMOPSQLSource{DB: db}
+		}
 	}
-
-	if params.Cluster {
-		fmt.Fprint(&command, " --cluster")
-		fmt.Fprint(&command, " --clusterGranularities ", params.ClusterGranularities)
+	if bigQuery != "" {
+		params.BigQuery = lib.NewBigQuerySource(bigQuery)
+		if params.InputFormat == lib.InputOMOP {
+			params.OMOPSource = params.BigQuery
+		}
 	}
 
-	fmt.Fprint(&command, " --pfilters ", params.PFilters)
-	fmt.Fprint(&command, " --tfilters ", params.TFilters)
-
-	if params.NrOfThreads > 0 {
-		fmt.Fprint(&command, " --nrOfThreads ", params.NrOfThreads)
+	var err error
+	if params.ComparePFilters != "" {
+		err = lib.RunDifferential(&params)
+	} else if params.Sweep != "" {
+		err = lib.RunSweep(&params)
+	} else {
+		err = lib.Run(&params)
 	}
-
-	err := lib.Run(&params)
 	if err != nil {
 		panic(err)
 	}
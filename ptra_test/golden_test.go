@@ -0,0 +1,129 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package ptra_test
+
+import (
+	"bytes"
+	"flag"
+	"github.com/imec-int/ptra/lib"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// End-to-end test of ptra in deterministic mode. The test runs ptra on synthetic data and compares the output files to
+// golden files in testdata/golden. After an intended change of the results, regenerate the golden files with:
+//
+//	go test ./ptra_test -run TestGoldenOutput -update
+
+var update = flag.Bool("update", false, "update the golden files")
+
+const goldenName = "golden"
+
+// goldenFiles lists the output files of a run that are compared to the golden files.
+var goldenFiles = []string{
+	"golden-pairs.tab",
+	"golden-pair-gaps.tab",
+	"golden-pair-ages.tab",
+	"golden-trajectories.tab",
+	"golden-manifest.json",
+	"golden-trajectories-merged-graph.gml",
+	"golden-trajectories-individual-graphs.gml",
+	"golden-trajectories-merged-graph.graphml",
+	"golden-trajectories-individual-graphs.graphml",
+	"golden-trajectories-merged-graph.dot",
+	"golden-results.json",
+	"golden-trajectories-cytoscape.json",
+	"golden-trajectories-sankey.json",
+	"golden-trajectories-tree.txt",
+	"golden-summary.csv",
+}
+
+func runGoldenExperiment(t *testing.T) string {
+	dir := t.TempDir()
+	synthParams := &lib.SynthParams{
+		OutputPath:        filepath.Join(dir, "input"),
+		NofPatients:       2000,
+		MeanDiagnoses:     6,
+		CodeDistribution:  lib.SynthUniform,
+		Trajectories:      lib.ParseSynthTrajectories("I10,E11.9,N18.30;J44.9,I50.9,I48.91"),
+		TrajectoryRate:    0.1,
+		BladderCancerRate: 0.02,
+		MinYOB:            1920,
+		MaxYOB:            2000,
+		Seed:              1,
+	}
+	if err := lib.GenerateSyntheticData(synthParams); err != nil {
+		t.Fatal(err)
+	}
+	params := &lib.ExperimentParams{
+		Name:                goldenName,
+		PatientInfo:         filepath.Join(synthParams.OutputPath, lib.SynthPatientFile),
+		DiagnosisInfo:       "./icd10cm_tabular_2022.xml",
+		PatientDiagnoses:    filepath.Join(synthParams.OutputPath, lib.SynthDiagnosisFile),
+		OutputPath:          filepath.Join(dir, "output"),
+		NofAgeGroups:        6,
+		Lvl:                 3,
+		MaxYears:            5.0,
+		MinYears:            0.5,
+		MinPatients:         50,
+		MaxTrajectoryLength: 5,
+		MinTrajectoryLength: 3,
+		Iter:                100,
+		RR:                  1.0,
+		SecondaryWeight:     1,
+		Deterministic:       true,
+	}
+	if err := lib.Run(params); err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(params.OutputPath, goldenName)
+}
+
+func TestGoldenOutput(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping end-to-end test in short mode")
+	}
+	outputDir := runGoldenExperiment(t)
+	tempDir := filepath.Dir(filepath.Dir(outputDir)) // the run manifest records the input and output paths
+	for _, name := range goldenFiles {
+		got, err := os.ReadFile(filepath.Join(outputDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = bytes.ReplaceAll(got, []byte(tempDir), []byte("TMPDIR"))
+		goldenFile := filepath.Join("testdata", "golden", name)
+		if *update {
+			if err := os.MkdirAll(filepath.Dir(goldenFile), 0700); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(goldenFile, got, 0600); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		want, err := os.ReadFile(goldenFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s differs from golden file %s, rerun with -update if the change is intended", name, goldenFile)
+		}
+	}
+}
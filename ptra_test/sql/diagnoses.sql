@@ -0,0 +1,2 @@
+SELECT d.patient_id, 'ICD-10-CM', d.icd10_code, d.diagnosis_date
+FROM research.diagnoses d
@@ -0,0 +1,2 @@
+SELECT p.id, CASE p.gender WHEN 'male' THEN 'M' WHEN 'female' THEN 'F' END, p.birth_year, p.death_date, p.state
+FROM research.patients p
@@ -0,0 +1,2 @@
+SELECT t.patient_id, t.diagnosis_date, t.site, t.morphology, 'TNM_' || t.t, 'TNM_' || t.n, 'TNM_' || t.m
+FROM research.tumors t
@@ -0,0 +1,182 @@
+graph [
+	directed 1
+	multigraph 1
+	node [
+		id 3068
+		label "Essential (primary) hypertension"
+		code "I10"
+		level 2
+		cat0 "Diseases of the circulatory system (I00-I99)"
+		cat1 "Hypertensive diseases (I10-I16)"
+	]
+	node [
+		id 1804
+		label "Type 2 diabetes mellitus without complications"
+		code "E11.9"
+		level 3
+		cat0 "Endocrine, nutritional and metabolic diseases (E00-E89)"
+		cat1 "Diabetes mellitus (E08-E13)"
+		cat2 "Type 2 diabetes mellitus"
+	]
+	node [
+		id 5121
+		label "Chronic kidney disease, stage 3 unspecified"
+		code "N18.30"
+		level 4
+		cat0 "Diseases of the genitourinary system (N00-N99)"
+		cat1 "Acute kidney failure and chronic kidney disease (N17-N19)"
+		cat2 "Chronic kidney disease (CKD)"
+		cat3 "Chronic kidney disease, stage 3 (moderate)"
+	]
+	edge [
+		tid 1
+		thash "2be6bfb9f2f548cf"
+		tlen 2
+		tidx 0
+		source 3068
+		target 1804
+		patients 199
+		RR "2.65"
+		gapMin 183
+		gapQ1 302
+		gapMedian 457
+		gapQ3 612
+		gapIQR 310
+		gapMax 1814
+	]
+	edge [
+		tid 1
+		thash "2be6bfb9f2f548cf"
+		tlen 2
+		tidx 1
+		source 1804
+		target 5121
+		patients 70
+		RR "2.80"
+		gapMin 188
+		gapQ1 269
+		gapMedian 416
+		gapQ3 530
+		gapIQR 261
+		gapMax 721
+	]
+	node [
+		id 3068
+		label "Essential (primary) hypertension"
+		code "I10"
+		level 2
+		cat0 "Diseases of the circulatory system (I00-I99)"
+		cat1 "Hypertensive diseases (I10-I16)"
+	]
+	node [
+		id 1804
+		label "Type 2 diabetes mellitus without complications"
+		code "E11.9"
+		level 3
+		cat0 "Endocrine, nutritional and metabolic diseases (E00-E89)"
+		cat1 "Diabetes mellitus (E08-E13)"
+		cat2 "Type 2 diabetes mellitus"
+	]
+	node [
+		id 5121
+		label "Chronic kidney disease, stage 3 unspecified"
+		code "N18.30"
+		level 4
+		cat0 "Diseases of the genitourinary system (N00-N99)"
+		cat1 "Acute kidney failure and chronic kidney disease (N17-N19)"
+		cat2 "Chronic kidney disease (CKD)"
+		cat3 "Chronic kidney disease, stage 3 (moderate)"
+	]
+	edge [
+		tid 1
+		thash "2be6bfb9f2f548cf"
+		tlen 2
+		tidx 0
+		source 3068
+		target 1804
+		patients 199
+		RR "2.65"
+		gapMin 183
+		gapQ1 302
+		gapMedian 457
+		gapQ3 612
+		gapIQR 310
+		gapMax 1814
+	]
+	edge [
+		tid 1
+		thash "2be6bfb9f2f548cf"
+		tlen 2
+		tidx 1
+		source 1804
+		target 5121
+		patients 70
+		RR "2.80"
+		gapMin 188
+		gapQ1 269
+		gapMedian 416
+		gapQ3 530
+		gapIQR 261
+		gapMax 721
+	]
+	node [
+		id 3559
+		label "Chronic obstructive pulmonary disease, unspecified"
+		code "J44.9"
+		level 3
+		cat0 "Diseases of the respiratory system (J00-J99)"
+		cat1 "Chronic lower respiratory diseases (J40-J47)"
+		cat2 "Other chronic obstructive pulmonary disease"
+	]
+	node [
+		id 3228
+		label "Heart failure, unspecified"
+		code "I50.9"
+		level 3
+		cat0 "Diseases of the circulatory system (I00-I99)"
+		cat1 "Other forms of heart disease (I30-I5A)"
+		cat2 "Heart failure"
+	]
+	node [
+		id 3214
+		label "Unspecified atrial fibrillation"
+		code "I48.91"
+		level 4
+		cat0 "Diseases of the circulatory system (I00-I99)"
+		cat1 "Other forms of heart disease (I30-I5A)"
+		cat2 "Atrial fibrillation and flutter"
+		cat3 "Unspecified atrial fibrillation and atrial flutter"
+	]
+	edge [
+		tid 2
+		thash "df19a1b075b6caf2"
+		tlen 2
+		tidx 0
+		source 3559
+		target 3228
+		patients 208
+		RR "3.10"
+		gapMin 190
+		gapQ1 308
+		gapMedian 458
+		gapQ3 582
+		gapIQR 274
+		gapMax 1806
+	]
+	edge [
+		tid 2
+		thash "df19a1b075b6caf2"
+		tlen 2
+		tidx 1
+		source 3228
+		target 3214
+		patients 73
+		RR "2.71"
+		gapMin 185
+		gapQ1 337
+		gapMedian 468
+		gapQ3 604
+		gapIQR 267
+		gapMax 728
+	]
+]